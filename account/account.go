@@ -0,0 +1,565 @@
+package account
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aopoltorzhicky/go_kraken/rest"
+	ws "github.com/aopoltorzhicky/go_kraken/websocket"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+	log "github.com/sirupsen/logrus"
+)
+
+// Provider - REST methods which are used to load and reconcile balances, e.g. `rest.Kraken`
+type Provider interface {
+	GetAccountBalancesEx() (map[string]rest.BalanceEx, error)
+	GetOpenPositions(docalcs bool, txIDs ...string) (map[string]rest.Position, error)
+}
+
+// Option - option function for `Tracker`
+type Option func(*Tracker)
+
+// WithBufferSize - size of events channel. If events aren't read fast enough, the oldest ones are dropped. Default: 1024.
+func WithBufferSize(size int) Option {
+	return func(t *Tracker) {
+		t.bufferSize = size
+	}
+}
+
+// WithClock - source of time of events. Default: `time.Now`.
+func WithClock(clock func() time.Time) Option {
+	return func(t *Tracker) {
+		t.clock = clock
+	}
+}
+
+// WithReconcileInterval - interval of reconciliation with REST after `Start`. Zero disables it. Default: 1 minute.
+func WithReconcileInterval(interval time.Duration) Option {
+	return func(t *Tracker) {
+		t.interval = interval
+	}
+}
+
+// Balance - balance of asset
+type Balance struct {
+	Asset      string
+	Total      decimal.Decimal
+	Credit     decimal.Decimal
+	CreditUsed decimal.Decimal
+	// Held - funds which are reserved by open orders
+	Held decimal.Decimal
+}
+
+// Available - funds which can be used by new orders: total and credit without used credit and held funds
+func (b Balance) Available() decimal.Decimal {
+	return b.Total.Add(b.Credit).Sub(b.CreditUsed).Sub(b.Held)
+}
+
+func (b Balance) equal(other Balance) bool {
+	return b.Total.Equal(other.Total) && b.Credit.Equal(other.Credit) && b.CreditUsed.Equal(other.CreditUsed) && b.Held.Equal(other.Held)
+}
+
+// Reason - cause of balance change
+type Reason string
+
+// Reasons
+const (
+	// ReasonTrade - trade of `ownTrades` channel is applied
+	ReasonTrade Reason = "trade"
+	// ReasonOrder - funds are reserved or released by order of `openOrders` channel
+	ReasonOrder Reason = "order"
+	// ReasonReconcile - balance is corrected by REST snapshot
+	ReasonReconcile Reason = "reconcile"
+)
+
+// Event - change of balance
+type Event struct {
+	Balance  Balance
+	Previous Balance
+	Reason   Reason
+	// ID - trade ID or transaction ID of order which caused the change. It's empty for reconciliation.
+	ID   string
+	Time time.Time
+}
+
+// asset - balance of asset. Held funds are the sum of known order reservations and funds which are held
+// on exchange by orders the tracker doesn't see, e.g. placed before subscription.
+type asset struct {
+	total      decimal.Decimal
+	credit     decimal.Decimal
+	creditUsed decimal.Decimal
+	reserved   decimal.Decimal
+	extra      decimal.Decimal
+}
+
+func (a *asset) balance(name string) Balance {
+	return Balance{
+		Asset:      name,
+		Total:      a.total,
+		Credit:     a.credit,
+		CreditUsed: a.creditUsed,
+		Held:       a.reserved.Add(a.extra),
+	}
+}
+
+// orderFlags - flags of order which are kept after the order is closed, because its trades may be received later
+type orderFlags struct {
+	flags  ws.OrderFlags
+	closed time.Time
+}
+
+// reservation - funds which are reserved by order
+type reservation struct {
+	asset  string
+	amount decimal.Decimal
+}
+
+// Tracker - keeps balances current between REST snapshots. Trades of `ownTrades` channel change totals and orders
+// of `openOrders` channel reserve funds, so `Available` shows funds which can be used by new orders.
+type Tracker struct {
+	provider Provider
+	pairs    map[string]rest.AssetPair
+
+	assets       map[string]*asset
+	positions    map[string]rest.Position
+	orders       *ws.OpenOrdersCache
+	reservations map[string]reservation
+	// flags - flags of orders by transaction IDs. Flags of closed orders are pruned by `Reconcile`.
+	flags map[string]orderFlags
+	// trades - times of applied trades by IDs. Trades before the last reconciliation are already in REST balances,
+	// so they are skipped by time and their IDs are pruned by `Reconcile`.
+	trades     map[string]time.Time
+	reconciled time.Time
+
+	clock      func() time.Time
+	interval   time.Duration
+	bufferSize int
+	events     *ws.Feed[Event]
+
+	unsubscribe []func() error
+	stop        chan struct{}
+	closeOnce   sync.Once
+	wg          sync.WaitGroup
+
+	mx sync.Mutex
+}
+
+// New - creates balance tracker. Pairs metadata is requested once from `assets`, e.g. `rest.Kraken`.
+// Call `Reconcile` to load balances before handling of updates.
+func New(provider Provider, assets ws.AssetPairsProvider, opts ...Option) (*Tracker, error) {
+	metadata, err := assets.AssetPairs()
+	if err != nil {
+		return nil, errors.Wrap(err, "can't receive asset pairs")
+	}
+
+	t := &Tracker{
+		provider:     provider,
+		pairs:        make(map[string]rest.AssetPair, len(metadata)),
+		assets:       make(map[string]*asset),
+		positions:    make(map[string]rest.Position),
+		orders:       ws.NewOpenOrdersCache(),
+		reservations: make(map[string]reservation),
+		flags:        make(map[string]orderFlags),
+		trades:       make(map[string]time.Time),
+		clock:        time.Now,
+		interval:     time.Minute,
+		bufferSize:   1024,
+		stop:         make(chan struct{}),
+	}
+	for _, pair := range metadata {
+		t.pairs[pair.WSName] = pair
+	}
+	for i := range opts {
+		opts[i](t)
+	}
+	t.events = ws.NewFeed[Event](t.bufferSize)
+	return t, nil
+}
+
+// Events - provides channel with changes of balances. It's closed by `Close`.
+func (t *Tracker) Events() <-chan Event {
+	return t.events.C()
+}
+
+// Dropped - returns count of events which were dropped because `Events()` channel wasn't read fast enough
+func (t *Tracker) Dropped() uint64 {
+	return t.events.Dropped()
+}
+
+// Subscribe - subscribes tracker to `openOrders` and `ownTrades` channels of websocket client by its own handles,
+// so it doesn't read `Listen()` of the client.
+func (t *Tracker) Subscribe(k *ws.Kraken) error {
+	orders, err := k.SubscribeOpenOrdersHandle(ws.WithCallback(func(event ws.Event[ws.OpenOrdersUpdate]) {
+		t.Handle(event.Update())
+	}))
+	if err != nil {
+		return err
+	}
+	trades, err := k.SubscribeOwnTradesHandle(ws.WithCallback(func(event ws.Event[ws.OwnTradesUpdate]) {
+		t.Handle(event.Update())
+	}))
+	if err != nil {
+		_ = orders.Close()
+		return err
+	}
+
+	t.mx.Lock()
+	t.unsubscribe = append(t.unsubscribe, orders.Close, trades.Close)
+	t.mx.Unlock()
+	return nil
+}
+
+// Start - starts periodic reconciliation. Updates are received by `Subscribe` or given to `Handle` by caller.
+func (t *Tracker) Start() {
+	if t.interval > 0 {
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+
+			ticker := time.NewTicker(t.interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-t.stop:
+					return
+				case <-ticker.C:
+					if err := t.Reconcile(); err != nil {
+						log.Errorf("account: %s", err)
+					}
+				}
+			}
+		}()
+	}
+}
+
+// Close - stops reconciliation, unsubscribes handles of `Subscribe` and closes `Events()` channel
+func (t *Tracker) Close() error {
+	var err error
+	t.closeOnce.Do(func() {
+		close(t.stop)
+		t.wg.Wait()
+
+		t.mx.Lock()
+		unsubscribe := t.unsubscribe
+		t.unsubscribe = nil
+		t.mx.Unlock()
+
+		for i := range unsubscribe {
+			if e := unsubscribe[i](); e != nil && err == nil {
+				err = e
+			}
+		}
+		t.events.Close()
+	})
+	return err
+}
+
+// Balance - returns balance of asset by its REST name, e.g. `XXBT`
+func (t *Tracker) Balance(name string) Balance {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	if a, ok := t.assets[name]; ok {
+		return a.balance(name)
+	}
+	return Balance{Asset: name}
+}
+
+// Balances - returns balances of all known assets
+func (t *Tracker) Balances() map[string]Balance {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	result := make(map[string]Balance, len(t.assets))
+	for name, a := range t.assets {
+		result[name] = a.balance(name)
+	}
+	return result
+}
+
+// Available - returns funds of asset which can be used by new orders
+func (t *Tracker) Available(name string) decimal.Decimal {
+	return t.Balance(name).Available()
+}
+
+// Positions - returns margin positions of the last reconciliation by transaction IDs
+func (t *Tracker) Positions() map[string]rest.Position {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	result := make(map[string]rest.Position, len(t.positions))
+	for txID, position := range t.positions {
+		result[txID] = position
+	}
+	return result
+}
+
+// Reconcile - replaces balances and positions by REST snapshots. Held funds of exchange which aren't explained
+// by known orders are kept until the next snapshot of `openOrders` channel. Trades which are older than the request
+// are treated as included in the snapshot. Exchange time of trades is compared with the clock of the tracker, so the clock
+// has to be synchronized: if it's behind the exchange, trades of the snapshot may be applied twice, and if it's ahead,
+// trades right after the request may be skipped.
+func (t *Tracker) Reconcile() error {
+	requested := t.clock()
+	balances, err := t.provider.GetAccountBalancesEx()
+	if err != nil {
+		return errors.Wrap(err, "can't receive balances")
+	}
+	positions, err := t.provider.GetOpenPositions(false)
+	if err != nil {
+		return errors.Wrap(err, "can't receive open positions")
+	}
+
+	t.mx.Lock()
+	var out events
+	now := t.clock()
+	for name := range t.assets {
+		if _, ok := balances[name]; ok {
+			continue
+		}
+		// assets with zero balance are omitted by exchange
+		t.change(name, ReasonReconcile, "", now, &out, func(a *asset) {
+			a.total, a.credit, a.creditUsed, a.extra = decimal.Zero, decimal.Zero, decimal.Zero, decimal.Zero
+		})
+	}
+	for name, balance := range balances {
+		balance := balance
+		t.change(name, ReasonReconcile, "", now, &out, func(a *asset) {
+			a.total = balance.Balance
+			a.credit = balance.Credit
+			a.creditUsed = balance.CreditUsed
+			a.extra = balance.HoldTrade.Sub(a.reserved)
+			if a.extra.IsNegative() {
+				a.extra = decimal.Zero
+			}
+		})
+	}
+	t.positions = positions
+	t.reconciled = requested
+	for tradeID, ts := range t.trades {
+		if ts.Before(requested) {
+			delete(t.trades, tradeID)
+		}
+	}
+	// trades of orders closed before the request are skipped by time, so their flags aren't needed anymore
+	for txID, flags := range t.flags {
+		if !flags.closed.IsZero() && flags.closed.Before(requested) {
+			delete(t.flags, txID)
+		}
+	}
+	t.flush(out)
+	return nil
+}
+
+// Handle - applies websocket update. Updates which don't relate to balances are ignored.
+func (t *Tracker) Handle(update ws.Update) {
+	switch data := update.Data.(type) {
+	case ws.OwnTradesUpdate:
+		t.mx.Lock()
+		var out events
+		// snapshot of every subscription repeats recent trades, so they are deduplicated by IDs and
+		// trades which are older than the last reconciliation are already in balances
+		for _, trades := range data {
+			for tradeID, trade := range trades {
+				if _, ok := t.trades[tradeID]; ok {
+					continue
+				}
+				ts := trade.Time.Time
+				if ts.IsZero() {
+					ts = t.clock()
+				}
+				if ts.Before(t.reconciled) {
+					continue
+				}
+				t.trades[tradeID] = ts
+				t.trade(tradeID, trade, &out)
+			}
+		}
+		t.flush(out)
+	case ws.OpenOrdersUpdate:
+		changed, err := t.orders.Apply(update)
+		if errors.Is(err, ws.ErrSequenceDuplicate) {
+			return
+		}
+		if err != nil {
+			log.Warnf("account: %s", err)
+		}
+
+		t.mx.Lock()
+		var out events
+		now := t.clock()
+		if update.Sequence.Value == 1 {
+			// snapshot contains all open orders, so reservations are built from scratch
+			for txID := range t.reservations {
+				if _, ok := changed[txID]; !ok {
+					t.reserve(txID, reservation{}, now, &out)
+				}
+			}
+			for name := range t.assets {
+				t.change(name, ReasonOrder, "", now, &out, func(a *asset) { a.extra = decimal.Zero })
+			}
+		}
+		for txID, order := range changed {
+			t.remember(txID, order, now)
+			t.reserve(txID, t.reservation(order), now, &out)
+		}
+		t.flush(out)
+	}
+}
+
+// trade - applies spot trade to balances of base and quote assets. Margin trades change positions only,
+// which are updated by `Reconcile`.
+func (t *Tracker) trade(tradeID string, trade ws.OwnTrade, out *events) {
+	if trade.Margin.IsPositive() {
+		return
+	}
+	pair, ok := t.pairs[trade.Pair]
+	if !ok {
+		log.Warnf("account: unknown pair %s of trade %s", trade.Pair, tradeID)
+		return
+	}
+
+	now := t.clock()
+	base, quote := trade.Vol, trade.Cost.Neg()
+	if trade.Type == ws.SideSell {
+		base, quote = base.Neg(), quote.Neg()
+	}
+
+	// fee is sent in quote currency
+	if t.feeInBase(trade) {
+		if trade.Price.IsPositive() {
+			base = base.Sub(trade.Fee.Div(trade.Price))
+		}
+	} else {
+		quote = quote.Sub(trade.Fee)
+	}
+
+	t.change(pair.Base, ReasonTrade, tradeID, now, out, func(a *asset) { a.total = a.total.Add(base) })
+	t.change(pair.Quote, ReasonTrade, tradeID, now, out, func(a *asset) { a.total = a.total.Add(quote) })
+}
+
+// remember - keeps flags of order, so fee of its trades is known after the order is closed
+func (t *Tracker) remember(txID string, order ws.OpenOrder, now time.Time) {
+	flags, ok := t.flags[txID]
+	if !ok && order.Oflags == "" {
+		return
+	}
+	if order.Oflags != "" {
+		flags.flags = order.Oflags
+	}
+	if order.Status.Final() && flags.closed.IsZero() {
+		flags.closed = now
+	}
+	t.flags[txID] = flags
+}
+
+// feeInBase - returns true if fee of trade is charged in base currency. It's default for sell orders.
+func (t *Tracker) feeInBase(trade ws.OwnTrade) bool {
+	flags := t.flags[trade.OrderID].flags
+	switch {
+	case flags.Has(ws.FlagFeeInBase):
+		return true
+	case flags.Has(ws.FlagFeeInQuote):
+		return false
+	default:
+		return trade.Type == ws.SideSell
+	}
+}
+
+// reservation - funds which are reserved by open order. Sell order reserves the rest of volume in base currency and
+// buy order reserves its cost in quote currency. Market buy orders and margin orders don't reserve funds.
+func (t *Tracker) reservation(order ws.OpenOrder) reservation {
+	if order.Status.Final() || isMargin(order.Descr.Leverage) {
+		return reservation{}
+	}
+	pair, ok := t.pairs[order.Descr.Pair]
+	if !ok {
+		return reservation{}
+	}
+
+	var result reservation
+	switch {
+	case order.Descr.Type == ws.SideSell:
+		result = reservation{asset: pair.Base, amount: order.Vol.Sub(order.VolExec)}
+	case order.Oflags.Has(ws.FlagVolumeQuoted):
+		result = reservation{asset: pair.Quote, amount: order.Vol.Sub(order.Cost)}
+	default:
+		price := order.Descr.Price
+		if isLimitTriggered(order.Descr.Ordertype) {
+			price = order.Descr.Price2
+		}
+		result = reservation{asset: pair.Quote, amount: order.Vol.Sub(order.VolExec).Mul(price)}
+	}
+	if !result.amount.IsPositive() {
+		return reservation{}
+	}
+	return result
+}
+
+// reserve - replaces reservation of order
+func (t *Tracker) reserve(txID string, value reservation, now time.Time, out *events) {
+	previous := t.reservations[txID]
+	if previous.asset == value.asset && previous.amount.Equal(value.amount) {
+		return
+	}
+	if value.asset == "" {
+		delete(t.reservations, txID)
+	} else {
+		t.reservations[txID] = value
+	}
+
+	if previous.asset == value.asset {
+		t.change(value.asset, ReasonOrder, txID, now, out, func(a *asset) { a.reserved = a.reserved.Add(value.amount).Sub(previous.amount) })
+		return
+	}
+	if previous.asset != "" {
+		t.change(previous.asset, ReasonOrder, txID, now, out, func(a *asset) { a.reserved = a.reserved.Sub(previous.amount) })
+	}
+	if value.asset != "" {
+		t.change(value.asset, ReasonOrder, txID, now, out, func(a *asset) { a.reserved = a.reserved.Add(value.amount) })
+	}
+}
+
+// change - modifies asset and emits event if its balance was changed
+func (t *Tracker) change(name string, reason Reason, id string, now time.Time, out *events, fn func(*asset)) {
+	a := t.asset(name)
+	previous := a.balance(name)
+	fn(a)
+	if current := a.balance(name); !current.equal(previous) {
+		*out = append(*out, Event{Balance: current, Previous: previous, Reason: reason, ID: id, Time: now})
+	}
+}
+
+func (t *Tracker) asset(name string) *asset {
+	a, ok := t.assets[name]
+	if !ok {
+		a = &asset{}
+		t.assets[name] = a
+	}
+	return a
+}
+
+// events - events which are collected under lock of tracker and sent after it
+type events []Event
+
+// flush - sends events and releases lock of tracker. Feed never blocks, so events are sent under the lock in order of calls.
+func (t *Tracker) flush(out events) {
+	defer t.mx.Unlock()
+	t.events.Publish(out...)
+}
+
+// isMargin - returns true if leverage of order description means margin order, e.g. `5:1`
+func isMargin(leverage string) bool {
+	switch leverage {
+	case "", "none", "0:1", "1:1":
+		return false
+	default:
+		return true
+	}
+}
+
+// isLimitTriggered - returns true if order is executed by limit price `price2` after trigger, e.g. `stop-loss-limit`
+func isLimitTriggered(orderType string) bool {
+	return orderType == ws.OrderTypeStopLossLimit || orderType == ws.OrderTypeTakeProfitLimit
+}
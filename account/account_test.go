@@ -0,0 +1,322 @@
+package account
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aopoltorzhicky/go_kraken/krakentest"
+	"github.com/aopoltorzhicky/go_kraken/rest"
+	ws "github.com/aopoltorzhicky/go_kraken/websocket"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var pairs = krakentest.AssetPairs{
+	"XXBTZUSD": {Altname: "XBTUSD", WSName: ws.BTCUSD, Base: "XXBT", Quote: "ZUSD"},
+}
+
+func newTracker(t *testing.T, provider Provider) *Tracker {
+	tracker, err := New(provider, pairs, WithClock(func() time.Time { return time.Unix(1700000000, 0) }))
+	require.NoError(t, err)
+	return tracker
+}
+
+func drain(tracker *Tracker) []Event {
+	return krakentest.Drain(tracker.Events())
+}
+
+func dec(value string) decimal.Decimal {
+	return decimal.RequireFromString(value)
+}
+
+func balance(total, hold string) rest.BalanceEx {
+	return rest.BalanceEx{Balance: dec(total), HoldTrade: dec(hold)}
+}
+
+func openOrders(sequence int64, orders map[string]ws.OpenOrder) ws.Update {
+	return ws.Update{ChannelName: ws.ChanOpenOrders, Data: ws.OpenOrdersUpdate{orders}, Sequence: ws.Seq{Value: sequence}}
+}
+
+func ownTrades(sequence int64, trades map[string]ws.OwnTrade) ws.Update {
+	return ws.Update{ChannelName: ws.ChanOwnTrades, Data: ws.OwnTradesUpdate{trades}, Sequence: ws.Seq{Value: sequence}}
+}
+
+func at(seconds int64) ws.Timestamp {
+	return ws.Timestamp{Time: time.Unix(seconds, 0)}
+}
+
+func limit(side, price, volume string) ws.OpenOrder {
+	return ws.OpenOrder{
+		Descr:  ws.OpenOrderDescr{Pair: ws.BTCUSD, Type: side, Ordertype: ws.OrderTypeLimit, Price: dec(price), Leverage: "none"},
+		Status: ws.OrderStatusOpen,
+		Vol:    dec(volume),
+	}
+}
+
+func TestTracker(t *testing.T) {
+	provider := &krakentest.Account{
+		Balances: map[string]rest.BalanceEx{"XXBT": balance("2", "0.5"), "ZUSD": balance("10000", "0")},
+	}
+	tracker := newTracker(t, provider)
+
+	require.NoError(t, tracker.Reconcile())
+	events := drain(tracker)
+	require.Len(t, events, 2)
+	assert.Equal(t, ReasonReconcile, events[0].Reason)
+	assert.Equal(t, "1.5", tracker.Available("XXBT").String(), "held funds of exchange")
+
+	// snapshot of open orders replaces held funds of exchange
+	tracker.Handle(openOrders(1, map[string]ws.OpenOrder{
+		"O1": limit(ws.SideSell, "110", "0.5"),
+		"O2": limit(ws.SideBuy, "100", "1"),
+	}))
+	assert.Equal(t, "0.5", tracker.Balance("XXBT").Held.String())
+	assert.Equal(t, "100", tracker.Balance("ZUSD").Held.String())
+	assert.Equal(t, "9900", tracker.Available("ZUSD").String())
+
+	// trades before reconciliation are already in balances
+	tracker.Handle(ownTrades(1, map[string]ws.OwnTrade{
+		"T0": {OrderID: "O0", Pair: ws.BTCUSD, Type: ws.SideBuy, Price: dec("90"), Vol: dec("1"), Cost: dec("90"), Time: at(1699999000)},
+	}))
+	assert.Equal(t, "2", tracker.Balance("XXBT").Total.String())
+
+	trade := ws.OwnTrade{OrderID: "O2", Pair: ws.BTCUSD, Type: ws.SideBuy, Price: dec("100"), Vol: dec("0.4"), Cost: dec("40"), Fee: dec("0.1")}
+	tracker.Handle(ownTrades(2, map[string]ws.OwnTrade{"T1": trade}))
+	tracker.Handle(ownTrades(3, map[string]ws.OwnTrade{"T1": trade}))
+	tracker.Handle(openOrders(2, map[string]ws.OpenOrder{"O2": {VolExec: dec("0.4"), Cost: dec("40")}}))
+	tracker.Handle(openOrders(3, map[string]ws.OpenOrder{"O1": {Status: ws.OrderStatusCanceled}}))
+
+	xbt, usd := tracker.Balance("XXBT"), tracker.Balance("ZUSD")
+	assert.Equal(t, "2.4", xbt.Total.String())
+	assert.True(t, xbt.Held.IsZero())
+	assert.Equal(t, "9959.9", usd.Total.String())
+	assert.Equal(t, "60", usd.Held.String())
+	assert.Equal(t, "9899.9", usd.Available().String())
+
+	events = drain(tracker)
+	reasons := make([]Reason, len(events))
+	for i := range events {
+		reasons[i] = events[i].Reason
+	}
+	assert.Equal(t, []Reason{ReasonOrder, ReasonOrder, ReasonOrder, ReasonTrade, ReasonTrade, ReasonOrder, ReasonOrder}, reasons)
+	assert.Equal(t, "T1", events[3].ID)
+	assert.Equal(t, "2", events[3].Previous.Total.String())
+	assert.Equal(t, "O1", events[6].ID)
+
+	// fee of sell order is charged in base currency by default
+	tracker.Handle(ownTrades(4, map[string]ws.OwnTrade{
+		"T2": {OrderID: "O3", Pair: ws.BTCUSD, Type: ws.SideSell, Price: dec("100"), Vol: dec("1"), Cost: dec("100"), Fee: dec("0.2")},
+	}))
+	assert.Equal(t, "1.398", tracker.Balance("XXBT").Total.String())
+	assert.Equal(t, "10059.9", tracker.Balance("ZUSD").Total.String())
+
+	// margin trades change positions only
+	tracker.Handle(ownTrades(5, map[string]ws.OwnTrade{
+		"T3": {OrderID: "O4", Pair: ws.BTCUSD, Type: ws.SideBuy, Price: dec("100"), Vol: dec("1"), Cost: dec("100"), Margin: dec("20")},
+	}))
+	assert.Equal(t, "1.398", tracker.Balance("XXBT").Total.String())
+}
+
+func TestTracker_Reservations(t *testing.T) {
+	tracker := newTracker(t, &krakentest.Account{})
+
+	stop := limit(ws.SideBuy, "120", "2")
+	stop.Descr.Ordertype = ws.OrderTypeStopLossLimit
+	stop.Descr.Price2 = dec("121")
+	quoted := limit(ws.SideBuy, "0", "500")
+	quoted.Oflags = ws.OrderFlags(ws.FlagVolumeQuoted)
+	quoted.Cost = dec("100")
+	margin := limit(ws.SideBuy, "100", "1")
+	margin.Descr.Leverage = "5:1"
+	unknown := limit(ws.SideSell, "100", "1")
+	unknown.Descr.Pair = "ETH/USD"
+
+	tracker.Handle(openOrders(1, map[string]ws.OpenOrder{"S": stop, "Q": quoted, "M": margin, "U": unknown}))
+	assert.Equal(t, "642", tracker.Balance("ZUSD").Held.String())
+	assert.True(t, tracker.Balance("XXBT").Held.IsZero())
+
+	// the next snapshot removes reservations of missing orders
+	tracker.Handle(openOrders(1, map[string]ws.OpenOrder{"Q": quoted}))
+	assert.Equal(t, "400", tracker.Balance("ZUSD").Held.String())
+}
+
+func TestTracker_FeeFlags(t *testing.T) {
+	tracker := newTracker(t, &krakentest.Account{})
+
+	order := limit(ws.SideBuy, "100", "1")
+	order.Oflags = ws.OrderFlags(ws.FlagFeeInBase)
+	tracker.Handle(openOrders(1, map[string]ws.OpenOrder{"O1": order}))
+	tracker.Handle(ownTrades(2, map[string]ws.OwnTrade{
+		"T1": {OrderID: "O1", Pair: ws.BTCUSD, Type: ws.SideBuy, Price: dec("100"), Vol: dec("1"), Cost: dec("100"), Fee: dec("0.5")},
+	}))
+	assert.Equal(t, "0.995", tracker.Balance("XXBT").Total.String())
+	assert.Equal(t, "-100", tracker.Balance("ZUSD").Total.String())
+
+	// trade of order which is already closed keeps fee currency of the order
+	order = limit(ws.SideSell, "100", "1")
+	order.Oflags = ws.OrderFlags(ws.FlagFeeInQuote)
+	tracker.Handle(openOrders(3, map[string]ws.OpenOrder{"O2": order}))
+	tracker.Handle(openOrders(4, map[string]ws.OpenOrder{"O2": {Status: ws.OrderStatusClosed}}))
+	tracker.Handle(ownTrades(5, map[string]ws.OwnTrade{
+		"T2": {OrderID: "O2", Pair: ws.BTCUSD, Type: ws.SideSell, Price: dec("100"), Vol: dec("1"), Cost: dec("100"), Fee: dec("0.5")},
+	}))
+	assert.Equal(t, "-0.005", tracker.Balance("XXBT").Total.String())
+	assert.Equal(t, "-0.5", tracker.Balance("ZUSD").Total.String())
+}
+
+func TestTracker_Reconcile(t *testing.T) {
+	provider := &krakentest.Account{
+		Balances:  map[string]rest.BalanceEx{"XXBT": balance("1", "0"), "ZUSD": {Balance: dec("100"), Credit: dec("50"), CreditUsed: dec("10"), HoldTrade: dec("30")}},
+		Positions: map[string]rest.Position{"P1": {OrderID: "O1", Pair: "XXBTZUSD", Volume: 1}},
+	}
+	tracker := newTracker(t, provider)
+	tracker.Handle(openOrders(1, map[string]ws.OpenOrder{"O1": limit(ws.SideBuy, "10", "2")}))
+	require.NoError(t, tracker.Reconcile())
+
+	usd := tracker.Balance("ZUSD")
+	assert.Equal(t, "30", usd.Held.String(), "held funds of unknown orders are added")
+	assert.Equal(t, "110", usd.Available().String())
+	assert.Len(t, tracker.Positions(), 1)
+
+	// drift is corrected and assets which disappeared are zeroed
+	provider.Balances = map[string]rest.BalanceEx{"ZUSD": balance("90", "20")}
+	drain(tracker)
+	require.NoError(t, tracker.Reconcile())
+	assert.True(t, tracker.Balance("XXBT").Total.IsZero())
+	assert.Equal(t, "20", tracker.Balance("ZUSD").Held.String())
+
+	events := drain(tracker)
+	require.Len(t, events, 2)
+	for _, event := range events {
+		assert.Equal(t, ReasonReconcile, event.Reason)
+	}
+
+	provider.Err = errors.New("timeout")
+	assert.Error(t, tracker.Reconcile())
+}
+
+func TestTracker_Resubscription(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	provider := &krakentest.Account{
+		Balances: map[string]rest.BalanceEx{"XXBT": balance("1", "0"), "ZUSD": balance("1000", "0")},
+	}
+	tracker, err := New(provider, pairs, WithClock(func() time.Time { return now }))
+	require.NoError(t, err)
+	require.NoError(t, tracker.Reconcile())
+
+	old := ws.OwnTrade{OrderID: "O0", Pair: ws.BTCUSD, Type: ws.SideBuy, Price: dec("100"), Vol: dec("1"), Cost: dec("100"), Time: at(1699999000)}
+	missed := ws.OwnTrade{OrderID: "O1", Pair: ws.BTCUSD, Type: ws.SideBuy, Price: dec("100"), Vol: dec("1"), Cost: dec("100"), Time: at(1700000100)}
+	later := ws.OwnTrade{OrderID: "O2", Pair: ws.BTCUSD, Type: ws.SideSell, Price: dec("100"), Vol: dec("1"), Cost: dec("100"), Time: at(1700000300)}
+
+	// fill which was made while disconnected is received by snapshot of the new subscription
+	tracker.Handle(ownTrades(1, map[string]ws.OwnTrade{"T0": old, "T1": missed}))
+	assert.Equal(t, "2", tracker.Balance("XXBT").Total.String())
+	assert.Equal(t, "900", tracker.Balance("ZUSD").Total.String())
+
+	// the next snapshot repeats applied trades
+	tracker.Handle(ownTrades(1, map[string]ws.OwnTrade{"T1": missed, "T2": later}))
+	assert.Equal(t, "1", tracker.Balance("XXBT").Total.String())
+	assert.Equal(t, "1000", tracker.Balance("ZUSD").Total.String())
+
+	// reconciliation prunes trades which are in REST balances
+	now = time.Unix(1700000200, 0)
+	require.NoError(t, tracker.Reconcile())
+	assert.Len(t, tracker.trades, 1)
+	tracker.Handle(ownTrades(1, map[string]ws.OwnTrade{"T1": missed, "T2": later}))
+	assert.Equal(t, "1", tracker.Balance("XXBT").Total.String())
+}
+
+// connect - connects client to fake exchange which has asks of BTC/USD at 100, 101 and 102
+func connect(t *testing.T) *ws.Kraken {
+	t.Helper()
+
+	server := krakentest.NewServer()
+	t.Cleanup(server.Close)
+	require.NoError(t, server.SetBook(ws.BTCUSD, []ws.PriceLevel{
+		{Price: decimal.NewFromInt(100), Volume: decimal.NewFromInt(1)},
+		{Price: decimal.NewFromInt(101), Volume: decimal.NewFromInt(1)},
+		{Price: decimal.NewFromInt(102), Volume: decimal.NewFromInt(1)},
+	}, nil))
+
+	k := ws.NewKraken(server.URL(), ws.WithTokenProvider(krakentest.StaticToken(krakentest.DefaultToken)))
+	require.NoError(t, k.Connect())
+	t.Cleanup(func() {
+		k.Close()
+	})
+	return k
+}
+
+// subscribe - subscribes tracker and another consumer of `ownTrades` channel to the same client
+func subscribe(t *testing.T, k *ws.Kraken, tracker *Tracker) *ws.SubscriptionHandle[ws.OwnTradesUpdate] {
+	t.Helper()
+
+	require.NoError(t, tracker.Subscribe(k))
+	own, err := k.SubscribeOwnTradesHandle()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = own.Close()
+	})
+	require.Eventually(t, func() bool { return own.Status() == ws.StateSubscribed }, time.Second, 5*time.Millisecond)
+	return own
+}
+
+// receiveTrades - reads own trades of the handle until `count` trades are received
+func receiveTrades(t *testing.T, handle *ws.SubscriptionHandle[ws.OwnTradesUpdate], count int) []ws.OwnTrade {
+	t.Helper()
+
+	result := make([]ws.OwnTrade, 0, count)
+	for len(result) < count {
+		select {
+		case event := <-handle.C():
+			for _, trades := range event.Data {
+				for _, trade := range trades {
+					result = append(result, trade)
+				}
+			}
+		case <-time.After(time.Second):
+			require.FailNow(t, "trades aren't received", "received %d of %d", len(result), count)
+		}
+	}
+	return result
+}
+
+func TestTracker_SharedClient(t *testing.T) {
+	k := connect(t)
+
+	tracker, err := New(&krakentest.Account{}, pairs, WithReconcileInterval(0))
+	require.NoError(t, err)
+	defer tracker.Close()
+	own := subscribe(t, k, tracker)
+
+	require.NoError(t, k.AddOrder(ws.AddOrderRequest{Pair: ws.BTCUSD, Type: ws.SideBuy, Ordertype: ws.OrderTypeMarket, Volume: "2"}))
+	assert.Len(t, receiveTrades(t, own, 2), 2)
+	require.Eventually(t, func() bool {
+		return tracker.Balance("XXBT").Total.Equal(decimal.NewFromInt(2))
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestTracker_StoppedReader(t *testing.T) {
+	k := connect(t)
+
+	tracker, err := New(&krakentest.Account{}, pairs, WithReconcileInterval(0), WithBufferSize(1))
+	require.NoError(t, err)
+	own := subscribe(t, k, tracker)
+
+	// nobody reads events of tracker: read loop isn't blocked and other consumers receive their updates
+	for i := 0; i < 3; i++ {
+		require.NoError(t, k.AddOrder(ws.AddOrderRequest{Pair: ws.BTCUSD, Type: ws.SideBuy, Ordertype: ws.OrderTypeMarket, Volume: "1"}))
+	}
+	assert.Len(t, receiveTrades(t, own, 3), 3)
+	require.Eventually(t, func() bool {
+		return tracker.Balance("XXBT").Total.Equal(decimal.NewFromInt(3))
+	}, time.Second, 5*time.Millisecond)
+	assert.NotZero(t, tracker.Dropped())
+
+	require.NoError(t, tracker.Close())
+	require.NoError(t, tracker.Close())
+	assert.Len(t, drain(tracker), 1, "the latest event is kept")
+	_, ok := <-tracker.Events()
+	assert.False(t, ok)
+}
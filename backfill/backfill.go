@@ -0,0 +1,379 @@
+package backfill
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aopoltorzhicky/go_kraken/candles"
+	"github.com/aopoltorzhicky/go_kraken/rest"
+	"github.com/aopoltorzhicky/go_kraken/websocket"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrBufferOverflow - live trades don't fit into buffer until history reaches them
+var ErrBufferOverflow = errors.New("live trades buffer overflow")
+
+// TradesProvider - source of historical trades. `rest.Kraken` implements it.
+type TradesProvider interface {
+	GetPairTrades(pair string, since int64) (rest.PairTrades, error)
+}
+
+// LiveSource - subscribes `fn` to live trades of the pair. It returns function which unsubscribes.
+type LiveSource func(pair string, fn func([]websocket.Trade)) (func() error, error)
+
+// FromKraken - returns live source which subscribes to `trade` channel of websocket client
+func FromKraken(k *websocket.Kraken) LiveSource {
+	return func(pair string, fn func([]websocket.Trade)) (func() error, error) {
+		handle, err := k.SubscribeTradesHandle([]string{pair}, websocket.WithCallback(func(event websocket.Event[[]websocket.Trade]) {
+			fn(event.Data)
+		}))
+		if err != nil {
+			return nil, err
+		}
+		return handle.Close, nil
+	}
+}
+
+// Option - option function for `Stream`
+type Option func(*Stream)
+
+// WithRequestInterval - add minimal interval between REST requests. Default: 2s which fits public rate limit of Kraken.
+func WithRequestInterval(interval time.Duration) Option {
+	return func(s *Stream) {
+		s.interval = interval
+	}
+}
+
+// WithMaxRetries - add count of retries of failed REST request. Default: 5.
+func WithMaxRetries(count int) Option {
+	return func(s *Stream) {
+		s.maxRetries = count
+	}
+}
+
+// WithBufferSize - add custom capacity of `Trades()` channel and of buffered live trades.
+// If live trades overflow the buffer until history reaches them, stream stops with `ErrBufferOverflow`.
+// After that trades which don't fit are dropped and counted by `Dropped`, so the stream continues with a gap. Default: 1024.
+func WithBufferSize(size int) Option {
+	return func(s *Stream) {
+		s.bufferSize = size
+	}
+}
+
+// Stream - ordered stream of trades of one pair which starts with REST history and continues with websocket trades.
+// Live trades are subscribed before paging history and buffered in memory until history reaches them, so there are no gaps.
+// Trades which are received by both ways are delivered once.
+type Stream struct {
+	provider TradesProvider
+	source   LiveSource
+	wsPair   string
+	restPair string
+	since    time.Time
+
+	interval   time.Duration
+	maxRetries int
+	bufferSize int
+
+	out         chan candles.Trade
+	unsubscribe func() error
+
+	live     []candles.Trade
+	isLive   bool
+	dropped  uint64
+	err      error
+	liveMx   sync.Mutex
+	wake     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+
+	// lastTime and counts - time of the last delivered trade and count of trades delivered at that time by key
+	lastTime time.Time
+	counts   map[tradeKey]int
+}
+
+type tradeKey struct {
+	price  string
+	volume string
+	side   string
+}
+
+// seam - boundary between trades which are already delivered and the next source of trades: the next REST page
+// or websocket trades. Trades of the next source at the boundary time are duplicates only while count of their key
+// doesn't exceed count of delivered ones, so real trades with equal price and volume are kept.
+type seam struct {
+	time   time.Time
+	counts map[tradeKey]int
+	seen   map[tradeKey]int
+}
+
+func (s *Stream) newSeam() *seam {
+	counts := make(map[tradeKey]int, len(s.counts))
+	for key, count := range s.counts {
+		counts[key] = count
+	}
+	return &seam{
+		time:   s.lastTime,
+		counts: counts,
+		seen:   make(map[tradeKey]int),
+	}
+}
+
+func (s *seam) duplicate(ts time.Time, key tradeKey) bool {
+	if !ts.Equal(s.time) {
+		return false
+	}
+	s.seen[key]++
+	return s.seen[key] <= s.counts[key]
+}
+
+// New - creates stream of trades of the pair from `since`. Pair is passed in websocket (`XBT/USD`) and REST (`XBTUSD`) forms.
+func New(provider TradesProvider, source LiveSource, wsPair, restPair string, since time.Time, opts ...Option) *Stream {
+	s := &Stream{
+		provider:   provider,
+		source:     source,
+		wsPair:     wsPair,
+		restPair:   restPair,
+		since:      since,
+		interval:   2 * time.Second,
+		maxRetries: 5,
+		bufferSize: 1024,
+		wake:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		counts:     make(map[tradeKey]int),
+	}
+	for i := range opts {
+		opts[i](s)
+	}
+	s.out = make(chan candles.Trade, s.bufferSize)
+	return s
+}
+
+// Start - subscribes to live trades and starts paging history
+func (s *Stream) Start() error {
+	unsubscribe, err := s.source(s.wsPair, s.onLive)
+	if err != nil {
+		return err
+	}
+	s.unsubscribe = unsubscribe
+
+	s.wg.Add(1)
+	go s.run()
+	return nil
+}
+
+// Trades - returns ordered trades. Channel is closed by `Close` or if history can't be received.
+func (s *Stream) Trades() <-chan candles.Trade {
+	return s.out
+}
+
+// Live - returns true if history is delivered and stream continues with websocket trades
+func (s *Stream) Live() bool {
+	s.liveMx.Lock()
+	defer s.liveMx.Unlock()
+	return s.isLive
+}
+
+// Err - returns error which stopped the stream
+func (s *Stream) Err() error {
+	s.liveMx.Lock()
+	defer s.liveMx.Unlock()
+	return s.err
+}
+
+// Dropped - returns count of live trades which were dropped because reader didn't keep up after history was delivered
+func (s *Stream) Dropped() uint64 {
+	s.liveMx.Lock()
+	defer s.liveMx.Unlock()
+	return s.dropped
+}
+
+// Close - unsubscribes from live trades and stops the stream
+func (s *Stream) Close() error {
+	var err error
+	s.stopOnce.Do(func() {
+		close(s.stop)
+		s.wg.Wait()
+		if s.unsubscribe != nil {
+			err = s.unsubscribe()
+		}
+	})
+	return err
+}
+
+func (s *Stream) onLive(data []websocket.Trade) {
+	trades := make([]candles.Trade, 0, len(data))
+	for i := range data {
+		trade, err := candles.FromWebsocket(data[i])
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		trades = append(trades, trade)
+	}
+
+	s.liveMx.Lock()
+	switch free := s.bufferSize - len(s.live); {
+	case len(trades) <= free:
+		s.live = append(s.live, trades...)
+	case !s.isLive:
+		// history can't be joined with live trades without gap
+		if s.err == nil {
+			s.err = ErrBufferOverflow
+		}
+	default:
+		// slow reader mustn't block websocket client, so the stream continues with a gap
+		if free < 0 {
+			free = 0
+		}
+		s.live = append(s.live, trades[:free]...)
+		s.dropped += uint64(len(trades) - free)
+		log.Warnf("%d live trades of %s are dropped: reader is too slow", len(trades)-free, s.wsPair)
+	}
+	s.liveMx.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Stream) run() {
+	defer s.wg.Done()
+	defer close(s.out)
+
+	if err := s.history(); err != nil {
+		s.liveMx.Lock()
+		s.err = err
+		s.liveMx.Unlock()
+		return
+	}
+
+	s.liveMx.Lock()
+	s.isLive = true
+	s.liveMx.Unlock()
+
+	live := s.newSeam()
+	for {
+		if !s.drain(live) || s.Err() != nil {
+			return
+		}
+		select {
+		case <-s.stop:
+			return
+		case <-s.wake:
+		}
+	}
+}
+
+// history - pages REST trades until it reaches live trades or the end of history
+func (s *Stream) history() error {
+	cursor := s.since.UnixNano()
+	for {
+		page, err := s.request(cursor)
+		if err != nil {
+			return err
+		}
+
+		boundary := s.newSeam()
+		for i := range page.Trades {
+			if !s.deliver(candles.FromREST(page.Trades[i]), boundary) {
+				return nil
+			}
+		}
+		if err := s.Err(); err != nil {
+			return err
+		}
+
+		next, err := strconv.ParseInt(page.Last, 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "invalid cursor: %s", page.Last)
+		}
+		if len(page.Trades) == 0 || next <= cursor || s.reachedLive() {
+			return nil
+		}
+		cursor = next
+
+		select {
+		case <-s.stop:
+			return nil
+		case <-time.After(s.interval):
+		}
+	}
+}
+
+// request - requests page with retries. Rate limit errors are retried with growing delay.
+func (s *Stream) request(cursor int64) (rest.PairTrades, error) {
+	delay := s.interval
+	for attempt := 0; ; attempt++ {
+		page, err := s.provider.GetPairTrades(s.restPair, cursor)
+		if err == nil {
+			return page, nil
+		}
+		if attempt >= s.maxRetries {
+			return page, errors.Wrap(err, "can't receive trades")
+		}
+		if strings.Contains(err.Error(), "Rate limit") {
+			delay *= 2
+		}
+		log.Warnf("trades request failed, retry in %s: %s", delay, err)
+
+		select {
+		case <-s.stop:
+			return page, errors.New("stream is closed")
+		case <-time.After(delay):
+		}
+	}
+}
+
+// reachedLive - returns true if delivered history overlaps with buffered live trades
+func (s *Stream) reachedLive() bool {
+	s.liveMx.Lock()
+	defer s.liveMx.Unlock()
+	return len(s.live) > 0 && !s.lastTime.Before(s.live[0].Time)
+}
+
+// drain - delivers buffered live trades. It returns false if stream is closed.
+func (s *Stream) drain(boundary *seam) bool {
+	s.liveMx.Lock()
+	trades := s.live
+	s.live = nil
+	s.liveMx.Unlock()
+
+	for i := range trades {
+		if !s.deliver(trades[i], boundary) {
+			return false
+		}
+	}
+	return true
+}
+
+// deliver - sends trade if it isn't older than delivered ones and isn't a duplicate on the seam. It returns false if stream is closed.
+func (s *Stream) deliver(trade candles.Trade, boundary *seam) bool {
+	// REST returns time as float, so both sources are compared with microsecond precision as websocket sends
+	trade.Time = trade.Time.Round(time.Microsecond)
+	key := tradeKey{
+		price:  trade.Price.String(),
+		volume: trade.Volume.String(),
+		side:   trade.Side,
+	}
+
+	if trade.Time.Before(s.lastTime) || boundary.duplicate(trade.Time, key) {
+		return true
+	}
+	if trade.Time.After(s.lastTime) {
+		s.lastTime = trade.Time
+		s.counts = make(map[tradeKey]int)
+	}
+	s.counts[key]++
+
+	select {
+	case s.out <- trade:
+		return true
+	case <-s.stop:
+		return false
+	}
+}
@@ -0,0 +1,259 @@
+package backfill
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aopoltorzhicky/go_kraken/candles"
+	"github.com/aopoltorzhicky/go_kraken/rest"
+	"github.com/aopoltorzhicky/go_kraken/websocket"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type tradesMock struct {
+	pages map[int64]rest.PairTrades
+	err   error
+	calls int
+	mx    sync.Mutex
+}
+
+func (m *tradesMock) GetPairTrades(pair string, since int64) (rest.PairTrades, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	m.calls++
+	if m.err != nil {
+		return rest.PairTrades{}, m.err
+	}
+	page, ok := m.pages[since]
+	if !ok {
+		return rest.PairTrades{Pair: pair, Last: "0"}, nil
+	}
+	return page, nil
+}
+
+type liveMock struct {
+	initial []websocket.Trade
+	fn      func([]websocket.Trade)
+	closed  bool
+}
+
+func (m *liveMock) source(pair string, fn func([]websocket.Trade)) (func() error, error) {
+	m.fn = fn
+	if len(m.initial) > 0 {
+		fn(m.initial)
+	}
+	return func() error {
+		m.closed = true
+		return nil
+	}, nil
+}
+
+func liveTrade(ts, price string) websocket.Trade {
+	return websocket.Trade{
+		Price:  json.Number(price),
+		Volume: "1",
+		Time:   json.Number(ts),
+		Side:   websocket.Buy,
+	}
+}
+
+func restTrade(ts, price float64) rest.Trade {
+	return rest.Trade{
+		Price:  price,
+		Volume: 1,
+		Time:   ts,
+		Side:   websocket.Buy,
+	}
+}
+
+func receive(t *testing.T, s *Stream, count int) []candles.Trade {
+	t.Helper()
+
+	trades := make([]candles.Trade, 0, count)
+	for len(trades) < count {
+		select {
+		case trade, ok := <-s.Trades():
+			require.True(t, ok, "stream is closed: %v", s.Err())
+			trades = append(trades, trade)
+		case <-time.After(time.Second):
+			t.Fatalf("received %d trades of %d", len(trades), count)
+		}
+	}
+	return trades
+}
+
+func TestStream(t *testing.T) {
+	provider := &tradesMock{
+		pages: map[int64]rest.PairTrades{
+			1000000000000: {
+				Trades: []rest.Trade{restTrade(1000.1, 100), restTrade(1000.2, 101)},
+				Last:   "1000200000000",
+			},
+			1000200000000: {
+				// the last trade of the previous page is repeated
+				Trades: []rest.Trade{restTrade(1000.2, 101), restTrade(1000.3, 102)},
+				Last:   "1000300000000",
+			},
+		},
+	}
+	live := &liveMock{
+		initial: []websocket.Trade{liveTrade("1000.300000", "102"), liveTrade("1000.400000", "103")},
+	}
+
+	s := New(provider, live.source, "XBT/USD", "XBTUSD", time.Unix(1000, 0), WithRequestInterval(time.Millisecond))
+	require.NoError(t, s.Start())
+
+	trades := receive(t, s, 4)
+	for i, price := range []int64{100, 101, 102, 103} {
+		assert.EqualValues(t, price, trades[i].Price.IntPart())
+	}
+	assert.Equal(t, time.Unix(1000, 400000000).UTC(), trades[3].Time)
+	assert.Equal(t, 2, provider.calls)
+
+	// live trades after switch are delivered, old ones are skipped
+	live.fn([]websocket.Trade{liveTrade("1000.100000", "99"), liveTrade("1000.500000", "104")})
+	trades = receive(t, s, 1)
+	assert.EqualValues(t, 104, trades[0].Price.IntPart())
+	assert.True(t, s.Live())
+
+	require.NoError(t, s.Close())
+	assert.True(t, live.closed)
+	_, ok := <-s.Trades()
+	assert.False(t, ok)
+	assert.NoError(t, s.Err())
+}
+
+func TestStream_EndOfHistory(t *testing.T) {
+	provider := &tradesMock{
+		pages: map[int64]rest.PairTrades{
+			1000000000000: {
+				Trades: []rest.Trade{restTrade(1000.1, 100)},
+				Last:   "1000100000000",
+			},
+		},
+	}
+	live := &liveMock{}
+
+	s := New(provider, live.source, "XBT/USD", "XBTUSD", time.Unix(1000, 0), WithRequestInterval(time.Millisecond))
+	require.NoError(t, s.Start())
+	defer s.Close()
+
+	receive(t, s, 1)
+	require.Eventually(t, s.Live, time.Second, time.Millisecond)
+	assert.Equal(t, 2, provider.calls)
+
+	live.fn([]websocket.Trade{liveTrade("1000.200000", "101")})
+	trades := receive(t, s, 1)
+	assert.EqualValues(t, 101, trades[0].Price.IntPart())
+}
+
+func TestStream_Error(t *testing.T) {
+	provider := &tradesMock{err: errors.New("EAPI:Rate limit exceeded")}
+	live := &liveMock{}
+
+	s := New(provider, live.source, "XBT/USD", "XBTUSD", time.Unix(1000, 0), WithRequestInterval(time.Millisecond), WithMaxRetries(2))
+	require.NoError(t, s.Start())
+	defer s.Close()
+
+	select {
+	case _, ok := <-s.Trades():
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("stream isn't stopped")
+	}
+	assert.Error(t, s.Err())
+	assert.False(t, s.Live())
+	assert.Equal(t, 3, provider.calls)
+}
+
+func TestStream_Duplicates(t *testing.T) {
+	provider := &tradesMock{
+		pages: map[int64]rest.PairTrades{
+			1000000000000: {
+				// two real trades with equal price and volume in one microsecond
+				Trades: []rest.Trade{restTrade(1000.1, 100), restTrade(1000.2, 101), restTrade(1000.2, 101)},
+				Last:   "1000200000000",
+			},
+		},
+	}
+	live := &liveMock{
+		// websocket repeats both REST trades and sends the third one at the same time
+		initial: []websocket.Trade{liveTrade("1000.200000", "101"), liveTrade("1000.200000", "101"), liveTrade("1000.200000", "101")},
+	}
+
+	s := New(provider, live.source, "XBT/USD", "XBTUSD", time.Unix(1000, 0), WithRequestInterval(time.Millisecond))
+	require.NoError(t, s.Start())
+	defer s.Close()
+
+	trades := receive(t, s, 4)
+	for i, price := range []int64{100, 101, 101, 101} {
+		assert.EqualValues(t, price, trades[i].Price.IntPart())
+	}
+
+	// equal live trades after the seam are delivered
+	live.fn([]websocket.Trade{liveTrade("1000.300000", "102"), liveTrade("1000.300000", "102")})
+	live.fn([]websocket.Trade{liveTrade("1000.300000", "102")})
+	assert.Len(t, receive(t, s, 3), 3)
+
+	select {
+	case trade := <-s.Trades():
+		t.Fatalf("unexpected trade: %v", trade)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestStream_BufferOverflow(t *testing.T) {
+	provider := &tradesMock{
+		pages: map[int64]rest.PairTrades{
+			1000000000000: {
+				Trades: []rest.Trade{restTrade(1000.1, 100)},
+				Last:   "1000100000000",
+			},
+		},
+	}
+	live := &liveMock{
+		initial: []websocket.Trade{liveTrade("1000.200000", "101"), liveTrade("1000.300000", "102"), liveTrade("1000.400000", "103")},
+	}
+
+	s := New(provider, live.source, "XBT/USD", "XBTUSD", time.Unix(1000, 0), WithRequestInterval(time.Millisecond), WithBufferSize(2))
+	require.NoError(t, s.Start())
+	defer s.Close()
+
+	require.Eventually(t, func() bool { return s.Err() != nil }, time.Second, time.Millisecond)
+	assert.ErrorIs(t, s.Err(), ErrBufferOverflow)
+	for range s.Trades() {
+	}
+	assert.False(t, s.Live())
+}
+
+func TestStream_SlowReader(t *testing.T) {
+	provider := &tradesMock{}
+	live := &liveMock{}
+
+	s := New(provider, live.source, "XBT/USD", "XBTUSD", time.Unix(1000, 0), WithRequestInterval(time.Millisecond), WithBufferSize(2))
+	require.NoError(t, s.Start())
+	defer s.Close()
+	require.Eventually(t, s.Live, time.Second, time.Millisecond)
+
+	// nobody reads, so trades fill the channel, the buffer and the trade which is being sent
+	for i := 0; i < 10; i++ {
+		live.fn([]websocket.Trade{liveTrade(fmt.Sprintf("1000.%06d", i+1), "100")})
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.NoError(t, s.Err())
+	assert.EqualValues(t, 5, s.Dropped())
+
+	trades := receive(t, s, 5)
+	assert.Equal(t, time.Unix(1000, 5000).UTC(), trades[4].Time)
+
+	// the stream continues after the gap
+	live.fn([]websocket.Trade{liveTrade("1000.000020", "100")})
+	trades = receive(t, s, 1)
+	assert.Equal(t, time.Unix(1000, 20000).UTC(), trades[0].Time)
+}
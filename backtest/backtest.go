@@ -0,0 +1,354 @@
+package backtest
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/aopoltorzhicky/go_kraken/candles"
+	"github.com/aopoltorzhicky/go_kraken/paper"
+	"github.com/aopoltorzhicky/go_kraken/strategy"
+	ws "github.com/aopoltorzhicky/go_kraken/websocket"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+)
+
+// ErrUnordered - event of history is older than the previous one
+var ErrUnordered = errors.New("events are not ordered by time")
+
+// depth - volume of each side of synthetic book. History has no books, so orders are executed at the last price with slippage.
+var depth = decimal.NewFromInt(1_000_000_000)
+
+// Option - option function for `Backtester`
+type Option func(*Backtester)
+
+// WithLatency - delay between the moment when strategy sends request and the moment when it's applied to the book
+func WithLatency(latency time.Duration) Option {
+	return func(b *Backtester) {
+		b.latency = latency
+	}
+}
+
+// WithSlippage - distance between the last price and price of taker execution as a fraction of price, e.g. `0.0005` is 5 bps
+func WithSlippage(slippage decimal.Decimal) Option {
+	return func(b *Backtester) {
+		b.books.slippage = slippage
+	}
+}
+
+// WithFeeVolume - 30-day trading volume in USD which selects starting fee tier. Volume of fills is added to it during the run.
+func WithFeeVolume(volume decimal.Decimal) Option {
+	return func(b *Backtester) {
+		b.feeVolume = volume
+	}
+}
+
+// WithInitialCapital - capital in quote currency which is used to calculate drawdown in percents and final equity
+func WithInitialCapital(capital decimal.Decimal) Option {
+	return func(b *Backtester) {
+		b.capital = capital
+	}
+}
+
+// WithInterval - builds candles with interval from trades of history and passes them to `Strategy.OnCandle` as `strategy.Run` does
+func WithInterval(interval time.Duration) Option {
+	return func(b *Backtester) {
+		b.interval = interval
+	}
+}
+
+// WithEquityInterval - minimal interval between points of equity curve in report. Default: 1 minute. Zero records every event.
+func WithEquityInterval(interval time.Duration) Option {
+	return func(b *Backtester) {
+		b.equityInterval = interval
+	}
+}
+
+// request - request of strategy which waits for latency
+type request struct {
+	due   time.Time
+	apply func() error
+	fail  func(err error) ws.Update
+}
+
+// Backtester - replays history of trades and candles into strategy and simulates its orders with `paper.Engine`.
+// All pairs are expected to have the same quote currency. Backtester is single use.
+type Backtester struct {
+	strategy strategy.Strategy
+	engine   *paper.Engine
+	books    *books
+	orders   *orders
+	builders map[string]*candles.Builder
+
+	latency        time.Duration
+	feeVolume      decimal.Decimal
+	capital        decimal.Decimal
+	interval       time.Duration
+	equityInterval time.Duration
+
+	now     time.Time
+	pending []request
+	err     error
+
+	account
+}
+
+// New - creates backtester. Pairs metadata with fee tiers is requested from `assets`, e.g. `rest.Kraken` or `Pairs`.
+func New(s strategy.Strategy, assets ws.AssetPairsProvider, opts ...Option) (*Backtester, error) {
+	b := &Backtester{
+		strategy:       s,
+		books:          &books{snapshots: make(map[string]ws.OrderBookSnapshot)},
+		builders:       make(map[string]*candles.Builder),
+		feeVolume:      decimal.Zero,
+		capital:        decimal.Zero,
+		equityInterval: time.Minute,
+		account:        newAccount(),
+	}
+	for i := range opts {
+		opts[i](b)
+	}
+	b.orders = &orders{b: b, updates: make(chan ws.Update)}
+
+	engine, err := paper.New(b.books, assets,
+		paper.WithClock(func() time.Time { return b.now }),
+		paper.WithFeeVolume(b.feeVolume),
+		paper.WithBufferSize(1<<16),
+	)
+	if err != nil {
+		return nil, err
+	}
+	b.engine = engine
+	return b, nil
+}
+
+// Run - replays sources merged by time and returns report. Requests which are not applied before the end of history are dropped.
+func (b *Backtester) Run(sources ...Source) (Report, error) {
+	history, err := newMerge(sources)
+	if err != nil {
+		return Report{}, err
+	}
+
+	b.strategy.Start(b.orders)
+	for b.err == nil {
+		event, err := history.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Report{}, err
+		}
+		if event.Time.Before(b.now) {
+			return Report{}, errors.Wrapf(ErrUnordered, "%s before %s", event.Time, b.now)
+		}
+		b.handle(event)
+	}
+	if b.err != nil {
+		return Report{}, b.err
+	}
+	return b.report(b.capital), nil
+}
+
+// Orders - returns all simulated orders
+func (b *Backtester) Orders() []paper.Order {
+	return b.engine.Orders()
+}
+
+func (b *Backtester) handle(event Event) {
+	b.dispatch(event.Time)
+	b.now = event.Time
+
+	switch {
+	case event.Trade != nil:
+		b.market(event.Pair, event.Trade.Price, event.Trade.Volume, event.Trade.Side)
+		b.strategy.OnTrade(event.Pair, *event.Trade)
+		b.build(event.Pair, *event.Trade)
+	case event.Candle != nil:
+		candle := event.Candle
+		// path of price inside the candle: the nearest extremum is reached first
+		path := []decimal.Decimal{candle.Open, candle.Low, candle.High, candle.Close}
+		if candle.Close.LessThan(candle.Open) {
+			path[1], path[2] = candle.High, candle.Low
+		}
+		volume := candle.Volume.Div(decimal.NewFromInt(int64(len(path))))
+		for _, price := range path {
+			b.market(event.Pair, price, volume, "")
+		}
+		b.strategy.OnCandle(event.Pair, *candle)
+	}
+
+	b.dispatch(b.now)
+	b.mark(b.now)
+}
+
+// market - moves synthetic book to the trade price and passes the trade to the engine
+func (b *Backtester) market(pair string, price, volume decimal.Decimal, side string) {
+	if !price.IsPositive() {
+		return
+	}
+	if side == "" {
+		side = ws.Buy
+		if last, ok := b.prices[pair]; ok && price.LessThan(last) {
+			side = ws.Sell
+		}
+	}
+	b.prices[pair] = price
+	b.books.set(pair, price)
+	b.engine.HandleTrades(pair, []ws.Trade{{
+		Price:     json.Number(price.String()),
+		Volume:    json.Number(volume.String()),
+		Side:      side,
+		OrderType: ws.Limit,
+	}})
+	b.drain()
+}
+
+// build - passes trade to candle builder of the pair if candles are built from trades
+func (b *Backtester) build(pair string, trade candles.Trade) {
+	if b.interval <= 0 {
+		return
+	}
+	builder, ok := b.builders[pair]
+	if !ok {
+		var err error
+		builder, err = candles.NewTimeBuilder(b.interval, candles.WithHandler(func(candle candles.Candle) {
+			b.strategy.OnCandle(pair, candle)
+		}))
+		if err != nil {
+			b.err = err
+			return
+		}
+		b.builders[pair] = builder
+	}
+	if err := builder.Add(trade); err != nil {
+		b.err = errors.Wrap(err, pair)
+	}
+}
+
+// dispatch - applies requests of strategy which reach the exchange until `until`
+func (b *Backtester) dispatch(until time.Time) {
+	for len(b.pending) > 0 && !b.pending[0].due.After(until) {
+		req := b.pending[0]
+		b.pending = b.pending[1:]
+		if req.due.After(b.now) {
+			b.now = req.due
+		}
+		if err := req.apply(); err != nil {
+			b.strategy.OnUpdate(req.fail(err))
+		}
+		b.drain()
+	}
+}
+
+// drain - delivers updates of the engine to account and strategy
+func (b *Backtester) drain() {
+	for {
+		select {
+		case update := <-b.engine.Listen():
+			if trades, ok := update.Data.(ws.OwnTradesUpdate); ok {
+				for _, trade := range trades {
+					for id, t := range trade {
+						b.fill(b.now, id, t)
+					}
+				}
+			}
+			b.strategy.OnUpdate(update)
+		default:
+			return
+		}
+	}
+}
+
+func (b *Backtester) send(apply func() error, fail func(err error) ws.Update) {
+	b.pending = append(b.pending, request{
+		due:   b.now.Add(b.latency),
+		apply: apply,
+		fail:  fail,
+	})
+}
+
+// orders - order entry of strategy which delays requests by latency. Updates are delivered to `Strategy.OnUpdate`,
+// so `Listen` returns channel without messages.
+type orders struct {
+	b       *Backtester
+	updates chan ws.Update
+}
+
+var _ ws.OrderEntry = (*orders)(nil)
+
+func (o *orders) AddOrder(req ws.AddOrderRequest) error {
+	o.b.send(func() error {
+		return o.b.engine.AddOrder(req)
+	}, func(err error) ws.Update {
+		return ws.Update{ChannelName: ws.EventAddOrder, Data: ws.AddOrderResponse{
+			ReqID:        req.ReqID,
+			Event:        ws.EventAddOrderStatus,
+			Status:       ws.StatusError,
+			ErrorMessage: err.Error(),
+		}}
+	})
+	return nil
+}
+
+func (o *orders) EditOrder(req ws.EditOrderRequest) error {
+	o.b.send(func() error {
+		return o.b.engine.EditOrder(req)
+	}, func(err error) ws.Update {
+		return ws.Update{ChannelName: ws.EventEditOrder, Data: ws.EditOrderResponse{
+			Event:        ws.EventEditOrderStatus,
+			OriginalTxID: req.OrderID,
+			ReqID:        req.ReqID,
+			Status:       ws.StatusError,
+			ErrorMessage: err.Error(),
+		}}
+	})
+	return nil
+}
+
+func (o *orders) CancelOrder(orderIDs []string) error {
+	o.b.send(func() error {
+		return o.b.engine.CancelOrder(orderIDs)
+	}, func(err error) ws.Update {
+		return ws.Update{ChannelName: ws.EventCancelOrder, Data: ws.CancelOrderResponse{
+			Event:        ws.EventCancelOrderStatus,
+			Status:       ws.StatusError,
+			ErrorMessage: err.Error(),
+		}}
+	})
+	return nil
+}
+
+func (o *orders) CancelAll() error {
+	o.b.send(o.b.engine.CancelAll, func(err error) ws.Update {
+		return ws.Update{ChannelName: ws.EventCancelAllStatus, Data: ws.CancelAllResponse{
+			Event:        ws.EventCancelAllStatus,
+			Status:       ws.StatusError,
+			ErrorMessage: err.Error(),
+		}}
+	})
+	return nil
+}
+
+func (o *orders) Listen() <-chan ws.Update {
+	return o.updates
+}
+
+// books - synthetic order books around the last prices
+type books struct {
+	snapshots map[string]ws.OrderBookSnapshot
+	slippage  decimal.Decimal
+}
+
+func (b *books) Snapshot(pair string) (ws.OrderBookSnapshot, bool) {
+	snapshot, ok := b.snapshots[pair]
+	return snapshot, ok
+}
+
+func (b *books) set(pair string, price decimal.Decimal) {
+	shift := price.Mul(b.slippage)
+	b.snapshots[pair] = ws.OrderBookSnapshot{
+		Pair:  pair,
+		Asks:  []ws.PriceLevel{{Price: price.Add(shift), Volume: depth}},
+		Bids:  []ws.PriceLevel{{Price: price.Sub(shift), Volume: depth}},
+		Valid: true,
+	}
+}
@@ -0,0 +1,235 @@
+package backtest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aopoltorzhicky/go_kraken/candles"
+	"github.com/aopoltorzhicky/go_kraken/paper"
+	"github.com/aopoltorzhicky/go_kraken/rest"
+	ws "github.com/aopoltorzhicky/go_kraken/websocket"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testPairs = Pairs{
+	ws.BTCUSD: {
+		Altname:      "XBTUSD",
+		PairDecimals: 1,
+		LotDecimals:  8,
+		Fees:         [][]float64{{0, 0.26}, {50000, 0.24}},
+		FeesMaker:    [][]float64{{0, 0.16}, {50000, 0.14}},
+		OrderMin:     decimal.RequireFromString("0.0001"),
+	},
+}
+
+type strategyMock struct {
+	orders  ws.OrderEntry
+	trades  []candles.Trade
+	candles []candles.Candle
+	updates []ws.Update
+
+	onTrade  func(m *strategyMock, trade candles.Trade)
+	onCandle func(m *strategyMock, candle candles.Candle)
+	onUpdate func(m *strategyMock, update ws.Update)
+}
+
+func (m *strategyMock) Start(orders ws.OrderEntry) {
+	m.orders = orders
+}
+
+func (m *strategyMock) OnTrade(pair string, trade candles.Trade) {
+	m.trades = append(m.trades, trade)
+	if m.onTrade != nil {
+		m.onTrade(m, trade)
+	}
+}
+
+func (m *strategyMock) OnCandle(pair string, candle candles.Candle) {
+	m.candles = append(m.candles, candle)
+	if m.onCandle != nil {
+		m.onCandle(m, candle)
+	}
+}
+
+func (m *strategyMock) OnUpdate(update ws.Update) {
+	m.updates = append(m.updates, update)
+	if m.onUpdate != nil {
+		m.onUpdate(m, update)
+	}
+}
+
+func (m *strategyMock) fills() int {
+	count := 0
+	for _, update := range m.updates {
+		if update.ChannelName == ws.ChanOwnTrades {
+			count++
+		}
+	}
+	return count
+}
+
+func candle(minute int64, open, high, low, close, volume string) candles.Candle {
+	start := time.Unix(1700000000+minute*60, 0).UTC()
+	return candles.Candle{
+		Start:  start,
+		End:    start.Add(time.Minute),
+		Open:   decimal.RequireFromString(open),
+		High:   decimal.RequireFromString(high),
+		Low:    decimal.RequireFromString(low),
+		Close:  decimal.RequireFromString(close),
+		Volume: decimal.RequireFromString(volume),
+	}
+}
+
+func TestBacktester_Candles(t *testing.T) {
+	s := &strategyMock{
+		onCandle: func(m *strategyMock, candle candles.Candle) {
+			if len(m.candles) == 1 {
+				assert.NoError(t, m.orders.AddOrder(ws.AddOrderRequest{
+					Pair: ws.BTCUSD, Type: ws.SideBuy, Ordertype: ws.OrderTypeMarket, Volume: "1",
+				}))
+			}
+		},
+		onUpdate: func(m *strategyMock, update ws.Update) {
+			if update.ChannelName == ws.ChanOwnTrades && m.fills() == 1 {
+				assert.NoError(t, m.orders.AddOrder(ws.AddOrderRequest{
+					Pair: ws.BTCUSD, Type: ws.SideSell, Ordertype: ws.OrderTypeLimit, Price: "110", Volume: "1",
+				}))
+			}
+		},
+	}
+	b, err := New(s, testPairs,
+		WithSlippage(decimal.RequireFromString("0.001")),
+		WithInitialCapital(decimal.NewFromInt(1000)),
+		WithEquityInterval(0),
+	)
+	require.NoError(t, err)
+
+	report, err := b.Run(FromCandles(ws.BTCUSD, []candles.Candle{
+		candle(0, "100", "101", "99", "100", "4"),
+		candle(1, "100", "101", "94", "95", "4"),
+		candle(2, "95", "111", "94", "110", "8"),
+		candle(3, "110", "110", "95", "96", "4"),
+	}))
+	require.NoError(t, err)
+	assert.Len(t, s.candles, 4)
+
+	require.Len(t, report.Fills, 2)
+	assert.Equal(t, "100.1", report.Fills[0].Price.String(), "taker price with slippage")
+	assert.Equal(t, "0.26026", report.Fills[0].Fee.String())
+	assert.Equal(t, ws.SideSell, report.Fills[1].Side)
+	assert.Equal(t, "110", report.Fills[1].Price.String(), "resting order is filled by trade through its price")
+	assert.Equal(t, "0.176", report.Fills[1].Fee.String(), "maker fee")
+
+	assert.Equal(t, "0.43626", report.Fees.String())
+	assert.Equal(t, "210.1", report.Turnover.String())
+	assert.Equal(t, "9.46374", report.PnL.String())
+	assert.Equal(t, "1009.46374", report.FinalEquity.String())
+	assert.Equal(t, "5", report.MaxDrawdown.String())
+	assert.Equal(t, "0.50018", report.MaxDrawdownPercent.StringFixed(5))
+	assert.True(t, report.Positions[ws.BTCUSD].IsZero())
+	assert.Len(t, report.Equity, 4)
+
+	orders := b.Orders()
+	require.Len(t, orders, 2)
+	assert.Equal(t, paper.StatusClosed, orders[1].Status)
+}
+
+func TestBacktester_Latency(t *testing.T) {
+	start := time.Unix(1700000000, 0).UTC()
+	trades := []candles.Trade{
+		{Price: decimal.NewFromInt(100), Volume: decimal.NewFromInt(1), Time: start, Side: ws.Buy},
+		{Price: decimal.NewFromInt(101), Volume: decimal.NewFromInt(1), Time: start.Add(time.Second), Side: ws.Buy},
+		{Price: decimal.NewFromInt(103), Volume: decimal.NewFromInt(1), Time: start.Add(3 * time.Second), Side: ws.Buy},
+	}
+	s := &strategyMock{
+		onTrade: func(m *strategyMock, trade candles.Trade) {
+			if len(m.trades) > 1 {
+				return
+			}
+			assert.NoError(t, m.orders.AddOrder(ws.AddOrderRequest{
+				Pair: ws.BTCUSD, Type: ws.SideBuy, Ordertype: ws.OrderTypeMarket, Volume: "0.5",
+			}))
+			assert.NoError(t, m.orders.AddOrder(ws.AddOrderRequest{
+				Pair: ws.ETHUSD, Type: ws.SideBuy, Ordertype: ws.OrderTypeMarket, Volume: "0.5", ReqID: 7,
+			}))
+		},
+	}
+	b, err := New(s, testPairs, WithLatency(2*time.Second), WithInterval(time.Second))
+	require.NoError(t, err)
+
+	report, err := b.Run(FromTrades(ws.BTCUSD, trades))
+	require.NoError(t, err)
+
+	require.Len(t, report.Fills, 1)
+	assert.Equal(t, "101", report.Fills[0].Price.String(), "order reaches the book after the second trade")
+	assert.Equal(t, start.Add(2*time.Second), report.Fills[0].Time)
+	assert.Equal(t, "0.5", report.Positions[ws.BTCUSD].String())
+	assert.Equal(t, "0.8687", report.PnL.String())
+
+	var rejected *ws.AddOrderResponse
+	for _, update := range s.updates {
+		if response, ok := update.Data.(ws.AddOrderResponse); ok && response.ReqID == 7 {
+			rejected = &response
+		}
+	}
+	require.NotNil(t, rejected)
+	assert.Equal(t, ws.StatusError, rejected.Status)
+
+	assert.Len(t, s.candles, 3, "candles are built from trades with gap fill")
+}
+
+func TestBacktester_Unordered(t *testing.T) {
+	b, err := New(&strategyMock{}, testPairs)
+	require.NoError(t, err)
+
+	_, err = b.Run(FromCandles(ws.BTCUSD, []candles.Candle{
+		candle(1, "100", "100", "100", "100", "1"),
+		candle(0, "100", "100", "100", "100", "1"),
+	}))
+	assert.ErrorIs(t, err, ErrUnordered)
+}
+
+func TestReadTradesCSV(t *testing.T) {
+	trades, err := ReadTradesCSV(strings.NewReader("time,price,volume,side\n1700000000.5,100.1,0.5,b\n2023-11-14T22:13:21Z,100.2,1,s\n"))
+	require.NoError(t, err)
+	require.Len(t, trades, 2)
+	assert.Equal(t, time.Unix(1700000000, 500000000).UTC(), trades[0].Time)
+	assert.Equal(t, "100.1", trades[0].Price.String())
+	assert.Equal(t, ws.Buy, trades[0].Side)
+	assert.Equal(t, time.Unix(1700000001, 0).UTC(), trades[1].Time.UTC())
+
+	_, err = ReadTradesCSV(strings.NewReader("1700000000,abc,1\n"))
+	assert.Error(t, err)
+}
+
+func TestReadRecording(t *testing.T) {
+	dir := t.TempDir()
+	recorder, err := ws.NewRecorder(dir, ws.WithFilePrefix("trades"))
+	require.NoError(t, err)
+	for _, data := range []string{
+		`{"event":"heartbeat"}`,
+		`[0,[["5541.20000","0.15850568","1534614057.321597","s","l",""],["5541.30000","1","1534614058.1","b","m",""]],"trade","XBT/USD"]`,
+		`[1,{"a":["5541.30000","2.50700000","1534614248.456738"]},"ticker","XBT/USD"]`,
+	} {
+		require.NoError(t, recorder.Record(ws.Frame{Time: time.Now(), Kind: ws.FrameReceived, Data: data}))
+	}
+	require.NoError(t, recorder.Close())
+
+	files, err := ws.RecordingFiles(dir, "trades")
+	require.NoError(t, err)
+	trades, err := ReadRecording(files)
+	require.NoError(t, err)
+	require.Len(t, trades[ws.BTCUSD], 2)
+	assert.Equal(t, "5541.2", trades[ws.BTCUSD][0].Price.String())
+	assert.Equal(t, ws.Buy, trades[ws.BTCUSD][1].Side)
+}
+
+func TestPairs(t *testing.T) {
+	pairs, err := Pairs{ws.ETHUSD: rest.AssetPair{Altname: "ETHUSD"}}.AssetPairs()
+	require.NoError(t, err)
+	assert.Equal(t, ws.ETHUSD, pairs[ws.ETHUSD].WSName)
+}
@@ -0,0 +1,183 @@
+package backtest
+
+import (
+	"time"
+
+	"github.com/aopoltorzhicky/go_kraken/rest"
+	ws "github.com/aopoltorzhicky/go_kraken/websocket"
+	"github.com/shopspring/decimal"
+)
+
+// Pairs - pairs metadata by websocket names. It's used instead of `rest.Kraken` for offline runs.
+type Pairs map[string]rest.AssetPair
+
+// AssetPairs - implements `websocket.AssetPairsProvider`
+func (p Pairs) AssetPairs(pairs ...string) (map[string]rest.AssetPair, error) {
+	result := make(map[string]rest.AssetPair, len(p))
+	for name, pair := range p {
+		if pair.WSName == "" {
+			pair.WSName = name
+		}
+		result[name] = pair
+	}
+	return result, nil
+}
+
+// Fill - execution of strategy order
+type Fill struct {
+	Time    time.Time
+	TradeID string
+	OrderID string
+	Pair    string
+	// Side - `buy` or `sell`
+	Side   string
+	Price  decimal.Decimal
+	Volume decimal.Decimal
+	Cost   decimal.Decimal
+	Fee    decimal.Decimal
+}
+
+// EquityPoint - point of equity curve
+type EquityPoint struct {
+	Time   time.Time
+	Equity decimal.Decimal
+}
+
+// Report - result of backtest. Amounts are in quote currency.
+type Report struct {
+	Start time.Time
+	End   time.Time
+
+	InitialCapital decimal.Decimal
+	FinalEquity    decimal.Decimal
+	// PnL - realized and unrealized profit after fees. Open positions are valued at the last price.
+	PnL  decimal.Decimal
+	Fees decimal.Decimal
+	// Turnover - total cost of fills
+	Turnover decimal.Decimal
+	// MaxDrawdown - the largest fall of equity from its peak
+	MaxDrawdown decimal.Decimal
+	// MaxDrawdownPercent - the largest fall of equity in percents of its peak. It's zero if equity has never been positive.
+	MaxDrawdownPercent decimal.Decimal
+
+	Fills []Fill
+	// Positions - volume of base currency by pairs at the end of history
+	Positions map[string]decimal.Decimal
+	Equity    []EquityPoint
+}
+
+// account - cash, positions and statistics which are built from fills
+type account struct {
+	prices    map[string]decimal.Decimal
+	positions map[string]decimal.Decimal
+	cash      decimal.Decimal
+	fees      decimal.Decimal
+	turnover  decimal.Decimal
+	fills     []Fill
+
+	start, end  time.Time
+	peak        decimal.Decimal
+	drawdown    decimal.Decimal
+	drawdownPct decimal.Decimal
+	curve       []EquityPoint
+}
+
+func newAccount() account {
+	return account{
+		prices:    make(map[string]decimal.Decimal),
+		positions: make(map[string]decimal.Decimal),
+		fills:     make([]Fill, 0),
+		curve:     make([]EquityPoint, 0),
+	}
+}
+
+// fill - applies trade of the engine to cash and positions
+func (b *Backtester) fill(ts time.Time, id string, trade ws.OwnTrade) {
+	volume, cost, fee := trade.Vol, trade.Cost, trade.Fee
+	position := b.positions[trade.Pair]
+	if trade.Type == ws.SideBuy {
+		position = position.Add(volume)
+		b.cash = b.cash.Sub(cost)
+	} else {
+		position = position.Sub(volume)
+		b.cash = b.cash.Add(cost)
+	}
+	b.positions[trade.Pair] = position
+	b.cash = b.cash.Sub(fee)
+	b.fees = b.fees.Add(fee)
+	b.turnover = b.turnover.Add(cost)
+
+	b.fills = append(b.fills, Fill{
+		Time:    ts,
+		TradeID: id,
+		OrderID: trade.OrderID,
+		Pair:    trade.Pair,
+		Side:    trade.Type,
+		Price:   trade.Price,
+		Volume:  volume,
+		Cost:    cost,
+		Fee:     fee,
+	})
+}
+
+// equity - cash with positions which are valued at the last prices
+func (a *account) equity(capital decimal.Decimal) decimal.Decimal {
+	equity := capital.Add(a.cash)
+	for pair, position := range a.positions {
+		equity = equity.Add(position.Mul(a.prices[pair]))
+	}
+	return equity
+}
+
+// mark - updates drawdown and equity curve
+func (b *Backtester) mark(ts time.Time) {
+	equity := b.equity(b.capital)
+	if b.start.IsZero() {
+		b.start = ts
+		b.peak = equity
+	}
+	b.end = ts
+
+	if equity.GreaterThan(b.peak) {
+		b.peak = equity
+	}
+	if drawdown := b.peak.Sub(equity); drawdown.GreaterThan(b.drawdown) {
+		b.drawdown = drawdown
+	}
+	if b.peak.IsPositive() {
+		if percent := b.peak.Sub(equity).Div(b.peak).Mul(decimal.NewFromInt(100)); percent.GreaterThan(b.drawdownPct) {
+			b.drawdownPct = percent
+		}
+	}
+
+	last := len(b.curve) - 1
+	if last < 0 || ts.Sub(b.curve[last].Time) >= b.equityInterval {
+		b.curve = append(b.curve, EquityPoint{Time: ts, Equity: equity})
+	}
+}
+
+func (a *account) report(capital decimal.Decimal) Report {
+	equity := a.equity(capital)
+	if last := len(a.curve) - 1; last >= 0 && !a.curve[last].Time.Equal(a.end) {
+		a.curve = append(a.curve, EquityPoint{Time: a.end, Equity: equity})
+	}
+
+	positions := make(map[string]decimal.Decimal, len(a.positions))
+	for pair, position := range a.positions {
+		positions[pair] = position
+	}
+	return Report{
+		Start:              a.start,
+		End:                a.end,
+		InitialCapital:     capital,
+		FinalEquity:        equity,
+		PnL:                equity.Sub(capital),
+		Fees:               a.fees,
+		Turnover:           a.turnover,
+		MaxDrawdown:        a.drawdown,
+		MaxDrawdownPercent: a.drawdownPct,
+		Fills:              a.fills,
+		Positions:          positions,
+		Equity:             a.curve,
+	}
+}
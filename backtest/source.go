@@ -0,0 +1,216 @@
+package backtest
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aopoltorzhicky/go_kraken/candles"
+	ws "github.com/aopoltorzhicky/go_kraken/websocket"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+)
+
+// Event - market data event of history. One of `Trade` and `Candle` is set.
+type Event struct {
+	// Pair - websocket name of the pair, e.g. `XBT/USD`
+	Pair string
+	// Time - time when event is known: time of trade or end of candle
+	Time   time.Time
+	Trade  *candles.Trade
+	Candle *candles.Candle
+}
+
+// Source - history of market data ordered by time. `Next` returns `io.EOF` at the end.
+type Source interface {
+	Next() (Event, error)
+}
+
+// sliceSource - source of events which are kept in memory
+type sliceSource struct {
+	events []Event
+}
+
+func (s *sliceSource) Next() (Event, error) {
+	if len(s.events) == 0 {
+		return Event{}, io.EOF
+	}
+	event := s.events[0]
+	s.events = s.events[1:]
+	return event, nil
+}
+
+// FromTrades - source of trades of the pair, e.g. collected from `backfill.Stream`
+func FromTrades(pair string, trades []candles.Trade) Source {
+	events := make([]Event, len(trades))
+	for i := range trades {
+		trade := trades[i]
+		events[i] = Event{Pair: pair, Time: trade.Time, Trade: &trade}
+	}
+	return &sliceSource{events: events}
+}
+
+// FromCandles - source of candles of the pair. Candle is delivered at its end.
+func FromCandles(pair string, history []candles.Candle) Source {
+	events := make([]Event, len(history))
+	for i := range history {
+		candle := history[i]
+		events[i] = Event{Pair: pair, Time: candle.End, Candle: &candle}
+	}
+	return &sliceSource{events: events}
+}
+
+// ReadTradesCSV - reads trades from CSV with columns `time,price,volume,side`. Time is unix time with fraction of seconds
+// or RFC3339, side is `b` or `s`. Header line is skipped if it starts with `time`.
+func ReadTradesCSV(r io.Reader) ([]candles.Trade, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	trades := make([]candles.Trade, 0)
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return trades, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "can't read csv")
+		}
+		if line == 1 && len(record) > 0 && strings.EqualFold(strings.TrimSpace(record[0]), "time") {
+			continue
+		}
+		if len(record) < 3 {
+			return nil, errors.Errorf("line %d: expected at least 3 columns, got %d", line, len(record))
+		}
+
+		var trade candles.Trade
+		if trade.Time, err = parseTime(strings.TrimSpace(record[0])); err != nil {
+			return nil, errors.Wrapf(err, "line %d: time", line)
+		}
+		if trade.Price, err = decimal.NewFromString(strings.TrimSpace(record[1])); err != nil {
+			return nil, errors.Wrapf(err, "line %d: price", line)
+		}
+		if trade.Volume, err = decimal.NewFromString(strings.TrimSpace(record[2])); err != nil {
+			return nil, errors.Wrapf(err, "line %d: volume", line)
+		}
+		if len(record) > 3 {
+			trade.Side = strings.TrimSpace(record[3])
+		}
+		trades = append(trades, trade)
+	}
+}
+
+func parseTime(value string) (time.Time, error) {
+	if seconds, err := decimal.NewFromString(value); err == nil {
+		nanos := seconds.Mul(decimal.NewFromInt(int64(time.Second))).IntPart()
+		return time.Unix(0, nanos).UTC(), nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// ReadRecording - reads trades of `trade` channel from files of `websocket.Recorder` by pairs
+func ReadRecording(files []string) (map[string][]candles.Trade, error) {
+	result := make(map[string][]candles.Trade)
+	for _, file := range files {
+		if err := readRecordingFile(file, result); err != nil {
+			return nil, errors.Wrap(err, file)
+		}
+	}
+	return result, nil
+}
+
+func readRecordingFile(file string, result map[string][]candles.Trade) error {
+	reader, err := ws.OpenRecording(file)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	for {
+		frame, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if frame.Kind != ws.FrameReceived {
+			continue
+		}
+
+		// channel message: [channelID, data, channelName, pair]
+		var message []json.RawMessage
+		if err := json.Unmarshal([]byte(frame.Data), &message); err != nil || len(message) != 4 {
+			continue
+		}
+		var channel, pair string
+		if err := json.Unmarshal(message[2], &channel); err != nil || channel != ws.ChanTrades {
+			continue
+		}
+		if err := json.Unmarshal(message[3], &pair); err != nil {
+			return err
+		}
+		var trades []ws.Trade
+		if err := json.Unmarshal(message[1], &trades); err != nil {
+			return err
+		}
+		for i := range trades {
+			trade, err := candles.FromWebsocket(trades[i])
+			if err != nil {
+				return err
+			}
+			result[pair] = append(result[pair], trade)
+		}
+	}
+}
+
+// merge - merges sources by time. Events with equal time keep order of sources.
+type merge struct {
+	sources []Source
+	heads   []*Event
+}
+
+func newMerge(sources []Source) (*merge, error) {
+	m := &merge{
+		sources: sources,
+		heads:   make([]*Event, len(sources)),
+	}
+	for i := range sources {
+		if err := m.advance(i); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *merge) advance(i int) error {
+	event, err := m.sources[i].Next()
+	switch {
+	case err == io.EOF:
+		m.heads[i] = nil
+	case err != nil:
+		return errors.Wrap(err, "source "+strconv.Itoa(i))
+	default:
+		m.heads[i] = &event
+	}
+	return nil
+}
+
+func (m *merge) Next() (Event, error) {
+	best := -1
+	for i, head := range m.heads {
+		if head != nil && (best == -1 || head.Time.Before(m.heads[best].Time)) {
+			best = i
+		}
+	}
+	if best == -1 {
+		return Event{}, io.EOF
+	}
+	event := *m.heads[best]
+	if err := m.advance(best); err != nil {
+		return Event{}, err
+	}
+	return event, nil
+}
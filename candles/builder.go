@@ -0,0 +1,369 @@
+package candles
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aopoltorzhicky/go_kraken/rest"
+	"github.com/aopoltorzhicky/go_kraken/websocket"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+)
+
+// ErrLateTrade - trade is older than the current candle. It happens if backfill overlaps with live trades.
+var ErrLateTrade = errors.New("trade is older than the current candle")
+
+// BarType - rule of closing candles
+type BarType int
+
+// Bar types
+const (
+	// TimeBars - candle is closed on interval boundary
+	TimeBars BarType = iota
+	// VolumeBars - candle is closed when its volume reaches threshold. Trade is split between candles if it exceeds the threshold.
+	VolumeBars
+	// TickBars - candle is closed after count of trades
+	TickBars
+)
+
+// Candle - OHLCV candle
+type Candle struct {
+	// Start - start of the interval for time bars or time of the first trade
+	Start time.Time
+	// End - end of the interval (exclusive) for time bars or time of the last trade
+	End    time.Time
+	Open   decimal.Decimal
+	High   decimal.Decimal
+	Low    decimal.Decimal
+	Close  decimal.Decimal
+	Volume decimal.Decimal
+	// VWAP - volume-weighted average price. It's equal to close for candle without trades.
+	VWAP  decimal.Decimal
+	Count int64
+	// Filled - candle was created for interval without trades. Its prices are equal to close of the previous candle.
+	Filled bool
+
+	quote decimal.Decimal
+}
+
+// Option - option function for `Builder`
+type Option func(*Builder)
+
+// WithHandler - add function which receives closed candles
+func WithHandler(fn func(Candle)) Option {
+	return func(b *Builder) {
+		b.handler = fn
+	}
+}
+
+// WithoutGapFill - don't emit empty candles for intervals without trades
+func WithoutGapFill() Option {
+	return func(b *Builder) {
+		b.fillGaps = false
+	}
+}
+
+// Builder - aggregates trades into candles. Trades must be added in order of exchange time. Time is taken only from trades
+// and `Advance`, so the builder gives the same candles for live stream and for history.
+type Builder struct {
+	barType   BarType
+	interval  time.Duration
+	threshold decimal.Decimal
+	count     int64
+
+	handler  func(Candle)
+	fillGaps bool
+
+	current *Candle
+	last    *Candle
+	mx      sync.Mutex
+}
+
+func newBuilder(barType BarType, opts []Option) *Builder {
+	b := &Builder{
+		barType:  barType,
+		fillGaps: true,
+	}
+	for i := range opts {
+		opts[i](b)
+	}
+	return b
+}
+
+// NewTimeBuilder - creates builder of candles with interval, e.g. `5 * time.Second`. Intervals are aligned to unix epoch.
+func NewTimeBuilder(interval time.Duration, opts ...Option) (*Builder, error) {
+	if interval <= 0 {
+		return nil, errors.Errorf("invalid interval: %s", interval)
+	}
+	b := newBuilder(TimeBars, opts)
+	b.interval = interval
+	return b, nil
+}
+
+// NewVolumeBuilder - creates builder of candles with `volume` in base currency each
+func NewVolumeBuilder(volume decimal.Decimal, opts ...Option) (*Builder, error) {
+	if !volume.IsPositive() {
+		return nil, errors.Errorf("invalid volume: %s", volume)
+	}
+	b := newBuilder(VolumeBars, opts)
+	b.threshold = volume
+	return b, nil
+}
+
+// NewTickBuilder - creates builder of candles with `count` trades each
+func NewTickBuilder(count int64, opts ...Option) (*Builder, error) {
+	if count <= 0 {
+		return nil, errors.Errorf("invalid count: %d", count)
+	}
+	b := newBuilder(TickBars, opts)
+	b.count = count
+	return b, nil
+}
+
+// Add - adds trade to the current candle. Candles which are closed by the trade are passed to handler.
+func (b *Builder) Add(trade Trade) error {
+	closed, err := b.add(trade)
+	b.emit(closed)
+	return err
+}
+
+// AddWebsocket - adds trades of websocket `trade` channel
+func (b *Builder) AddWebsocket(trades []websocket.Trade) error {
+	for i := range trades {
+		trade, err := FromWebsocket(trades[i])
+		if err != nil {
+			return err
+		}
+		if err := b.Add(trade); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddREST - adds trades received by REST `GetTrades`
+func (b *Builder) AddREST(trades []rest.Trade) error {
+	for i := range trades {
+		if err := b.Add(FromREST(trades[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Advance - closes time candles which end before `now` and fills intervals without trades. `now` should be exchange time,
+// e.g. time of the last received message. It does nothing for volume and tick bars.
+func (b *Builder) Advance(now time.Time) {
+	if b.barType != TimeBars {
+		return
+	}
+
+	b.mx.Lock()
+	var closed []Candle
+	if b.current != nil && !b.current.End.After(now) {
+		closed = append(closed, b.close())
+	}
+	if b.current == nil {
+		closed = append(closed, b.fill(b.align(now))...)
+	}
+	b.mx.Unlock()
+
+	b.emit(closed)
+}
+
+// Current - returns candle which isn't closed yet
+func (b *Builder) Current() (Candle, bool) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if b.current == nil {
+		return Candle{}, false
+	}
+	return b.current.withVWAP(), true
+}
+
+// Last - returns the last closed candle
+func (b *Builder) Last() (Candle, bool) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if b.last == nil {
+		return Candle{}, false
+	}
+	return *b.last, true
+}
+
+func (b *Builder) add(trade Trade) ([]Candle, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	switch b.barType {
+	case TimeBars:
+		return b.addTime(trade)
+	case VolumeBars:
+		return b.addVolume(trade)
+	default:
+		return b.addTick(trade)
+	}
+}
+
+func (b *Builder) addTime(trade Trade) ([]Candle, error) {
+	start := b.align(trade.Time)
+
+	var closed []Candle
+	if b.current != nil {
+		switch {
+		case start.Before(b.current.Start):
+			return nil, ErrLateTrade
+		case start.After(b.current.Start):
+			closed = append(closed, b.close())
+		}
+	} else if b.last != nil && start.Before(b.last.End) {
+		return nil, ErrLateTrade
+	}
+
+	if b.current == nil {
+		closed = append(closed, b.fill(start)...)
+		b.open(trade.Price, start, start.Add(b.interval))
+	}
+	b.current.add(trade.Price, trade.Volume)
+	return closed, nil
+}
+
+func (b *Builder) addVolume(trade Trade) ([]Candle, error) {
+	if err := b.checkOrder(trade); err != nil {
+		return nil, err
+	}
+
+	var closed []Candle
+	remaining := trade.Volume
+	for {
+		if b.current == nil {
+			b.open(trade.Price, trade.Time, trade.Time)
+		}
+		b.current.End = trade.Time
+
+		volume := remaining
+		if left := b.threshold.Sub(b.current.Volume); volume.GreaterThan(left) {
+			volume = left
+		}
+		b.current.add(trade.Price, volume)
+		remaining = remaining.Sub(volume)
+
+		if b.current.Volume.GreaterThanOrEqual(b.threshold) {
+			closed = append(closed, b.close())
+		}
+		if !remaining.IsPositive() {
+			return closed, nil
+		}
+	}
+}
+
+func (b *Builder) addTick(trade Trade) ([]Candle, error) {
+	if err := b.checkOrder(trade); err != nil {
+		return nil, err
+	}
+
+	if b.current == nil {
+		b.open(trade.Price, trade.Time, trade.Time)
+	}
+	b.current.End = trade.Time
+	b.current.add(trade.Price, trade.Volume)
+
+	if b.current.Count >= b.count {
+		return []Candle{b.close()}, nil
+	}
+	return nil, nil
+}
+
+func (b *Builder) checkOrder(trade Trade) error {
+	switch {
+	case b.current != nil && trade.Time.Before(b.current.End):
+		return ErrLateTrade
+	case b.current == nil && b.last != nil && trade.Time.Before(b.last.End):
+		return ErrLateTrade
+	}
+	return nil
+}
+
+func (b *Builder) align(t time.Time) time.Time {
+	nanos := t.UnixNano()
+	aligned := nanos - nanos%int64(b.interval)
+	if nanos < 0 && aligned != nanos {
+		aligned -= int64(b.interval)
+	}
+	return time.Unix(0, aligned).UTC()
+}
+
+func (b *Builder) open(price decimal.Decimal, start, end time.Time) {
+	b.current = &Candle{
+		Start: start,
+		End:   end,
+		Open:  price,
+		High:  price,
+		Low:   price,
+		Close: price,
+	}
+}
+
+func (b *Builder) close() Candle {
+	candle := b.current.withVWAP()
+	b.last = &candle
+	b.current = nil
+	return candle
+}
+
+// fill - returns empty candles between the last candle and `until`
+func (b *Builder) fill(until time.Time) []Candle {
+	if !b.fillGaps || b.last == nil {
+		return nil
+	}
+
+	var filled []Candle
+	for end := b.last.End.Add(b.interval); !end.After(until); end = b.last.End.Add(b.interval) {
+		candle := Candle{
+			Start:  b.last.End,
+			End:    end,
+			Open:   b.last.Close,
+			High:   b.last.Close,
+			Low:    b.last.Close,
+			Close:  b.last.Close,
+			VWAP:   b.last.Close,
+			Filled: true,
+		}
+		b.last = &candle
+		filled = append(filled, candle)
+	}
+	return filled
+}
+
+func (b *Builder) emit(candles []Candle) {
+	if b.handler == nil {
+		return
+	}
+	for i := range candles {
+		b.handler(candles[i])
+	}
+}
+
+func (c *Candle) add(price, volume decimal.Decimal) {
+	if price.GreaterThan(c.High) {
+		c.High = price
+	}
+	if price.LessThan(c.Low) {
+		c.Low = price
+	}
+	c.Close = price
+	c.Volume = c.Volume.Add(volume)
+	c.quote = c.quote.Add(price.Mul(volume))
+	c.Count++
+}
+
+func (c Candle) withVWAP() Candle {
+	if c.Volume.IsZero() {
+		c.VWAP = c.Close
+	} else {
+		c.VWAP = c.quote.Div(c.Volume)
+	}
+	return c
+}
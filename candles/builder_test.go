@@ -0,0 +1,154 @@
+package candles
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aopoltorzhicky/go_kraken/rest"
+	"github.com/aopoltorzhicky/go_kraken/websocket"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func trade(seconds int64, price, volume string) Trade {
+	return Trade{
+		Price:  decimal.RequireFromString(price),
+		Volume: decimal.RequireFromString(volume),
+		Time:   time.Unix(seconds, 0).UTC(),
+		Side:   websocket.Buy,
+	}
+}
+
+func assertDecimal(t *testing.T, expected string, actual decimal.Decimal) {
+	t.Helper()
+	assert.True(t, decimal.RequireFromString(expected).Equal(actual), "expected %s, got %s", expected, actual)
+}
+
+func TestTimeBuilder(t *testing.T) {
+	var closed []Candle
+	builder, err := NewTimeBuilder(10*time.Second, WithHandler(func(c Candle) {
+		closed = append(closed, c)
+	}))
+	require.NoError(t, err)
+
+	require.NoError(t, builder.Add(trade(1000, "100", "1")))
+	require.NoError(t, builder.Add(trade(1003, "102", "1")))
+	require.NoError(t, builder.Add(trade(1009, "99", "2")))
+	assert.Empty(t, closed)
+
+	current, ok := builder.Current()
+	require.True(t, ok)
+	assertDecimal(t, "100", current.VWAP)
+
+	// trade after gap closes the candle and fills two empty intervals
+	require.NoError(t, builder.Add(trade(1035, "101", "1")))
+	require.Len(t, closed, 3)
+
+	first := closed[0]
+	assert.Equal(t, time.Unix(1000, 0).UTC(), first.Start)
+	assert.Equal(t, time.Unix(1010, 0).UTC(), first.End)
+	assertDecimal(t, "100", first.Open)
+	assertDecimal(t, "102", first.High)
+	assertDecimal(t, "99", first.Low)
+	assertDecimal(t, "99", first.Close)
+	assertDecimal(t, "4", first.Volume)
+	assertDecimal(t, "100", first.VWAP)
+	assert.EqualValues(t, 3, first.Count)
+	assert.False(t, first.Filled)
+
+	for _, filled := range closed[1:] {
+		assert.True(t, filled.Filled)
+		assertDecimal(t, "99", filled.Open)
+		assertDecimal(t, "99", filled.Close)
+		assert.True(t, filled.Volume.IsZero())
+	}
+	assert.Equal(t, time.Unix(1030, 0).UTC(), closed[2].End)
+
+	assert.ErrorIs(t, builder.Add(trade(1020, "100", "1")), ErrLateTrade)
+
+	// exchange time closes the candle without new trades
+	builder.Advance(time.Unix(1055, 0))
+	require.Len(t, closed, 5)
+	assertDecimal(t, "101", closed[3].Close)
+	assert.True(t, closed[4].Filled)
+	_, ok = builder.Current()
+	assert.False(t, ok)
+}
+
+func TestTimeBuilder_WithoutGapFill(t *testing.T) {
+	var closed []Candle
+	builder, err := NewTimeBuilder(time.Second, WithoutGapFill(), WithHandler(func(c Candle) {
+		closed = append(closed, c)
+	}))
+	require.NoError(t, err)
+
+	require.NoError(t, builder.Add(trade(1000, "100", "1")))
+	require.NoError(t, builder.Add(trade(1005, "101", "1")))
+	require.Len(t, closed, 1)
+
+	last, ok := builder.Last()
+	require.True(t, ok)
+	assert.Equal(t, closed[0], last)
+}
+
+func TestVolumeBuilder(t *testing.T) {
+	var closed []Candle
+	builder, err := NewVolumeBuilder(decimal.NewFromInt(2), WithHandler(func(c Candle) {
+		closed = append(closed, c)
+	}))
+	require.NoError(t, err)
+
+	require.NoError(t, builder.Add(trade(1000, "100", "1.5")))
+	// trade is split between three candles
+	require.NoError(t, builder.Add(trade(1001, "110", "3")))
+	require.Len(t, closed, 2)
+	assertDecimal(t, "2", closed[0].Volume)
+	// (100 * 1.5 + 110 * 0.5) / 2
+	assertDecimal(t, "102.5", closed[0].VWAP)
+	assertDecimal(t, "2", closed[1].Volume)
+	assertDecimal(t, "110", closed[1].Open)
+
+	current, ok := builder.Current()
+	require.True(t, ok)
+	assertDecimal(t, "0.5", current.Volume)
+
+	_, err = NewVolumeBuilder(decimal.Zero)
+	assert.Error(t, err)
+}
+
+func TestTickBuilder(t *testing.T) {
+	var closed []Candle
+	builder, err := NewTickBuilder(2, WithHandler(func(c Candle) {
+		closed = append(closed, c)
+	}))
+	require.NoError(t, err)
+
+	require.NoError(t, builder.AddREST([]rest.Trade{
+		{Price: 100, Volume: 1, Time: 1000.5},
+		{Price: 101, Volume: 1, Time: 1001.25},
+		{Price: 102, Volume: 1, Time: 1002},
+	}))
+	require.Len(t, closed, 1)
+	assert.Equal(t, time.Unix(1000, 500000000).UTC(), closed[0].Start)
+	assert.Equal(t, time.Unix(1001, 250000000).UTC(), closed[0].End)
+	assertDecimal(t, "100.5", closed[0].VWAP)
+
+	assert.ErrorIs(t, builder.Add(trade(1001, "100", "1")), ErrLateTrade)
+}
+
+func TestFromWebsocket(t *testing.T) {
+	trade, err := FromWebsocket(websocket.Trade{
+		Price:  "5541.20000",
+		Volume: "0.15850568",
+		Time:   "1534614057.321597",
+		Side:   websocket.Sell,
+	})
+	require.NoError(t, err)
+	assertDecimal(t, "5541.2", trade.Price)
+	assert.Equal(t, time.Unix(1534614057, 321597000).UTC(), trade.Time)
+	assert.Equal(t, websocket.Sell, trade.Side)
+
+	_, err = FromWebsocket(websocket.Trade{Price: "x"})
+	assert.Error(t, err)
+}
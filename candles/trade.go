@@ -0,0 +1,68 @@
+package candles
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/aopoltorzhicky/go_kraken/rest"
+	"github.com/aopoltorzhicky/go_kraken/websocket"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+)
+
+// Trade - trade which is used to build candles
+type Trade struct {
+	Price  decimal.Decimal
+	Volume decimal.Decimal
+	// Time - exchange time of the trade
+	Time time.Time
+	// Side - `b` for buy and `s` for sell as Kraken sends it
+	Side string
+}
+
+// FromWebsocket - converts trade from websocket `trade` channel
+func FromWebsocket(trade websocket.Trade) (Trade, error) {
+	price, err := decimal.NewFromString(trade.Price.String())
+	if err != nil {
+		return Trade{}, errors.Wrap(err, "price")
+	}
+	volume, err := decimal.NewFromString(trade.Volume.String())
+	if err != nil {
+		return Trade{}, errors.Wrap(err, "volume")
+	}
+	ts, err := parseTime(trade.Time)
+	if err != nil {
+		return Trade{}, errors.Wrap(err, "time")
+	}
+	return Trade{
+		Price:  price,
+		Volume: volume,
+		Time:   ts,
+		Side:   trade.Side,
+	}, nil
+}
+
+// FromREST - converts trade from REST `Trades` method
+func FromREST(trade rest.Trade) Trade {
+	return Trade{
+		Price:  decimal.NewFromFloat(trade.Price),
+		Volume: decimal.NewFromFloat(trade.Volume),
+		Time:   floatTime(trade.Time),
+		Side:   trade.Side,
+	}
+}
+
+// parseTime - parses unix time with fraction of seconds, e.g. `1534614057.321597`
+func parseTime(value json.Number) (time.Time, error) {
+	seconds, err := decimal.NewFromString(value.String())
+	if err != nil {
+		return time.Time{}, err
+	}
+	nanos := seconds.Shift(9).Round(0).IntPart()
+	return time.Unix(0, nanos).UTC(), nil
+}
+
+func floatTime(value float64) time.Time {
+	nanos := decimal.NewFromFloat(value).Shift(9).Round(0).IntPart()
+	return time.Unix(0, nanos).UTC()
+}
@@ -19,10 +19,20 @@ func main() {
 		log.Fatalf("Error connecting to web socket: %s", err.Error())
 	}
 
-	// subscribe to BTCUSD`s book
-	if err := kraken.SubscribeBook([]string{ws.BTCUSD}, ws.Depth10); err != nil {
-		log.Fatalf("SubscribeBook error: %s", err.Error())
+	// subscribe to BTCUSD`s book, which is resynchronized automatically on checksum mismatch or reconnect
+	// 10 - a depth of order book, 1 - the price precision, 8 - the volume precision of XBT/USD
+	orderBook, err := kraken.NewManagedBook(ws.BTCUSD, ws.Depth10, 1, 8,
+		ws.WithBookStateCallback(func(event ws.BookEvent) {
+			log.Printf("Book of %s is %s (resyncs: %d)", event.Pair, event.State, event.Resyncs)
+		}),
+		ws.WithBookUpdateCallback(func(book *ws.OrderBook) {
+			log.Print(book.String())
+		}),
+	)
+	if err != nil {
+		log.Fatalf("NewManagedBook error: %s", err.Error())
 	}
+	defer orderBook.Close()
 
 	// subscribe to BTCUSD`s candles
 	if err := kraken.SubscribeCandles([]string{ws.BTCUSD}, ws.Interval1440); err != nil {
@@ -44,8 +54,6 @@ func main() {
 		log.Fatalf("SubscribeSpread error: %s", err.Error())
 	}
 
-	orderBook := ws.NewOrderBook(10, 5, 8)
-
 	for {
 		select {
 		case <-signals:
@@ -81,12 +89,6 @@ func main() {
 				log.Printf("----Spread of %s----", update.Pair)
 				log.Printf("Ask: %s with %s", data.Ask.String(), data.AskVolume.String())
 				log.Printf("Bid: %s with %s", data.Bid.String(), data.BidVolume.String())
-			case ws.OrderBookUpdate:
-				if err := orderBook.ApplyUpdate(data, true); err != nil {
-					log.Fatal(err)
-				}
-
-				log.Print(orderBook.String())
 			default:
 			}
 		}
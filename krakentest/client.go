@@ -0,0 +1,173 @@
+package krakentest
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	ws "github.com/aopoltorzhicky/go_kraken/websocket"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// subscription - public subscription of client to the channel of one pair
+type subscription struct {
+	id          int64
+	name        string
+	channelName string
+	pair        Pair
+	depth       int
+	interval    int64
+}
+
+// outgoing - frame in send queue of client
+type outgoing struct {
+	data  []byte
+	delay time.Duration
+}
+
+// client - connection of websocket client. Its fields are guarded by lock of server.
+type client struct {
+	server *Server
+	conn   *websocket.Conn
+
+	subs []*subscription
+	// private - sequences of subscribed private channels
+	private map[string]int64
+
+	out       chan outgoing
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newClient(server *Server, conn *websocket.Conn) *client {
+	return &client{
+		server:  server,
+		conn:    conn,
+		private: make(map[string]int64),
+		out:     make(chan outgoing, 1024),
+		done:    make(chan struct{}),
+	}
+}
+
+func (c *client) readThread() {
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		c.server.handle(c, data)
+	}
+}
+
+// writeThread - writes queued frames in order. Delay of faulty frame delays all next frames as slow network does.
+func (c *client) writeThread() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case msg := <-c.out:
+			if msg.delay > 0 {
+				select {
+				case <-c.done:
+					return
+				case <-time.After(msg.delay):
+				}
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg.data); err != nil {
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+func (c *client) heartbeatThread(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.sendEvent(ws.EventType{Event: ws.EventHeartbeat})
+		}
+	}
+}
+
+func (c *client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// send - queues frame. Frames of closed client are dropped.
+func (c *client) send(data []byte, delay time.Duration) {
+	select {
+	case c.out <- outgoing{data: data, delay: delay}:
+	case <-c.done:
+	}
+}
+
+// sendEvent - sends event without faults
+func (c *client) sendEvent(event interface{}) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	c.send(data, 0)
+}
+
+// sendData - sends channel message with faults of server. It's called under lock of server.
+func (c *client) sendData(msg interface{}) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	data, delay := c.server.fault(data)
+	if data == nil {
+		return
+	}
+	c.send(data, delay)
+}
+
+// sendPrivate - sends message of private channel if client is subscribed to it. It's called under lock of server.
+func (c *client) sendPrivate(name string, data interface{}) {
+	sequence, ok := c.private[name]
+	if !ok {
+		return
+	}
+	sequence++
+	c.private[name] = sequence
+	c.sendData([]interface{}{data, name, map[string]int64{"sequence": sequence}})
+}
+
+func (c *client) subscribed(channelName, pair string) *subscription {
+	for _, sub := range c.subs {
+		if sub.channelName == channelName && sub.pair.Name == pair {
+			return sub
+		}
+	}
+	return nil
+}
+
+func (c *client) remove(sub *subscription) {
+	for i := range c.subs {
+		if c.subs[i] == sub {
+			c.subs = append(c.subs[:i], c.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+func itoa(value int64) string {
+	return strconv.FormatInt(value, 10)
+}
@@ -0,0 +1,431 @@
+package krakentest
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	ws "github.com/aopoltorzhicky/go_kraken/websocket"
+	"github.com/shopspring/decimal"
+)
+
+// Order statuses
+const (
+	OrderPending  = "pending"
+	OrderOpen     = "open"
+	OrderClosed   = "closed"
+	OrderCanceled = "canceled"
+)
+
+// Order - order which is placed by `addOrder`
+type Order struct {
+	ID string
+	// Pair - websocket name of the pair
+	Pair string
+	// Side - `ws.SideBuy` or `ws.SideSell`
+	Side string
+	// Type - `ws.OrderTypeLimit` or `ws.OrderTypeMarket`
+	Type     string
+	Price    decimal.Decimal
+	Volume   decimal.Decimal
+	Executed decimal.Decimal
+	Cost     decimal.Decimal
+	Status   string
+	UserRef  int64
+	Opened   time.Time
+}
+
+func (o Order) remaining() decimal.Decimal {
+	return o.Volume.Sub(o.Executed)
+}
+
+func (o Order) isBuy() bool {
+	return o.Side == ws.SideBuy
+}
+
+// ownTrade - execution of order
+type ownTrade struct {
+	id     string
+	order  *Order
+	price  decimal.Decimal
+	volume decimal.Decimal
+	time   time.Time
+	pair   Pair
+}
+
+// engine - tiny matching engine. Incoming orders take liquidity of server order book,
+// the rest of limit order waits for public trade which crosses its price. Its fields are guarded by lock of server.
+type engine struct {
+	server *Server
+	orders []*Order
+	trades []ownTrade
+	lastID int64
+}
+
+func newEngine(server *Server) *engine {
+	return &engine{
+		server: server,
+	}
+}
+
+// Orders - returns all orders in order of placement
+func (s *Server) Orders() []Order {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	orders := make([]Order, len(s.engine.orders))
+	for i := range s.engine.orders {
+		orders[i] = *s.engine.orders[i]
+	}
+	return orders
+}
+
+// nextID - returns identifier in Kraken format, e.g. `O00000-00000-000001`
+func (e *engine) nextID(prefix string) string {
+	e.lastID++
+	return fmt.Sprintf("%s00000-00000-%06d", prefix, e.lastID)
+}
+
+func (e *engine) addOrder(c *client, data []byte) {
+	var req ws.AddOrderRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		c.sendEvent(errorEvent(ws.EventAddOrderStatus, "EGeneral:Invalid arguments"))
+		return
+	}
+	response := ws.AddOrderResponse{
+		ReqID:  req.ReqID,
+		Event:  ws.EventAddOrderStatus,
+		Status: "ok",
+	}
+
+	e.server.mx.Lock()
+	defer e.server.mx.Unlock()
+
+	order, pair, message := e.parseOrder(req)
+	if message != "" {
+		response.Status = "error"
+		response.ErrorMessage = message
+		c.sendEvent(response)
+		return
+	}
+	response.Description = description(pair, order)
+	if req.Validate == "true" {
+		c.sendEvent(response)
+		return
+	}
+
+	order.ID = e.nextID("O")
+	order.Status = OrderPending
+	order.Opened = e.server.now()
+	e.orders = append(e.orders, order)
+	response.TxID = order.ID
+	c.sendEvent(response)
+
+	e.sendOrders(map[string]interface{}{order.ID: orderInfo(pair, order)})
+	order.Status = OrderOpen
+	e.sendOrders(map[string]interface{}{order.ID: map[string]string{"status": OrderOpen}})
+
+	e.take(pair, order)
+	if order.Status == OrderOpen && order.Type == ws.OrderTypeMarket {
+		e.cancel(order, "Insufficient liquidity")
+	}
+}
+
+// parseOrder - validates request. It returns error message if order is invalid.
+func (e *engine) parseOrder(req ws.AddOrderRequest) (*Order, Pair, string) {
+	if req.Token != e.server.token {
+		return nil, Pair{}, "EGeneral:Invalid arguments:token"
+	}
+	pair, ok := e.server.pair(req.Pair)
+	if !ok {
+		return nil, pair, "EQuery:Unknown asset pair"
+	}
+	if req.Type != ws.SideBuy && req.Type != ws.SideSell {
+		return nil, pair, "EGeneral:Invalid arguments:type"
+	}
+	if req.Ordertype != ws.OrderTypeLimit && req.Ordertype != ws.OrderTypeMarket {
+		return nil, pair, "EGeneral:Invalid arguments:ordertype"
+	}
+	volume, err := decimal.NewFromString(req.Volume)
+	if err != nil || !volume.IsPositive() {
+		return nil, pair, "EGeneral:Invalid arguments:volume"
+	}
+
+	order := &Order{
+		Pair:   pair.Name,
+		Side:   req.Type,
+		Type:   req.Ordertype,
+		Volume: volume.Round(pair.VolumeDecimals),
+	}
+	if req.Ordertype == ws.OrderTypeLimit {
+		price, err := decimal.NewFromString(req.Price)
+		if err != nil || !price.IsPositive() {
+			return nil, pair, "EGeneral:Invalid arguments:price"
+		}
+		order.Price = price.Round(pair.PriceDecimals)
+	}
+	if req.UserRef != "" {
+		if _, err := fmt.Sscan(req.UserRef, &order.UserRef); err != nil {
+			return nil, pair, "EGeneral:Invalid arguments:userref"
+		}
+	}
+	return order, pair, ""
+}
+
+// take - fills order by levels of server order book
+func (e *engine) take(pair Pair, order *Order) {
+	var trades []Trade
+	e.server.changeBookLocked(pair, func(b *book, now time.Time) {
+		levels := b.side(order.isBuy())
+		for order.remaining().IsPositive() && len(*levels) > 0 {
+			level := (*levels)[0]
+			if order.Type == ws.OrderTypeLimit {
+				if order.isBuy() && level.price.GreaterThan(order.Price) || !order.isBuy() && level.price.LessThan(order.Price) {
+					break
+				}
+			}
+			volume := decimal.Min(order.remaining(), level.volume)
+			b.set(order.isBuy(), level.price, level.volume.Sub(volume), now)
+			e.fill(pair, order, level.price, volume, now)
+
+			trade := Trade{Price: level.price, Volume: volume, Side: ws.Buy, OrderType: ws.Limit, Time: now}
+			if !order.isBuy() {
+				trade.Side = ws.Sell
+			}
+			if order.Type == ws.OrderTypeMarket {
+				trade.OrderType = ws.Market
+			}
+			trades = append(trades, trade)
+		}
+	})
+	if len(trades) > 0 {
+		e.server.publishTrades(pair, trades)
+	}
+}
+
+// fillResting - fills open limit orders which are crossed by public trade
+func (e *engine) fillResting(pair Pair, trade Trade) {
+	available := trade.Volume
+	now := e.server.now()
+	for _, order := range e.orders {
+		if !available.IsPositive() {
+			return
+		}
+		if order.Pair != pair.Name || order.Status != OrderOpen || order.Type != ws.OrderTypeLimit {
+			continue
+		}
+		// sell trade hits bids, buy trade lifts asks
+		crossed := order.isBuy() && trade.Side == ws.Sell && !trade.Price.GreaterThan(order.Price) ||
+			!order.isBuy() && trade.Side != ws.Sell && !trade.Price.LessThan(order.Price)
+		if !crossed {
+			continue
+		}
+		volume := decimal.Min(order.remaining(), available)
+		available = available.Sub(volume)
+		e.fill(pair, order, order.Price, volume, now)
+	}
+}
+
+// fill - executes part of order and sends private updates
+func (e *engine) fill(pair Pair, order *Order, price, volume decimal.Decimal, now time.Time) {
+	order.Executed = order.Executed.Add(volume)
+	order.Cost = order.Cost.Add(price.Mul(volume))
+
+	trade := ownTrade{
+		id:     e.nextID("T"),
+		order:  order,
+		price:  price,
+		volume: volume,
+		time:   now,
+		pair:   pair,
+	}
+	e.trades = append(e.trades, trade)
+	e.sendTrades([]map[string]interface{}{{trade.id: tradeInfo(trade)}})
+
+	e.sendOrders(map[string]interface{}{
+		order.ID: map[string]interface{}{
+			"vol_exec":  order.Executed.StringFixed(pair.VolumeDecimals),
+			"cost":      order.Cost.StringFixed(pair.PriceDecimals),
+			"fee":       decimal.Zero.StringFixed(pair.PriceDecimals),
+			"avg_price": order.Cost.Div(order.Executed).StringFixed(pair.PriceDecimals),
+			"userref":   order.UserRef,
+		},
+	})
+	if !order.remaining().IsPositive() {
+		order.Status = OrderClosed
+		e.sendOrders(map[string]interface{}{order.ID: map[string]string{"status": OrderClosed}})
+	}
+}
+
+func (e *engine) cancel(order *Order, reason string) {
+	order.Status = OrderCanceled
+	e.sendOrders(map[string]interface{}{
+		order.ID: map[string]string{"status": OrderCanceled, "reason": reason},
+	})
+}
+
+func (e *engine) cancelOrder(c *client, data []byte) {
+	var req ws.CancelOrderRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		c.sendEvent(errorEvent(ws.EventCancelOrderStatus, "EGeneral:Invalid arguments"))
+		return
+	}
+	response := ws.CancelOrderResponse{
+		ReqID:  req.ReqID,
+		Event:  ws.EventCancelOrderStatus,
+		Status: "ok",
+	}
+
+	e.server.mx.Lock()
+	defer e.server.mx.Unlock()
+
+	if req.Token != e.server.token {
+		response.Status = "error"
+		response.ErrorMessage = "EGeneral:Invalid arguments:token"
+		c.sendEvent(response)
+		return
+	}
+
+	orders := make([]*Order, 0, len(req.TxID))
+	for _, id := range req.TxID {
+		order := e.find(id)
+		if order == nil || order.Status != OrderOpen {
+			response.Status = "error"
+			response.ErrorMessage = "EOrder:Unknown order"
+			c.sendEvent(response)
+			return
+		}
+		orders = append(orders, order)
+	}
+	for _, order := range orders {
+		e.cancel(order, "User requested")
+	}
+	c.sendEvent(response)
+}
+
+func (e *engine) cancelAll(c *client, data []byte) {
+	var req ws.AuthRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		c.sendEvent(errorEvent(ws.EventCancelAllStatus, "EGeneral:Invalid arguments"))
+		return
+	}
+	response := ws.CancelAllResponse{
+		Event:  ws.EventCancelAllStatus,
+		Status: "ok",
+	}
+
+	e.server.mx.Lock()
+	defer e.server.mx.Unlock()
+
+	if req.Token != e.server.token {
+		response.Status = "error"
+		response.ErrorMessage = "EGeneral:Invalid arguments:token"
+		c.sendEvent(response)
+		return
+	}
+	for _, order := range e.orders {
+		if order.Status == OrderOpen {
+			e.cancel(order, "User requested")
+			response.Count++
+		}
+	}
+	c.sendEvent(response)
+}
+
+func (e *engine) find(id string) *Order {
+	for _, order := range e.orders {
+		if order.ID == id {
+			return order
+		}
+	}
+	return nil
+}
+
+// snapshot - sends open orders or own trades to the client which is subscribed to the channel
+func (e *engine) snapshot(c *client, name string) {
+	switch name {
+	case ws.ChanOpenOrders:
+		orders := make([]map[string]interface{}, 0)
+		for _, order := range e.orders {
+			if order.Status == OrderOpen {
+				pair, _ := e.server.pair(order.Pair)
+				orders = append(orders, map[string]interface{}{order.ID: orderInfo(pair, order)})
+			}
+		}
+		c.sendPrivate(name, orders)
+	case ws.ChanOwnTrades:
+		trades := make([]map[string]interface{}, len(e.trades))
+		for i := range e.trades {
+			trades[i] = map[string]interface{}{e.trades[i].id: tradeInfo(e.trades[i])}
+		}
+		c.sendPrivate(name, trades)
+	}
+}
+
+func (e *engine) sendOrders(update map[string]interface{}) {
+	for c := range e.server.clients {
+		c.sendPrivate(ws.ChanOpenOrders, []map[string]interface{}{update})
+	}
+}
+
+func (e *engine) sendTrades(update []map[string]interface{}) {
+	for c := range e.server.clients {
+		c.sendPrivate(ws.ChanOwnTrades, update)
+	}
+}
+
+func description(pair Pair, order *Order) string {
+	if order.Type == ws.OrderTypeMarket {
+		return fmt.Sprintf("%s %s %s @ market", order.Side, order.Volume.StringFixed(pair.VolumeDecimals), pair.Name)
+	}
+	return fmt.Sprintf("%s %s %s @ limit %s", order.Side, order.Volume.StringFixed(pair.VolumeDecimals), pair.Name, order.Price.StringFixed(pair.PriceDecimals))
+}
+
+func orderInfo(pair Pair, order *Order) map[string]interface{} {
+	price := order.Price.StringFixed(pair.PriceDecimals)
+	zero := decimal.Zero.StringFixed(pair.PriceDecimals)
+	return map[string]interface{}{
+		"refid":    nil,
+		"userref":  order.UserRef,
+		"status":   order.Status,
+		"opentm":   formatTime(order.Opened),
+		"starttm":  "0",
+		"expiretm": "0",
+		"descr": map[string]string{
+			"pair":      pair.Name,
+			"type":      order.Side,
+			"ordertype": order.Type,
+			"price":     price,
+			"price2":    zero,
+			"leverage":  "none",
+			"order":     description(pair, order),
+			"close":     "",
+		},
+		"vol":        order.Volume.StringFixed(pair.VolumeDecimals),
+		"vol_exec":   order.Executed.StringFixed(pair.VolumeDecimals),
+		"cost":       order.Cost.StringFixed(pair.PriceDecimals),
+		"fee":        zero,
+		"avg_price":  zero,
+		"stopprice":  zero,
+		"limitprice": zero,
+		"misc":       "",
+		"oflags":     "fciq",
+	}
+}
+
+func tradeInfo(trade ownTrade) map[string]string {
+	pair := trade.pair
+	return map[string]string{
+		"ordertxid": trade.order.ID,
+		"postxid":   "TKH2SE-M7IF5-CFI7LT",
+		"pair":      pair.Name,
+		"time":      formatTime(trade.time),
+		"type":      trade.order.Side,
+		"ordertype": trade.order.Type,
+		"price":     trade.price.StringFixed(pair.PriceDecimals),
+		"cost":      trade.price.Mul(trade.volume).StringFixed(pair.PriceDecimals),
+		"fee":       decimal.Zero.StringFixed(pair.PriceDecimals),
+		"vol":       trade.volume.StringFixed(pair.VolumeDecimals),
+		"margin":    decimal.Zero.StringFixed(pair.PriceDecimals),
+	}
+}
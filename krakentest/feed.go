@@ -0,0 +1,168 @@
+package krakentest
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	ws "github.com/aopoltorzhicky/go_kraken/websocket"
+	"github.com/shopspring/decimal"
+)
+
+// feedDepth - count of levels of each side which are generated by random feed
+const feedDepth = 25
+
+// feedState - random walk of one pair
+type feedState struct {
+	pair   Pair
+	mid    decimal.Decimal
+	tick   decimal.Decimal
+	candle Candle
+	trades int64
+}
+
+// RandomFeed - publishes random order book updates, trades, tickers and 1 minute candles of pairs every interval
+// until `stop` is called or server is closed. The same seed gives the same data.
+func (s *Server) RandomFeed(pairs []string, interval time.Duration, seed int64) (stop func()) {
+	rnd := rand.New(rand.NewSource(seed))
+	done := make(chan struct{})
+	closed := make(chan struct{})
+
+	states := make([]*feedState, 0, len(pairs))
+	s.mx.Lock()
+	for _, name := range pairs {
+		pair, ok := s.pair(name)
+		if !ok {
+			continue
+		}
+		tick := decimal.New(1, -pair.PriceDecimals)
+		if pair.PriceDecimals > 1 {
+			tick = decimal.New(1, -1)
+		}
+		states = append(states, &feedState{
+			pair: pair,
+			mid:  decimal.NewFromInt(1000),
+			tick: tick,
+		})
+	}
+	s.mx.Unlock()
+
+	s.feeds.Add(1)
+	go func() {
+		defer s.feeds.Done()
+		defer close(closed)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-s.stopped:
+				return
+			case <-ticker.C:
+				s.mx.Lock()
+				for _, state := range states {
+					s.step(state, rnd)
+				}
+				s.mx.Unlock()
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+		<-closed
+	}
+}
+
+// step - generates one step of random feed. It's called under lock of server.
+func (s *Server) step(state *feedState, rnd *rand.Rand) {
+	pair := state.pair
+	volume := func() decimal.Decimal {
+		return decimal.NewFromFloat(0.1 + rnd.Float64()*5).Round(pair.VolumeDecimals)
+	}
+
+	switch rnd.Intn(3) {
+	case 0:
+		state.mid = state.mid.Add(state.tick)
+	case 1:
+		state.mid = state.mid.Sub(state.tick)
+	}
+
+	s.changeBookLocked(pair, func(b *book, now time.Time) {
+		// levels which are crossed by moved mid price are removed
+		for len(b.asks) > 0 && !b.asks[0].price.GreaterThan(state.mid) {
+			b.asks = b.asks[1:]
+		}
+		for len(b.bids) > 0 && !b.bids[0].price.LessThan(state.mid) {
+			b.bids = b.bids[1:]
+		}
+
+		if len(b.asks) == 0 || len(b.bids) == 0 {
+			for i := 1; i <= feedDepth; i++ {
+				offset := state.tick.Mul(decimal.NewFromInt(int64(i)))
+				b.set(true, state.mid.Add(offset), volume(), now)
+				b.set(false, state.mid.Sub(offset), volume(), now)
+			}
+			return
+		}
+
+		for i := rnd.Intn(3) + 1; i > 0; i-- {
+			offset := state.tick.Mul(decimal.NewFromInt(int64(rnd.Intn(feedDepth) + 1)))
+			isAsk := rnd.Intn(2) == 0
+			price := state.mid.Sub(offset)
+			if isAsk {
+				price = state.mid.Add(offset)
+			}
+			level := volume()
+			if rnd.Intn(3) == 0 {
+				level = decimal.Zero
+			}
+			b.set(isAsk, price, level, now)
+		}
+	})
+
+	b := s.books[pair.Name]
+	if rnd.Intn(2) == 0 || len(b.asks) == 0 || len(b.bids) == 0 {
+		return
+	}
+
+	trade := Trade{Volume: volume().Div(decimal.NewFromInt(10)).Round(pair.VolumeDecimals), Time: s.now()}
+	if rnd.Intn(2) == 0 {
+		trade.Side, trade.Price = ws.Buy, b.asks[0].price
+	} else {
+		trade.Side, trade.Price = ws.Sell, b.bids[0].price
+	}
+	s.publishTrades(pair, []Trade{trade})
+	s.engine.fillResting(pair, trade)
+	state.trades++
+
+	candle := &state.candle
+	minute := trade.Time.Truncate(time.Minute)
+	if candle.Count == 0 || candle.Time.Truncate(time.Minute).Before(minute) {
+		*candle = Candle{Open: trade.Price, High: trade.Price, Low: trade.Price}
+	}
+	candle.Time = trade.Time
+	candle.High = decimal.Max(candle.High, trade.Price)
+	candle.Low = decimal.Min(candle.Low, trade.Price)
+	candle.Close = trade.Price
+	candle.VWAP = candle.VWAP.Mul(candle.Volume).Add(trade.Price.Mul(trade.Volume)).Div(candle.Volume.Add(trade.Volume))
+	candle.Volume = candle.Volume.Add(trade.Volume)
+	candle.Count++
+	s.publishCandle(pair, ws.Interval1, *candle)
+
+	s.broadcastTicker(pair, Ticker{
+		Last:       trade.Price,
+		LastVolume: trade.Volume,
+		Volume:     candle.Volume,
+		VWAP:       candle.VWAP,
+		Low:        candle.Low,
+		High:       candle.High,
+		Open:       candle.Open,
+		Trades:     state.trades,
+	})
+}
@@ -0,0 +1,437 @@
+package krakentest
+
+import (
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strings"
+	"time"
+
+	ws "github.com/aopoltorzhicky/go_kraken/websocket"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+)
+
+// ErrUnknownPair - pair isn't served by the server
+var ErrUnknownPair = errors.New("unknown pair")
+
+// checksumDepth - count of levels of each side which are used in checksum
+const checksumDepth = 10
+
+// Trade - public trade
+type Trade struct {
+	Price  decimal.Decimal
+	Volume decimal.Decimal
+	// Side - `ws.Buy` or `ws.Sell`. Default: `ws.Buy`.
+	Side string
+	// OrderType - `ws.Limit` or `ws.Market`. Default: `ws.Limit`.
+	OrderType string
+	// Time - default: current time of server clock
+	Time time.Time
+}
+
+// Ticker - ticker message. Zero ask and bid are taken from the top of order book.
+type Ticker struct {
+	Ask        decimal.Decimal
+	Bid        decimal.Decimal
+	Last       decimal.Decimal
+	LastVolume decimal.Decimal
+	Volume     decimal.Decimal
+	VWAP       decimal.Decimal
+	Low        decimal.Decimal
+	High       decimal.Decimal
+	Open       decimal.Decimal
+	Trades     int64
+}
+
+// Candle - ohlc message
+type Candle struct {
+	// Time - time of the last update of the candle. End of the interval is computed from it.
+	Time   time.Time
+	Open   decimal.Decimal
+	High   decimal.Decimal
+	Low    decimal.Decimal
+	Close  decimal.Decimal
+	VWAP   decimal.Decimal
+	Volume decimal.Decimal
+	Count  int64
+}
+
+// bookLevel - price level of server order book
+type bookLevel struct {
+	price  decimal.Decimal
+	volume decimal.Decimal
+	time   time.Time
+}
+
+// book - full order book of the pair. Subscribers receive top levels of their depth.
+type book struct {
+	asks []bookLevel
+	bids []bookLevel
+}
+
+func (b *book) clone() *book {
+	return &book{
+		asks: append([]bookLevel(nil), b.asks...),
+		bids: append([]bookLevel(nil), b.bids...),
+	}
+}
+
+func (b *book) side(isAsk bool) *[]bookLevel {
+	if isAsk {
+		return &b.asks
+	}
+	return &b.bids
+}
+
+// set - sets volume of the level. Zero volume removes the level.
+func (b *book) set(isAsk bool, price, volume decimal.Decimal, t time.Time) {
+	levels := b.side(isAsk)
+	i := sort.Search(len(*levels), func(i int) bool {
+		if isAsk {
+			return (*levels)[i].price.GreaterThanOrEqual(price)
+		}
+		return (*levels)[i].price.LessThanOrEqual(price)
+	})
+	found := i < len(*levels) && (*levels)[i].price.Equal(price)
+
+	switch {
+	case !volume.IsPositive():
+		if found {
+			*levels = append((*levels)[:i], (*levels)[i+1:]...)
+		}
+	case found:
+		(*levels)[i].volume = volume
+		(*levels)[i].time = t
+	default:
+		*levels = append(*levels, bookLevel{})
+		copy((*levels)[i+1:], (*levels)[i:])
+		(*levels)[i] = bookLevel{price: price, volume: volume, time: t}
+	}
+}
+
+func top(levels []bookLevel, depth int) []bookLevel {
+	if len(levels) > depth {
+		return levels[:depth]
+	}
+	return levels
+}
+
+// SetBook - replaces order book of the pair. Subscribers receive the difference as updates with valid checksums.
+func (s *Server) SetBook(pair string, asks, bids []ws.PriceLevel) error {
+	return s.changeBook(pair, func(b *book, p Pair, now time.Time) {
+		b.asks = b.asks[:0]
+		b.bids = b.bids[:0]
+		for i := range asks {
+			b.set(true, asks[i].Price.Round(p.PriceDecimals), asks[i].Volume.Round(p.VolumeDecimals), now)
+		}
+		for i := range bids {
+			b.set(false, bids[i].Price.Round(p.PriceDecimals), bids[i].Volume.Round(p.VolumeDecimals), now)
+		}
+	})
+}
+
+// UpdateBook - changes levels of order book of the pair. Level with zero volume is removed.
+func (s *Server) UpdateBook(pair string, asks, bids []ws.PriceLevel) error {
+	return s.changeBook(pair, func(b *book, p Pair, now time.Time) {
+		for i := range asks {
+			b.set(true, asks[i].Price.Round(p.PriceDecimals), asks[i].Volume.Round(p.VolumeDecimals), now)
+		}
+		for i := range bids {
+			b.set(false, bids[i].Price.Round(p.PriceDecimals), bids[i].Volume.Round(p.VolumeDecimals), now)
+		}
+	})
+}
+
+// Book - returns order book of the pair: asks in ascending and bids in descending order
+func (s *Server) Book(pair string) (asks, bids []ws.PriceLevel) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	b, ok := s.books[pair]
+	if !ok {
+		return nil, nil
+	}
+	return priceLevels(b.asks), priceLevels(b.bids)
+}
+
+func priceLevels(levels []bookLevel) []ws.PriceLevel {
+	result := make([]ws.PriceLevel, len(levels))
+	for i := range levels {
+		result[i] = ws.PriceLevel{Price: levels[i].price, Volume: levels[i].volume}
+	}
+	return result
+}
+
+func (s *Server) changeBook(pairName string, fn func(b *book, p Pair, now time.Time)) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	pair, ok := s.pair(pairName)
+	if !ok {
+		return errors.Wrap(ErrUnknownPair, pairName)
+	}
+	s.changeBookLocked(pair, func(b *book, now time.Time) {
+		fn(b, pair, now)
+	})
+	return nil
+}
+
+// changeBookLocked - changes order book and sends updates to subscribers. It's called under lock of server.
+func (s *Server) changeBookLocked(pair Pair, fn func(b *book, now time.Time)) {
+	b, ok := s.books[pair.Name]
+	if !ok {
+		b = new(book)
+		s.books[pair.Name] = b
+	}
+	old := b.clone()
+	fn(b, s.now())
+
+	s.broadcast(ws.ChanBook, pair.Name, func(sub *subscription) interface{} {
+		return bookUpdate(sub, old, b)
+	})
+}
+
+// bookSnapshot - returns snapshot message of subscription. It's called under lock of server.
+func (s *Server) bookSnapshot(sub *subscription) interface{} {
+	b, ok := s.books[sub.pair.Name]
+	if !ok {
+		b = new(book)
+	}
+	return []interface{}{
+		sub.id,
+		map[string]interface{}{
+			"as": formatLevels(sub.pair, top(b.asks, sub.depth)),
+			"bs": formatLevels(sub.pair, top(b.bids, sub.depth)),
+		},
+		sub.channelName,
+		sub.pair.Name,
+	}
+}
+
+// bookUpdate - returns update message with changes of top levels of subscription depth or nil if they are not changed
+func bookUpdate(sub *subscription, old, current *book) interface{} {
+	asks := sideDiff(sub.pair, top(old.asks, sub.depth), top(current.asks, sub.depth), old.asks)
+	bids := sideDiff(sub.pair, top(old.bids, sub.depth), top(current.bids, sub.depth), old.bids)
+	if len(asks) == 0 && len(bids) == 0 {
+		return nil
+	}
+
+	checksum := bookChecksum(sub.pair, top(current.asks, sub.depth), top(current.bids, sub.depth))
+	switch {
+	case len(bids) == 0:
+		return []interface{}{sub.id, map[string]interface{}{"a": asks, "c": checksum}, sub.channelName, sub.pair.Name}
+	case len(asks) == 0:
+		return []interface{}{sub.id, map[string]interface{}{"b": bids, "c": checksum}, sub.channelName, sub.pair.Name}
+	default:
+		return []interface{}{sub.id, map[string]interface{}{"a": asks}, map[string]interface{}{"b": bids, "c": checksum}, sub.channelName, sub.pair.Name}
+	}
+}
+
+// sideDiff - returns entries which turn `old` top levels into `current` ones: removed levels go first.
+// Levels which come into view from deeper part of the book are marked as republished.
+func sideDiff(pair Pair, old, current, oldFull []bookLevel) [][]string {
+	var removed, changed [][]string
+	for i := range old {
+		if findLevel(current, old[i].price) < 0 {
+			entry := formatLevel(pair, old[i])
+			entry[1] = decimal.Zero.StringFixed(pair.VolumeDecimals)
+			removed = append(removed, entry)
+		}
+	}
+	for i := range current {
+		j := findLevel(old, current[i].price)
+		switch {
+		case j >= 0 && old[j].volume.Equal(current[i].volume):
+		case j < 0 && isRepublished(oldFull, current[i]):
+			changed = append(changed, append(formatLevel(pair, current[i]), "r"))
+		default:
+			changed = append(changed, formatLevel(pair, current[i]))
+		}
+	}
+	return append(removed, changed...)
+}
+
+func isRepublished(levels []bookLevel, level bookLevel) bool {
+	j := findLevel(levels, level.price)
+	return j >= 0 && levels[j].volume.Equal(level.volume)
+}
+
+func findLevel(levels []bookLevel, price decimal.Decimal) int {
+	for i := range levels {
+		if levels[i].price.Equal(price) {
+			return i
+		}
+	}
+	return -1
+}
+
+func formatLevels(pair Pair, levels []bookLevel) [][]string {
+	result := make([][]string, len(levels))
+	for i := range levels {
+		result[i] = formatLevel(pair, levels[i])
+	}
+	return result
+}
+
+func formatLevel(pair Pair, level bookLevel) []string {
+	return []string{
+		level.price.StringFixed(pair.PriceDecimals),
+		level.volume.StringFixed(pair.VolumeDecimals),
+		formatTime(level.time),
+	}
+}
+
+// bookChecksum - CRC32 of top 10 asks and bids: price and volume without dot and leading zeros
+func bookChecksum(pair Pair, asks, bids []bookLevel) string {
+	var str strings.Builder
+	for _, levels := range [][]bookLevel{top(asks, checksumDepth), top(bids, checksumDepth)} {
+		for i := range levels {
+			str.WriteString(checksumValue(levels[i].price.StringFixed(pair.PriceDecimals)))
+			str.WriteString(checksumValue(levels[i].volume.StringFixed(pair.VolumeDecimals)))
+		}
+	}
+	return fmt.Sprint(crc32.ChecksumIEEE([]byte(str.String())))
+}
+
+func checksumValue(value string) string {
+	return strings.TrimLeft(strings.Replace(value, ".", "", 1), "0")
+}
+
+// formatTime - unix time with microseconds as Kraken sends it, e.g. `1534614057.321597`
+func formatTime(t time.Time) string {
+	micros := t.UnixNano() / int64(time.Microsecond)
+	return fmt.Sprintf("%d.%06d", micros/1e6, micros%1e6)
+}
+
+// PublishTrade - sends trades to subscribers of `trade` channel. Resting orders which are crossed by trades are filled.
+func (s *Server) PublishTrade(pairName string, trades ...Trade) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	pair, ok := s.pair(pairName)
+	if !ok {
+		return errors.Wrap(ErrUnknownPair, pairName)
+	}
+	s.publishTrades(pair, trades)
+	for i := range trades {
+		s.engine.fillResting(pair, trades[i])
+	}
+	return nil
+}
+
+// publishTrades - sends trades. It's called under lock of server.
+func (s *Server) publishTrades(pair Pair, trades []Trade) {
+	now := s.now()
+	entries := make([][]string, len(trades))
+	for i := range trades {
+		trade := trades[i]
+		if trade.Side == "" {
+			trade.Side = ws.Buy
+		}
+		if trade.OrderType == "" {
+			trade.OrderType = ws.Limit
+		}
+		if trade.Time.IsZero() {
+			trade.Time = now
+		}
+		entries[i] = []string{
+			trade.Price.StringFixed(pair.PriceDecimals),
+			trade.Volume.StringFixed(pair.VolumeDecimals),
+			formatTime(trade.Time),
+			trade.Side,
+			trade.OrderType,
+			"",
+		}
+	}
+	s.broadcast(ws.ChanTrades, pair.Name, func(sub *subscription) interface{} {
+		return []interface{}{sub.id, entries, sub.channelName, pair.Name}
+	})
+}
+
+// PublishTicker - sends ticker to subscribers of `ticker` channel
+func (s *Server) PublishTicker(pairName string, ticker Ticker) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	pair, ok := s.pair(pairName)
+	if !ok {
+		return errors.Wrap(ErrUnknownPair, pairName)
+	}
+	s.broadcastTicker(pair, ticker)
+	return nil
+}
+
+// broadcastTicker - sends ticker. It's called under lock of server.
+func (s *Server) broadcastTicker(pair Pair, ticker Ticker) {
+	if b, ok := s.books[pair.Name]; ok {
+		if ticker.Ask.IsZero() && len(b.asks) > 0 {
+			ticker.Ask = b.asks[0].price
+		}
+		if ticker.Bid.IsZero() && len(b.bids) > 0 {
+			ticker.Bid = b.bids[0].price
+		}
+	}
+
+	price := func(value decimal.Decimal) []string {
+		formatted := value.StringFixed(pair.PriceDecimals)
+		return []string{formatted, formatted}
+	}
+	volume := ticker.Volume.StringFixed(pair.VolumeDecimals)
+	data := map[string]interface{}{
+		"a": []interface{}{ticker.Ask.StringFixed(pair.PriceDecimals), 1, "1.000"},
+		"b": []interface{}{ticker.Bid.StringFixed(pair.PriceDecimals), 1, "1.000"},
+		"c": []string{ticker.Last.StringFixed(pair.PriceDecimals), ticker.LastVolume.StringFixed(pair.VolumeDecimals)},
+		"v": []string{volume, volume},
+		"p": price(ticker.VWAP),
+		"t": []int64{ticker.Trades, ticker.Trades},
+		"l": price(ticker.Low),
+		"h": price(ticker.High),
+		"o": price(ticker.Open),
+	}
+	s.broadcast(ws.ChanTicker, pair.Name, func(sub *subscription) interface{} {
+		return []interface{}{sub.id, data, sub.channelName, pair.Name}
+	})
+}
+
+// PublishCandle - sends candle to subscribers of `ohlc` channel with the interval in minutes
+func (s *Server) PublishCandle(pairName string, interval int64, candle Candle) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	pair, ok := s.pair(pairName)
+	if !ok {
+		return errors.Wrap(ErrUnknownPair, pairName)
+	}
+	s.publishCandle(pair, interval, candle)
+	return nil
+}
+
+// publishCandle - sends candle. It's called under lock of server.
+func (s *Server) publishCandle(pair Pair, interval int64, candle Candle) {
+	if candle.Time.IsZero() {
+		candle.Time = s.now()
+	}
+	// intervals are aligned to unix epoch
+	length := int64(time.Duration(interval) * time.Minute)
+	nanos := candle.Time.UnixNano()
+	end := time.Unix(0, nanos-nanos%length+length)
+
+	data := []interface{}{
+		formatTime(candle.Time),
+		formatTime(end),
+		candle.Open.StringFixed(pair.PriceDecimals),
+		candle.High.StringFixed(pair.PriceDecimals),
+		candle.Low.StringFixed(pair.PriceDecimals),
+		candle.Close.StringFixed(pair.PriceDecimals),
+		candle.VWAP.StringFixed(pair.PriceDecimals),
+		candle.Volume.StringFixed(pair.VolumeDecimals),
+		candle.Count,
+	}
+	s.broadcast(ws.ChanCandles, pair.Name, func(sub *subscription) interface{} {
+		if sub.interval != interval {
+			return nil
+		}
+		return []interface{}{sub.id, data, sub.channelName, pair.Name}
+	})
+}
@@ -0,0 +1,210 @@
+package krakentest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aopoltorzhicky/go_kraken/rest"
+	ws "github.com/aopoltorzhicky/go_kraken/websocket"
+)
+
+// StaticToken - token provider which always returns the same token, e.g. `DefaultToken`. It implements `websocket.TokenProvider`.
+type StaticToken string
+
+// Token -
+func (t StaticToken) Token() (string, time.Duration, error) {
+	return string(t), time.Hour, nil
+}
+
+// OrderEntry - order entry which records requests instead of sending them. It implements `websocket.OrderEntry`.
+// Updates which are pushed to `Updates` are received by `Listen()`.
+type OrderEntry struct {
+	Updates chan ws.Update
+
+	added    []ws.AddOrderRequest
+	edited   []ws.EditOrderRequest
+	canceled []string
+	err      error
+	mx       sync.Mutex
+}
+
+// NewOrderEntry - creates recording order entry
+func NewOrderEntry() *OrderEntry {
+	return &OrderEntry{
+		Updates: make(chan ws.Update, 1024),
+	}
+}
+
+// SetError - sets error which is returned by the next requests
+func (e *OrderEntry) SetError(err error) {
+	e.mx.Lock()
+	e.err = err
+	e.mx.Unlock()
+}
+
+// AddOrder - records request
+func (e *OrderEntry) AddOrder(req ws.AddOrderRequest) error {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	e.added = append(e.added, req)
+	return e.err
+}
+
+// EditOrder - records request
+func (e *OrderEntry) EditOrder(req ws.EditOrderRequest) error {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	e.edited = append(e.edited, req)
+	return e.err
+}
+
+// CancelOrder - records identifiers of orders
+func (e *OrderEntry) CancelOrder(orderIDs []string) error {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	e.canceled = append(e.canceled, orderIDs...)
+	return e.err
+}
+
+// CancelAll -
+func (e *OrderEntry) CancelAll() error {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	return e.err
+}
+
+// Listen -
+func (e *OrderEntry) Listen() <-chan ws.Update {
+	return e.Updates
+}
+
+// Added - returns recorded `AddOrder` requests
+func (e *OrderEntry) Added() []ws.AddOrderRequest {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	return append([]ws.AddOrderRequest(nil), e.added...)
+}
+
+// Edited - returns recorded `EditOrder` requests
+func (e *OrderEntry) Edited() []ws.EditOrderRequest {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	return append([]ws.EditOrderRequest(nil), e.edited...)
+}
+
+// Canceled - returns identifiers of orders passed to `CancelOrder`
+func (e *OrderEntry) Canceled() []string {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	return append([]string(nil), e.canceled...)
+}
+
+// AssetPairs - static metadata of pairs by REST name. It implements `websocket.AssetPairsProvider`.
+type AssetPairs map[string]rest.AssetPair
+
+// AssetPairs -
+func (p AssetPairs) AssetPairs(pairs ...string) (map[string]rest.AssetPair, error) {
+	return p, nil
+}
+
+// Books - static order books by websocket pair name. It implements `paper.BookProvider`.
+type Books map[string]ws.OrderBookSnapshot
+
+// Snapshot -
+func (b Books) Snapshot(pair string) (ws.OrderBookSnapshot, bool) {
+	snapshot, ok := b[pair]
+	return snapshot, ok
+}
+
+// Account - static private REST data. It implements providers of packages `oms`, `account` and `risk`.
+// Fields are read under lock, so change them by `Set` while account is used by other goroutines.
+type Account struct {
+	Balances     map[string]rest.BalanceEx
+	Positions    map[string]rest.Position
+	TradeBalance rest.TradeBalanceResponse
+	OpenOrders   map[string]rest.OrderInfo
+	ClosedOrders map[string]rest.OrderInfo
+	// Orders - orders which are returned by `QueryOrders` if they are requested
+	Orders map[string]rest.OrderInfo
+	// Err - error which is returned by all requests
+	Err error
+
+	// QueriedIDs - identifiers requested by all `QueryOrders` calls, ClosedStart - start of the last `GetClosedOrders` call
+	QueriedIDs  []string
+	ClosedStart int64
+
+	mx sync.Mutex
+}
+
+// Set - changes fields under lock
+func (a *Account) Set(fn func(a *Account)) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	fn(a)
+}
+
+// GetAccountBalancesEx -
+func (a *Account) GetAccountBalancesEx() (map[string]rest.BalanceEx, error) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	return a.Balances, a.Err
+}
+
+// GetOpenPositions -
+func (a *Account) GetOpenPositions(docalcs bool, txIDs ...string) (map[string]rest.Position, error) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	return a.Positions, a.Err
+}
+
+// GetTradeBalance -
+func (a *Account) GetTradeBalance(baseAsset string) (rest.TradeBalanceResponse, error) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	return a.TradeBalance, a.Err
+}
+
+// GetOpenOrders -
+func (a *Account) GetOpenOrders(needTrades bool, userRef string) (rest.OpenOrdersResponse, error) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	return rest.OpenOrdersResponse{Orders: a.OpenOrders}, a.Err
+}
+
+// GetClosedOrders -
+func (a *Account) GetClosedOrders(needTrades bool, userRef string, start int64, end int64) (rest.ClosedOrdersResponse, error) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	a.ClosedStart = start
+	return rest.ClosedOrdersResponse{Orders: a.ClosedOrders, Count: int64(len(a.ClosedOrders))}, a.Err
+}
+
+// QueryOrders -
+func (a *Account) QueryOrders(needTrades bool, userRef string, txIDs ...string) (map[string]rest.OrderInfo, error) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	a.QueriedIDs = append(a.QueriedIDs, txIDs...)
+	result := make(map[string]rest.OrderInfo)
+	for _, id := range txIDs {
+		if order, ok := a.Orders[id]; ok {
+			result[id] = order
+		}
+	}
+	return result, a.Err
+}
+
+// Drain - returns values which are buffered in the channel without waiting for new ones
+func Drain[T any](ch <-chan T) []T {
+	result := make([]T, 0)
+	for {
+		select {
+		case value, ok := <-ch:
+			if !ok {
+				return result
+			}
+			result = append(result, value)
+		default:
+			return result
+		}
+	}
+}
@@ -0,0 +1,678 @@
+package krakentest
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aopoltorzhicky/go_kraken/rest"
+	ws "github.com/aopoltorzhicky/go_kraken/websocket"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+)
+
+// Default credentials which are accepted by `RESTServer`. Secret is base64 encoded as Kraken secrets are.
+const (
+	DefaultAPIKey    = "krakentest-key"
+	DefaultAPISecret = "a3Jha2VudGVzdC1zZWNyZXQ="
+)
+
+// Default rate limit of `RESTServer` which equals to limit of Kraken starter tier
+const (
+	DefaultRateLimit = 15
+	DefaultRateDecay = 0.33
+)
+
+// maxTrades - maximum count of trades in response of `Trades` method
+const maxTrades = 1000
+
+// Kraken errors which are returned by `RESTServer`
+const (
+	EGeneralUnknownMethod    = "EGeneral:Unknown method"
+	EGeneralInvalidArguments = "EGeneral:Invalid arguments"
+	EAPIInvalidKey           = "EAPI:Invalid key"
+	EAPIInvalidSignature     = "EAPI:Invalid signature"
+	EAPIInvalidNonce         = "EAPI:Invalid nonce"
+	EAPIRateLimit            = "EAPI:Rate limit exceeded"
+	EQueryUnknownAssetPair   = "EQuery:Unknown asset pair"
+	EOrderUnknownOrder       = "EOrder:Unknown order"
+	EOrderInsufficientFunds  = "EOrder:Insufficient funds"
+	EOrderMinimum            = "EOrder:Order minimum not met"
+	EOrderInvalidPrice       = "EOrder:Invalid price"
+	EOrderPostOnly           = "EOrder:Post only order"
+	EOrderNoLiquidity        = "EOrder:Insufficient liquidity"
+)
+
+// RESTPair - asset pair which is served by `RESTServer`
+type RESTPair struct {
+	// Name - name of the pair in responses, e.g. `XXBTZUSD`
+	Name string
+	// Altname - alternate name, e.g. `XBTUSD`
+	Altname string
+	// WSName - websocket name, e.g. `XBT/USD`
+	WSName string
+	// Base and Quote - assets of the pair, e.g. `XXBT` and `ZUSD`
+	Base  string
+	Quote string
+
+	PairDecimals int32
+	LotDecimals  int32
+	OrderMin     decimal.Decimal
+	// Fee and MakerFee - fees in percents, e.g. `0.26`
+	Fee      decimal.Decimal
+	MakerFee decimal.Decimal
+}
+
+// DefaultRESTPair - pair which is served if pairs are not passed to `WithRESTPairs`
+var DefaultRESTPair = RESTPair{
+	Name:         "XXBTZUSD",
+	Altname:      "XBTUSD",
+	WSName:       "XBT/USD",
+	Base:         "XXBT",
+	Quote:        "ZUSD",
+	PairDecimals: 1,
+	LotDecimals:  8,
+	OrderMin:     decimal.New(1, -4),
+	Fee:          decimal.New(26, -2),
+	MakerFee:     decimal.New(16, -2),
+}
+
+// RESTFault - fault which is returned instead of response of REST method
+type RESTFault struct {
+	// Status - HTTP status code. Default: 200.
+	Status int
+	// Errors - Kraken errors of response, e.g. `EService:Unavailable`
+	Errors []string
+}
+
+// RESTOption - option function for `RESTServer`
+type RESTOption func(*RESTServer)
+
+// WithRESTPairs - add list of served pairs. Default: `DefaultRESTPair`.
+func WithRESTPairs(pairs ...RESTPair) RESTOption {
+	return func(s *RESTServer) {
+		s.pairs = append(s.pairs, pairs...)
+	}
+}
+
+// WithAPIKey - add credentials which are accepted by private methods. Default: `DefaultAPIKey` and `DefaultAPISecret`.
+func WithAPIKey(key, secret string) RESTOption {
+	return func(s *RESTServer) {
+		s.keys[key] = &apiKey{secret: secret}
+	}
+}
+
+// WithRateLimit - add maximum of API counter and its decay per second. Default: `DefaultRateLimit` and `DefaultRateDecay`.
+func WithRateLimit(limit, decay float64) RESTOption {
+	return func(s *RESTServer) {
+		s.rateLimit = limit
+		s.rateDecay = decay
+	}
+}
+
+// WithRESTClock - add source of server time. Default: `time.Now`.
+func WithRESTClock(clock func() time.Time) RESTOption {
+	return func(s *RESTServer) {
+		s.clock = clock
+	}
+}
+
+// WithWebsocketToken - add token which is returned by `GetWebSocketsToken`. Default: `DefaultToken`.
+func WithWebsocketToken(token string) RESTOption {
+	return func(s *RESTServer) {
+		s.token = token
+	}
+}
+
+// apiKey - state of credentials: the last nonce and API counter
+type apiKey struct {
+	secret  string
+	nonce   uint64
+	counter float64
+	updated time.Time
+}
+
+// restMarket - public market data of one pair
+type restMarket struct {
+	asks   []rest.PriceLevel
+	bids   []rest.PriceLevel
+	trades []Trade
+}
+
+// RESTServer - in-process server which speaks Kraken REST API. It verifies signatures, nonces and API counter
+// of private requests as Kraken does, keeps balances and orders of the account and injects faults.
+type RESTServer struct {
+	http *httptest.Server
+
+	pairs     []RESTPair
+	keys      map[string]*apiKey
+	rateLimit float64
+	rateDecay float64
+	clock     func() time.Time
+	token     string
+
+	markets map[string]*restMarket
+	faults  map[string][]RESTFault
+	calls   map[string]int
+
+	account *account
+
+	mx sync.Mutex
+}
+
+// NewRESTServer - creates and starts server. It listens on local address until `Close`.
+func NewRESTServer(opts ...RESTOption) *RESTServer {
+	s := &RESTServer{
+		keys:      make(map[string]*apiKey),
+		rateLimit: DefaultRateLimit,
+		rateDecay: DefaultRateDecay,
+		clock:     time.Now,
+		token:     DefaultToken,
+		markets:   make(map[string]*restMarket),
+		faults:    make(map[string][]RESTFault),
+		calls:     make(map[string]int),
+	}
+	for i := range opts {
+		opts[i](s)
+	}
+	if len(s.pairs) == 0 {
+		s.pairs = []RESTPair{DefaultRESTPair}
+	}
+	if len(s.keys) == 0 {
+		s.keys[DefaultAPIKey] = &apiKey{secret: DefaultAPISecret}
+	}
+	for i := range s.pairs {
+		s.markets[s.pairs[i].Name] = new(restMarket)
+	}
+	s.account = newAccount(s)
+	s.http = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// URL - returns base URL of the server which is passed to `rest.WithURL`
+func (s *RESTServer) URL() string {
+	return s.http.URL
+}
+
+// Close - stops the server
+func (s *RESTServer) Close() {
+	s.http.Close()
+}
+
+// InjectFault - returns `fault` instead of the next `count` responses of `method`, e.g. `AddOrder`
+func (s *RESTServer) InjectFault(method string, count int, fault RESTFault) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for i := 0; i < count; i++ {
+		s.faults[method] = append(s.faults[method], fault)
+	}
+}
+
+// Calls - returns count of received requests of `method` including rejected ones
+func (s *RESTServer) Calls(method string) int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.calls[method]
+}
+
+// SetBook - replaces order book of the pair which is returned by `Depth` and used by market orders. Asks are sorted ascending and bids descending.
+func (s *RESTServer) SetBook(pairName string, asks, bids []rest.PriceLevel) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	pair, ok := s.pair(pairName)
+	if !ok {
+		return errors.Wrap(ErrUnknownPair, pairName)
+	}
+	market := s.markets[pair.Name]
+	market.asks = append([]rest.PriceLevel(nil), asks...)
+	market.bids = append([]rest.PriceLevel(nil), bids...)
+	sort.SliceStable(market.asks, func(i, j int) bool { return market.asks[i].Price.LessThan(market.asks[j].Price) })
+	sort.SliceStable(market.bids, func(i, j int) bool { return market.bids[i].Price.GreaterThan(market.bids[j].Price) })
+	return nil
+}
+
+// PublishTrade - adds public trades which are returned by `Trades` and `Ticker`. Open orders which are crossed by trades are filled.
+func (s *RESTServer) PublishTrade(pairName string, trades ...Trade) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	pair, ok := s.pair(pairName)
+	if !ok {
+		return errors.Wrap(ErrUnknownPair, pairName)
+	}
+	market := s.markets[pair.Name]
+	for i := range trades {
+		trade := trades[i]
+		if trade.Side == "" {
+			trade.Side = ws.Buy
+		}
+		if trade.OrderType == "" {
+			trade.OrderType = ws.Limit
+		}
+		if trade.Time.IsZero() {
+			trade.Time = s.clock()
+		}
+		market.trades = append(market.trades, trade)
+		s.account.fillResting(pair, trade)
+	}
+	return nil
+}
+
+// pair - finds pair by name, altname or websocket name. It's called under lock of server.
+func (s *RESTServer) pair(name string) (RESTPair, bool) {
+	for i := range s.pairs {
+		if s.pairs[i].Name == name || s.pairs[i].Altname == name || s.pairs[i].WSName == name {
+			return s.pairs[i], true
+		}
+	}
+	return RESTPair{}, false
+}
+
+// restHandler - handler of REST method. It's called under lock of server and returns result or Kraken error.
+type restHandler func(s *RESTServer, args url.Values) (interface{}, string)
+
+var publicMethods = map[string]restHandler{
+	"Time":       (*RESTServer).time,
+	"Assets":     (*RESTServer).assets,
+	"AssetPairs": (*RESTServer).assetPairs,
+	"Ticker":     (*RESTServer).ticker,
+	"Depth":      (*RESTServer).depth,
+	"Trades":     (*RESTServer).trades,
+}
+
+var privateMethods = map[string]restHandler{
+	"Balance":            (*RESTServer).balance,
+	"BalanceEx":          (*RESTServer).balanceEx,
+	"OpenOrders":         (*RESTServer).openOrders,
+	"ClosedOrders":       (*RESTServer).closedOrders,
+	"QueryOrders":        (*RESTServer).queryOrders,
+	"TradesHistory":      (*RESTServer).tradesHistory,
+	"AddOrder":           (*RESTServer).addOrder,
+	"EditOrder":          (*RESTServer).editOrder,
+	"CancelOrder":        (*RESTServer).cancelOrder,
+	"CancelAll":          (*RESTServer).cancelAll,
+	"GetWebSocketsToken": (*RESTServer).websocketToken,
+}
+
+// methodCost - increment of API counter by method. Order methods have separate limits on Kraken and don't change the counter.
+func methodCost(method string) float64 {
+	switch method {
+	case "TradesHistory", "QueryTrades", "Ledgers", "QueryLedgers":
+		return 2
+	case "AddOrder", "EditOrder", "CancelOrder", "CancelAll":
+		return 0
+	default:
+		return 1
+	}
+}
+
+func (s *RESTServer) serve(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 3 || parts[0] != rest.APIVersion {
+		writeResponse(w, http.StatusNotFound, nil, EGeneralUnknownMethod)
+		return
+	}
+	method := parts[2]
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.calls[method]++
+	if faults := s.faults[method]; len(faults) > 0 {
+		s.faults[method] = faults[1:]
+		status := faults[0].Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		writeResponse(w, status, nil, faults[0].Errors...)
+		return
+	}
+
+	var handler restHandler
+	switch parts[1] {
+	case "public":
+		handler = publicMethods[method]
+	case "private":
+		handler = privateMethods[method]
+	}
+	if handler == nil {
+		writeResponse(w, http.StatusNotFound, nil, EGeneralUnknownMethod)
+		return
+	}
+
+	args, err := url.ParseQuery(string(body))
+	if err != nil {
+		writeResponse(w, http.StatusOK, nil, EGeneralInvalidArguments)
+		return
+	}
+	if parts[1] == "public" {
+		for key, values := range r.URL.Query() {
+			args[key] = append(args[key], values...)
+		}
+	} else if krakenErr := s.authorize(r, method, body, args); krakenErr != "" {
+		writeResponse(w, http.StatusOK, nil, krakenErr)
+		return
+	}
+
+	result, krakenErr := handler(s, args)
+	if krakenErr != "" {
+		writeResponse(w, http.StatusOK, nil, krakenErr)
+		return
+	}
+	writeResponse(w, http.StatusOK, result)
+}
+
+// authorize - verifies key, signature, nonce and API counter of private request. It's called under lock of server.
+func (s *RESTServer) authorize(r *http.Request, method string, body []byte, args url.Values) string {
+	key, ok := s.keys[r.Header.Get("API-Key")]
+	if !ok {
+		return EAPIInvalidKey
+	}
+
+	nonce := args.Get("nonce")
+	sign, err := signature(key.secret, r.URL.Path, nonce, string(body))
+	if err != nil || !hmac.Equal([]byte(sign), []byte(r.Header.Get("API-Sign"))) {
+		return EAPIInvalidSignature
+	}
+
+	value, err := strconv.ParseUint(nonce, 10, 64)
+	if err != nil || value <= key.nonce {
+		return EAPIInvalidNonce
+	}
+	key.nonce = value
+
+	now := s.clock()
+	if !key.updated.IsZero() {
+		key.counter -= now.Sub(key.updated).Seconds() * s.rateDecay
+		if key.counter < 0 {
+			key.counter = 0
+		}
+	}
+	key.updated = now
+
+	cost := methodCost(method)
+	if key.counter+cost > s.rateLimit {
+		return EAPIRateLimit
+	}
+	key.counter += cost
+	return ""
+}
+
+// signature - `API-Sign` of request: HMAC-SHA512 of URI path and SHA256 of nonce and POST data with base64 decoded secret
+func signature(secret, path, nonce, body string) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(nonce + body))
+	mac := hmac.New(sha512.New, key)
+	mac.Write([]byte(path))
+	mac.Write(hash[:])
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func writeResponse(w http.ResponseWriter, status int, result interface{}, krakenErrors ...string) {
+	if krakenErrors == nil {
+		krakenErrors = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(rest.KrakenResponse{Error: krakenErrors, Result: result}); err != nil {
+		return
+	}
+}
+
+// requestPairs - returns pairs of `pair` argument or all pairs if `all` is set and argument is empty
+func (s *RESTServer) requestPairs(args url.Values, all bool) ([]RESTPair, string) {
+	value := args.Get("pair")
+	if value == "" {
+		if all {
+			return s.pairs, ""
+		}
+		return nil, EGeneralInvalidArguments + ":pair"
+	}
+	names := strings.Split(value, ",")
+	pairs := make([]RESTPair, 0, len(names))
+	for _, name := range names {
+		pair, ok := s.pair(name)
+		if !ok {
+			return nil, EQueryUnknownAssetPair
+		}
+		pairs = append(pairs, pair)
+	}
+	return pairs, ""
+}
+
+func (s *RESTServer) time(args url.Values) (interface{}, string) {
+	now := s.clock().UTC()
+	return rest.TimeResponse{
+		Unixtime: now.Unix(),
+		Rfc1123:  now.Format("Mon, 02 Jan 06 15:04:05 -0700"),
+	}, ""
+}
+
+// assetAltname - altname of asset, e.g. `XBT` for `XXBT`
+func assetAltname(asset string) string {
+	if len(asset) == 4 && (asset[0] == 'X' || asset[0] == 'Z') {
+		return asset[1:]
+	}
+	return asset
+}
+
+func (s *RESTServer) assets(args url.Values) (interface{}, string) {
+	var filter map[string]bool
+	if value := args.Get("asset"); value != "" {
+		filter = make(map[string]bool)
+		for _, name := range strings.Split(value, ",") {
+			filter[name] = true
+		}
+	}
+
+	result := make(map[string]rest.Asset)
+	for _, pair := range s.pairs {
+		for _, asset := range []string{pair.Base, pair.Quote} {
+			altname := assetAltname(asset)
+			if filter != nil && !filter[asset] && !filter[altname] {
+				continue
+			}
+			result[asset] = rest.Asset{
+				AlternateName:   altname,
+				AssetClass:      "currency",
+				Decimals:        10,
+				DisplayDecimals: 5,
+			}
+		}
+	}
+	if filter != nil && len(result) == 0 {
+		return nil, "EQuery:Unknown asset"
+	}
+	return result, ""
+}
+
+func (s *RESTServer) assetPairs(args url.Values) (interface{}, string) {
+	pairs, krakenErr := s.requestPairs(args, true)
+	if krakenErr != "" {
+		return nil, krakenErr
+	}
+	result := make(map[string]rest.AssetPair)
+	for _, pair := range pairs {
+		fee, _ := pair.Fee.Float64()
+		makerFee, _ := pair.MakerFee.Float64()
+		result[pair.Name] = rest.AssetPair{
+			Altname:           pair.Altname,
+			AssetClassBase:    "currency",
+			Base:              pair.Base,
+			AssetClassQuote:   "currency",
+			Quote:             pair.Quote,
+			Lot:               "unit",
+			PairDecimals:      int(pair.PairDecimals),
+			LotDecimals:       int(pair.LotDecimals),
+			LotMultiplier:     1,
+			LeverageBuy:       []int{},
+			LeverageSell:      []int{},
+			Fees:              [][]float64{{0, fee}},
+			FeesMaker:         [][]float64{{0, makerFee}},
+			FeeVolumeCurrency: "ZUSD",
+			MarginCall:        80,
+			MarginStop:        40,
+			WSName:            pair.WSName,
+			OrderMin:          pair.OrderMin,
+		}
+	}
+	return result, ""
+}
+
+func (s *RESTServer) ticker(args url.Values) (interface{}, string) {
+	pairs, krakenErr := s.requestPairs(args, false)
+	if krakenErr != "" {
+		return nil, krakenErr
+	}
+
+	result := make(map[string]interface{})
+	for _, pair := range pairs {
+		market := s.markets[pair.Name]
+		price := func(value decimal.Decimal) string {
+			return value.StringFixed(pair.PairDecimals)
+		}
+		volume := func(value decimal.Decimal) string {
+			return value.StringFixed(pair.LotDecimals)
+		}
+		level := func(levels []rest.PriceLevel) []string {
+			if len(levels) == 0 {
+				return []string{price(decimal.Zero), "0", volume(decimal.Zero)}
+			}
+			return []string{price(levels[0].Price), levels[0].Volume.Ceil().String(), volume(levels[0].Volume)}
+		}
+
+		var last, lastVolume, open, low, high, total, notional decimal.Decimal
+		for i, trade := range market.trades {
+			if i == 0 {
+				open, low, high = trade.Price, trade.Price, trade.Price
+			}
+			last, lastVolume = trade.Price, trade.Volume
+			low = decimal.Min(low, trade.Price)
+			high = decimal.Max(high, trade.Price)
+			total = total.Add(trade.Volume)
+			notional = notional.Add(trade.Price.Mul(trade.Volume))
+		}
+		vwap := decimal.Zero
+		if total.IsPositive() {
+			vwap = notional.Div(total)
+		}
+		count := len(market.trades)
+
+		result[pair.Name] = map[string]interface{}{
+			"a": level(market.asks),
+			"b": level(market.bids),
+			"c": []string{price(last), volume(lastVolume)},
+			"v": []string{volume(total), volume(total)},
+			"p": []string{price(vwap), price(vwap)},
+			"t": []int{count, count},
+			"l": []string{price(low), price(low)},
+			"h": []string{price(high), price(high)},
+			"o": price(open),
+		}
+	}
+	return result, ""
+}
+
+func (s *RESTServer) depth(args url.Values) (interface{}, string) {
+	pairs, krakenErr := s.requestPairs(args, false)
+	if krakenErr != "" {
+		return nil, krakenErr
+	}
+	pair := pairs[0]
+	count := 100
+	if value := args.Get("count"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > 500 {
+			return nil, EGeneralInvalidArguments + ":count"
+		}
+		count = parsed
+	}
+
+	unix := s.clock().Unix()
+	format := func(levels []rest.PriceLevel) [][]interface{} {
+		if len(levels) > count {
+			levels = levels[:count]
+		}
+		items := make([][]interface{}, len(levels))
+		for i := range levels {
+			items[i] = []interface{}{
+				levels[i].Price.StringFixed(pair.PairDecimals),
+				levels[i].Volume.StringFixed(pair.LotDecimals),
+				unix,
+			}
+		}
+		return items
+	}
+
+	market := s.markets[pair.Name]
+	return map[string]interface{}{
+		pair.Name: map[string]interface{}{
+			"asks": format(market.asks),
+			"bids": format(market.bids),
+		},
+	}, ""
+}
+
+func (s *RESTServer) trades(args url.Values) (interface{}, string) {
+	pairs, krakenErr := s.requestPairs(args, false)
+	if krakenErr != "" {
+		return nil, krakenErr
+	}
+	pair := pairs[0]
+	var since int64
+	if value := args.Get("since"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, EGeneralInvalidArguments + ":since"
+		}
+		since = parsed
+	}
+
+	market := s.markets[pair.Name]
+	items := make([][]interface{}, 0)
+	last := since
+	for _, trade := range market.trades {
+		if len(items) == maxTrades {
+			break
+		}
+		if trade.Time.UnixNano() <= since {
+			continue
+		}
+		items = append(items, []interface{}{
+			trade.Price.StringFixed(pair.PairDecimals),
+			trade.Volume.StringFixed(pair.LotDecimals),
+			json.Number(formatTime(trade.Time)),
+			trade.Side,
+			trade.OrderType,
+			"",
+		})
+		last = trade.Time.UnixNano()
+	}
+	return map[string]interface{}{
+		pair.Name: items,
+		"last":    strconv.FormatInt(last, 10),
+	}, ""
+}
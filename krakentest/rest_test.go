@@ -0,0 +1,246 @@
+package krakentest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aopoltorzhicky/go_kraken/rest"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRESTClient(t *testing.T, opts ...RESTOption) (*RESTServer, *rest.Kraken) {
+	server := NewRESTServer(opts...)
+	t.Cleanup(server.Close)
+	return server, rest.New(DefaultAPIKey, DefaultAPISecret, rest.WithURL(server.URL()))
+}
+
+func restLevels(values ...string) []rest.PriceLevel {
+	result := make([]rest.PriceLevel, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		result = append(result, rest.PriceLevel{
+			Price:  decimal.RequireFromString(values[i]),
+			Volume: decimal.RequireFromString(values[i+1]),
+		})
+	}
+	return result
+}
+
+func TestRESTServer_Public(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	server, api := newRESTClient(t, WithRESTClock(func() time.Time { return now }))
+
+	serverTime, err := api.Time()
+	require.NoError(t, err)
+	assert.Equal(t, now.Unix(), serverTime.Unixtime)
+
+	pairs, err := api.AssetPairs("XBTUSD")
+	require.NoError(t, err)
+	require.Contains(t, pairs, "XXBTZUSD")
+	assert.Equal(t, "XBT/USD", pairs["XXBTZUSD"].WSName)
+	assert.Equal(t, [][]float64{{0, 0.26}}, pairs["XXBTZUSD"].Fees)
+
+	_, err = api.AssetPairs("DOGEUSD")
+	assert.ErrorContains(t, err, EQueryUnknownAssetPair)
+
+	require.NoError(t, server.SetBook("XBTUSD", restLevels("101", "2", "100.5", "1"), restLevels("99", "3", "99.5", "1")))
+	books, err := api.GetOrderBook("XBTUSD", 1)
+	require.NoError(t, err)
+	book := books["XXBTZUSD"]
+	assert.Equal(t, restLevels("100.5", "1"), book.AskLevels())
+	assert.Equal(t, restLevels("99.5", "1"), book.BidLevels())
+
+	first, second := now.Add(-time.Second), now
+	require.NoError(t, server.PublishTrade("XBT/USD",
+		Trade{Price: decimal.NewFromInt(100), Volume: decimal.NewFromInt(1), Time: first},
+		Trade{Price: decimal.NewFromInt(102), Volume: decimal.NewFromInt(3), Side: rest.TradeSell, Time: second},
+	))
+
+	trades, err := api.GetPairTrades("XBTUSD", 0)
+	require.NoError(t, err)
+	assert.Equal(t, "XXBTZUSD", trades.Pair)
+	require.Len(t, trades.Trades, 2)
+	assert.Equal(t, rest.TradeSell, trades.Trades[1].Side)
+
+	next, err := api.GetPairTrades("XBTUSD", first.UnixNano())
+	require.NoError(t, err)
+	require.Len(t, next.Trades, 1)
+	assert.Equal(t, 102.0, next.Trades[0].Price)
+	assert.Equal(t, trades.Last, next.Last)
+
+	tickers, err := api.Ticker("XBTUSD")
+	require.NoError(t, err)
+	ticker := tickers["XXBTZUSD"]
+	assert.Equal(t, "102", ticker.Close.Price.String())
+	assert.Equal(t, "100.5", ticker.Ask.Price.String())
+	assert.Equal(t, "101.5", ticker.VolumeAveragePrice.Price.String())
+	assert.Equal(t, int64(2), ticker.Trades.Today)
+}
+
+func TestRESTServer_Auth(t *testing.T) {
+	t.Run("invalid key", func(t *testing.T) {
+		server, _ := newRESTClient(t)
+		api := rest.New("unknown", DefaultAPISecret, rest.WithURL(server.URL()))
+		_, err := api.GetAccountBalances()
+		assert.ErrorContains(t, err, EAPIInvalidKey)
+	})
+
+	t.Run("invalid signature", func(t *testing.T) {
+		server, _ := newRESTClient(t)
+		api := rest.New(DefaultAPIKey, "c2VjcmV0", rest.WithURL(server.URL()))
+		_, err := api.GetAccountBalances()
+		assert.ErrorContains(t, err, EAPIInvalidSignature)
+	})
+
+	t.Run("nonce", func(t *testing.T) {
+		server, _ := newRESTClient(t)
+		send := func(nonce string) []string {
+			body := url.Values{"nonce": {nonce}}.Encode()
+			path := "/0/private/Balance"
+			sign, err := signature(DefaultAPISecret, path, nonce, body)
+			require.NoError(t, err)
+
+			req, err := http.NewRequest(http.MethodPost, server.URL()+path, strings.NewReader(body))
+			require.NoError(t, err)
+			req.Header.Set("API-Key", DefaultAPIKey)
+			req.Header.Set("API-Sign", sign)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			var response rest.KrakenResponse
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+			return response.Error
+		}
+
+		assert.Empty(t, send("100"))
+		assert.Equal(t, []string{EAPIInvalidNonce}, send("100"))
+		assert.Equal(t, []string{EAPIInvalidNonce}, send("99"))
+		assert.Empty(t, send("101"))
+	})
+
+	t.Run("rate limit", func(t *testing.T) {
+		now := time.Unix(1700000000, 0)
+		server, api := newRESTClient(t, WithRateLimit(4, 1), WithRESTClock(func() time.Time { return now }))
+
+		for i := 0; i < 4; i++ {
+			_, err := api.GetAccountBalances()
+			require.NoError(t, err)
+		}
+		_, err := api.GetAccountBalances()
+		assert.ErrorContains(t, err, EAPIRateLimit)
+
+		_, err = api.AddOrder("XBTUSD", rest.Buy, rest.Market, 1, nil)
+		assert.NotContains(t, err.Error(), EAPIRateLimit, "orders don't change API counter")
+
+		now = now.Add(2 * time.Second)
+		_, err = api.GetTradesHistory("", false, 0, 0)
+		require.NoError(t, err)
+		_, err = api.GetAccountBalances()
+		assert.ErrorContains(t, err, EAPIRateLimit)
+		assert.Equal(t, 6, server.Calls("Balance"))
+	})
+}
+
+func TestRESTServer_Orders(t *testing.T) {
+	server, api := newRESTClient(t)
+	server.SetBalance("ZUSD", decimal.NewFromInt(1000))
+	require.NoError(t, server.SetBook("XXBTZUSD", restLevels("101", "1", "102", "1"), restLevels("99", "1", "98", "1")))
+
+	_, err := api.AddOrder("XBTUSD", rest.Buy, rest.Limit, 1, map[string]interface{}{"price": 100.25})
+	assert.ErrorContains(t, err, EOrderInvalidPrice)
+
+	_, err = api.AddOrder("XBTUSD", rest.Buy, rest.Limit, 20, map[string]interface{}{"price": "100"})
+	assert.ErrorContains(t, err, EOrderInsufficientFunds)
+
+	_, err = api.AddOrder("XBTUSD", rest.Buy, rest.Limit, 1, map[string]interface{}{"price": "101", "oflags": "post"})
+	assert.ErrorContains(t, err, EOrderPostOnly)
+
+	validated, err := api.AddOrder("XBTUSD", rest.Buy, rest.Limit, 1, map[string]interface{}{"price": "100", "validate": true})
+	require.NoError(t, err)
+	assert.Empty(t, validated.TransactionIds)
+	assert.Equal(t, "buy 1.00000000 XBTUSD @ limit 100.0", validated.Description.Info)
+
+	resting, err := api.AddOrder("XBTUSD", rest.Buy, rest.Limit, 2, map[string]interface{}{"price": "100", "userref": int64(7)})
+	require.NoError(t, err)
+	require.Len(t, resting.TransactionIds, 1)
+	txid := resting.TransactionIds[0]
+
+	open, err := api.GetOpenOrders(false, "7")
+	require.NoError(t, err)
+	require.Contains(t, open.Orders, txid)
+	assert.Equal(t, OrderOpen, open.Orders[txid].Status)
+
+	balances, err := api.GetAccountBalancesEx()
+	require.NoError(t, err)
+	assert.Equal(t, "200.52", balances["ZUSD"].HoldTrade.String())
+
+	require.NoError(t, server.PublishTrade("XBTUSD", Trade{Price: decimal.NewFromInt(100), Volume: decimal.RequireFromString("0.5"), Side: rest.TradeSell}))
+	orders, err := api.QueryOrders(false, "", txid)
+	require.NoError(t, err)
+	assert.Equal(t, 0.5, orders[txid].VolumeExecuted)
+	assert.Equal(t, 0.08, orders[txid].Fee)
+
+	edited, err := api.EditOrder(txid, "XBTUSD", map[string]interface{}{"volume": "1", "price": "99.5"})
+	require.NoError(t, err)
+	assert.NotEqual(t, txid, edited.TransactionId)
+	assert.Equal(t, OrderCanceled, server.Orders()[txid].Status)
+
+	cancelled, err := api.Cancel(edited.TransactionId)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), cancelled.Count)
+	_, err = api.Cancel(edited.TransactionId)
+	assert.ErrorContains(t, err, EOrderUnknownOrder)
+
+	// market order takes two levels of the book with taker fee
+	market, err := api.AddOrder("XBTUSD", rest.Buy, rest.Market, 1.5, nil)
+	require.NoError(t, err)
+	order := server.Orders()[market.TransactionIds[0]]
+	assert.Equal(t, OrderClosed, order.Status)
+	assert.InDelta(t, 152.0, order.Cost, 1e-9)
+
+	_, err = api.AddOrder("XBTUSD", rest.Buy, rest.Market, 5, nil)
+	assert.ErrorContains(t, err, EOrderNoLiquidity)
+
+	balance, err := api.GetAccountBalances()
+	require.NoError(t, err)
+	assert.Equal(t, "2", balance["XXBT"].String())
+	// 1000 - 50 - 0.08 (maker) - 152 - 0.3952 (taker)
+	assert.Equal(t, "797.5248", balance["ZUSD"].String())
+
+	closed, err := api.GetClosedOrders(false, "", 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), closed.Count)
+
+	history, err := api.GetTradesHistory("", false, 0, 0)
+	require.NoError(t, err)
+	assert.Len(t, history.Trades, 3)
+
+	token, err := api.GetWebSocketsToken()
+	require.NoError(t, err)
+	assert.Equal(t, DefaultToken, token.Token)
+}
+
+func TestRESTServer_Faults(t *testing.T) {
+	server, api := newRESTClient(t)
+	server.InjectFault("Balance", 1, RESTFault{Errors: []string{"EService:Unavailable"}})
+	server.InjectFault("Time", 1, RESTFault{Status: http.StatusBadGateway})
+
+	_, err := api.GetAccountBalances()
+	assert.ErrorContains(t, err, "EService:Unavailable")
+	_, err = api.GetAccountBalances()
+	assert.NoError(t, err)
+
+	_, err = api.Time()
+	assert.ErrorContains(t, err, "invalid status code 502")
+	_, err = api.Time()
+	assert.NoError(t, err)
+
+	assert.Equal(t, 2, server.Calls("Balance"))
+	assert.Equal(t, 2, server.Calls("Time"))
+}
@@ -0,0 +1,615 @@
+package krakentest
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aopoltorzhicky/go_kraken/rest"
+	"github.com/shopspring/decimal"
+)
+
+// balanceDecimals - precision of balances in responses
+const balanceDecimals = 10
+
+// restOrder - order of account
+type restOrder struct {
+	txid      string
+	pair      RESTPair
+	side      string
+	orderType string
+	price     decimal.Decimal
+	volume    decimal.Decimal
+	executed  decimal.Decimal
+	cost      decimal.Decimal
+	fee       decimal.Decimal
+	userRef   int64
+	flags     string
+	status    string
+	reason    string
+	opened    time.Time
+	closed    time.Time
+}
+
+func (o *restOrder) remaining() decimal.Decimal {
+	return o.volume.Sub(o.executed)
+}
+
+func (o *restOrder) isBuy() bool {
+	return o.side == rest.Buy
+}
+
+// restFill - part of order which is executed at one price
+type restFill struct {
+	price  decimal.Decimal
+	volume decimal.Decimal
+}
+
+// account - balances, orders and trades of `RESTServer`. Its fields are guarded by lock of server.
+type account struct {
+	server   *RESTServer
+	balances map[string]decimal.Decimal
+	orders   []*restOrder
+	trades   map[string]rest.PrivateTrade
+	lastID   int64
+}
+
+func newAccount(server *RESTServer) *account {
+	return &account{
+		server:   server,
+		balances: make(map[string]decimal.Decimal),
+		trades:   make(map[string]rest.PrivateTrade),
+	}
+}
+
+// SetBalance - sets balance of asset, e.g. `ZUSD`
+func (s *RESTServer) SetBalance(asset string, amount decimal.Decimal) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.account.balances[asset] = amount
+}
+
+// Balances - returns copy of account balances
+func (s *RESTServer) Balances() map[string]decimal.Decimal {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	balances := make(map[string]decimal.Decimal, len(s.account.balances))
+	for asset, amount := range s.account.balances {
+		balances[asset] = amount
+	}
+	return balances
+}
+
+// Orders - returns all orders of account by txid as `QueryOrders` does
+func (s *RESTServer) Orders() map[string]rest.OrderInfo {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	orders := make(map[string]rest.OrderInfo, len(s.account.orders))
+	for _, order := range s.account.orders {
+		orders[order.txid] = orderDetails(order)
+	}
+	return orders
+}
+
+// nextID - returns identifier in Kraken format, e.g. `O00000-00000-000001`
+func (a *account) nextID(prefix string) string {
+	a.lastID++
+	return fmt.Sprintf("%s00000-00000-%06d", prefix, a.lastID)
+}
+
+func (a *account) find(txid string) *restOrder {
+	for _, order := range a.orders {
+		if order.txid == txid {
+			return order
+		}
+	}
+	return nil
+}
+
+// hold - amount of asset which is reserved by open orders. Buy orders reserve cost with taker fee.
+func (a *account) hold(asset string) decimal.Decimal {
+	hold := decimal.Zero
+	for _, order := range a.orders {
+		if order.status != OrderOpen {
+			continue
+		}
+		switch {
+		case order.isBuy() && order.pair.Quote == asset:
+			hold = hold.Add(order.remaining().Mul(order.price).Mul(feeRate(order.pair.Fee).Add(decimal.NewFromInt(1))))
+		case !order.isBuy() && order.pair.Base == asset:
+			hold = hold.Add(order.remaining())
+		}
+	}
+	return hold
+}
+
+func (a *account) available(asset string) decimal.Decimal {
+	return a.balances[asset].Sub(a.hold(asset))
+}
+
+// feeRate - converts fee in percents to rate
+func feeRate(fee decimal.Decimal) decimal.Decimal {
+	return fee.Div(decimal.NewFromInt(100))
+}
+
+// take - returns fills of order against levels of order book which are crossed by its limit price. The book isn't changed.
+func (a *account) take(order *restOrder) []restFill {
+	market := a.server.markets[order.pair.Name]
+	levels := market.bids
+	if order.isBuy() {
+		levels = market.asks
+	}
+
+	fills := make([]restFill, 0)
+	left := order.remaining()
+	for _, level := range levels {
+		if !left.IsPositive() {
+			break
+		}
+		if order.orderType == rest.Limit {
+			if order.isBuy() && level.Price.GreaterThan(order.price) {
+				break
+			}
+			if !order.isBuy() && level.Price.LessThan(order.price) {
+				break
+			}
+		}
+		volume := decimal.Min(left, level.Volume)
+		fills = append(fills, restFill{price: level.Price, volume: volume})
+		left = left.Sub(volume)
+	}
+	return fills
+}
+
+// fill - executes part of order and changes balances
+func (a *account) fill(order *restOrder, price, volume decimal.Decimal, maker bool, now time.Time) {
+	fee := order.pair.Fee
+	if maker {
+		fee = order.pair.MakerFee
+	}
+	cost := price.Mul(volume)
+	feeAmount := cost.Mul(feeRate(fee)).Round(balanceDecimals)
+
+	base, quote := order.pair.Base, order.pair.Quote
+	if order.isBuy() {
+		a.balances[base] = a.balances[base].Add(volume)
+		a.balances[quote] = a.balances[quote].Sub(cost).Sub(feeAmount)
+	} else {
+		a.balances[base] = a.balances[base].Sub(volume)
+		a.balances[quote] = a.balances[quote].Add(cost).Sub(feeAmount)
+	}
+
+	order.executed = order.executed.Add(volume)
+	order.cost = order.cost.Add(cost)
+	order.fee = order.fee.Add(feeAmount)
+	if !order.remaining().IsPositive() {
+		order.status = OrderClosed
+		order.closed = now
+	}
+
+	fPrice, _ := price.Float64()
+	fCost, _ := cost.Float64()
+	fFee, _ := feeAmount.Float64()
+	fVolume, _ := volume.Float64()
+	a.trades[a.nextID("T")] = rest.PrivateTrade{
+		OrderID:   order.txid,
+		Pair:      order.pair.Name,
+		Time:      unixSeconds(now),
+		Side:      order.side,
+		OrderType: order.orderType,
+		Price:     fPrice,
+		Cost:      fCost,
+		Fee:       fFee,
+		Volume:    fVolume,
+		Misc:      "",
+	}
+}
+
+// fillResting - fills open limit orders of the pair which are crossed by public trade. Orders are filled in placement order.
+func (a *account) fillResting(pair RESTPair, trade Trade) {
+	left := trade.Volume
+	for _, order := range a.orders {
+		if !left.IsPositive() {
+			return
+		}
+		if order.status != OrderOpen || order.pair.Name != pair.Name {
+			continue
+		}
+		if order.isBuy() && trade.Price.GreaterThan(order.price) {
+			continue
+		}
+		if !order.isBuy() && trade.Price.LessThan(order.price) {
+			continue
+		}
+		volume := decimal.Min(left, order.remaining())
+		a.fill(order, order.price, volume, true, trade.Time)
+		left = left.Sub(volume)
+	}
+}
+
+func (a *account) cancel(order *restOrder, reason string) {
+	order.status = OrderCanceled
+	order.reason = reason
+	order.closed = a.server.clock()
+}
+
+// parseOrder - reads order from arguments of `AddOrder`
+func (a *account) parseOrder(args url.Values) (*restOrder, string) {
+	pairs, krakenErr := a.server.requestPairs(args, false)
+	if krakenErr != "" {
+		return nil, krakenErr
+	}
+	order := &restOrder{
+		pair:      pairs[0],
+		side:      args.Get("type"),
+		orderType: args.Get("ordertype"),
+		flags:     args.Get("oflags"),
+	}
+	if order.side != rest.Buy && order.side != rest.Sell {
+		return nil, EGeneralInvalidArguments + ":type"
+	}
+	if order.orderType != rest.Market && order.orderType != rest.Limit {
+		return nil, EGeneralInvalidArguments + ":ordertype"
+	}
+
+	volume, err := decimal.NewFromString(args.Get("volume"))
+	if err != nil || !volume.IsPositive() {
+		return nil, EGeneralInvalidArguments + ":volume"
+	}
+	if volume.LessThan(order.pair.OrderMin) {
+		return nil, EOrderMinimum
+	}
+	order.volume = volume
+
+	if order.orderType == rest.Limit {
+		if krakenErr := order.setPrice(args.Get("price")); krakenErr != "" {
+			return nil, krakenErr
+		}
+	}
+	if value := args.Get("userref"); value != "" {
+		userRef, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return nil, EGeneralInvalidArguments + ":userref"
+		}
+		order.userRef = userRef
+	}
+	return order, ""
+}
+
+// setPrice - sets limit price. Price with more decimals than the pair allows is rejected as Kraken does.
+func (o *restOrder) setPrice(value string) string {
+	price, err := decimal.NewFromString(value)
+	if err != nil || !price.IsPositive() {
+		return EGeneralInvalidArguments + ":price"
+	}
+	if !price.Equal(price.Truncate(o.pair.PairDecimals)) {
+		return fmt.Sprintf("%s:%s price can only be specified up to %d decimals.", EOrderInvalidPrice, o.pair.Name, o.pair.PairDecimals)
+	}
+	o.price = price
+	return ""
+}
+
+// place - checks funds and executes order against the book. Remaining volume of limit order rests in the book.
+func (a *account) place(order *restOrder, validate bool) string {
+	fills := a.take(order)
+	if strings.Contains(order.flags, "post") && len(fills) > 0 {
+		return EOrderPostOnly
+	}
+
+	taken := decimal.Zero
+	cost := decimal.Zero
+	for _, fill := range fills {
+		taken = taken.Add(fill.volume)
+		cost = cost.Add(fill.price.Mul(fill.volume))
+	}
+	if order.orderType == rest.Market && taken.LessThan(order.volume) {
+		return EOrderNoLiquidity
+	}
+
+	if order.isBuy() {
+		resting := order.volume.Sub(taken).Mul(order.price)
+		required := cost.Add(resting).Mul(feeRate(order.pair.Fee).Add(decimal.NewFromInt(1)))
+		if a.available(order.pair.Quote).LessThan(required) {
+			return EOrderInsufficientFunds
+		}
+	} else if a.available(order.pair.Base).LessThan(order.volume) {
+		return EOrderInsufficientFunds
+	}
+	if validate {
+		return ""
+	}
+
+	now := a.server.clock()
+	order.txid = a.nextID("O")
+	order.status = OrderOpen
+	order.opened = now
+	a.orders = append(a.orders, order)
+	for _, fill := range fills {
+		a.fill(order, fill.price, fill.volume, false, now)
+	}
+	return ""
+}
+
+func (s *RESTServer) addOrder(args url.Values) (interface{}, string) {
+	order, krakenErr := s.account.parseOrder(args)
+	if krakenErr != "" {
+		return nil, krakenErr
+	}
+	validate := args.Get("validate") == "true"
+	if krakenErr := s.account.place(order, validate); krakenErr != "" {
+		return nil, krakenErr
+	}
+
+	response := map[string]interface{}{
+		"descr": map[string]string{"order": orderDescription(order)},
+	}
+	if !validate {
+		response["txid"] = []string{order.txid}
+	}
+	return response, ""
+}
+
+func (s *RESTServer) editOrder(args url.Values) (interface{}, string) {
+	original := s.account.find(args.Get("txid"))
+	if original == nil || original.status != OrderOpen {
+		return nil, EOrderUnknownOrder
+	}
+	if pair, ok := s.pair(args.Get("pair")); !ok || pair.Name != original.pair.Name {
+		return nil, EQueryUnknownAssetPair
+	}
+
+	order := &restOrder{
+		pair:      original.pair,
+		side:      original.side,
+		orderType: original.orderType,
+		price:     original.price,
+		volume:    original.volume,
+		userRef:   original.userRef,
+		flags:     original.flags,
+	}
+	if value := args.Get("volume"); value != "" {
+		volume, err := decimal.NewFromString(value)
+		if err != nil || !volume.IsPositive() {
+			return nil, EGeneralInvalidArguments + ":volume"
+		}
+		order.volume = volume
+	}
+	if value := args.Get("price"); value != "" {
+		if krakenErr := order.setPrice(value); krakenErr != "" {
+			return nil, krakenErr
+		}
+	}
+	if order.volume.LessThan(original.executed) {
+		return nil, EGeneralInvalidArguments + ":volume"
+	}
+
+	// funds of the original order are released before the new one is checked
+	original.status = OrderCanceled
+	if krakenErr := s.account.place(order, false); krakenErr != "" {
+		original.status = OrderOpen
+		return nil, krakenErr
+	}
+	s.account.cancel(original, "Order replaced")
+
+	return map[string]interface{}{
+		"descr":            map[string]string{"order": orderDescription(order)},
+		"txid":             order.txid,
+		"originaltxid":     original.txid,
+		"volume":           order.volume.StringFixed(order.pair.LotDecimals),
+		"price":            order.price.StringFixed(order.pair.PairDecimals),
+		"price2":           "0",
+		"orders_cancelled": 1,
+		"status":           "ok",
+	}, ""
+}
+
+func (s *RESTServer) cancelOrder(args url.Values) (interface{}, string) {
+	txid := args.Get("txid")
+	userRef, err := strconv.ParseInt(txid, 10, 64)
+	isUserRef := err == nil
+
+	var count int64
+	for _, order := range s.account.orders {
+		if order.status != OrderOpen {
+			continue
+		}
+		if order.txid == txid || (isUserRef && order.userRef == userRef) {
+			s.account.cancel(order, "User requested")
+			count++
+		}
+	}
+	if count == 0 {
+		return nil, EOrderUnknownOrder
+	}
+	return rest.CancelResponse{Count: count}, ""
+}
+
+func (s *RESTServer) cancelAll(args url.Values) (interface{}, string) {
+	var count int64
+	for _, order := range s.account.orders {
+		if order.status == OrderOpen {
+			s.account.cancel(order, "User requested")
+			count++
+		}
+	}
+	return rest.CancelResponse{Count: count}, ""
+}
+
+func (s *RESTServer) balance(args url.Values) (interface{}, string) {
+	result := make(map[string]string, len(s.account.balances))
+	for asset, amount := range s.account.balances {
+		result[asset] = amount.StringFixed(balanceDecimals)
+	}
+	return result, ""
+}
+
+func (s *RESTServer) balanceEx(args url.Values) (interface{}, string) {
+	result := make(map[string]rest.BalanceEx, len(s.account.balances))
+	for asset, amount := range s.account.balances {
+		result[asset] = rest.BalanceEx{
+			Balance:   amount,
+			HoldTrade: s.account.hold(asset),
+		}
+	}
+	return result, ""
+}
+
+// userRefFilter - returns filter of orders by `userref` argument
+func userRefFilter(args url.Values) (func(order *restOrder) bool, string) {
+	value := args.Get("userref")
+	if value == "" {
+		return func(order *restOrder) bool { return true }, ""
+	}
+	userRef, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, EGeneralInvalidArguments + ":userref"
+	}
+	return func(order *restOrder) bool { return order.userRef == userRef }, ""
+}
+
+// timeRange - returns filter by `start` and `end` arguments in unix seconds
+func timeRange(args url.Values) (func(t time.Time) bool, string) {
+	var start, end int64
+	for name, value := range map[string]*int64{"start": &start, "end": &end} {
+		if arg := args.Get(name); arg != "" {
+			parsed, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil {
+				return nil, EGeneralInvalidArguments + ":" + name
+			}
+			*value = parsed
+		}
+	}
+	return func(t time.Time) bool {
+		if start != 0 && t.Unix() < start {
+			return false
+		}
+		return end == 0 || t.Unix() <= end
+	}, ""
+}
+
+func (s *RESTServer) openOrders(args url.Values) (interface{}, string) {
+	filter, krakenErr := userRefFilter(args)
+	if krakenErr != "" {
+		return nil, krakenErr
+	}
+	orders := make(map[string]rest.OrderInfo)
+	for _, order := range s.account.orders {
+		if order.status == OrderOpen && filter(order) {
+			orders[order.txid] = orderDetails(order)
+		}
+	}
+	return rest.OpenOrdersResponse{Orders: orders}, ""
+}
+
+func (s *RESTServer) closedOrders(args url.Values) (interface{}, string) {
+	filter, krakenErr := userRefFilter(args)
+	if krakenErr != "" {
+		return nil, krakenErr
+	}
+	inRange, krakenErr := timeRange(args)
+	if krakenErr != "" {
+		return nil, krakenErr
+	}
+	orders := make(map[string]rest.OrderInfo)
+	for _, order := range s.account.orders {
+		if order.status != OrderOpen && filter(order) && inRange(order.closed) {
+			orders[order.txid] = orderDetails(order)
+		}
+	}
+	return rest.ClosedOrdersResponse{Count: int64(len(orders)), Orders: orders}, ""
+}
+
+func (s *RESTServer) queryOrders(args url.Values) (interface{}, string) {
+	filter, krakenErr := userRefFilter(args)
+	if krakenErr != "" {
+		return nil, krakenErr
+	}
+	if args.Get("txid") == "" {
+		return nil, EGeneralInvalidArguments + ":txid"
+	}
+	orders := make(map[string]rest.OrderInfo)
+	for _, txid := range strings.Split(args.Get("txid"), ",") {
+		order := s.account.find(txid)
+		if order == nil {
+			return nil, EOrderUnknownOrder
+		}
+		if filter(order) {
+			orders[order.txid] = orderDetails(order)
+		}
+	}
+	return orders, ""
+}
+
+func (s *RESTServer) tradesHistory(args url.Values) (interface{}, string) {
+	inRange, krakenErr := timeRange(args)
+	if krakenErr != "" {
+		return nil, krakenErr
+	}
+	trades := make(map[string]rest.PrivateTrade)
+	for id, trade := range s.account.trades {
+		if inRange(time.Unix(int64(trade.Time), 0)) {
+			trades[id] = trade
+		}
+	}
+	return rest.TradesHistoryResponse{Trades: trades, Count: int64(len(trades))}, ""
+}
+
+func (s *RESTServer) websocketToken(args url.Values) (interface{}, string) {
+	return rest.GetWebSocketTokenResponse{Token: s.token, Expires: 900}, ""
+}
+
+// orderDescription - description of order as Kraken returns it, e.g. `buy 1.25000000 XBTUSD @ limit 27500.0`
+func orderDescription(order *restOrder) string {
+	description := fmt.Sprintf("%s %s %s @ %s", order.side, order.volume.StringFixed(order.pair.LotDecimals), order.pair.Altname, order.orderType)
+	if order.orderType == rest.Limit {
+		description += " " + order.price.StringFixed(order.pair.PairDecimals)
+	}
+	return description
+}
+
+func orderDetails(order *restOrder) rest.OrderInfo {
+	price, _ := order.price.Float64()
+	volume, _ := order.volume.Float64()
+	executed, _ := order.executed.Float64()
+	cost, _ := order.cost.Float64()
+	fee, _ := order.fee.Float64()
+	average := 0.0
+	if order.executed.IsPositive() {
+		average, _ = order.cost.Div(order.executed).Float64()
+	}
+
+	info := rest.OrderInfo{
+		UserRef:       order.userRef,
+		Status:        order.status,
+		Reason:        order.reason,
+		OpenTimestamp: unixSeconds(order.opened),
+		Description: rest.OrderDescription{
+			Pair:      order.pair.Altname,
+			Side:      order.side,
+			OrderType: order.orderType,
+			Price:     price,
+			Leverage:  "none",
+			Info:      orderDescription(order),
+		},
+		Volume:         volume,
+		VolumeExecuted: executed,
+		Cost:           cost,
+		Fee:            fee,
+		AveragePrice:   average,
+		Flags:          order.flags,
+	}
+	if !order.closed.IsZero() {
+		info.CloseTimestamp = unixSeconds(order.closed)
+	}
+	return info
+}
+
+// unixSeconds - unix time with fractional seconds as Kraken REST API returns it
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
@@ -0,0 +1,458 @@
+package krakentest
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	ws "github.com/aopoltorzhicky/go_kraken/websocket"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// Default precision of pairs which are not passed to `WithPairs`
+const (
+	DefaultPriceDecimals  = 5
+	DefaultVolumeDecimals = 8
+)
+
+// DefaultToken - token which is accepted by default for private channels and orders
+const DefaultToken = "krakentest-token"
+
+// Pair - pair which is served by the server
+type Pair struct {
+	// Name - websocket name of the pair, e.g. `XBT/USD`
+	Name           string
+	PriceDecimals  int32
+	VolumeDecimals int32
+}
+
+// Faults - faults which are injected into channel messages. Events (statuses, pongs) are not affected.
+type Faults struct {
+	// DropRate - probability of dropping a message
+	DropRate float64
+	// MalformedRate - probability of replacing a message with malformed frame
+	MalformedRate float64
+	// Delay - delay of every message
+	Delay time.Duration
+}
+
+// Option - option function for `Server`
+type Option func(*Server)
+
+// WithPairs - add list of served pairs. Subscription to other pairs is rejected. Default: any pair with default precision.
+func WithPairs(pairs ...Pair) Option {
+	return func(s *Server) {
+		for i := range pairs {
+			s.pairs[pairs[i].Name] = pairs[i]
+		}
+	}
+}
+
+// WithToken - add token which is required by private channels and orders. Default: `DefaultToken`.
+func WithToken(token string) Option {
+	return func(s *Server) {
+		s.token = token
+	}
+}
+
+// WithHeartbeat - add interval of heartbeat events. Default: 1s.
+func WithHeartbeat(interval time.Duration) Option {
+	return func(s *Server) {
+		s.heartbeat = interval
+	}
+}
+
+// WithClock - add source of exchange time of messages. Default: `time.Now`.
+func WithClock(clock func() time.Time) Option {
+	return func(s *Server) {
+		s.clock = clock
+	}
+}
+
+// WithSeed - add seed of random faults. Default: 1.
+func WithSeed(seed int64) Option {
+	return func(s *Server) {
+		s.rnd = rand.New(rand.NewSource(seed))
+	}
+}
+
+// Server - in-process websocket server which speaks Kraken Websocket API v1. It answers pings and subscriptions,
+// publishes scripted or random market data, matches orders against its order books and injects faults.
+type Server struct {
+	http     *httptest.Server
+	upgrader websocket.Upgrader
+
+	pairs     map[string]Pair
+	token     string
+	heartbeat time.Duration
+	clock     func() time.Time
+
+	clients   map[*client]struct{}
+	channelID int64
+	faults    Faults
+	rnd       *rand.Rand
+
+	books   map[string]*book
+	engine  *engine
+	feeds   sync.WaitGroup
+	stopped chan struct{}
+
+	mx sync.Mutex
+}
+
+// NewServer - creates and starts server. It listens on local address until `Close`.
+func NewServer(opts ...Option) *Server {
+	s := &Server{
+		pairs:     make(map[string]Pair),
+		token:     DefaultToken,
+		heartbeat: time.Second,
+		clock:     time.Now,
+		clients:   make(map[*client]struct{}),
+		rnd:       rand.New(rand.NewSource(1)),
+		books:     make(map[string]*book),
+		stopped:   make(chan struct{}),
+	}
+	for i := range opts {
+		opts[i](s)
+	}
+	s.engine = newEngine(s)
+	s.http = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// URL - returns websocket URL of the server which is passed to `websocket.NewKraken`
+func (s *Server) URL() string {
+	return "ws" + strings.TrimPrefix(s.http.URL, "http")
+}
+
+// Close - disconnects clients and stops the server
+func (s *Server) Close() {
+	s.mx.Lock()
+	select {
+	case <-s.stopped:
+		s.mx.Unlock()
+		return
+	default:
+	}
+	close(s.stopped)
+	s.mx.Unlock()
+
+	s.feeds.Wait()
+	s.Disconnect()
+	s.http.Close()
+}
+
+// Clients - returns count of connected clients
+func (s *Server) Clients() int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return len(s.clients)
+}
+
+// SetFaults - sets faults which are injected into channel messages of all clients
+func (s *Server) SetFaults(faults Faults) {
+	s.mx.Lock()
+	s.faults = faults
+	s.mx.Unlock()
+}
+
+// Disconnect - forcibly closes connections of all clients
+func (s *Server) Disconnect() {
+	s.mx.Lock()
+	clients := make([]*client, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mx.Unlock()
+
+	for _, c := range clients {
+		c.close()
+	}
+}
+
+// SendRaw - sends frame to all clients as is, e.g. malformed or unknown message
+func (s *Server) SendRaw(frame []byte) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for c := range s.clients {
+		c.send(frame, 0)
+	}
+}
+
+func (s *Server) pair(name string) (Pair, bool) {
+	if len(s.pairs) == 0 {
+		return Pair{
+			Name:           name,
+			PriceDecimals:  DefaultPriceDecimals,
+			VolumeDecimals: DefaultVolumeDecimals,
+		}, name != ""
+	}
+	pair, ok := s.pairs[name]
+	return pair, ok
+}
+
+func (s *Server) now() time.Time {
+	return s.clock()
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	c := newClient(s, conn)
+	s.mx.Lock()
+	s.clients[c] = struct{}{}
+	s.mx.Unlock()
+
+	go c.writeThread()
+	go c.heartbeatThread(s.heartbeat)
+
+	c.sendEvent(map[string]interface{}{
+		"event":        ws.EventSystemStatus,
+		"connectionID": 8628615390848610000,
+		"status":       "online",
+		"version":      "1.9.0",
+	})
+	c.readThread()
+
+	s.mx.Lock()
+	delete(s.clients, c)
+	s.mx.Unlock()
+	c.close()
+}
+
+// handle - handles request of client
+func (s *Server) handle(c *client, data []byte) {
+	var event ws.EventType
+	if err := json.Unmarshal(data, &event); err != nil {
+		c.sendEvent(errorEvent("", "EGeneral:Invalid arguments"))
+		return
+	}
+
+	switch event.Event {
+	case ws.EventPing:
+		var ping ws.PingRequest
+		if err := json.Unmarshal(data, &ping); err != nil {
+			return
+		}
+		c.sendEvent(ws.PongResponse{Event: ws.EventPong, ReqID: ping.ReqID})
+	case ws.EventSubscribe:
+		s.subscribe(c, data)
+	case ws.EventUnsubscribe:
+		s.unsubscribe(c, data)
+	case ws.EventAddOrder:
+		s.engine.addOrder(c, data)
+	case ws.EventCancelOrder:
+		s.engine.cancelOrder(c, data)
+	case ws.EventCancelAll:
+		s.engine.cancelAll(c, data)
+	default:
+		c.sendEvent(errorEvent(event.Event, "EGeneral:Unknown method"))
+	}
+}
+
+// subscriptionRequest - public and private subscription requests in one structure
+type subscriptionRequest struct {
+	ReqID        json.Number `json:"reqid,omitempty"`
+	Pairs        []string    `json:"pair"`
+	Subscription struct {
+		ws.Subscription
+		Token string `json:"token"`
+	} `json:"subscription"`
+}
+
+func (s *Server) subscribe(c *client, data []byte) {
+	var req subscriptionRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		c.sendEvent(errorEvent(ws.EventSubscriptionStatus, "EGeneral:Invalid arguments"))
+		return
+	}
+	spec := req.Subscription.Subscription
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	switch spec.Name {
+	case ws.ChanOpenOrders, ws.ChanOwnTrades:
+		status := ws.SubscriptionStatus{
+			ChannelName:  spec.Name,
+			Event:        ws.EventSubscriptionStatus,
+			Status:       ws.SubscriptionStatusSubscribed,
+			ReqID:        req.ReqID.String(),
+			Subscription: ws.Subscription{Name: spec.Name},
+		}
+		if req.Subscription.Token != s.token {
+			status.Status = ws.SubscriptionStatusError
+			status.Error = "EGeneral:Invalid arguments:token"
+			c.sendEvent(status)
+			return
+		}
+		c.sendEvent(status)
+		c.private[spec.Name] = 0
+		if spec.Snapshot == nil || *spec.Snapshot {
+			s.engine.snapshot(c, spec.Name)
+		}
+		return
+	case ws.ChanBook, ws.ChanTicker, ws.ChanTrades, ws.ChanCandles, ws.ChanSpread:
+	default:
+		c.sendEvent(errorEvent(ws.EventSubscriptionStatus, "Subscription name invalid"))
+		return
+	}
+
+	if spec.Name == ws.ChanBook && spec.Depth == 0 {
+		spec.Depth = ws.Depth10
+	}
+	if spec.Name == ws.ChanCandles && spec.Interval == 0 {
+		spec.Interval = ws.Interval1
+	}
+	name := channelName(spec)
+
+	for _, pairName := range req.Pairs {
+		status := ws.SubscriptionStatus{
+			ChannelName:  name,
+			Event:        ws.EventSubscriptionStatus,
+			Status:       ws.SubscriptionStatusSubscribed,
+			Pair:         pairName,
+			ReqID:        req.ReqID.String(),
+			Subscription: spec,
+		}
+		pair, ok := s.pair(pairName)
+		switch {
+		case !ok:
+			status.Status = ws.SubscriptionStatusError
+			status.Error = "Currency pair not supported " + pairName
+		case c.subscribed(name, pairName) != nil:
+			status.Status = ws.SubscriptionStatusError
+			status.Error = "Already subscribed"
+		}
+		if status.Status == ws.SubscriptionStatusError {
+			c.sendEvent(status)
+			continue
+		}
+
+		s.channelID++
+		status.ChannelID = s.channelID
+		sub := &subscription{
+			id:          s.channelID,
+			name:        spec.Name,
+			channelName: name,
+			pair:        pair,
+			depth:       int(spec.Depth),
+			interval:    spec.Interval,
+		}
+		c.subs = append(c.subs, sub)
+		c.sendEvent(status)
+
+		if sub.name == ws.ChanBook && (spec.Snapshot == nil || *spec.Snapshot) {
+			c.sendData(s.bookSnapshot(sub))
+		}
+	}
+}
+
+func (s *Server) unsubscribe(c *client, data []byte) {
+	var req subscriptionRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		c.sendEvent(errorEvent(ws.EventSubscriptionStatus, "EGeneral:Invalid arguments"))
+		return
+	}
+	spec := req.Subscription.Subscription
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if spec.Name == ws.ChanOpenOrders || spec.Name == ws.ChanOwnTrades {
+		delete(c.private, spec.Name)
+		c.sendEvent(ws.SubscriptionStatus{
+			ChannelName:  spec.Name,
+			Event:        ws.EventSubscriptionStatus,
+			Status:       ws.SubscriptionStatusUnsubscribed,
+			Subscription: ws.Subscription{Name: spec.Name},
+		})
+		return
+	}
+
+	for _, pairName := range req.Pairs {
+		var sub *subscription
+		for _, item := range c.subs {
+			if item.name == spec.Name && item.pair.Name == pairName &&
+				(spec.Depth == 0 || int64(item.depth) == spec.Depth) &&
+				(spec.Interval == 0 || item.interval == spec.Interval) {
+				sub = item
+				break
+			}
+		}
+		if sub == nil {
+			c.sendEvent(ws.SubscriptionStatus{
+				Event:        ws.EventSubscriptionStatus,
+				Status:       ws.SubscriptionStatusError,
+				Pair:         pairName,
+				Error:        "Subscription Not Found",
+				Subscription: spec,
+			})
+			continue
+		}
+		c.remove(sub)
+		c.sendEvent(ws.SubscriptionStatus{
+			ChannelID:    sub.id,
+			ChannelName:  sub.channelName,
+			Event:        ws.EventSubscriptionStatus,
+			Status:       ws.SubscriptionStatusUnsubscribed,
+			Pair:         pairName,
+			Subscription: spec,
+		})
+	}
+}
+
+// broadcast - sends channel message built by `fn` to subscribers of the channel and pair. `fn` returns nil to skip subscriber.
+func (s *Server) broadcast(name, pair string, fn func(sub *subscription) interface{}) {
+	for c := range s.clients {
+		for _, sub := range c.subs {
+			if sub.name != name || sub.pair.Name != pair {
+				continue
+			}
+			if msg := fn(sub); msg != nil {
+				c.sendData(msg)
+			}
+		}
+	}
+}
+
+// fault - returns faulty frame, nil to drop it or the same frame. It's called under lock of server.
+func (s *Server) fault(frame []byte) ([]byte, time.Duration) {
+	faults := s.faults
+	if faults.DropRate > 0 && s.rnd.Float64() < faults.DropRate {
+		return nil, 0
+	}
+	if faults.MalformedRate > 0 && s.rnd.Float64() < faults.MalformedRate {
+		return frame[:len(frame)/2], faults.Delay
+	}
+	return frame, faults.Delay
+}
+
+func errorEvent(event, message string) map[string]interface{} {
+	return map[string]interface{}{
+		"event":        event,
+		"status":       "error",
+		"errorMessage": message,
+	}
+}
+
+func channelName(spec ws.Subscription) string {
+	switch spec.Name {
+	case ws.ChanBook:
+		return ws.ChanBook + "-" + itoa(spec.Depth)
+	case ws.ChanCandles:
+		return ws.ChanCandles + "-" + itoa(spec.Interval)
+	default:
+		return spec.Name
+	}
+}
@@ -0,0 +1,328 @@
+package krakentest
+
+import (
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ws "github.com/aopoltorzhicky/go_kraken/websocket"
+	"github.com/gorilla/websocket"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func levels(from, step float64, count int) []ws.PriceLevel {
+	result := make([]ws.PriceLevel, count)
+	for i := range result {
+		result[i] = ws.PriceLevel{
+			Price:  decimal.NewFromFloat(from + step*float64(i)),
+			Volume: decimal.NewFromInt(int64(i + 1)),
+		}
+	}
+	return result
+}
+
+func connect(t *testing.T, server *Server, opts ...ws.KrakenOption) *ws.Kraken {
+	t.Helper()
+
+	opts = append([]ws.KrakenOption{ws.WithReconnectTimeout(10 * time.Millisecond)}, opts...)
+	k := ws.NewKraken(server.URL(), opts...)
+	require.NoError(t, k.Connect())
+	t.Cleanup(func() {
+		k.Close()
+	})
+	return k
+}
+
+func receive[T any](t *testing.T, handle *ws.SubscriptionHandle[T]) T {
+	t.Helper()
+
+	select {
+	case event := <-handle.C():
+		return event.Data
+	case <-time.After(time.Second):
+		t.Fatal("update wasn't received")
+	}
+	var empty T
+	return empty
+}
+
+// sameBook - returns true if client book is equal to top levels of server book
+func sameBook(server *Server, book *ws.ManagedBook, depth int) bool {
+	asks, bids := server.Book(ws.BTCUSD)
+	if len(asks) > depth {
+		asks = asks[:depth]
+	}
+	if len(bids) > depth {
+		bids = bids[:depth]
+	}
+
+	snapshot := book.Snapshot()
+	if !snapshot.Valid || len(snapshot.Asks) != len(asks) || len(snapshot.Bids) != len(bids) {
+		return false
+	}
+	for i := range asks {
+		if !asks[i].Equal(snapshot.Asks[i]) {
+			return false
+		}
+	}
+	for i := range bids {
+		if !bids[i].Equal(snapshot.Bids[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestServer_Book(t *testing.T) {
+	server := NewServer(WithPairs(Pair{Name: ws.BTCUSD, PriceDecimals: 1, VolumeDecimals: 8}))
+	defer server.Close()
+	require.NoError(t, server.SetBook(ws.BTCUSD, levels(100.1, 0.1, 15), levels(100, -0.1, 15)))
+
+	k := connect(t, server)
+	book, err := k.NewManagedBook(ws.BTCUSD, ws.Depth10, 1, 8)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return sameBook(server, book, 10) }, time.Second, 5*time.Millisecond)
+
+	// removed levels are replaced by republished ones from the deeper part of the book
+	require.NoError(t, server.UpdateBook(ws.BTCUSD,
+		[]ws.PriceLevel{{Price: decimal.NewFromFloat(100.1)}, {Price: decimal.NewFromFloat(100.2)}},
+		[]ws.PriceLevel{{Price: decimal.NewFromFloat(99.9), Volume: decimal.NewFromInt(7)}},
+	))
+	require.Eventually(t, func() bool { return sameBook(server, book, 10) }, time.Second, 5*time.Millisecond)
+	assert.Zero(t, book.Resyncs())
+
+	// dropped update breaks checksum of the next one and the book is resynchronized
+	server.SetFaults(Faults{DropRate: 1})
+	require.NoError(t, server.UpdateBook(ws.BTCUSD, []ws.PriceLevel{{Price: decimal.NewFromFloat(100.3)}}, nil))
+	server.SetFaults(Faults{})
+	require.NoError(t, server.UpdateBook(ws.BTCUSD, nil, []ws.PriceLevel{{Price: decimal.NewFromInt(100), Volume: decimal.NewFromInt(9)}}))
+	require.Eventually(t, func() bool { return book.Resyncs() == 1 && sameBook(server, book, 10) }, time.Second, 5*time.Millisecond)
+}
+
+func TestServer_Channels(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	k := connect(t, server)
+
+	trades, err := k.SubscribeTradesHandle([]string{ws.BTCUSD})
+	require.NoError(t, err)
+	ticker, err := k.SubscribeTickerHandle([]string{ws.BTCUSD})
+	require.NoError(t, err)
+	candles, err := k.SubscribeCandlesHandle([]string{ws.BTCUSD}, ws.Interval5)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return candles.Status() == ws.StateSubscribed && ticker.Status() == ws.StateSubscribed && trades.Status() == ws.StateSubscribed
+	}, time.Second, 5*time.Millisecond)
+
+	ts := time.Unix(1534614057, 321597000)
+	require.NoError(t, server.PublishTrade(ws.BTCUSD, Trade{Price: decimal.NewFromFloat(5541.2), Volume: decimal.NewFromFloat(0.5), Side: ws.Sell, Time: ts}))
+	trade := receive(t, trades)
+	require.Len(t, trade, 1)
+	assert.Equal(t, "5541.20000", trade[0].Price.String())
+	assert.Equal(t, "1534614057.321597", trade[0].Time.String())
+	assert.Equal(t, ws.Sell, trade[0].Side)
+
+	require.NoError(t, server.PublishTicker(ws.BTCUSD, Ticker{Ask: decimal.NewFromInt(101), Bid: decimal.NewFromInt(100), Last: decimal.NewFromInt(100), Trades: 3}))
+	tick := receive(t, ticker)
+	assert.Equal(t, "101.00000", tick.Ask.Price.String())
+	assert.EqualValues(t, 3, tick.TradeVolume.Today)
+
+	require.NoError(t, server.PublishCandle(ws.BTCUSD, ws.Interval5, Candle{Time: ts, Open: decimal.NewFromInt(1), High: decimal.NewFromInt(2), Count: 2}))
+	candle := receive(t, candles)
+	assert.Equal(t, "1534614300.000000", candle.EndTime.String())
+	assert.Equal(t, "2.00000", candle.High.String())
+	assert.EqualValues(t, 2, candle.Count)
+
+	// other interval isn't received
+	require.NoError(t, server.PublishCandle(ws.BTCUSD, ws.Interval1, Candle{Time: ts}))
+	assert.Error(t, server.PublishTrade("", Trade{}))
+	select {
+	case <-candles.C():
+		t.Fatal("candle of other interval")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestServer_Orders(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	require.NoError(t, server.SetBook(ws.BTCUSD, levels(100, 1, 3), levels(99, -1, 3)))
+
+	k := connect(t, server, ws.WithTokenProvider(StaticToken(DefaultToken)))
+	own, err := k.SubscribeOwnTradesHandle()
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return own.Status() == ws.StateSubscribed }, time.Second, 5*time.Millisecond)
+	assert.Empty(t, receive(t, own))
+
+	// buy takes 1 at 100 and 2 at 101, the rest waits at 101
+	require.NoError(t, k.AddOrder(ws.AddOrderRequest{Ordertype: ws.OrderTypeLimit, Pair: ws.BTCUSD, Price: "101", Type: ws.SideBuy, Volume: "4"}))
+	var status ws.AddOrderResponse
+	select {
+	case upd := <-k.Listen():
+		status = upd.Data.(ws.AddOrderResponse)
+	case <-time.After(time.Second):
+		t.Fatal("order status wasn't received")
+	}
+	assert.NotEmpty(t, status.TxID)
+
+	for _, expected := range []string{"100.00000", "101.00000"} {
+		update := receive(t, own)
+		require.Len(t, update, 1)
+		for _, trade := range update[0] {
+			assert.Equal(t, expected, trade.Price.StringFixed(5))
+			assert.Equal(t, status.TxID, trade.OrderID)
+		}
+	}
+
+	asks, _ := server.Book(ws.BTCUSD)
+	require.Len(t, asks, 1)
+	assert.True(t, asks[0].Price.Equal(decimal.NewFromInt(102)))
+
+	orders := server.Orders()
+	require.Len(t, orders, 1)
+	assert.Equal(t, OrderOpen, orders[0].Status)
+	assert.Equal(t, "3", orders[0].Executed.String())
+
+	// public sell trade fills the rest at limit price
+	require.NoError(t, server.PublishTrade(ws.BTCUSD, Trade{Price: decimal.NewFromInt(100), Volume: decimal.NewFromInt(5), Side: ws.Sell}))
+	update := receive(t, own)
+	for _, trade := range update[0] {
+		assert.Equal(t, "1.00000000", trade.Vol.StringFixed(8))
+		assert.Equal(t, "101.00000", trade.Price.StringFixed(5))
+	}
+	assert.Equal(t, OrderClosed, server.Orders()[0].Status)
+
+	require.NoError(t, k.AddOrder(ws.AddOrderRequest{Ordertype: ws.OrderTypeLimit, Pair: ws.BTCUSD, Price: "90", Type: ws.SideBuy, Volume: "1"}))
+	require.Eventually(t, func() bool { return len(server.Orders()) == 2 }, time.Second, 5*time.Millisecond)
+	require.NoError(t, k.CancelOrder([]string{server.Orders()[1].ID}))
+	require.Eventually(t, func() bool { return server.Orders()[1].Status == OrderCanceled }, time.Second, 5*time.Millisecond)
+}
+
+func TestServer_Reconnect(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	require.NoError(t, server.SetBook(ws.BTCUSD, levels(100.1, 0.1, 10), levels(100, -0.1, 10)))
+
+	k := connect(t, server)
+	book, err := k.NewManagedBook(ws.BTCUSD, ws.Depth10, 5, 8)
+	require.NoError(t, err)
+	require.Eventually(t, book.Valid, time.Second, 5*time.Millisecond)
+
+	// malformed frames are skipped by the client
+	server.SetFaults(Faults{MalformedRate: 1})
+	require.NoError(t, server.UpdateBook(ws.BTCUSD, nil, []ws.PriceLevel{{Price: decimal.NewFromFloat(99.95), Volume: decimal.NewFromInt(1)}}))
+	server.SetFaults(Faults{})
+
+	server.Disconnect()
+	require.Eventually(t, func() bool { return server.Clients() == 1 && book.Valid() && sameBook(server, book, 10) }, 2*time.Second, 5*time.Millisecond)
+	assert.NotZero(t, book.Resyncs())
+}
+
+// failingToken - token provider which fails while `failing` is set
+type failingToken struct {
+	failing int32
+}
+
+func (p *failingToken) Token() (string, time.Duration, error) {
+	if atomic.LoadInt32(&p.failing) == 1 {
+		return "", 0, errors.New("rest is unavailable")
+	}
+	return DefaultToken, time.Hour, nil
+}
+
+func TestServer_ResubscribeWithoutToken(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	tokens := &failingToken{}
+	k := connect(t, server, ws.WithTokenProvider(tokens), ws.WithHeartbeatTimeout(20*time.Millisecond))
+	_, err := k.SubscribeOwnTradesHandle()
+	require.NoError(t, err)
+	_, err = k.SubscribeTickerHandle([]string{ws.BTCUSD})
+	require.NoError(t, err)
+	_, err = k.SubscribeSpreadHandle([]string{ws.BTCUSD})
+	require.NoError(t, err)
+
+	// states - returns states of subscriptions by channel names
+	states := func() map[string]ws.SubscriptionState {
+		result := make(map[string]ws.SubscriptionState)
+		for _, info := range k.Subscriptions() {
+			result[info.ChannelName] = info.State
+		}
+		return result
+	}
+	expect := func(ownTrades ws.SubscriptionState) func() bool {
+		return func() bool {
+			current := states()
+			return current[ws.ChanOwnTrades] == ownTrades && current[ws.ChanTicker] == ws.StateSubscribed && current[ws.ChanSpread] == ws.StateSubscribed
+		}
+	}
+	require.Eventually(t, expect(ws.StateSubscribed), time.Second, 5*time.Millisecond)
+
+	// token can't be received after reconnect: public channels are resubscribed anyway
+	atomic.StoreInt32(&tokens.failing, 1)
+	server.Disconnect()
+	require.Eventually(t, expect(ws.StatePending), time.Second, 5*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, ws.StatePending, states()[ws.ChanOwnTrades])
+
+	// private channel is retried when token is available again
+	atomic.StoreInt32(&tokens.failing, 0)
+	require.Eventually(t, expect(ws.StateSubscribed), time.Second, 5*time.Millisecond)
+}
+
+func TestServer_RandomFeed(t *testing.T) {
+	server := NewServer(WithHeartbeat(10 * time.Millisecond))
+	defer server.Close()
+
+	stop := server.RandomFeed([]string{ws.BTCUSD}, time.Millisecond, 42)
+	k := connect(t, server)
+	book, err := k.NewManagedBook(ws.BTCUSD, ws.Depth10, DefaultPriceDecimals, DefaultVolumeDecimals)
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+	stop()
+	require.Eventually(t, func() bool { return sameBook(server, book, 10) }, time.Second, 5*time.Millisecond)
+	assert.Zero(t, book.Resyncs())
+}
+
+func TestServer_Protocol(t *testing.T) {
+	server := NewServer(WithPairs(Pair{Name: ws.BTCUSD, PriceDecimals: 1, VolumeDecimals: 8}), WithHeartbeat(0))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(server.URL(), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	read := func() map[string]interface{} {
+		t.Helper()
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		_, data, err := conn.ReadMessage()
+		require.NoError(t, err)
+		var event map[string]interface{}
+		require.NoError(t, json.Unmarshal(data, &event))
+		return event
+	}
+	assert.Equal(t, ws.EventSystemStatus, read()["event"])
+
+	require.NoError(t, conn.WriteJSON(ws.PingRequest{Event: ws.EventPing, ReqID: 7}))
+	pong := read()
+	assert.Equal(t, ws.EventPong, pong["event"])
+	assert.EqualValues(t, 7, pong["reqid"])
+
+	require.NoError(t, conn.WriteJSON(ws.SubscriptionRequest{Event: ws.EventSubscribe, Pairs: []string{"ETH/USD"}, Subscription: ws.Subscription{Name: ws.ChanTicker}}))
+	status := read()
+	assert.Equal(t, ws.SubscriptionStatusError, status["status"])
+
+	require.NoError(t, conn.WriteJSON(ws.AuthSubscriptionRequest{Event: ws.EventSubscribe, Subs: ws.AuthDataRequest{Name: ws.ChanOwnTrades, Token: "wrong"}}))
+	status = read()
+	assert.Equal(t, "EGeneral:Invalid arguments:token", status["errorMessage"])
+
+	require.NoError(t, conn.WriteJSON(ws.UnsubscribeRequest{Event: ws.EventUnsubscribe, Pairs: []string{ws.BTCUSD}, Subscription: ws.Subscription{Name: ws.ChanTicker}}))
+	status = read()
+	assert.Equal(t, "Subscription Not Found", status["errorMessage"])
+}
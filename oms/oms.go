@@ -0,0 +1,676 @@
+package oms
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aopoltorzhicky/go_kraken/rest"
+	ws "github.com/aopoltorzhicky/go_kraken/websocket"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+	log "github.com/sirupsen/logrus"
+)
+
+// Errors
+var (
+	ErrUnknownOrder      = errors.New("unknown order")
+	ErrDuplicateClientID = errors.New("duplicate client order ID")
+	ErrNotAcknowledged   = errors.New("order is not acknowledged by exchange")
+)
+
+// OrdersProvider - REST methods which are used to reconcile orders, e.g. `rest.Kraken`
+type OrdersProvider interface {
+	GetOpenOrders(needTrades bool, userRef string) (rest.OpenOrdersResponse, error)
+	GetClosedOrders(needTrades bool, userRef string, start int64, end int64) (rest.ClosedOrdersResponse, error)
+	QueryOrders(needTrades bool, userRef string, txIDs ...string) (map[string]rest.OrderInfo, error)
+}
+
+// Option - option function for `Manager`
+type Option func(*Manager)
+
+// WithBufferSize - size of events channel. If events aren't read fast enough, the oldest ones are dropped. Default: 1024.
+func WithBufferSize(size int) Option {
+	return func(m *Manager) {
+		m.bufferSize = size
+	}
+}
+
+// WithClock - source of time of events. Default: `time.Now`.
+func WithClock(clock func() time.Time) Option {
+	return func(m *Manager) {
+		m.clock = clock
+	}
+}
+
+// Fill - execution of order
+type Fill struct {
+	TradeID string
+	Time    time.Time
+	Price   decimal.Decimal
+	Volume  decimal.Decimal
+	Cost    decimal.Decimal
+	Fee     decimal.Decimal
+}
+
+// Order - tracked order. Order can be found by transaction ID of exchange, client order ID and user reference.
+type Order struct {
+	// ClientID - client order ID which is given to `Submit` or received as `cl_ord_id`
+	ClientID string
+	TxID     string
+	ReqID    int64
+	UserRef  int64
+
+	Pair   string
+	Side   string
+	Type   string
+	Price  decimal.Decimal
+	Price2 decimal.Decimal
+	Volume decimal.Decimal
+	Flags  string
+
+	Executed decimal.Decimal
+	Cost     decimal.Decimal
+	Fee      decimal.Decimal
+	// AvgPrice - average price of executed volume
+	AvgPrice decimal.Decimal
+
+	State State
+	// Reason - reason of rejection, cancellation or expiry
+	Reason string
+	// ReplacedBy - transaction ID of order which replaced this one by `EditOrder`
+	ReplacedBy string
+
+	Opened  time.Time
+	Closed  time.Time
+	Updated time.Time
+	Fills   []Fill
+}
+
+// Remaining - volume which is not executed yet
+func (o Order) Remaining() decimal.Decimal {
+	return o.Volume.Sub(o.Executed)
+}
+
+// hasFill - returns true if trade is already applied to order
+func (o *Order) hasFill(tradeID string) bool {
+	for i := range o.Fills {
+		if o.Fills[i].TradeID == tradeID {
+			return true
+		}
+	}
+	return false
+}
+
+// Event - change of order. `From` and `To` are equal if only executed volume of order was changed.
+type Event struct {
+	// Order - copy of order after the change
+	Order Order
+	From  State
+	To    State
+	// Fill - execution which caused the event if it's known
+	Fill *Fill
+}
+
+// Manager - order management system. It tracks orders from submit to the final state by websocket updates
+// of `openOrders` and `ownTrades` channels and order statuses and reconciles them with REST snapshots.
+type Manager struct {
+	entry    ws.OrderEntry
+	provider OrdersProvider
+
+	orders     []*Order
+	byTxID     map[string]*Order
+	byClientID map[string]*Order
+	byReqID    map[int64]*Order
+	lastReqID  int64
+
+	clock      func() time.Time
+	bufferSize int
+	events     *ws.Feed[Event]
+
+	unsubscribe []func() error
+	closeOnce   sync.Once
+
+	mx sync.Mutex
+}
+
+// New - creates order management system. Orders are sent to `entry` which is `websocket.Kraken` or `paper.Engine`.
+// `provider` is used by `Reconcile` and may be nil if reconciliation isn't needed.
+func New(entry ws.OrderEntry, provider OrdersProvider, opts ...Option) *Manager {
+	m := &Manager{
+		entry:      entry,
+		provider:   provider,
+		orders:     make([]*Order, 0),
+		byTxID:     make(map[string]*Order),
+		byClientID: make(map[string]*Order),
+		byReqID:    make(map[int64]*Order),
+		lastReqID:  time.Now().UnixNano() / int64(time.Millisecond),
+		clock:      time.Now,
+		bufferSize: 1024,
+	}
+	for i := range opts {
+		opts[i](m)
+	}
+	m.events = ws.NewFeed[Event](m.bufferSize)
+	return m
+}
+
+// Events - provides channel with changes of orders. It's closed by `Close`.
+func (m *Manager) Events() <-chan Event {
+	return m.events.C()
+}
+
+// Dropped - returns count of events which were dropped because `Events()` channel wasn't read fast enough
+func (m *Manager) Dropped() uint64 {
+	return m.events.Dropped()
+}
+
+// Subscribe - subscribes manager to `openOrders` and `ownTrades` channels of websocket client by its own handles.
+// Order statuses are sent only to `Listen()` of the client, so pass them to `Handle` by `websocket.Dispatcher`.
+func (m *Manager) Subscribe(k *ws.Kraken) error {
+	orders, err := k.SubscribeOpenOrdersHandle(ws.WithCallback(func(event ws.Event[ws.OpenOrdersUpdate]) {
+		m.Handle(event.Update())
+	}))
+	if err != nil {
+		return err
+	}
+	trades, err := k.SubscribeOwnTradesHandle(ws.WithCallback(func(event ws.Event[ws.OwnTradesUpdate]) {
+		m.Handle(event.Update())
+	}))
+	if err != nil {
+		_ = orders.Close()
+		return err
+	}
+
+	m.mx.Lock()
+	m.unsubscribe = append(m.unsubscribe, orders.Close, trades.Close)
+	m.mx.Unlock()
+	return nil
+}
+
+// Close - unsubscribes handles of `Subscribe` and closes `Events()` channel
+func (m *Manager) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		m.mx.Lock()
+		unsubscribe := m.unsubscribe
+		m.unsubscribe = nil
+		m.mx.Unlock()
+
+		for i := range unsubscribe {
+			if e := unsubscribe[i](); e != nil && err == nil {
+				err = e
+			}
+		}
+		m.events.Close()
+	})
+	return err
+}
+
+// Submit - registers order in pending state and sends it. `clientID` is optional. Request ID is assigned if it's empty
+// and it's used to match acknowledgement of exchange. If acknowledgement is lost, order is recognized by its user reference,
+// side and volume, so set user reference to recover such orders.
+func (m *Manager) Submit(clientID string, req ws.AddOrderRequest) error {
+	m.mx.Lock()
+	if clientID != "" {
+		if _, ok := m.byClientID[clientID]; ok {
+			m.mx.Unlock()
+			return errors.Wrap(ErrDuplicateClientID, clientID)
+		}
+	}
+	if req.ReqID == 0 {
+		m.lastReqID++
+		req.ReqID = m.lastReqID
+	}
+
+	order := &Order{
+		ClientID: clientID,
+		ReqID:    req.ReqID,
+		Pair:     req.Pair,
+		Side:     req.Type,
+		Type:     req.Ordertype,
+		Price:    parseDecimal(req.Price),
+		Price2:   parseDecimal(req.Price2),
+		Volume:   parseDecimal(req.Volume),
+		Flags:    req.OFlags,
+		State:    StatePending,
+		Updated:  m.clock(),
+	}
+	if req.UserRef != "" {
+		order.UserRef, _ = strconv.ParseInt(req.UserRef, 10, 64)
+	}
+	m.orders = append(m.orders, order)
+	m.byReqID[order.ReqID] = order
+	if clientID != "" {
+		m.byClientID[clientID] = order
+	}
+
+	var out events
+	out.add(order, StatePending, nil)
+	m.flush(out)
+
+	if err := m.entry.AddOrder(req); err != nil {
+		m.reject(req.ReqID, err.Error())
+		return err
+	}
+	return nil
+}
+
+// Cancel - sends cancellation of order by client order ID or transaction ID. State is changed when exchange confirms it.
+func (m *Manager) Cancel(id string) error {
+	m.mx.Lock()
+	order := m.find(id)
+	if order == nil {
+		m.mx.Unlock()
+		return errors.Wrap(ErrUnknownOrder, id)
+	}
+	txID := order.TxID
+	m.mx.Unlock()
+
+	if txID == "" {
+		return errors.Wrap(ErrNotAcknowledged, id)
+	}
+	return m.entry.CancelOrder([]string{txID})
+}
+
+// Order - returns copy of order by client order ID or transaction ID
+func (m *Manager) Order(id string) (Order, bool) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	order := m.find(id)
+	if order == nil {
+		return Order{}, false
+	}
+	return order.copy(), true
+}
+
+// Orders - returns copies of all tracked orders in order of registration
+func (m *Manager) Orders() []Order {
+	return m.filter(func(*Order) bool { return true })
+}
+
+// Active - returns copies of orders which are not in terminal state
+func (m *Manager) Active() []Order {
+	return m.filter(func(order *Order) bool { return !order.State.Terminal() })
+}
+
+// ByUserRef - returns copies of orders with user reference
+func (m *Manager) ByUserRef(userRef int64) []Order {
+	return m.filter(func(order *Order) bool { return order.UserRef == userRef })
+}
+
+func (m *Manager) filter(fn func(*Order) bool) []Order {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	result := make([]Order, 0)
+	for _, order := range m.orders {
+		if fn(order) {
+			result = append(result, order.copy())
+		}
+	}
+	return result
+}
+
+func (m *Manager) find(id string) *Order {
+	if order, ok := m.byClientID[id]; ok {
+		return order
+	}
+	return m.byTxID[id]
+}
+
+// Handle - applies websocket update. Updates which don't relate to orders are ignored.
+func (m *Manager) Handle(update ws.Update) {
+	switch data := update.Data.(type) {
+	case ws.AddOrderResponse:
+		if data.Status == ws.StatusOK {
+			m.acknowledge(data.ReqID, data.TxID)
+		} else {
+			m.reject(data.ReqID, data.ErrorMessage)
+		}
+	case ws.EditOrderResponse:
+		if data.Status == ws.StatusOK {
+			m.replace(data.OriginalTxID, data.TxID)
+		}
+	case ws.OpenOrdersUpdate:
+		m.mx.Lock()
+		var out events
+		for _, orders := range data {
+			for txID, delta := range orders {
+				m.openOrder(txID, delta, &out)
+			}
+		}
+		m.flush(out)
+	case ws.OwnTradesUpdate:
+		m.mx.Lock()
+		var out events
+		for _, trades := range data {
+			for tradeID, trade := range trades {
+				m.ownTrade(tradeID, trade, &out)
+			}
+		}
+		m.flush(out)
+	}
+}
+
+// acknowledge - links pending order with transaction ID of exchange. Updates of `openOrders` and `ownTrades` may overtake
+// acknowledgement, e.g. if they are received by subscription handles, so order which they registered is merged into the pending one.
+func (m *Manager) acknowledge(reqID int64, txID string) {
+	m.mx.Lock()
+	var out events
+	if order, ok := m.byReqID[reqID]; ok && txID != "" {
+		delete(m.byReqID, reqID)
+		to := StateOpen
+		if registered, ok := m.byTxID[txID]; ok && registered != order {
+			m.absorb(order, registered)
+			if registered.State != StatePending {
+				to = registered.State
+			}
+		}
+		m.link(order, txID)
+		m.transit(order, to, nil, &out)
+	}
+	m.flush(out)
+}
+
+// absorb - moves execution of order which was registered by updates before acknowledgement to the pending order and forgets it
+func (m *Manager) absorb(order, registered *Order) {
+	if registered.Flags != "" {
+		order.Flags = registered.Flags
+	}
+	if registered.UserRef != 0 {
+		order.UserRef = registered.UserRef
+	}
+	if order.ClientID == "" && registered.ClientID != "" {
+		order.ClientID = registered.ClientID
+		m.byClientID[order.ClientID] = order
+	}
+	order.Executed = registered.Executed
+	order.Cost = registered.Cost
+	order.Fee = registered.Fee
+	order.AvgPrice = registered.AvgPrice
+	order.Reason = registered.Reason
+	order.Opened = registered.Opened
+	order.Closed = registered.Closed
+	order.Fills = registered.Fills
+
+	for i := range m.orders {
+		if m.orders[i] == registered {
+			m.orders = append(m.orders[:i], m.orders[i+1:]...)
+			break
+		}
+	}
+}
+
+// reject - finishes pending order which was rejected by exchange
+func (m *Manager) reject(reqID int64, reason string) {
+	m.mx.Lock()
+	var out events
+	if order, ok := m.byReqID[reqID]; ok {
+		delete(m.byReqID, reqID)
+		order.Reason = reason
+		m.transit(order, StateRejected, nil, &out)
+	}
+	m.flush(out)
+}
+
+// replace - registers order which replaced the original one after `EditOrder`. Client order ID is moved to the new order.
+func (m *Manager) replace(originalID, txID string) {
+	m.mx.Lock()
+	var out events
+	original, ok := m.byTxID[originalID]
+	if ok && txID != "" && txID != originalID {
+		original.ReplacedBy = txID
+		order := m.byTxID[txID]
+		if order == nil {
+			order = &Order{
+				ClientID: original.ClientID,
+				UserRef:  original.UserRef,
+				Pair:     original.Pair,
+				Side:     original.Side,
+				Type:     original.Type,
+				Price:    original.Price,
+				Price2:   original.Price2,
+				Volume:   original.Volume,
+				Flags:    original.Flags,
+				State:    StatePending,
+			}
+			m.orders = append(m.orders, order)
+			m.link(order, txID)
+		}
+		if original.ClientID != "" {
+			order.ClientID = original.ClientID
+			m.byClientID[original.ClientID] = order
+		}
+		m.transit(order, StateOpen, nil, &out)
+	}
+	m.flush(out)
+}
+
+func (m *Manager) link(order *Order, txID string) {
+	order.TxID = txID
+	m.byTxID[txID] = order
+}
+
+// openOrder - merges update of `openOrders` channel. The first message of order has all fields and next ones only changed fields.
+func (m *Manager) openOrder(txID string, delta ws.OpenOrder, out *events) {
+	order, ok := m.byTxID[txID]
+	if !ok {
+		order = m.match(txID, delta.UserRef, delta.ClOrdID, delta.Descr.Type, delta.Vol)
+	}
+
+	if delta.Descr.Pair != "" {
+		order.Pair = delta.Descr.Pair
+	}
+	if delta.Descr.Type != "" {
+		order.Side = delta.Descr.Type
+	}
+	if delta.Descr.Ordertype != "" {
+		order.Type = delta.Descr.Ordertype
+	}
+	if delta.Has("descr") {
+		order.Price = delta.Descr.Price
+		order.Price2 = delta.Descr.Price2
+	}
+	if delta.Has("vol") {
+		order.Volume = delta.Vol
+	}
+	if delta.Has("oflags") {
+		order.Flags = string(delta.Oflags)
+	}
+	if delta.Has("userref") {
+		order.UserRef = delta.UserRef
+	}
+	if !delta.OpenTime.IsZero() {
+		order.Opened = delta.OpenTime.Time
+	}
+
+	m.execution(order, delta.VolExec, delta.Cost, delta.Fee, delta.AveragePrice())
+	if delta.CancelReason != "" {
+		order.Reason = delta.CancelReason
+	}
+	m.status(order, string(delta.Status), out)
+}
+
+// ownTrade - applies execution of order. Trades which were already applied are skipped.
+func (m *Manager) ownTrade(tradeID string, trade ws.OwnTrade, out *events) {
+	order, ok := m.byTxID[trade.OrderID]
+	if !ok {
+		order = m.match(trade.OrderID, trade.UserRef, "", trade.Type, decimal.Zero)
+		order.Pair = trade.Pair
+		order.Type = trade.OrderType
+	}
+	if order.hasFill(tradeID) {
+		return
+	}
+
+	fill := Fill{
+		TradeID: tradeID,
+		Time:    trade.Time.Time,
+		Price:   trade.Price,
+		Volume:  trade.Vol,
+		Cost:    trade.Cost,
+		Fee:     trade.Fee,
+	}
+	order.Fills = append(order.Fills, fill)
+
+	var volume, cost, fee decimal.Decimal
+	for i := range order.Fills {
+		volume = volume.Add(order.Fills[i].Volume)
+		cost = cost.Add(order.Fills[i].Cost)
+		fee = fee.Add(order.Fills[i].Fee)
+	}
+	m.execution(order, volume, cost, fee, decimal.Zero)
+
+	to := order.State
+	if !to.Terminal() {
+		to = StatePartiallyFilled
+		if order.Volume.IsPositive() && !order.Remaining().IsPositive() {
+			to = StateFilled
+		}
+	}
+	m.transit(order, to, &fill, out)
+}
+
+// execution - updates executed volume of order. Values are cumulative, so the largest one is taken from websocket deltas,
+// own trades and REST snapshots which may come in any order.
+func (m *Manager) execution(order *Order, volume, cost, fee, price decimal.Decimal) {
+	if volume.GreaterThan(order.Executed) {
+		order.Executed = volume
+	}
+	if cost.GreaterThan(order.Cost) {
+		order.Cost = cost
+	}
+	if fee.GreaterThan(order.Fee) {
+		order.Fee = fee
+	}
+	switch {
+	case price.IsPositive():
+		order.AvgPrice = price
+	case order.Executed.IsPositive():
+		order.AvgPrice = order.Cost.Div(order.Executed)
+	}
+}
+
+// status - changes state of order by status of exchange. Delta without status may change only executed volume.
+func (m *Manager) status(order *Order, status string, out *events) {
+	state, ok := stateOf(status, order.Executed.IsPositive())
+	if !ok {
+		if !order.Executed.IsPositive() || !order.State.CanTransit(StatePartiallyFilled) {
+			return
+		}
+		state = StatePartiallyFilled
+	}
+	m.transit(order, state, nil, out)
+}
+
+// match - finds order by `lookup`. Unknown orders, e.g. placed by other applications, are registered in pending state.
+func (m *Manager) match(txID string, userRef int64, clientID, side string, volume decimal.Decimal) *Order {
+	if order := m.lookup(txID, userRef, clientID, side, volume); order != nil {
+		return order
+	}
+
+	order := &Order{
+		ClientID: clientID,
+		UserRef:  userRef,
+		Side:     side,
+		Volume:   volume,
+		State:    StatePending,
+	}
+	m.orders = append(m.orders, order)
+	m.link(order, txID)
+	if clientID != "" {
+		m.byClientID[clientID] = order
+	}
+	return order
+}
+
+// lookup - finds order by transaction ID or pending order which was sent by this manager and wasn't acknowledged,
+// e.g. because of reconnect. Pending order is matched by client order ID or by user reference, side and volume.
+func (m *Manager) lookup(txID string, userRef int64, clientID, side string, volume decimal.Decimal) *Order {
+	if order, ok := m.byTxID[txID]; ok {
+		return order
+	}
+
+	var found *Order
+	if order, ok := m.byClientID[clientID]; ok && clientID != "" && order.TxID == "" {
+		found = order
+	}
+	for i := 0; found == nil && userRef != 0 && i < len(m.orders); i++ {
+		order := m.orders[i]
+		if order.TxID != "" || order.State != StatePending || order.UserRef != userRef {
+			continue
+		}
+		if side != "" && order.Side != side {
+			continue
+		}
+		if volume.IsPositive() && !order.Volume.Equal(volume) {
+			continue
+		}
+		found = order
+	}
+	if found != nil {
+		m.link(found, txID)
+		delete(m.byReqID, found.ReqID)
+	}
+	return found
+}
+
+// transit - changes state of order and emits event. Fill is reported even if state isn't changed.
+// It returns false if transition isn't allowed.
+func (m *Manager) transit(order *Order, to State, fill *Fill, out *events) bool {
+	from := order.State
+	if from != to && !from.CanTransit(to) {
+		log.Warnf("oms: order %s can't change state from %s to %s", order.TxID, from, to)
+		if fill != nil {
+			out.add(order, from, fill)
+		}
+		return false
+	}
+
+	now := m.clock()
+	if fill != nil || from != to {
+		order.Updated = now
+	}
+	if from != to {
+		order.State = to
+		if to.Terminal() && order.Closed.IsZero() {
+			order.Closed = now
+		}
+	}
+	if fill != nil || from != to {
+		out.add(order, from, fill)
+	}
+	return true
+}
+
+func (o *Order) copy() Order {
+	result := *o
+	result.Fills = append([]Fill(nil), o.Fills...)
+	return result
+}
+
+// events - events which are collected under lock of manager and sent by `flush`
+type events []Event
+
+func (e *events) add(order *Order, from State, fill *Fill) {
+	*e = append(*e, Event{Order: order.copy(), From: from, To: order.State, Fill: fill})
+}
+
+// flush - sends events and releases lock of manager. Feed never blocks, so events are sent under the lock in order of calls.
+func (m *Manager) flush(out events) {
+	defer m.mx.Unlock()
+	m.events.Publish(out...)
+}
+
+func parseDecimal(value string) decimal.Decimal {
+	if value == "" {
+		return decimal.Zero
+	}
+	result, err := decimal.NewFromString(value)
+	if err != nil {
+		return decimal.Zero
+	}
+	return result
+}
@@ -0,0 +1,329 @@
+package oms
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aopoltorzhicky/go_kraken/krakentest"
+	"github.com/aopoltorzhicky/go_kraken/rest"
+	ws "github.com/aopoltorzhicky/go_kraken/websocket"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newManager(entry *krakentest.OrderEntry, provider OrdersProvider) *Manager {
+	return New(entry, provider, WithClock(func() time.Time { return time.Unix(1700000000, 0) }))
+}
+
+func drain(m *Manager) []Event {
+	return krakentest.Drain(m.Events())
+}
+
+func states(events []Event) []State {
+	result := make([]State, len(events))
+	for i := range events {
+		result[i] = events[i].To
+	}
+	return result
+}
+
+func ownTrade(orderID, id, volume, cost string) ws.Update {
+	return ws.Update{ChannelName: ws.ChanOwnTrades, Data: ws.OwnTradesUpdate{{id: ws.OwnTrade{
+		OrderID: orderID, Pair: ws.BTCUSD, Type: ws.SideBuy, Price: decimal.NewFromInt(100), Vol: decimal.RequireFromString(volume),
+		Cost: decimal.RequireFromString(cost), Fee: decimal.RequireFromString("0.1"), Time: ws.Timestamp{Time: time.Unix(1700000001, 5e8)},
+	}}}}
+}
+
+func TestManager_Lifecycle(t *testing.T) {
+	entry := krakentest.NewOrderEntry()
+	m := newManager(entry, nil)
+
+	require.NoError(t, m.Submit("c1", ws.AddOrderRequest{
+		Pair: ws.BTCUSD, Type: ws.SideBuy, Ordertype: ws.OrderTypeLimit, Price: "100", Volume: "1", UserRef: "5",
+	}))
+	require.Len(t, entry.Added(), 1)
+	reqID := entry.Added()[0].ReqID
+	assert.NotZero(t, reqID)
+	assert.ErrorIs(t, m.Submit("c1", ws.AddOrderRequest{}), ErrDuplicateClientID)
+
+	m.Handle(ws.Update{ChannelName: ws.EventAddOrder, Data: ws.AddOrderResponse{ReqID: reqID, Status: ws.StatusOK, TxID: "O1"}})
+	m.Handle(ws.Update{ChannelName: ws.ChanOpenOrders, Data: ws.OpenOrdersUpdate{{"O1": ws.OpenOrder{
+		Descr:    ws.OpenOrderDescr{Pair: ws.BTCUSD, Type: ws.SideBuy, Ordertype: ws.OrderTypeLimit, Price: decimal.NewFromInt(100)},
+		Status:   ws.OrderStatusOpen,
+		Vol:      decimal.NewFromInt(1),
+		OpenTime: ws.Timestamp{Time: time.Unix(1700000000, 25e7)},
+		UserRef:  5,
+	}}}})
+	m.Handle(ownTrade("O1", "T1", "0.4", "40"))
+	m.Handle(ownTrade("O1", "T1", "0.4", "40"))
+	// delta of open order carries only changed fields
+	m.Handle(ws.Update{ChannelName: ws.ChanOpenOrders, Data: ws.OpenOrdersUpdate{{"O1": ws.OpenOrder{
+		VolExec: decimal.RequireFromString("0.4"), Cost: decimal.NewFromInt(40), Fee: decimal.RequireFromString("0.1"), Price: decimal.NewFromInt(100),
+	}}}})
+	m.Handle(ownTrade("O1", "T2", "0.6", "60"))
+	m.Handle(ws.Update{ChannelName: ws.ChanOpenOrders, Data: ws.OpenOrdersUpdate{{"O1": ws.OpenOrder{Status: ws.OrderStatusClosed}}}})
+
+	events := drain(m)
+	assert.Equal(t, []State{StatePending, StateOpen, StatePartiallyFilled, StateFilled}, states(events))
+	require.NotNil(t, events[2].Fill)
+	assert.Equal(t, "T1", events[2].Fill.TradeID)
+	assert.Equal(t, StateOpen, events[2].From)
+	assert.Equal(t, "T2", events[3].Fill.TradeID)
+
+	order, ok := m.Order("c1")
+	require.True(t, ok)
+	assert.Equal(t, "O1", order.TxID)
+	assert.Equal(t, int64(5), order.UserRef)
+	assert.Equal(t, StateFilled, order.State)
+	assert.Equal(t, "1", order.Executed.String())
+	assert.Equal(t, "100", order.Cost.String())
+	assert.Equal(t, "0.2", order.Fee.String(), "fees of own trades aren't counted twice with websocket delta")
+	assert.Equal(t, "100", order.AvgPrice.String())
+	assert.Len(t, order.Fills, 2)
+	assert.Equal(t, time.Unix(1700000000, 250000000), order.Opened)
+	assert.Empty(t, m.Active())
+
+	byTxID, ok := m.Order("O1")
+	require.True(t, ok)
+	assert.Equal(t, "c1", byTxID.ClientID)
+	assert.Len(t, m.ByUserRef(5), 1)
+}
+
+func TestManager_Reject(t *testing.T) {
+	entry := krakentest.NewOrderEntry()
+	m := newManager(entry, nil)
+
+	require.NoError(t, m.Submit("c1", ws.AddOrderRequest{Pair: ws.BTCUSD, Type: ws.SideBuy, Ordertype: ws.OrderTypeMarket, Volume: "1"}))
+	m.Handle(ws.Update{ChannelName: ws.EventAddOrder, Data: ws.AddOrderResponse{
+		ReqID: entry.Added()[0].ReqID, Status: ws.StatusError, ErrorMessage: "EOrder:Insufficient funds",
+	}})
+
+	entry.SetError(errors.New("not connected"))
+	assert.Error(t, m.Submit("c2", ws.AddOrderRequest{Pair: ws.BTCUSD, Type: ws.SideBuy, Ordertype: ws.OrderTypeMarket, Volume: "1"}))
+
+	assert.Equal(t, []State{StatePending, StateRejected, StatePending, StateRejected}, states(drain(m)))
+	order, _ := m.Order("c1")
+	assert.Equal(t, "EOrder:Insufficient funds", order.Reason)
+	order, _ = m.Order("c2")
+	assert.Equal(t, StateRejected, order.State)
+}
+
+func TestManager_CancelEdit(t *testing.T) {
+	entry := krakentest.NewOrderEntry()
+	m := newManager(entry, nil)
+
+	require.NoError(t, m.Submit("c1", ws.AddOrderRequest{Pair: ws.BTCUSD, Type: ws.SideSell, Ordertype: ws.OrderTypeLimit, Price: "110", Volume: "1"}))
+	assert.ErrorIs(t, m.Cancel("c1"), ErrNotAcknowledged)
+	assert.ErrorIs(t, m.Cancel("c9"), ErrUnknownOrder)
+	m.Handle(ws.Update{ChannelName: ws.EventAddOrder, Data: ws.AddOrderResponse{ReqID: entry.Added()[0].ReqID, Status: ws.StatusOK, TxID: "O1"}})
+
+	m.Handle(ws.Update{ChannelName: ws.EventEditOrder, Data: ws.EditOrderResponse{Status: ws.StatusOK, TxID: "O2", OriginalTxID: "O1"}})
+	m.Handle(ws.Update{ChannelName: ws.ChanOpenOrders, Data: ws.OpenOrdersUpdate{{"O1": ws.OpenOrder{Status: ws.OrderStatusCanceled, CancelReason: "Order replaced"}}}})
+
+	order, ok := m.Order("c1")
+	require.True(t, ok)
+	assert.Equal(t, "O2", order.TxID, "client order ID follows the new order")
+	assert.Equal(t, StateOpen, order.State)
+
+	original, _ := m.Order("O1")
+	assert.Equal(t, StateCanceled, original.State)
+	assert.Equal(t, "O2", original.ReplacedBy)
+	assert.Equal(t, "Order replaced", original.Reason)
+
+	require.NoError(t, m.Cancel("c1"))
+	assert.Equal(t, []string{"O2"}, entry.Canceled())
+	m.Handle(ws.Update{ChannelName: ws.ChanOpenOrders, Data: ws.OpenOrdersUpdate{{"O2": ws.OpenOrder{Status: ws.OrderStatusExpired}}}})
+	order, _ = m.Order("c1")
+	assert.Equal(t, StateExpired, order.State)
+
+	// terminal state is never left
+	m.Handle(ws.Update{ChannelName: ws.ChanOpenOrders, Data: ws.OpenOrdersUpdate{{"O2": ws.OpenOrder{Status: ws.OrderStatusOpen}}}})
+	order, _ = m.Order("c1")
+	assert.Equal(t, StateExpired, order.State)
+}
+
+func TestManager_Reconcile(t *testing.T) {
+	entry := krakentest.NewOrderEntry()
+	provider := &krakentest.Account{
+		OpenOrders: map[string]rest.OrderInfo{
+			"O3": {Status: "open", UserRef: float64(7), Volume: 1, VolumeExecuted: 0.25, Cost: 25, Description: rest.OrderDescription{Pair: "XBTUSD", Side: ws.SideBuy}},
+			"O5": {Status: "open", Volume: 3, OpenTimestamp: 1699999000.5, Description: rest.OrderDescription{Pair: "XBTUSD", Side: ws.SideSell, OrderType: ws.OrderTypeLimit}},
+		},
+		ClosedOrders: map[string]rest.OrderInfo{
+			"O2": {Status: "closed", Volume: 1, VolumeExecuted: 1, Cost: 101, Fee: 0.2},
+			"O9": {Status: "closed", Volume: 1, VolumeExecuted: 1},
+		},
+		Orders: map[string]rest.OrderInfo{
+			"O4": {Status: "canceled", Reason: "User requested", Volume: 2},
+		},
+	}
+	m := newManager(entry, provider)
+
+	for i, userRef := range []string{"7", "0", "0"} {
+		require.NoError(t, m.Submit("", ws.AddOrderRequest{Pair: ws.BTCUSD, Type: ws.SideBuy, Ordertype: ws.OrderTypeLimit, Price: "100", Volume: "1", UserRef: userRef}))
+		if i > 0 {
+			m.Handle(ws.Update{ChannelName: ws.EventAddOrder, Data: ws.AddOrderResponse{ReqID: entry.Added()[i].ReqID, Status: ws.StatusOK, TxID: []string{"", "O2", "O4"}[i]}})
+		}
+	}
+	drain(m)
+
+	require.NoError(t, m.Reconcile())
+	assert.Equal(t, []string{"O4"}, provider.QueriedIDs)
+	assert.Equal(t, int64(1699999999), provider.ClosedStart)
+
+	recovered, ok := m.Order("O3")
+	require.True(t, ok, "acknowledgement lost on reconnect is recovered by user reference")
+	assert.Equal(t, StatePartiallyFilled, recovered.State)
+	assert.Equal(t, ws.BTCUSD, recovered.Pair)
+	assert.Equal(t, "25", recovered.Cost.String())
+
+	filled, _ := m.Order("O2")
+	assert.Equal(t, StateFilled, filled.State)
+	assert.Equal(t, "101", filled.Cost.String())
+	canceled, _ := m.Order("O4")
+	assert.Equal(t, StateCanceled, canceled.State)
+	assert.Equal(t, "User requested", canceled.Reason)
+
+	external, ok := m.Order("O5")
+	require.True(t, ok, "open order of other application is registered")
+	assert.Equal(t, StateOpen, external.State)
+	assert.Equal(t, "XBTUSD", external.Pair)
+
+	_, ok = m.Order("O9")
+	assert.False(t, ok, "unknown closed orders are skipped")
+	assert.Len(t, m.Orders(), 4)
+}
+
+func TestState(t *testing.T) {
+	assert.True(t, StatePending.CanTransit(StateRejected))
+	assert.False(t, StateOpen.CanTransit(StateRejected))
+	assert.False(t, StateFilled.CanTransit(StateCanceled))
+	assert.True(t, StateExpired.Terminal())
+	assert.False(t, StatePartiallyFilled.Terminal())
+}
+
+func TestManager_OvertakenAck(t *testing.T) {
+	entry := krakentest.NewOrderEntry()
+	m := newManager(entry, nil)
+
+	require.NoError(t, m.Submit("c1", ws.AddOrderRequest{Pair: ws.BTCUSD, Type: ws.SideBuy, Ordertype: ws.OrderTypeMarket, Volume: "1"}))
+	// updates of subscription handles are received before status of `Listen()`
+	m.Handle(ws.Update{ChannelName: ws.ChanOpenOrders, Data: ws.OpenOrdersUpdate{{"O1": ws.OpenOrder{
+		Descr: ws.OpenOrderDescr{Pair: ws.BTCUSD, Type: ws.SideBuy, Ordertype: ws.OrderTypeMarket}, Status: ws.OrderStatusOpen, Vol: decimal.NewFromInt(1),
+	}}}})
+	m.Handle(ownTrade("O1", "T1", "1", "100"))
+	m.Handle(ws.Update{ChannelName: ws.EventAddOrder, Data: ws.AddOrderResponse{ReqID: entry.Added()[0].ReqID, Status: ws.StatusOK, TxID: "O1"}})
+
+	require.Len(t, m.Orders(), 1)
+	order, ok := m.Order("c1")
+	require.True(t, ok)
+	assert.Equal(t, "O1", order.TxID)
+	assert.Equal(t, StateFilled, order.State)
+	assert.Len(t, order.Fills, 1)
+	events := drain(m)
+	assert.Equal(t, Event{Order: order, From: StatePending, To: StateFilled}, events[len(events)-1])
+}
+
+// connect - returns client of fake server which sells 1 at 100, 101 and 102
+func connect(t *testing.T) *ws.Kraken {
+	t.Helper()
+
+	server := krakentest.NewServer()
+	t.Cleanup(server.Close)
+	require.NoError(t, server.SetBook(ws.BTCUSD, []ws.PriceLevel{
+		{Price: decimal.NewFromInt(100), Volume: decimal.NewFromInt(1)},
+		{Price: decimal.NewFromInt(101), Volume: decimal.NewFromInt(1)},
+		{Price: decimal.NewFromInt(102), Volume: decimal.NewFromInt(1)},
+	}, nil))
+
+	k := ws.NewKraken(server.URL(), ws.WithTokenProvider(krakentest.StaticToken(krakentest.DefaultToken)))
+	require.NoError(t, k.Connect())
+	t.Cleanup(func() {
+		k.Close()
+	})
+	return k
+}
+
+// receiveTrades - reads own trades of the handle until `count` trades are received
+func receiveTrades(t *testing.T, handle *ws.SubscriptionHandle[ws.OwnTradesUpdate], count int) []ws.OwnTrade {
+	t.Helper()
+
+	result := make([]ws.OwnTrade, 0, count)
+	for len(result) < count {
+		select {
+		case event := <-handle.C():
+			for _, trades := range event.Data {
+				for _, trade := range trades {
+					result = append(result, trade)
+				}
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("received %d trades of %d", len(result), count)
+		}
+	}
+	return result
+}
+
+func TestManager_SharedClient(t *testing.T) {
+	k := connect(t)
+
+	m := New(k, nil)
+	defer m.Close()
+	require.NoError(t, m.Subscribe(k))
+
+	// another consumer of the same channel has its own handle
+	own, err := k.SubscribeOwnTradesHandle()
+	require.NoError(t, err)
+	defer own.Close()
+	require.Eventually(t, func() bool { return own.Status() == ws.StateSubscribed }, time.Second, 5*time.Millisecond)
+
+	// order statuses are read from `Listen()` by the only dispatcher
+	d := ws.NewDispatcher(k, m)
+	d.Start()
+	defer d.Close()
+
+	require.NoError(t, m.Submit("c1", ws.AddOrderRequest{Pair: ws.BTCUSD, Type: ws.SideBuy, Ordertype: ws.OrderTypeLimit, Price: "101", Volume: "2"}))
+	require.Eventually(t, func() bool {
+		order, ok := m.Order("c1")
+		return ok && order.State == StateFilled
+	}, time.Second, 5*time.Millisecond)
+
+	order, _ := m.Order("c1")
+	assert.NotEmpty(t, order.TxID)
+	assert.Len(t, order.Fills, 2)
+	for _, trade := range receiveTrades(t, own, 2) {
+		assert.Equal(t, order.TxID, trade.OrderID)
+	}
+}
+
+func TestManager_StoppedReader(t *testing.T) {
+	k := connect(t)
+
+	m := New(k, nil, WithBufferSize(1))
+	require.NoError(t, m.Subscribe(k))
+	own, err := k.SubscribeOwnTradesHandle()
+	require.NoError(t, err)
+	defer own.Close()
+	require.Eventually(t, func() bool { return own.Status() == ws.StateSubscribed }, time.Second, 5*time.Millisecond)
+
+	d := ws.NewDispatcher(k, m)
+	d.Start()
+	defer d.Close()
+
+	// nobody reads events of manager: read loop isn't blocked and other consumers receive their updates
+	for _, id := range []string{"c1", "c2", "c3"} {
+		require.NoError(t, m.Submit(id, ws.AddOrderRequest{Pair: ws.BTCUSD, Type: ws.SideBuy, Ordertype: ws.OrderTypeMarket, Volume: "1"}))
+	}
+	assert.Len(t, receiveTrades(t, own, 3), 3)
+	require.Eventually(t, func() bool { return len(m.Active()) == 0 }, time.Second, 5*time.Millisecond)
+	assert.NotZero(t, m.Dropped())
+
+	require.NoError(t, m.Close())
+	require.NoError(t, m.Close())
+	events := drain(m)
+	assert.Len(t, events, 1, "the latest event is kept")
+	_, ok := <-m.Events()
+	assert.False(t, ok)
+}
@@ -0,0 +1,196 @@
+package oms
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/aopoltorzhicky/go_kraken/rest"
+	ws "github.com/aopoltorzhicky/go_kraken/websocket"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxQueryOrders - maximum count of orders in one `QueryOrders` request
+const maxQueryOrders = 50
+
+// Reconcile - merges REST snapshots of orders into tracked ones. Open orders are requested first. Orders which are active
+// in manager but not open on exchange are searched in closed orders since the oldest of them and then by `QueryOrders`.
+// Pending orders whose acknowledgement was lost are matched by client order ID or user reference, side and volume.
+func (m *Manager) Reconcile() error {
+	if m.provider == nil {
+		return errors.New("orders provider is not set")
+	}
+
+	open, err := m.provider.GetOpenOrders(false, "")
+	if err != nil {
+		return errors.Wrap(err, "can't receive open orders")
+	}
+	m.apply(open.Orders, false)
+
+	missing, start := m.missing(open.Orders)
+	if len(missing) == 0 && !m.hasPending() {
+		return nil
+	}
+
+	closed, err := m.provider.GetClosedOrders(false, "", start, 0)
+	if err != nil {
+		return errors.Wrap(err, "can't receive closed orders")
+	}
+	m.apply(closed.Orders, true)
+
+	queried := make([]string, 0)
+	for _, txID := range missing {
+		_, isOpen := open.Orders[txID]
+		_, isClosed := closed.Orders[txID]
+		if !isOpen && !isClosed {
+			queried = append(queried, txID)
+		}
+	}
+
+	for len(queried) > 0 {
+		count := len(queried)
+		if count > maxQueryOrders {
+			count = maxQueryOrders
+		}
+		orders, err := m.provider.QueryOrders(false, "", queried[:count]...)
+		if err != nil {
+			return errors.Wrap(err, "can't query orders")
+		}
+		m.apply(orders, true)
+		queried = queried[count:]
+	}
+	return nil
+}
+
+// ReconcileOnReconnect - reconciles orders after each reconnect of websocket client. It returns function which removes the hook.
+func (m *Manager) ReconcileOnReconnect(k *ws.Kraken) func() {
+	return k.OnReconnect(func() {
+		go func() {
+			if err := m.Reconcile(); err != nil {
+				log.Errorf("oms: %s", err)
+			}
+		}()
+	})
+}
+
+// apply - merges REST orders. Unknown open orders are registered, but unknown closed orders are skipped if `tracked` is set.
+func (m *Manager) apply(orders map[string]rest.OrderInfo, tracked bool) {
+	m.mx.Lock()
+	var out events
+	for txID, info := range orders {
+		if tracked && m.lookup(txID, userRef(info.UserRef), info.ClOrdID, info.Description.Side, decimal.NewFromFloat(info.Volume)) == nil {
+			continue
+		}
+		m.snapshot(txID, info, &out)
+	}
+	m.flush(out)
+}
+
+// missing - returns active orders which are not open on exchange and unix time since which closed orders are requested
+func (m *Manager) missing(open map[string]rest.OrderInfo) ([]string, int64) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	result := make([]string, 0)
+	var start time.Time
+	for _, order := range m.orders {
+		if order.State.Terminal() {
+			continue
+		}
+		if _, ok := open[order.TxID]; ok && order.TxID != "" {
+			continue
+		}
+		if order.TxID != "" {
+			result = append(result, order.TxID)
+		}
+
+		// pending order has no open time of exchange, so time of submit is used
+		opened := order.Opened
+		if opened.IsZero() {
+			opened = order.Updated
+		}
+		if start.IsZero() || (!opened.IsZero() && opened.Before(start)) {
+			start = opened
+		}
+	}
+	if start.IsZero() {
+		return result, 0
+	}
+	return result, start.Unix() - 1
+}
+
+func (m *Manager) hasPending() bool {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	for _, order := range m.orders {
+		if order.TxID == "" && order.State == StatePending {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshot - merges full state of order from REST
+func (m *Manager) snapshot(txID string, info rest.OrderInfo, out *events) {
+	volume := decimal.NewFromFloat(info.Volume)
+	order := m.match(txID, userRef(info.UserRef), info.ClOrdID, info.Description.Side, volume)
+
+	// REST uses alternative names of pairs, so websocket name is kept if it's known
+	if order.Pair == "" {
+		order.Pair = info.Description.Pair
+	}
+	if order.Type == "" {
+		order.Type = info.Description.OrderType
+	}
+	if order.Side == "" {
+		order.Side = info.Description.Side
+	}
+	if info.Description.Price > 0 {
+		order.Price = decimal.NewFromFloat(info.Description.Price)
+	}
+	if info.Description.Price2 > 0 {
+		order.Price2 = decimal.NewFromFloat(info.Description.Price2)
+	}
+	if volume.IsPositive() {
+		order.Volume = volume
+	}
+	if info.Flags != "" {
+		order.Flags = info.Flags
+	}
+	if order.Opened.IsZero() && info.OpenTimestamp > 0 {
+		order.Opened = floatTime(info.OpenTimestamp)
+	}
+	if info.Reason != "" {
+		order.Reason = info.Reason
+	}
+	m.execution(order,
+		decimal.NewFromFloat(info.VolumeExecuted),
+		decimal.NewFromFloat(info.Cost),
+		decimal.NewFromFloat(info.Fee),
+		decimal.NewFromFloat(info.AveragePrice),
+	)
+	m.status(order, info.Status, out)
+}
+
+// userRef - user reference from REST is a number or null
+func userRef(value interface{}) int64 {
+	switch v := value.(type) {
+	case float64:
+		return int64(v)
+	case json.Number:
+		result, _ := v.Int64()
+		return result
+	case string:
+		result, _ := strconv.ParseInt(v, 10, 64)
+		return result
+	default:
+		return 0
+	}
+}
+
+func floatTime(value float64) time.Time {
+	return time.Unix(0, decimal.NewFromFloat(value).Mul(decimal.NewFromInt(int64(time.Second))).IntPart())
+}
@@ -0,0 +1,64 @@
+package oms
+
+// State - state of order in its lifecycle
+type State string
+
+// States
+const (
+	// StatePending - order is submitted and waits for acknowledgement of exchange
+	StatePending State = "pending"
+	// StateOpen - order is acknowledged and rests in the book or waits for trigger
+	StateOpen State = "open"
+	// StatePartiallyFilled - part of order volume is executed
+	StatePartiallyFilled State = "partially_filled"
+	// StateFilled - order volume is executed
+	StateFilled State = "filled"
+	// StateCanceled - order is cancelled by user or by exchange. It may be partially executed.
+	StateCanceled State = "canceled"
+	// StateExpired - order is expired by its expiration time
+	StateExpired State = "expired"
+	// StateRejected - order is rejected by exchange and never was in the book
+	StateRejected State = "rejected"
+)
+
+// transitions - allowed changes of state. States which are missing here are terminal.
+var transitions = map[State][]State{
+	StatePending:         {StateOpen, StatePartiallyFilled, StateFilled, StateCanceled, StateExpired, StateRejected},
+	StateOpen:            {StatePartiallyFilled, StateFilled, StateCanceled, StateExpired},
+	StatePartiallyFilled: {StateFilled, StateCanceled, StateExpired},
+}
+
+// Terminal - returns true if order can't change its state anymore
+func (s State) Terminal() bool {
+	_, ok := transitions[s]
+	return !ok
+}
+
+// CanTransit - returns true if state can be changed to `to`
+func (s State) CanTransit(to State) bool {
+	for _, state := range transitions[s] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
+
+// stateOf - converts status of Kraken order to state. Closed order is filled and open order with executed volume is partially filled.
+func stateOf(status string, executed bool) (State, bool) {
+	switch status {
+	case "pending", "open":
+		if executed {
+			return StatePartiallyFilled, true
+		}
+		return StateOpen, true
+	case "closed":
+		return StateFilled, true
+	case "canceled":
+		return StateCanceled, true
+	case "expired":
+		return StateExpired, true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,341 @@
+package paper
+
+import (
+	"github.com/aopoltorzhicky/go_kraken/rest"
+	ws "github.com/aopoltorzhicky/go_kraken/websocket"
+	"github.com/shopspring/decimal"
+	log "github.com/sirupsen/logrus"
+)
+
+var decimalHundred = decimal.NewFromInt(100)
+
+// updates - updates which are collected under lock of engine and sent after it
+type updates []ws.Update
+
+func (u *updates) event(name string, data interface{}) {
+	*u = append(*u, ws.Update{ChannelName: name, Data: data})
+}
+
+// prepend - adds status of request before updates which are caused by it as exchange sends them
+func (u *updates) prepend(name string, data interface{}) {
+	*u = append(updates{{ChannelName: name, Data: data}}, *u...)
+}
+
+func (u *updates) openOrder(id string, order ws.OpenOrder) {
+	u.event(ws.ChanOpenOrders, ws.OpenOrdersUpdate{{id: order}})
+}
+
+func (u *updates) ownTrade(id string, trade ws.OwnTrade) {
+	u.event(ws.ChanOwnTrades, ws.OwnTradesUpdate{{id: trade}})
+}
+
+// HandleTrades - triggers stop orders and fills resting orders which are crossed by trades of the pair.
+// Resting order at the trade price is filled only after the volume which was ahead of it in the queue is traded.
+func (e *Engine) HandleTrades(pair string, trades []ws.Trade) {
+	e.mx.Lock()
+	var out updates
+	for i := range trades {
+		price, err := decimal.NewFromString(trades[i].Price.String())
+		if err != nil {
+			log.Errorf("paper: invalid trade price %s: %s", trades[i].Price, err)
+			continue
+		}
+		volume, err := decimal.NewFromString(trades[i].Volume.String())
+		if err != nil {
+			log.Errorf("paper: invalid trade volume %s: %s", trades[i].Volume, err)
+			continue
+		}
+		e.trade(pair, price, volume, trades[i].Side, &out)
+	}
+	e.flush(out)
+}
+
+// HandleBook - re-evaluates resting orders of the pair after order book update: queue ahead of order shrinks with the volume
+// of its price level and orders which are crossed by the opposite side are filled. Pass it to `ws.WithTopOfBookHandler`.
+func (e *Engine) HandleBook(pair string) {
+	e.mx.Lock()
+	var out updates
+	snapshot, ok := e.books.Snapshot(pair)
+	if ok && snapshot.Valid {
+		for _, order := range e.resting(pair) {
+			own, opposite := snapshot.Bids, snapshot.Asks
+			if !order.isBuy() {
+				own, opposite = snapshot.Asks, snapshot.Bids
+			}
+			order.QueueAhead = decimal.Min(order.QueueAhead, levelVolume(own, order.limitPrice()))
+
+			crossed := decimal.Zero
+			for _, level := range opposite {
+				if !crosses(order, level.Price) {
+					break
+				}
+				crossed = crossed.Add(level.Volume)
+			}
+			if crossed.IsPositive() {
+				e.fill(order, order.limitPrice(), decimal.Min(crossed, order.remaining()), true, &out)
+			}
+		}
+	}
+	e.flush(out)
+}
+
+// flush - releases lock of engine and sends updates. Updates of concurrent calls keep order of the calls.
+func (e *Engine) flush(out updates) {
+	e.updates.PublishUnlock(&e.mx, out...)
+}
+
+// resting - open orders of the pair which wait in the book
+func (e *Engine) resting(pair string) []*Order {
+	orders := make([]*Order, 0)
+	for _, order := range e.orders {
+		if order.Pair == pair && order.Status == StatusOpen && !order.isStop() && order.limitPrice().IsPositive() {
+			orders = append(orders, order)
+		}
+	}
+	return orders
+}
+
+// crosses - returns true if order is executed at price of the opposite side
+func crosses(order *Order, price decimal.Decimal) bool {
+	limit := order.limitPrice()
+	if !limit.IsPositive() {
+		return true
+	}
+	if order.isBuy() {
+		return !price.GreaterThan(limit)
+	}
+	return !price.LessThan(limit)
+}
+
+func levelVolume(levels []ws.PriceLevel, price decimal.Decimal) decimal.Decimal {
+	for _, level := range levels {
+		if level.Price.Equal(price) {
+			return level.Volume
+		}
+	}
+	return decimal.Zero
+}
+
+// place - checks order and executes it against the book. It's called under lock of engine.
+func (e *Engine) place(order *Order, out *updates) error {
+	snapshot, err := e.accept(order)
+	if err != nil {
+		return err
+	}
+	e.open(order, snapshot, out)
+	return nil
+}
+
+// accept - checks that order can be placed to the current book and returns the book
+func (e *Engine) accept(order *Order) (ws.OrderBookSnapshot, error) {
+	snapshot, ok := e.books.Snapshot(order.Pair)
+	ready := ok && snapshot.Valid
+	if !order.isStop() && !ready {
+		return snapshot, ErrBookNotReady
+	}
+	if order.PostOnly && len(snapshot.Asks) > 0 && len(snapshot.Bids) > 0 {
+		opposite := snapshot.Asks[0].Price
+		if !order.isBuy() {
+			opposite = snapshot.Bids[0].Price
+		}
+		if crosses(order, opposite) {
+			return snapshot, ErrPostOnly
+		}
+	}
+	return snapshot, nil
+}
+
+// open - registers accepted order and executes it against the book
+func (e *Engine) open(order *Order, snapshot ws.OrderBookSnapshot, out *updates) {
+	order.ID = e.nextID("O")
+	order.Status = StatusOpen
+	order.Opened = e.clock()
+	e.orders = append(e.orders, order)
+	out.openOrder(order.ID, e.openOrder(order))
+
+	if order.isStop() {
+		return
+	}
+	e.execute(order, snapshot, decimal.Zero, out)
+}
+
+// execute - takes liquidity of the book. Remaining volume of limit order rests in the book, the rest is cancelled.
+// If the book is empty, market orders are executed at `fallback` price when it's set.
+func (e *Engine) execute(order *Order, snapshot ws.OrderBookSnapshot, fallback decimal.Decimal, out *updates) {
+	levels := snapshot.Asks
+	own := snapshot.Bids
+	if !order.isBuy() {
+		levels, own = snapshot.Bids, snapshot.Asks
+	}
+
+	for _, level := range levels {
+		if !order.remaining().IsPositive() || !crosses(order, level.Price) {
+			break
+		}
+		e.fill(order, level.Price, decimal.Min(order.remaining(), level.Volume), false, out)
+	}
+	if len(levels) == 0 && fallback.IsPositive() && crosses(order, fallback) {
+		e.fill(order, fallback, order.remaining(), false, out)
+	}
+
+	if order.Status != StatusOpen {
+		return
+	}
+	if order.IOC || !order.limitPrice().IsPositive() {
+		status := StatusCanceled
+		if order.Executed.IsPositive() {
+			status = StatusClosed
+		}
+		e.close(order, status, out)
+		return
+	}
+	order.QueueAhead = levelVolume(own, order.limitPrice())
+}
+
+// trade - handles one public trade of the pair. It's called under lock of engine.
+func (e *Engine) trade(pair string, price, volume decimal.Decimal, side string, out *updates) {
+	// orders which are triggered by the trade don't take part in it
+	resting := e.resting(pair)
+	for _, order := range e.orders {
+		if order.Pair != pair || order.Status != StatusOpen || !order.isStop() || !triggered(order, price) {
+			continue
+		}
+		order.Triggered = true
+		snapshot, ok := e.books.Snapshot(pair)
+		if !ok || !snapshot.Valid {
+			snapshot = ws.OrderBookSnapshot{}
+		}
+		e.execute(order, snapshot, price, out)
+	}
+
+	left := volume
+	for _, order := range resting {
+		if !left.IsPositive() {
+			return
+		}
+		limit := order.limitPrice()
+		switch {
+		case order.isBuy() && price.LessThan(limit), !order.isBuy() && price.GreaterThan(limit):
+			// trade through the price of order: the whole level was executed
+			order.QueueAhead = decimal.Zero
+		case price.Equal(limit) && (order.isBuy() == (side == ws.Sell)):
+			ahead := decimal.Min(order.QueueAhead, left)
+			order.QueueAhead = order.QueueAhead.Sub(ahead)
+			left = left.Sub(ahead)
+		default:
+			continue
+		}
+		filled := decimal.Min(left, order.remaining())
+		if filled.IsPositive() {
+			e.fill(order, limit, filled, true, out)
+			left = left.Sub(filled)
+		}
+	}
+}
+
+// triggered - returns true if trade price reaches trigger price of stop order
+func triggered(order *Order, price decimal.Decimal) bool {
+	isStopLoss := order.Type == ws.OrderTypeStopLoss || order.Type == ws.OrderTypeStopLossLimit
+	if order.isBuy() == isStopLoss {
+		return !price.LessThan(order.Price)
+	}
+	return !price.GreaterThan(order.Price)
+}
+
+// fee - fee in percents of the tier which is selected by trade volume
+func (e *Engine) fee(pair rest.AssetPair, maker bool) decimal.Decimal {
+	tiers := pair.Fees
+	if maker && len(pair.FeesMaker) > 0 {
+		tiers = pair.FeesMaker
+	}
+
+	fee := decimal.Zero
+	for _, tier := range tiers {
+		if len(tier) < 2 {
+			continue
+		}
+		if decimal.NewFromFloat(tier[0]).GreaterThan(e.feeVolume) {
+			break
+		}
+		fee = decimal.NewFromFloat(tier[1])
+	}
+	return fee
+}
+
+// fill - executes part of order and emits trade and order update
+func (e *Engine) fill(order *Order, price, volume decimal.Decimal, maker bool, out *updates) {
+	pair := e.pairs[order.Pair]
+	cost := price.Mul(volume)
+	fee := cost.Mul(e.fee(pair, maker)).Div(decimalHundred)
+
+	order.Executed = order.Executed.Add(volume)
+	order.Cost = order.Cost.Add(cost)
+	order.Fee = order.Fee.Add(fee)
+	// volume of fee tiers is in USD, cost is added in quote currency as it is
+	e.feeVolume = e.feeVolume.Add(cost)
+
+	now := e.clock()
+	priceDecimals, lotDecimals := int32(pair.PairDecimals), int32(pair.LotDecimals)
+	out.ownTrade(e.nextID("T"), ws.OwnTrade{
+		Cost:      cost,
+		Fee:       fee,
+		Margin:    decimal.Zero,
+		OrderID:   order.ID,
+		OrderType: order.Type,
+		Pair:      order.Pair,
+		Price:     price.Round(priceDecimals),
+		Time:      ws.Timestamp{Time: now},
+		Type:      order.Side,
+		Vol:       volume.Round(lotDecimals),
+		UserRef:   order.UserRef,
+	})
+	out.openOrder(order.ID, ws.OpenOrder{
+		Cost:    order.Cost,
+		Fee:     order.Fee,
+		Price:   order.Cost.Div(order.Executed).Round(priceDecimals),
+		VolExec: order.Executed.Round(lotDecimals),
+		UserRef: order.UserRef,
+	})
+
+	if !order.remaining().IsPositive() {
+		e.close(order, StatusClosed, out)
+	}
+}
+
+// close - finishes order with status
+func (e *Engine) close(order *Order, status string, out *updates) {
+	order.Status = status
+	order.Closed = e.clock()
+	out.openOrder(order.ID, ws.OpenOrder{
+		Status:  ws.OrderStatus(status),
+		UserRef: order.UserRef,
+	})
+}
+
+// openOrder - full state of order as the first message of `openOrders` channel
+func (e *Engine) openOrder(order *Order) ws.OpenOrder {
+	pair := e.pairs[order.Pair]
+	priceDecimals, lotDecimals := int32(pair.PairDecimals), int32(pair.LotDecimals)
+	return ws.OpenOrder{
+		Cost: decimal.Zero,
+		Descr: ws.OpenOrderDescr{
+			Leverage:  "none",
+			Order:     description(order, pair),
+			Ordertype: order.Type,
+			Pair:      order.Pair,
+			Price:     order.Price.Round(priceDecimals),
+			Price2:    order.Price2.Round(priceDecimals),
+			Type:      order.Side,
+		},
+		Fee:        decimal.Zero,
+		LimitPrice: order.limitPrice().Round(priceDecimals),
+		Oflags:     ws.OrderFlags(order.Flags),
+		OpenTime:   ws.Timestamp{Time: order.Opened},
+		Price:      decimal.Zero,
+		Status:     ws.OrderStatus(order.Status),
+		StopPrice:  decimal.Zero,
+		UserRef:    order.UserRef,
+		Vol:        order.Volume.Round(lotDecimals),
+		VolExec:    decimal.Zero,
+	}
+}
@@ -0,0 +1,495 @@
+package paper
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aopoltorzhicky/go_kraken/rest"
+	ws "github.com/aopoltorzhicky/go_kraken/websocket"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+)
+
+// Errors of order validation
+var (
+	ErrUnknownPair   = errors.New("unknown pair")
+	ErrUnknownOrder  = errors.New("unknown order")
+	ErrBookNotReady  = errors.New("order book isn't ready")
+	ErrOrderMinimum  = errors.New("order minimum not met")
+	ErrPostOnly      = errors.New("post only order crosses the book")
+	ErrInvalidVolume = errors.New("invalid volume")
+	ErrInvalidPrice  = errors.New("invalid price")
+	ErrOrderType     = errors.New("unsupported order type")
+)
+
+// Order statuses
+const (
+	StatusOpen     = "open"
+	StatusClosed   = "closed"
+	StatusCanceled = "canceled"
+)
+
+var _ ws.OrderEntry = (*Engine)(nil)
+
+// BookProvider - source of live order books by websocket pair name. `websocket.BookManager` implements it.
+type BookProvider interface {
+	Snapshot(pair string) (ws.OrderBookSnapshot, bool)
+}
+
+// Option - option function for `Engine`
+type Option func(*Engine)
+
+// WithFeeVolume - add 30 days trade volume which selects fee tier of `AssetPair.Fees`. Cost of paper trades is added to it
+// in quote currency of their pairs without conversion, while tiers of exchange are in USD, so the tier is exact only if all
+// paper trades are quoted in USD. Default: 0.
+func WithFeeVolume(volume decimal.Decimal) Option {
+	return func(e *Engine) {
+		e.feeVolume = volume
+	}
+}
+
+// WithClock - add source of time of orders and trades. Default: `time.Now`.
+func WithClock(clock func() time.Time) Option {
+	return func(e *Engine) {
+		e.clock = clock
+	}
+}
+
+// WithBufferSize - add custom capacity of `Listen()` channel. Default: 1024.
+func WithBufferSize(size int) Option {
+	return func(e *Engine) {
+		e.bufferSize = size
+	}
+}
+
+// WithOverflowPolicy - add behaviour of `Listen()` channel when it's full as `websocket.WithOverflowPolicy` does.
+// With `OverflowBlock` methods of engine wait until the reader receives their updates, so don't call them from the goroutine
+// which reads `Listen()` if it may be full. Other policies drop updates and count them by `Dropped`. Default: OverflowBlock.
+func WithOverflowPolicy(policy ws.OverflowPolicy) Option {
+	return func(e *Engine) {
+		e.overflowPolicy = policy
+	}
+}
+
+// Order - paper order
+type Order struct {
+	ID string
+	// Pair - websocket name of the pair
+	Pair string
+	// Side - `ws.SideBuy` or `ws.SideSell`
+	Side string
+	// Type - `ws.OrderTypeMarket`, `ws.OrderTypeLimit`, `ws.OrderTypeStopLoss`, `ws.OrderTypeStopLossLimit`,
+	// `ws.OrderTypeTakeProfit` or `ws.OrderTypeTakeProfitLimit`
+	Type string
+	// Price - limit price or trigger price of stop orders
+	Price decimal.Decimal
+	// Price2 - limit price of stop limit orders
+	Price2   decimal.Decimal
+	Volume   decimal.Decimal
+	Executed decimal.Decimal
+	Cost     decimal.Decimal
+	Fee      decimal.Decimal
+	Status   string
+	UserRef  int64
+	Flags    string
+	// PostOnly and IOC - order flags `post` and time in force `IOC`
+	PostOnly bool
+	IOC      bool
+	// Triggered - stop order was triggered by trade price
+	Triggered bool
+	// QueueAhead - estimated volume of the book which is executed before the resting order
+	QueueAhead decimal.Decimal
+	Opened     time.Time
+	Closed     time.Time
+}
+
+func (o *Order) remaining() decimal.Decimal {
+	return o.Volume.Sub(o.Executed)
+}
+
+func (o *Order) isBuy() bool {
+	return o.Side == ws.SideBuy
+}
+
+// isStop - order waits for trigger price
+func (o *Order) isStop() bool {
+	return o.Type != ws.OrderTypeMarket && o.Type != ws.OrderTypeLimit && !o.Triggered
+}
+
+// limitPrice - price which bounds execution. Zero for market orders.
+func (o *Order) limitPrice() decimal.Decimal {
+	switch o.Type {
+	case ws.OrderTypeLimit:
+		return o.Price
+	case ws.OrderTypeStopLossLimit, ws.OrderTypeTakeProfitLimit:
+		return o.Price2
+	default:
+		return decimal.Zero
+	}
+}
+
+// Engine - paper trading engine. It accepts the same requests as websocket order entry and simulates fills against
+// live order books and trades instead of sending orders to the exchange. Paper orders don't change the books,
+// so they don't take liquidity from each other except trades which are shared between resting orders.
+type Engine struct {
+	books BookProvider
+	pairs map[string]rest.AssetPair
+
+	feeVolume      decimal.Decimal
+	clock          func() time.Time
+	bufferSize     int
+	overflowPolicy ws.OverflowPolicy
+
+	orders  []*Order
+	lastID  int64
+	updates *ws.Publisher
+
+	mx sync.Mutex
+}
+
+// New - creates paper trading engine. Pairs metadata is requested once from `assets`, e.g. `rest.Kraken`.
+func New(books BookProvider, assets ws.AssetPairsProvider, opts ...Option) (*Engine, error) {
+	metadata, err := assets.AssetPairs()
+	if err != nil {
+		return nil, errors.Wrap(err, "can't receive asset pairs")
+	}
+
+	e := &Engine{
+		books:          books,
+		pairs:          make(map[string]rest.AssetPair, len(metadata)),
+		clock:          time.Now,
+		bufferSize:     1024,
+		overflowPolicy: ws.OverflowBlock,
+	}
+	for _, pair := range metadata {
+		e.pairs[pair.WSName] = pair
+	}
+	for i := range opts {
+		opts[i](e)
+	}
+	e.updates = ws.NewPublisher(e.bufferSize, e.overflowPolicy)
+	return e, nil
+}
+
+// Listen - provides channel with `ownTrades` and `openOrders` updates and order statuses in the same shape as `websocket.Kraken` does
+func (e *Engine) Listen() <-chan ws.Update {
+	return e.updates.C()
+}
+
+// Dropped - returns count of updates which were dropped by overflow policy because `Listen()` channel wasn't read fast enough
+func (e *Engine) Dropped() uint64 {
+	return e.updates.Metrics().DroppedUpdates
+}
+
+// Orders - returns copy of all paper orders in placement order
+func (e *Engine) Orders() []Order {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	orders := make([]Order, len(e.orders))
+	for i := range e.orders {
+		orders[i] = *e.orders[i]
+	}
+	return orders
+}
+
+// AddOrder - places paper order. Invalid requests are rejected by `addOrderStatus` with error status as exchange does.
+func (e *Engine) AddOrder(req ws.AddOrderRequest) error {
+	e.mx.Lock()
+	var out updates
+	order, err := e.parseOrder(req)
+	if err != nil {
+		out.event(ws.EventAddOrder, addOrderError(req, err))
+		e.flush(out)
+		return nil
+	}
+	if req.Validate == "true" {
+		e.mx.Unlock()
+		return nil
+	}
+
+	if err := e.place(order, &out); err != nil {
+		out.event(ws.EventAddOrder, addOrderError(req, err))
+		e.flush(out)
+		return nil
+	}
+	out.prepend(ws.EventAddOrder, ws.AddOrderResponse{
+		ReqID:       req.ReqID,
+		Description: description(order, e.pairs[order.Pair]),
+		Event:       ws.EventAddOrderStatus,
+		Status:      ws.StatusOK,
+		TxID:        order.ID,
+	})
+	e.flush(out)
+	return nil
+}
+
+// EditOrder - replaces open order with a new one with changed price, volume or user reference. Queue position is lost as on exchange.
+// Invalid requests are rejected by `editOrderStatus` with error status.
+func (e *Engine) EditOrder(req ws.EditOrderRequest) error {
+	e.mx.Lock()
+	var out updates
+	original := e.find(req.OrderID)
+	if original == nil || original.Status != StatusOpen {
+		out.event(ws.EventEditOrder, editOrderError(req, errors.Wrap(ErrUnknownOrder, req.OrderID)))
+		e.flush(out)
+		return nil
+	}
+	order, err := edited(original, req)
+	if err != nil {
+		out.event(ws.EventEditOrder, editOrderError(req, err))
+		e.flush(out)
+		return nil
+	}
+	// rejected edit leaves the original order untouched, so the replacement is checked before it's closed
+	snapshot, err := e.accept(order)
+	if err != nil {
+		out.event(ws.EventEditOrder, editOrderError(req, err))
+		e.flush(out)
+		return nil
+	}
+	response := ws.EditOrderResponse{
+		Event:        ws.EventEditOrderStatus,
+		OriginalTxID: original.ID,
+		ReqID:        req.ReqID,
+		Status:       ws.StatusOK,
+		Description:  description(order, e.pairs[order.Pair]),
+	}
+	if req.Validate == "true" {
+		out.event(ws.EventEditOrder, response)
+		e.flush(out)
+		return nil
+	}
+
+	e.close(original, StatusCanceled, &out)
+	e.open(order, snapshot, &out)
+	response.TxID = order.ID
+	out.event(ws.EventEditOrder, response)
+	e.flush(out)
+	return nil
+}
+
+func addOrderError(req ws.AddOrderRequest, err error) ws.AddOrderResponse {
+	return ws.AddOrderResponse{
+		ReqID:        req.ReqID,
+		Event:        ws.EventAddOrderStatus,
+		Status:       ws.StatusError,
+		ErrorMessage: err.Error(),
+	}
+}
+
+func editOrderError(req ws.EditOrderRequest, err error) ws.EditOrderResponse {
+	return ws.EditOrderResponse{
+		Event:        ws.EventEditOrderStatus,
+		OriginalTxID: req.OrderID,
+		ReqID:        req.ReqID,
+		Status:       ws.StatusError,
+		ErrorMessage: err.Error(),
+	}
+}
+
+// edited - returns new order which replaces the original one. Volume of request is the total volume,
+// so executed part of the original order is subtracted from it.
+func edited(original *Order, req ws.EditOrderRequest) (*Order, error) {
+	order := &Order{
+		Pair:      original.Pair,
+		Side:      original.Side,
+		Type:      original.Type,
+		Price:     original.Price,
+		Price2:    original.Price2,
+		Volume:    original.Volume,
+		UserRef:   original.UserRef,
+		Flags:     original.Flags,
+		PostOnly:  original.PostOnly,
+		IOC:       original.IOC,
+		Triggered: original.Triggered,
+	}
+
+	var err error
+	if req.Price != "" {
+		if order.Price, err = parsePrice(req.Price); err != nil {
+			return nil, err
+		}
+	}
+	if req.Price2 != "" {
+		if order.Price2, err = parsePrice(req.Price2); err != nil {
+			return nil, err
+		}
+	}
+	if req.Volume != "" {
+		if order.Volume, err = decimal.NewFromString(req.Volume); err != nil {
+			return nil, errors.Wrap(ErrInvalidVolume, req.Volume)
+		}
+	}
+	if req.NewUserRef != "" {
+		if order.UserRef, err = strconv.ParseInt(req.NewUserRef, 10, 64); err != nil {
+			return nil, errors.Wrap(err, "invalid user reference")
+		}
+	}
+
+	order.Volume = order.Volume.Sub(original.Executed)
+	if !order.Volume.IsPositive() {
+		return nil, errors.Wrap(ErrInvalidVolume, req.Volume)
+	}
+	return order, nil
+}
+
+// CancelOrder - cancels open orders by identifiers. If any of orders isn't open, none of them is canceled
+// and request is rejected by `cancelOrderStatus` with error status.
+func (e *Engine) CancelOrder(orderIDs []string) error {
+	e.mx.Lock()
+	var out updates
+	orders := make([]*Order, 0, len(orderIDs))
+	for _, id := range orderIDs {
+		order := e.find(id)
+		if order == nil || order.Status != StatusOpen {
+			out.event(ws.EventCancelOrder, ws.CancelOrderResponse{
+				Event:        ws.EventCancelOrderStatus,
+				Status:       ws.StatusError,
+				ErrorMessage: errors.Wrap(ErrUnknownOrder, id).Error(),
+			})
+			e.flush(out)
+			return nil
+		}
+		orders = append(orders, order)
+	}
+	for _, order := range orders {
+		e.close(order, StatusCanceled, &out)
+	}
+	out.event(ws.EventCancelOrder, ws.CancelOrderResponse{
+		Event:  ws.EventCancelOrderStatus,
+		Status: ws.StatusOK,
+	})
+	e.flush(out)
+	return nil
+}
+
+// CancelAll - cancels all open orders
+func (e *Engine) CancelAll() error {
+	e.mx.Lock()
+	var out updates
+	count := 0
+	for _, order := range e.orders {
+		if order.Status == StatusOpen {
+			e.close(order, StatusCanceled, &out)
+			count++
+		}
+	}
+	out.event(ws.EventCancelAllStatus, ws.CancelAllResponse{
+		Count:  count,
+		Event:  ws.EventCancelAllStatus,
+		Status: ws.StatusOK,
+	})
+	e.flush(out)
+	return nil
+}
+
+// SubscribeTrades - subscribes engine to trades of pairs of websocket client. It returns function which unsubscribes.
+func (e *Engine) SubscribeTrades(k *ws.Kraken, pairs []string) (func() error, error) {
+	handle, err := k.SubscribeTradesHandle(pairs, ws.WithCallback(func(event ws.Event[[]ws.Trade]) {
+		e.HandleTrades(event.Pair, event.Data)
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return handle.Close, nil
+}
+
+func (e *Engine) parseOrder(req ws.AddOrderRequest) (*Order, error) {
+	pair, ok := e.pairs[req.Pair]
+	if !ok {
+		return nil, errors.Wrap(ErrUnknownPair, req.Pair)
+	}
+
+	order := &Order{
+		Pair:     req.Pair,
+		Side:     req.Type,
+		Type:     req.Ordertype,
+		Flags:    req.OFlags,
+		PostOnly: hasFlag(req.OFlags, "post"),
+		IOC:      strings.EqualFold(req.TimeInForce, "IOC"),
+	}
+	if order.Side != ws.SideBuy && order.Side != ws.SideSell {
+		return nil, errors.Errorf("invalid side: %s", req.Type)
+	}
+
+	volume, err := decimal.NewFromString(req.Volume)
+	if err != nil || !volume.IsPositive() {
+		return nil, errors.Wrap(ErrInvalidVolume, req.Volume)
+	}
+	if volume.LessThan(pair.OrderMin) {
+		return nil, errors.Wrap(ErrOrderMinimum, req.Volume)
+	}
+	order.Volume = volume
+
+	switch order.Type {
+	case ws.OrderTypeMarket:
+	case ws.OrderTypeLimit, ws.OrderTypeStopLoss, ws.OrderTypeTakeProfit:
+		if order.Price, err = parsePrice(req.Price); err != nil {
+			return nil, err
+		}
+	case ws.OrderTypeStopLossLimit, ws.OrderTypeTakeProfitLimit:
+		if order.Price, err = parsePrice(req.Price); err != nil {
+			return nil, err
+		}
+		if order.Price2, err = parsePrice(req.Price2); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.Wrap(ErrOrderType, req.Ordertype)
+	}
+	if order.PostOnly && order.Type != ws.OrderTypeLimit {
+		return nil, errors.Wrap(ErrOrderType, "post only order has to be limit")
+	}
+
+	if req.UserRef != "" {
+		if order.UserRef, err = strconv.ParseInt(req.UserRef, 10, 64); err != nil {
+			return nil, errors.Wrap(err, "invalid user reference")
+		}
+	}
+	return order, nil
+}
+
+func parsePrice(value string) (decimal.Decimal, error) {
+	price, err := decimal.NewFromString(value)
+	if err != nil || !price.IsPositive() {
+		return decimal.Zero, errors.Wrap(ErrInvalidPrice, value)
+	}
+	return price, nil
+}
+
+func hasFlag(flags, flag string) bool {
+	for _, value := range strings.Split(flags, ",") {
+		if value == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// nextID - returns identifier in Kraken format, e.g. `O00000-00000-000001`
+func (e *Engine) nextID(prefix string) string {
+	e.lastID++
+	return fmt.Sprintf("%s00000-00000-%06d", prefix, e.lastID)
+}
+
+func (e *Engine) find(id string) *Order {
+	for _, order := range e.orders {
+		if order.ID == id {
+			return order
+		}
+	}
+	return nil
+}
+
+// description - order description as Kraken sends it, e.g. `buy 1.00000000 XBTUSD @ limit 27500.0`
+func description(order *Order, pair rest.AssetPair) string {
+	text := fmt.Sprintf("%s %s %s @ %s", order.Side, order.Volume.StringFixed(int32(pair.LotDecimals)), pair.Altname, order.Type)
+	if order.Type != ws.OrderTypeMarket {
+		text += " " + order.Price.StringFixed(int32(pair.PairDecimals))
+	}
+	return text
+}
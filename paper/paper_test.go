@@ -0,0 +1,368 @@
+package paper
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aopoltorzhicky/go_kraken/krakentest"
+	ws "github.com/aopoltorzhicky/go_kraken/websocket"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var pairs = krakentest.AssetPairs{
+	"XXBTZUSD": {
+		Altname:      "XBTUSD",
+		WSName:       ws.BTCUSD,
+		PairDecimals: 1,
+		LotDecimals:  8,
+		Fees:         [][]float64{{0, 0.26}, {50000, 0.24}},
+		FeesMaker:    [][]float64{{0, 0.16}, {50000, 0.14}},
+		OrderMin:     decimal.RequireFromString("0.0001"),
+	},
+}
+
+func levels(values ...string) []ws.PriceLevel {
+	result := make([]ws.PriceLevel, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		result = append(result, ws.PriceLevel{
+			Price:  decimal.RequireFromString(values[i]),
+			Volume: decimal.RequireFromString(values[i+1]),
+		})
+	}
+	return result
+}
+
+func newEngine(t *testing.T, books krakentest.Books, opts ...Option) *Engine {
+	t.Helper()
+	if books == nil {
+		books = krakentest.Books{}
+	}
+	if _, ok := books[ws.BTCUSD]; !ok {
+		books[ws.BTCUSD] = ws.OrderBookSnapshot{
+			Pair:  ws.BTCUSD,
+			Asks:  levels("101", "1", "102", "2"),
+			Bids:  levels("100", "2", "99", "3"),
+			Valid: true,
+		}
+	}
+	opts = append([]Option{WithClock(func() time.Time { return time.Unix(1700000000, 0) })}, opts...)
+	engine, err := New(books, pairs, opts...)
+	require.NoError(t, err)
+	return engine
+}
+
+func drain(engine *Engine) []ws.Update {
+	return krakentest.Drain(engine.Listen())
+}
+
+func ownTrades(updates []ws.Update) []ws.OwnTrade {
+	result := make([]ws.OwnTrade, 0)
+	for _, update := range updates {
+		if data, ok := update.Data.(ws.OwnTradesUpdate); ok {
+			for _, trades := range data {
+				for _, trade := range trades {
+					result = append(result, trade)
+				}
+			}
+		}
+	}
+	return result
+}
+
+// rejection - returns error message of the only update which has to be rejected request status
+func rejection(t *testing.T, engine *Engine) string {
+	t.Helper()
+	updates := drain(engine)
+	require.Len(t, updates, 1)
+	switch data := updates[0].Data.(type) {
+	case ws.AddOrderResponse:
+		assert.Equal(t, ws.StatusError, data.Status)
+		return data.ErrorMessage
+	case ws.EditOrderResponse:
+		assert.Equal(t, ws.StatusError, data.Status)
+		return data.ErrorMessage
+	case ws.CancelOrderResponse:
+		assert.Equal(t, ws.StatusError, data.Status)
+		return data.ErrorMessage
+	default:
+		t.Fatalf("unexpected update: %v", updates[0])
+		return ""
+	}
+}
+
+func trade(price, volume, side string) ws.Trade {
+	return ws.Trade{Price: json.Number(price), Volume: json.Number(volume), Side: side, OrderType: ws.Limit}
+}
+
+func TestEngine_Market(t *testing.T) {
+	engine := newEngine(t, nil)
+
+	require.NoError(t, engine.AddOrder(ws.AddOrderRequest{
+		Pair: ws.BTCUSD, Type: ws.SideBuy, Ordertype: ws.OrderTypeMarket, Volume: "2", ReqID: 5,
+	}))
+
+	updates := drain(engine)
+	require.Len(t, updates, 7)
+	assert.Equal(t, ws.EventAddOrder, updates[0].ChannelName)
+	status := updates[0].Data.(ws.AddOrderResponse)
+	assert.Equal(t, int64(5), status.ReqID)
+	assert.Equal(t, "buy 2.00000000 XBTUSD @ market", status.Description)
+
+	assert.Equal(t, ws.ChanOpenOrders, updates[1].ChannelName)
+	open := updates[1].Data.(ws.OpenOrdersUpdate)[0][status.TxID]
+	assert.Equal(t, ws.OrderStatus(StatusOpen), open.Status)
+
+	trades := ownTrades(updates)
+	require.Len(t, trades, 2)
+	assert.Equal(t, "101", trades[0].Price.String())
+	assert.Equal(t, "1", trades[0].Vol.String())
+	assert.Equal(t, "102", trades[1].Price.String())
+	assert.Equal(t, "0.2652", trades[1].Fee.String())
+
+	closed := updates[6].Data.(ws.OpenOrdersUpdate)[0][status.TxID]
+	assert.Equal(t, ws.OrderStatus(StatusClosed), closed.Status)
+
+	orders := engine.Orders()
+	require.Len(t, orders, 1)
+	assert.Equal(t, "203", orders[0].Cost.String())
+	assert.Equal(t, "0.5278", orders[0].Fee.String())
+}
+
+func TestEngine_LimitQueue(t *testing.T) {
+	books := krakentest.Books{}
+	engine := newEngine(t, books)
+
+	require.NoError(t, engine.AddOrder(ws.AddOrderRequest{
+		Pair: ws.BTCUSD, Type: ws.SideBuy, Ordertype: ws.OrderTypeLimit, Price: "100", Volume: "1",
+	}))
+	order := engine.Orders()[0]
+	assert.Equal(t, StatusOpen, order.Status)
+	assert.Equal(t, "2", order.QueueAhead.String())
+	drain(engine)
+
+	// buy trades and trades above the price don't touch the order
+	engine.HandleTrades(ws.BTCUSD, []ws.Trade{trade("100", "5", ws.Buy), trade("100.5", "5", ws.Sell)})
+	assert.Empty(t, drain(engine))
+
+	// queue ahead is traded first
+	engine.HandleTrades(ws.BTCUSD, []ws.Trade{trade("100", "1.5", ws.Sell)})
+	assert.Empty(t, drain(engine))
+	assert.Equal(t, "0.5", engine.Orders()[0].QueueAhead.String())
+
+	// cancellations ahead shrink the queue
+	snapshot := books[ws.BTCUSD]
+	snapshot.Bids = levels("100", "0.2", "99", "3")
+	books[ws.BTCUSD] = snapshot
+	engine.HandleBook(ws.BTCUSD)
+	assert.Equal(t, "0.2", engine.Orders()[0].QueueAhead.String())
+
+	engine.HandleTrades(ws.BTCUSD, []ws.Trade{trade("100", "0.5", ws.Sell)})
+	trades := ownTrades(drain(engine))
+	require.Len(t, trades, 1)
+	assert.Equal(t, "0.3", trades[0].Vol.String())
+	assert.Equal(t, "0.048", trades[0].Fee.String(), "maker fee")
+
+	// trade through the price fills the rest
+	engine.HandleTrades(ws.BTCUSD, []ws.Trade{trade("99.5", "3", ws.Sell)})
+	trades = ownTrades(drain(engine))
+	require.Len(t, trades, 1)
+	assert.Equal(t, "0.7", trades[0].Vol.String())
+	assert.Equal(t, "100", trades[0].Price.String())
+	assert.Equal(t, StatusClosed, engine.Orders()[0].Status)
+}
+
+func TestEngine_Flags(t *testing.T) {
+	engine := newEngine(t, nil)
+
+	require.NoError(t, engine.AddOrder(ws.AddOrderRequest{
+		Pair: ws.BTCUSD, Type: ws.SideBuy, Ordertype: ws.OrderTypeLimit, Price: "101", Volume: "1", OFlags: "fciq,post", ReqID: 7,
+	}))
+	updates := drain(engine)
+	require.Len(t, updates, 1)
+	assert.Equal(t, ws.EventAddOrder, updates[0].ChannelName)
+	assert.Equal(t, ws.AddOrderResponse{
+		ReqID: 7, Event: ws.EventAddOrderStatus, Status: ws.StatusError, ErrorMessage: ErrPostOnly.Error(),
+	}, updates[0].Data)
+
+	require.NoError(t, engine.AddOrder(ws.AddOrderRequest{
+		Pair: ws.BTCUSD, Type: ws.SideBuy, Ordertype: ws.OrderTypeLimit, Price: "101", Volume: "3", TimeInForce: "IOC",
+	}))
+	order := engine.Orders()[0]
+	assert.Equal(t, StatusClosed, order.Status)
+	assert.Equal(t, "1", order.Executed.String())
+	drain(engine)
+
+	require.NoError(t, engine.AddOrder(ws.AddOrderRequest{Pair: ws.BTCUSD, Type: ws.SideBuy, Ordertype: ws.OrderTypeMarket, Volume: "0.00001"}))
+	assert.Contains(t, rejection(t, engine), ErrOrderMinimum.Error())
+	require.NoError(t, engine.AddOrder(ws.AddOrderRequest{Pair: ws.ETHUSD, Type: ws.SideBuy, Ordertype: ws.OrderTypeMarket, Volume: "1"}))
+	assert.Contains(t, rejection(t, engine), ErrUnknownPair.Error())
+
+	require.NoError(t, engine.AddOrder(ws.AddOrderRequest{
+		Pair: ws.BTCUSD, Type: ws.SideBuy, Ordertype: ws.OrderTypeMarket, Volume: "1", Validate: "true",
+	}))
+	assert.Len(t, engine.Orders(), 1)
+}
+
+func TestEngine_Stop(t *testing.T) {
+	engine := newEngine(t, nil)
+
+	require.NoError(t, engine.AddOrder(ws.AddOrderRequest{
+		Pair: ws.BTCUSD, Type: ws.SideSell, Ordertype: ws.OrderTypeStopLoss, Price: "99.5", Volume: "3",
+	}))
+	require.NoError(t, engine.AddOrder(ws.AddOrderRequest{
+		Pair: ws.BTCUSD, Type: ws.SideBuy, Ordertype: ws.OrderTypeTakeProfitLimit, Price: "99", Price2: "98", Volume: "1",
+	}))
+	drain(engine)
+
+	engine.HandleTrades(ws.BTCUSD, []ws.Trade{trade("100", "1", ws.Sell)})
+	assert.Empty(t, drain(engine))
+
+	engine.HandleTrades(ws.BTCUSD, []ws.Trade{trade("99.5", "1", ws.Sell)})
+	trades := ownTrades(drain(engine))
+	require.Len(t, trades, 2)
+	assert.Equal(t, "100", trades[0].Price.String())
+	assert.Equal(t, "99", trades[1].Price.String())
+
+	orders := engine.Orders()
+	assert.Equal(t, StatusClosed, orders[0].Status)
+	assert.Equal(t, StatusOpen, orders[1].Status)
+	assert.False(t, orders[1].Triggered)
+
+	// take profit triggers and rests at its limit price
+	engine.HandleTrades(ws.BTCUSD, []ws.Trade{trade("99", "1", ws.Sell)})
+	assert.Empty(t, ownTrades(drain(engine)))
+	orders = engine.Orders()
+	assert.True(t, orders[1].Triggered)
+	assert.Equal(t, StatusOpen, orders[1].Status)
+
+	engine.HandleTrades(ws.BTCUSD, []ws.Trade{trade("97", "1", ws.Sell)})
+	trades = ownTrades(drain(engine))
+	require.Len(t, trades, 1)
+	assert.Equal(t, "98", trades[0].Price.String())
+}
+
+func TestEngine_EditCancel(t *testing.T) {
+	engine := newEngine(t, nil, WithFeeVolume(decimal.NewFromInt(60000)))
+
+	for _, price := range []string{"98", "97"} {
+		require.NoError(t, engine.AddOrder(ws.AddOrderRequest{
+			Pair: ws.BTCUSD, Type: ws.SideBuy, Ordertype: ws.OrderTypeLimit, Price: price, Volume: "1", UserRef: "3",
+		}))
+	}
+	orders := engine.Orders()
+	drain(engine)
+
+	require.NoError(t, engine.EditOrder(ws.EditOrderRequest{OrderID: orders[0].ID, Pair: ws.BTCUSD, Price: "101", Volume: "0.5"}))
+	updates := drain(engine)
+	edit := updates[len(updates)-1]
+	assert.Equal(t, ws.EventEditOrder, edit.ChannelName)
+	response := edit.Data.(ws.EditOrderResponse)
+	assert.Equal(t, orders[0].ID, response.OriginalTxID)
+
+	trades := ownTrades(updates)
+	require.Len(t, trades, 1)
+	assert.Equal(t, "0.1212", trades[0].Fee.String(), "fee of the second tier")
+	assert.Equal(t, int64(3), trades[0].UserRef)
+
+	require.NoError(t, engine.EditOrder(ws.EditOrderRequest{OrderID: orders[0].ID, Pair: ws.BTCUSD, Price: "90"}))
+	assert.Contains(t, rejection(t, engine), ErrUnknownOrder.Error())
+	require.NoError(t, engine.EditOrder(ws.EditOrderRequest{OrderID: orders[1].ID, Pair: ws.BTCUSD, Price: "-1"}))
+	assert.Contains(t, rejection(t, engine), ErrInvalidPrice.Error())
+
+	// request with closed order doesn't cancel other orders
+	require.NoError(t, engine.CancelOrder([]string{orders[1].ID, orders[0].ID}))
+	assert.Contains(t, rejection(t, engine), ErrUnknownOrder.Error())
+	assert.Equal(t, StatusOpen, engine.Orders()[1].Status)
+	require.NoError(t, engine.CancelOrder([]string{orders[1].ID}))
+	assert.Equal(t, ws.EventCancelOrder, drain(engine)[1].ChannelName)
+
+	require.NoError(t, engine.AddOrder(ws.AddOrderRequest{
+		Pair: ws.BTCUSD, Type: ws.SideSell, Ordertype: ws.OrderTypeLimit, Price: "110", Volume: "1",
+	}))
+	drain(engine)
+	require.NoError(t, engine.CancelAll())
+	updates = drain(engine)
+	require.Len(t, updates, 2)
+	assert.Equal(t, 1, updates[1].Data.(ws.CancelAllResponse).Count)
+}
+
+func TestEngine_RejectedEdit(t *testing.T) {
+	engine := newEngine(t, nil)
+
+	require.NoError(t, engine.AddOrder(ws.AddOrderRequest{
+		Pair: ws.BTCUSD, Type: ws.SideBuy, Ordertype: ws.OrderTypeLimit, Price: "99", Volume: "1", OFlags: "post",
+	}))
+	original := engine.Orders()[0]
+	drain(engine)
+
+	// post only order at the best ask is rejected and the original order keeps resting
+	require.NoError(t, engine.EditOrder(ws.EditOrderRequest{OrderID: original.ID, Pair: ws.BTCUSD, Price: "101"}))
+	assert.Contains(t, rejection(t, engine), ErrPostOnly.Error())
+	orders := engine.Orders()
+	require.Len(t, orders, 1)
+	assert.Equal(t, StatusOpen, orders[0].Status)
+	assert.Equal(t, "99", orders[0].Price.String())
+
+	// validation of edit answers by status and doesn't change orders
+	require.NoError(t, engine.EditOrder(ws.EditOrderRequest{OrderID: original.ID, Pair: ws.BTCUSD, Price: "98", Validate: "true"}))
+	updates := drain(engine)
+	require.Len(t, updates, 1)
+	response := updates[0].Data.(ws.EditOrderResponse)
+	assert.Equal(t, ws.StatusOK, response.Status)
+	assert.Equal(t, original.ID, response.OriginalTxID)
+	assert.Empty(t, response.TxID)
+	assert.Len(t, engine.Orders(), 1)
+}
+
+func TestEngine_BlockingReader(t *testing.T) {
+	engine := newEngine(t, nil, WithBufferSize(1))
+
+	// updates aren't dropped by default: engine waits for the reader
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = engine.AddOrder(ws.AddOrderRequest{Pair: ws.BTCUSD, Type: ws.SideBuy, Ordertype: ws.OrderTypeMarket, Volume: "1"})
+	}()
+	select {
+	case <-done:
+		t.Fatal("engine isn't blocked by full channel")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	received := make([]ws.Update, 0)
+	for len(received) < 5 {
+		received = append(received, <-engine.Listen())
+	}
+	<-done
+	assert.Equal(t, ws.EventAddOrder, received[0].ChannelName)
+	assert.Len(t, ownTrades(received), 1)
+	assert.Zero(t, engine.Dropped())
+}
+
+func TestEngine_SlowReader(t *testing.T) {
+	engine := newEngine(t, nil, WithBufferSize(2), WithOverflowPolicy(ws.OverflowDropOldest))
+
+	// nobody reads updates: requests and trades aren't blocked by drop policy, the oldest updates are dropped
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			_ = engine.AddOrder(ws.AddOrderRequest{Pair: ws.BTCUSD, Type: ws.SideBuy, Ordertype: ws.OrderTypeLimit, Price: "100", Volume: "1"})
+		}
+		engine.HandleTrades(ws.BTCUSD, []ws.Trade{trade("99", "100", ws.Sell)})
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("engine is blocked by reader")
+	}
+
+	assert.Len(t, drain(engine), 2)
+	assert.Equal(t, uint64(48), engine.Dropped())
+	for _, order := range engine.Orders() {
+		assert.Equal(t, StatusClosed, order.Status)
+	}
+}
@@ -26,19 +26,34 @@ type clientInterface interface {
 type Kraken struct {
 	key    string
 	secret string
+	url    string
 	client clientInterface
 }
 
+// Option - option function for `Kraken`
+type Option func(*Kraken)
+
+// WithURL - add base URL of API, e.g. URL of fake server in tests. Default: `APIUrl`.
+func WithURL(url string) Option {
+	return func(api *Kraken) {
+		api.url = strings.TrimSuffix(url, "/")
+	}
+}
+
 // New - constructor of Kraken object
-func New(key string, secret string) *Kraken {
+func New(key string, secret string, opts ...Option) *Kraken {
 	if key == "" || secret == "" {
 		log.Print("[WARNING] You are not set api key and secret!")
 	}
-	return &Kraken{
+	api := &Kraken{
 		key:    key,
 		secret: secret,
 		client: http.DefaultClient,
 	}
+	for i := range opts {
+		opts[i](api)
+	}
+	return api
 }
 
 func (api *Kraken) getSign(requestURL string, data url.Values) (string, error) {
@@ -65,12 +80,16 @@ func (api *Kraken) prepareRequest(method string, isPrivate bool, data url.Values
 	if data == nil {
 		data = url.Values{}
 	}
+	baseURL := api.url
+	if baseURL == "" {
+		baseURL = APIUrl
+	}
 	requestURL := ""
 	if isPrivate {
-		requestURL = fmt.Sprintf("%s/%s/private/%s", APIUrl, APIVersion, method)
+		requestURL = fmt.Sprintf("%s/%s/private/%s", baseURL, APIVersion, method)
 		data.Set("nonce", fmt.Sprintf("%d", time.Now().UnixNano()))
 	} else {
-		requestURL = fmt.Sprintf("%s/%s/public/%s", APIUrl, APIVersion, method)
+		requestURL = fmt.Sprintf("%s/%s/public/%s", baseURL, APIVersion, method)
 	}
 	req, err := http.NewRequest("POST", requestURL, strings.NewReader(data.Encode()))
 	if err != nil {
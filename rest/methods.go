@@ -112,6 +112,22 @@ func (api *Kraken) GetTrades(pair string, since int64) (TradeResponse, error) {
 	return response, nil
 }
 
+// GetPairTrades - returns trades of any pair from `since` cursor. Cursor is a `Last` field of the previous response
+// or unix time in nanoseconds. Unlike `GetTrades` it isn't limited by pairs known to the library.
+func (api *Kraken) GetPairTrades(pair string, since int64) (PairTrades, error) {
+	data := url.Values{
+		"pair": {pair},
+	}
+	if since > 0 {
+		data.Add("since", strconv.FormatInt(since, 10))
+	}
+	response := PairTrades{}
+	if err := api.request("Trades", false, data, &response); err != nil {
+		return response, err
+	}
+	return response, nil
+}
+
 // GetSpread - return array of pair name and recent spread data
 func (api *Kraken) GetSpread(pair string, since int64) (SpreadResponse, error) {
 	data := url.Values{
@@ -671,6 +671,25 @@ func TestKraken_GetTrades(t *testing.T) {
 	}
 }
 
+func TestKraken_GetPairTrades(t *testing.T) {
+	body := []byte(`{"error":[],"result":{"XXBTZUSD":[["5541.20000","0.15850568",1534614057.321597,"s","l",""]], "last": "1534614057321597000"}}`)
+	api := &Kraken{
+		client: &httpMock{
+			Response: &http.Response{
+				StatusCode: 200,
+				Body:       io.NopCloser(bytes.NewReader(body)),
+			},
+		},
+	}
+	got, err := api.GetPairTrades("XBTUSD", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "XXBTZUSD", got.Pair)
+	assert.Equal(t, "1534614057321597000", got.Last)
+	assert.Len(t, got.Trades, 1)
+	assert.Equal(t, 5541.2, got.Trades[0].Price)
+	assert.Equal(t, "s", got.Trades[0].Side)
+}
+
 func TestKraken_GetSpread(t *testing.T) {
 	json := []byte(`{"error":[],"result":{"ADACAD":[[1554224145,"0.091118","0.109331"]], "last":1554224725 }}`)
 	type args struct {
@@ -230,16 +230,15 @@ func (api *Kraken) QueryTrades(trades bool, txIDs ...string) (map[string]Private
 	return response, nil
 }
 
-// GetOpenPositions - returns list of open positions
+// GetOpenPositions - returns list of open positions. All open positions are returned if `txIDs` is empty.
 func (api *Kraken) GetOpenPositions(docalcs bool, txIDs ...string) (map[string]Position, error) {
 	data := url.Values{}
 	if docalcs {
 		data.Set("docalcs", "true")
 	}
-	if len(txIDs) == 0 {
-		return nil, errors.New("txIDs is required")
+	if len(txIDs) > 0 {
+		data.Set("txid", strings.Join(txIDs, ","))
 	}
-	data.Set("txid", strings.Join(txIDs, ","))
 
 	response := make(map[string]Position)
 	if err := api.request("OpenPositions", true, data, &response); err != nil {
@@ -277,12 +277,50 @@ func (item *OrderBookItem) UnmarshalJSON(buf []byte) error {
 	return nil
 }
 
+// Level - converts item to price level. Float values are converted to the shortest decimal which is parsed to the same float,
+// so prices and volumes received from Kraken are restored exactly.
+func (item OrderBookItem) Level() PriceLevel {
+	return PriceLevel{
+		Price:  decimal.NewFromFloat(item.Price),
+		Volume: decimal.NewFromFloat(item.Volume),
+	}
+}
+
 // OrderBook - struct of order book levels
 type OrderBook struct {
 	Asks []OrderBookItem `json:"asks"`
 	Bids []OrderBookItem `json:"bids"`
 }
 
+// AskLevels - returns asks as price levels from the best price
+func (book OrderBook) AskLevels() []PriceLevel {
+	return orderBookLevels(book.Asks)
+}
+
+// BidLevels - returns bids as price levels from the best price
+func (book OrderBook) BidLevels() []PriceLevel {
+	return orderBookLevels(book.Bids)
+}
+
+func orderBookLevels(items []OrderBookItem) []PriceLevel {
+	levels := make([]PriceLevel, len(items))
+	for i := range items {
+		levels[i] = items[i].Level()
+	}
+	return levels
+}
+
+// PriceLevel - aggregated price level of order book. It's shared by REST and websocket order books.
+type PriceLevel struct {
+	Price  decimal.Decimal `json:"price"`
+	Volume decimal.Decimal `json:"volume"`
+}
+
+// Equal - returns true if prices and volumes of levels are equal
+func (l PriceLevel) Equal(other PriceLevel) bool {
+	return l.Price.Equal(other.Price) && l.Volume.Equal(other.Volume)
+}
+
 // Trade - structure of public trades
 type Trade struct {
 	Price     float64
@@ -417,6 +455,40 @@ type TradeResponse struct {
 	XZECZUSD []Trade
 }
 
+// PairTrades - trades of one pair
+type PairTrades struct {
+	// Pair - name of the pair in the response
+	Pair   string
+	Trades []Trade
+	// Last - cursor for the next request
+	Last string
+}
+
+// UnmarshalJSON -
+func (item *PairTrades) UnmarshalJSON(buf []byte) error {
+	res := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(buf, &res); err != nil {
+		return err
+	}
+
+	if last, ok := res["last"]; ok {
+		var cursor json.Number
+		if err := json.Unmarshal(last, &cursor); err != nil {
+			return err
+		}
+		item.Last = cursor.String()
+		delete(res, "last")
+	}
+
+	for pair, data := range res {
+		item.Pair = pair
+		if err := json.Unmarshal(data, &item.Trades); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Spread - structure of spread data
 type Spread struct {
 	Time float64
@@ -566,6 +638,7 @@ type ClosedOrdersResponse struct {
 type OrderInfo struct {
 	RefID           *string          `json:"refid"`
 	UserRef         interface{}      `json:"userref"`
+	ClOrdID         string           `json:"cl_ord_id,omitempty"`
 	Status          string           `json:"status"`
 	Reason          string           `json:"reason,omitempty"`
 	OpenTimestamp   float64          `json:"opentm"`
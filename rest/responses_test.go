@@ -1,6 +1,7 @@
 package rest
 
 import (
+	"encoding/json"
 	"reflect"
 	"testing"
 
@@ -370,6 +371,22 @@ func TestOrderBookItem_UnmarshalJSON(t *testing.T) {
 	}
 }
 
+func TestOrderBook_Levels(t *testing.T) {
+	var book OrderBook
+	err := json.Unmarshal([]byte(`{"asks":[["5541.30000","2.50700000",1534614248]],"bids":[["5541.20000","0.00012345",1534614248]]}`), &book)
+	assert.NoError(t, err)
+
+	asks := book.AskLevels()
+	assert.Len(t, asks, 1)
+	assert.Equal(t, "5541.3", asks[0].Price.String())
+	assert.Equal(t, "2.507", asks[0].Volume.String())
+
+	bids := book.BidLevels()
+	assert.Len(t, bids, 1)
+	assert.Equal(t, "0.00012345", bids[0].Volume.String())
+	assert.True(t, bids[0].Equal(PriceLevel{Price: decimal.RequireFromString("5541.2"), Volume: decimal.RequireFromString("0.00012345")}))
+}
+
 func TestTrade_UnmarshalJSON(t *testing.T) {
 	type fields struct {
 		Price     float64
@@ -0,0 +1,501 @@
+package risk
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aopoltorzhicky/go_kraken/rest"
+	ws "github.com/aopoltorzhicky/go_kraken/websocket"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+	log "github.com/sirupsen/logrus"
+)
+
+var decimalHundred = decimal.NewFromInt(100)
+
+// Provider - REST methods which are polled by monitor, e.g. `rest.Kraken`
+type Provider interface {
+	GetTradeBalance(baseAsset string) (rest.TradeBalanceResponse, error)
+	GetOpenPositions(docalcs bool, txIDs ...string) (map[string]rest.Position, error)
+}
+
+// Level - risk level of account by its margin level
+type Level string
+
+// Levels
+const (
+	// LevelNormal - margin level is above warning threshold or there are no positions
+	LevelNormal Level = "normal"
+	// LevelWarning - margin level is close to margin call
+	LevelWarning Level = "warning"
+	// LevelMarginCall - margin level reached `AssetPair.MarginCall`
+	LevelMarginCall Level = "margin_call"
+	// LevelMarginStop - margin level reached `AssetPair.MarginStop` and positions are liquidated by exchange
+	LevelMarginStop Level = "margin_stop"
+)
+
+// severity - order of levels
+func (l Level) severity() int {
+	switch l {
+	case LevelWarning:
+		return 1
+	case LevelMarginCall:
+		return 2
+	case LevelMarginStop:
+		return 3
+	default:
+		return 0
+	}
+}
+
+// ReduceMode - way to reduce positions automatically
+type ReduceMode string
+
+// Reduce modes
+const (
+	// ReduceSettle - positions are closed by `settle-position` orders
+	ReduceSettle ReduceMode = "settle"
+	// ReduceOnly - positions are closed by market orders with `reduce_only` flag
+	ReduceOnly ReduceMode = "reduce_only"
+)
+
+// Option - option function for `Monitor`
+type Option func(*Monitor)
+
+// WithAsset - asset of trade balance. Profit of positions is recomputed by tickers only if it's quote currency of pair. Default: `ZUSD`.
+func WithAsset(asset string) Option {
+	return func(m *Monitor) {
+		m.asset = asset
+	}
+}
+
+// WithPollInterval - interval of REST polling after `Start`. Zero disables it. Default: 30 seconds.
+func WithPollInterval(interval time.Duration) Option {
+	return func(m *Monitor) {
+		m.interval = interval
+	}
+}
+
+// WithWarningBuffer - margin level in percents above margin call which raises warning. Default: 50.
+func WithWarningBuffer(buffer decimal.Decimal) Option {
+	return func(m *Monitor) {
+		m.warningBuffer = buffer
+	}
+}
+
+// WithAutoReduce - reduces positions when account reaches `level`. `fraction` is a part of open volume of each position
+// which is closed, e.g. 0.5. Orders are sent to `entry` once per crossing of level.
+func WithAutoReduce(entry ws.OrderEntry, level Level, mode ReduceMode, fraction decimal.Decimal) Option {
+	return func(m *Monitor) {
+		m.entry = entry
+		m.reduceLevel = level
+		m.reduceMode = mode
+		m.reduceFraction = fraction
+	}
+}
+
+// WithBufferSize - size of alerts channel. If alerts aren't read fast enough, the oldest ones are dropped. Default: 1024.
+func WithBufferSize(size int) Option {
+	return func(m *Monitor) {
+		m.bufferSize = size
+	}
+}
+
+// WithClock - source of time of alerts. Default: `time.Now`.
+func WithClock(clock func() time.Time) Option {
+	return func(m *Monitor) {
+		m.clock = clock
+	}
+}
+
+// Position - margin position with profit by the last price
+type Position struct {
+	TxID   string
+	Pair   string
+	Side   string
+	Volume decimal.Decimal
+	// EntryPrice - average price of position
+	EntryPrice decimal.Decimal
+	// Price - the last price of ticker which closes position. It's zero if ticker wasn't received.
+	Price  decimal.Decimal
+	Margin decimal.Decimal
+	Profit decimal.Decimal
+}
+
+// Status - margin state of account
+type Status struct {
+	Equity        decimal.Decimal
+	UsedMargin    decimal.Decimal
+	FreeMargin    decimal.Decimal
+	UnrealizedPnL decimal.Decimal
+	// MarginLevel - equity to used margin in percents. It's zero if there is no used margin.
+	MarginLevel decimal.Decimal
+	// MarginCall and MarginStop - thresholds of margin level in percents for pairs of positions
+	MarginCall decimal.Decimal
+	MarginStop decimal.Decimal
+	Level      Level
+	Positions  []Position
+	Time       time.Time
+}
+
+// Alert - change of risk level
+type Alert struct {
+	Status   Status
+	Previous Level
+}
+
+// position - open position of the last poll
+type position struct {
+	info   rest.Position
+	pair   rest.AssetPair
+	polled decimal.Decimal
+}
+
+// Monitor - watches margin level of account. Trade balance and positions are polled from REST and profit of positions
+// is recomputed between polls by tickers. Alerts are sent when risk level is changed.
+type Monitor struct {
+	provider Provider
+	pairs    map[string]rest.AssetPair
+	byWSName map[string]string
+
+	balance   rest.TradeBalanceResponse
+	positions map[string]position
+	prices    map[string]ws.TickerUpdate
+	level     Level
+
+	asset          string
+	interval       time.Duration
+	warningBuffer  decimal.Decimal
+	entry          ws.OrderEntry
+	reduceLevel    Level
+	reduceMode     ReduceMode
+	reduceFraction decimal.Decimal
+	clock          func() time.Time
+	bufferSize     int
+	alerts         *ws.Feed[Alert]
+
+	// changes - count of level changes, published - the last change which was sent to `Alerts()`
+	changes   uint64
+	published uint64
+
+	unsubscribe []func() error
+	stop        chan struct{}
+	closeOnce   sync.Once
+	wg          sync.WaitGroup
+
+	mx      sync.Mutex
+	alertMx sync.Mutex
+}
+
+// New - creates risk monitor. Pairs metadata is requested once from `assets`, e.g. `rest.Kraken`.
+func New(provider Provider, assets ws.AssetPairsProvider, opts ...Option) (*Monitor, error) {
+	metadata, err := assets.AssetPairs()
+	if err != nil {
+		return nil, errors.Wrap(err, "can't receive asset pairs")
+	}
+
+	m := &Monitor{
+		provider:       provider,
+		pairs:          metadata,
+		byWSName:       make(map[string]string, len(metadata)),
+		positions:      make(map[string]position),
+		prices:         make(map[string]ws.TickerUpdate),
+		level:          LevelNormal,
+		asset:          "ZUSD",
+		interval:       30 * time.Second,
+		warningBuffer:  decimal.NewFromInt(50),
+		reduceFraction: decimal.NewFromInt(1),
+		clock:          time.Now,
+		bufferSize:     1024,
+		stop:           make(chan struct{}),
+	}
+	for name, pair := range metadata {
+		m.byWSName[pair.WSName] = name
+	}
+	for i := range opts {
+		opts[i](m)
+	}
+	m.alerts = ws.NewFeed[Alert](m.bufferSize)
+	return m, nil
+}
+
+// Alerts - provides channel with changes of risk level. It's closed by `Close`.
+func (m *Monitor) Alerts() <-chan Alert {
+	return m.alerts.C()
+}
+
+// Dropped - returns count of alerts which were dropped because `Alerts()` channel wasn't read fast enough
+func (m *Monitor) Dropped() uint64 {
+	return m.alerts.Dropped()
+}
+
+// Subscribe - subscribes monitor to tickers of `pairs` by its own handle, so it doesn't read `Listen()` of the client.
+// Pairs are websocket names, e.g. `XBT/USD`.
+func (m *Monitor) Subscribe(k *ws.Kraken, pairs []string) error {
+	tickers, err := k.SubscribeTickerHandle(pairs, ws.WithCallback(func(event ws.Event[ws.TickerUpdate]) {
+		m.Handle(event.Update())
+	}))
+	if err != nil {
+		return err
+	}
+
+	m.mx.Lock()
+	m.unsubscribe = append(m.unsubscribe, tickers.Close)
+	m.mx.Unlock()
+	return nil
+}
+
+// Start - starts periodic polling. Tickers are received by `Subscribe` or given to `Handle` by caller.
+func (m *Monitor) Start() {
+	if m.interval > 0 {
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+
+			ticker := time.NewTicker(m.interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-m.stop:
+					return
+				case <-ticker.C:
+					if err := m.Poll(); err != nil {
+						log.Errorf("risk: %s", err)
+					}
+				}
+			}
+		}()
+	}
+}
+
+// Close - stops polling, unsubscribes handle of `Subscribe` and closes `Alerts()` channel
+func (m *Monitor) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		close(m.stop)
+		m.wg.Wait()
+
+		m.mx.Lock()
+		unsubscribe := m.unsubscribe
+		m.unsubscribe = nil
+		m.mx.Unlock()
+
+		for i := range unsubscribe {
+			if e := unsubscribe[i](); e != nil && err == nil {
+				err = e
+			}
+		}
+		m.alerts.Close()
+	})
+	return err
+}
+
+// Poll - receives trade balance and positions with computed profit from REST and checks risk level
+func (m *Monitor) Poll() error {
+	balance, err := m.provider.GetTradeBalance(m.asset)
+	if err != nil {
+		return errors.Wrap(err, "can't receive trade balance")
+	}
+	positions, err := m.provider.GetOpenPositions(true)
+	if err != nil {
+		return errors.Wrap(err, "can't receive open positions")
+	}
+
+	m.mx.Lock()
+	m.balance = balance
+	m.positions = make(map[string]position, len(positions))
+	for txID, info := range positions {
+		pair, ok := m.pairs[info.Pair]
+		if !ok {
+			log.Warnf("risk: unknown pair %s of position %s", info.Pair, txID)
+		}
+		m.positions[txID] = position{info: info, pair: pair, polled: decimal.NewFromFloat(info.Profit)}
+	}
+	m.check()
+	return nil
+}
+
+// Handle - applies ticker update. Other updates are ignored.
+func (m *Monitor) Handle(update ws.Update) {
+	ticker, ok := update.Data.(ws.TickerUpdate)
+	if !ok {
+		return
+	}
+	name, ok := m.byWSName[update.Pair]
+	if !ok {
+		return
+	}
+
+	m.mx.Lock()
+	m.prices[name] = ticker
+	m.check()
+}
+
+// Status - returns margin state by the last poll and tickers
+func (m *Monitor) Status() Status {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	return m.status()
+}
+
+// status - recomputes equity by profit of positions at prices of tickers
+func (m *Monitor) status() Status {
+	status := Status{
+		Equity:     decimal.NewFromFloat(m.balance.Equity),
+		UsedMargin: decimal.NewFromFloat(m.balance.OpenMargin),
+		Level:      LevelNormal,
+		Positions:  make([]Position, 0, len(m.positions)),
+		Time:       m.clock(),
+	}
+
+	var profit decimal.Decimal
+	for txID, p := range m.positions {
+		item := m.position(txID, p)
+		status.Equity = status.Equity.Add(item.Profit).Sub(p.polled)
+		profit = profit.Add(item.Profit)
+		status.Positions = append(status.Positions, item)
+
+		if call := decimal.NewFromInt(int64(p.pair.MarginCall)); call.GreaterThan(status.MarginCall) {
+			status.MarginCall = call
+		}
+		if stop := decimal.NewFromInt(int64(p.pair.MarginStop)); stop.GreaterThan(status.MarginStop) {
+			status.MarginStop = stop
+		}
+	}
+	status.UnrealizedPnL = profit
+	status.FreeMargin = status.Equity.Sub(status.UsedMargin)
+
+	if !status.UsedMargin.IsPositive() {
+		return status
+	}
+	status.MarginLevel = status.Equity.Div(status.UsedMargin).Mul(decimalHundred)
+	switch {
+	case status.MarginStop.IsPositive() && status.MarginLevel.LessThanOrEqual(status.MarginStop):
+		status.Level = LevelMarginStop
+	case status.MarginCall.IsPositive() && status.MarginLevel.LessThanOrEqual(status.MarginCall):
+		status.Level = LevelMarginCall
+	case status.MarginCall.IsPositive() && status.MarginLevel.LessThanOrEqual(status.MarginCall.Add(m.warningBuffer)):
+		status.Level = LevelWarning
+	}
+	return status
+}
+
+// position - profit of position at price of ticker. Long position is closed by bid and short one by ask.
+// Profit of REST is kept if ticker wasn't received or profit is in other currency than trade balance.
+func (m *Monitor) position(txID string, p position) Position {
+	volume := decimal.NewFromFloat(p.info.Volume)
+	cost := decimal.NewFromFloat(p.info.Cost)
+	result := Position{
+		TxID:   txID,
+		Pair:   p.pair.WSName,
+		Side:   p.info.Side,
+		Volume: volume.Sub(decimal.NewFromFloat(p.info.VolumeClosed)),
+		Margin: decimal.NewFromFloat(p.info.Margin),
+		Profit: p.polled,
+	}
+	if result.Pair == "" {
+		result.Pair = p.info.Pair
+	}
+	if volume.IsPositive() {
+		result.EntryPrice = cost.Div(volume)
+	}
+
+	ticker, ok := m.prices[p.info.Pair]
+	if !ok || p.pair.Quote != m.asset {
+		return result
+	}
+	price := ticker.Bid.Price
+	if p.info.Side == ws.SideSell {
+		price = ticker.Ask.Price
+	}
+	value, err := decimal.NewFromString(price.String())
+	if err != nil || !value.IsPositive() {
+		return result
+	}
+
+	result.Price = value
+	result.Profit = value.Sub(result.EntryPrice).Mul(result.Volume)
+	if p.info.Side == ws.SideSell {
+		result.Profit = result.Profit.Neg()
+	}
+	return result
+}
+
+// check - reduces positions and sends alert if risk level is changed. It releases lock of monitor.
+// Orders are sent before alert, so a slow reader of alerts can't delay them.
+func (m *Monitor) check() {
+	status := m.status()
+	previous := m.level
+	m.level = status.Level
+
+	var orders []ws.AddOrderRequest
+	if m.entry != nil && m.reduceLevel != "" &&
+		status.Level.severity() >= m.reduceLevel.severity() && previous.severity() < m.reduceLevel.severity() {
+		orders = m.reduce(status)
+	}
+	if previous != status.Level {
+		m.changes++
+	}
+	change := m.changes
+	m.mx.Unlock()
+
+	for i := range orders {
+		if err := m.entry.AddOrder(orders[i]); err != nil {
+			log.Errorf("risk: can't reduce position: %s", err)
+		}
+	}
+	if previous != status.Level {
+		m.publish(change, Alert{Status: status, Previous: previous})
+	}
+}
+
+// publish - sends alert of level change unless alert of a later change was already sent by concurrent check
+func (m *Monitor) publish(change uint64, alert Alert) {
+	m.alertMx.Lock()
+	defer m.alertMx.Unlock()
+
+	if change <= m.published {
+		return
+	}
+	m.published = change
+	m.alerts.Publish(alert)
+}
+
+// reduce - orders which close part of positions
+func (m *Monitor) reduce(status Status) []ws.AddOrderRequest {
+	orders := make([]ws.AddOrderRequest, 0, len(status.Positions))
+	for _, item := range status.Positions {
+		p := m.positions[item.TxID]
+		volume := item.Volume.Mul(m.reduceFraction).Round(int32(p.pair.LotDecimals))
+		if !volume.IsPositive() {
+			continue
+		}
+
+		side := ws.SideSell
+		if item.Side == ws.SideSell {
+			side = ws.SideBuy
+		}
+		req := ws.AddOrderRequest{
+			Ordertype: ws.OrderTypeSettlePosition,
+			Pair:      item.Pair,
+			Type:      side,
+			Volume:    volume.String(),
+			Leverage:  leverage(p.info),
+		}
+		if m.reduceMode == ReduceOnly {
+			req.Ordertype = ws.OrderTypeMarket
+			req.ReduceOnly = true
+		}
+		orders = append(orders, req)
+	}
+	return orders
+}
+
+// leverage - leverage of position by its cost and margin, e.g. `5:1`
+func leverage(info rest.Position) string {
+	if info.Margin <= 0 {
+		return "none"
+	}
+	return fmt.Sprintf("%d:1", decimal.NewFromFloat(info.Cost).Div(decimal.NewFromFloat(info.Margin)).Round(0).IntPart())
+}
@@ -0,0 +1,188 @@
+package risk
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aopoltorzhicky/go_kraken/krakentest"
+	"github.com/aopoltorzhicky/go_kraken/rest"
+	ws "github.com/aopoltorzhicky/go_kraken/websocket"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var pairs = krakentest.AssetPairs{
+	"XXBTZUSD": {Altname: "XBTUSD", WSName: ws.BTCUSD, Base: "XXBT", Quote: "ZUSD", LotDecimals: 8, MarginCall: 80, MarginStop: 40},
+	"XETHZEUR": {Altname: "ETHEUR", WSName: "ETH/EUR", Base: "XETH", Quote: "ZEUR", LotDecimals: 8, MarginCall: 80, MarginStop: 40},
+}
+
+func newProvider() *krakentest.Account {
+	return &krakentest.Account{
+		TradeBalance: rest.TradeBalanceResponse{Equity: 1000, OpenMargin: 500},
+		Positions: map[string]rest.Position{
+			"P1": {OrderID: "O1", Pair: "XXBTZUSD", Side: ws.SideBuy, Volume: 1, Cost: 1000, Margin: 500},
+		},
+	}
+}
+
+func ticker(pair, bid, ask string) ws.Update {
+	return ws.Update{ChannelName: ws.ChanTicker, Pair: pair, Data: ws.TickerUpdate{
+		Bid: ws.Level{Price: json.Number(bid)},
+		Ask: ws.Level{Price: json.Number(ask)},
+	}}
+}
+
+func drain(m *Monitor) []Alert {
+	return krakentest.Drain(m.Alerts())
+}
+
+func levels(alerts []Alert) []Level {
+	result := make([]Level, len(alerts))
+	for i := range alerts {
+		result[i] = alerts[i].Status.Level
+	}
+	return result
+}
+
+func TestMonitor(t *testing.T) {
+	entry := krakentest.NewOrderEntry()
+	m, err := New(newProvider(), pairs, WithAutoReduce(entry, LevelMarginCall, ReduceOnly, decimal.RequireFromString("0.5")))
+	require.NoError(t, err)
+
+	require.NoError(t, m.Poll())
+	status := m.Status()
+	assert.Equal(t, LevelNormal, status.Level)
+	assert.Equal(t, "200", status.MarginLevel.String())
+	assert.Equal(t, "80", status.MarginCall.String())
+	assert.Equal(t, "40", status.MarginStop.String())
+
+	// long position is valued by bid
+	for _, bid := range []string{"650", "400", "100", "1100", "400"} {
+		m.Handle(ticker(ws.BTCUSD, bid, "2000"))
+	}
+	m.Handle(ticker("ETH/EUR", "1", "1"))
+
+	alerts := drain(m)
+	assert.Equal(t, []Level{LevelWarning, LevelMarginCall, LevelMarginStop, LevelNormal, LevelMarginCall}, levels(alerts))
+	assert.Equal(t, LevelMarginCall, alerts[2].Previous)
+	assert.Equal(t, "-600", alerts[1].Status.UnrealizedPnL.String())
+	assert.Equal(t, "80", alerts[1].Status.MarginLevel.String())
+	assert.Equal(t, "400", alerts[1].Status.Positions[0].Price.String())
+
+	// positions are reduced once per crossing of level
+	added := entry.Added()
+	require.Len(t, added, 2)
+	assert.Equal(t, ws.AddOrderRequest{
+		Ordertype: ws.OrderTypeMarket, Pair: ws.BTCUSD, Type: ws.SideSell, Volume: "0.5", Leverage: "2:1", ReduceOnly: true,
+	}, added[0])
+}
+
+func TestMonitor_Short(t *testing.T) {
+	provider := newProvider()
+	provider.Positions["P1"] = rest.Position{Pair: "XXBTZUSD", Side: ws.SideSell, Volume: 2, VolumeClosed: 1, Cost: 2000, Margin: 400, Profit: 10}
+	entry := krakentest.NewOrderEntry()
+	m, err := New(provider, pairs, WithAutoReduce(entry, LevelWarning, ReduceSettle, decimal.NewFromInt(1)), WithWarningBuffer(decimal.NewFromInt(10)))
+	require.NoError(t, err)
+	require.NoError(t, m.Poll())
+
+	m.Handle(ticker(ws.BTCUSD, "100", "1500"))
+	status := m.Status()
+	assert.Equal(t, "-500", status.Positions[0].Profit.String(), "short position is valued by ask")
+	assert.Equal(t, "490", status.Equity.String())
+	assert.Equal(t, "-10", status.FreeMargin.String())
+	assert.Equal(t, LevelNormal, status.Level)
+
+	m.Handle(ticker(ws.BTCUSD, "100", "1565"))
+	assert.Equal(t, []Level{LevelWarning}, levels(drain(m)))
+	added := entry.Added()
+	require.Len(t, added, 1)
+	assert.Equal(t, ws.AddOrderRequest{
+		Ordertype: ws.OrderTypeSettlePosition, Pair: ws.BTCUSD, Type: ws.SideBuy, Volume: "1", Leverage: "5:1",
+	}, added[0])
+}
+
+func TestMonitor_Poll(t *testing.T) {
+	provider := newProvider()
+	provider.Positions["P2"] = rest.Position{Pair: "XETHZEUR", Side: ws.SideBuy, Volume: 1, Cost: 100, Margin: 50, Profit: -5}
+	m, err := New(provider, pairs, WithClock(func() time.Time { return time.Unix(1700000000, 0) }))
+	require.NoError(t, err)
+	require.NoError(t, m.Poll())
+
+	// profit in other currency than trade balance is taken from REST
+	m.Handle(ticker("ETH/EUR", "200", "201"))
+	status := m.Status()
+	assert.Equal(t, "1000", status.Equity.String())
+	assert.Equal(t, "-5", status.UnrealizedPnL.String())
+	assert.Equal(t, time.Unix(1700000000, 0), status.Time)
+
+	provider.TradeBalance = rest.TradeBalanceResponse{}
+	provider.Positions = nil
+	require.NoError(t, m.Poll())
+	status = m.Status()
+	assert.Equal(t, LevelNormal, status.Level)
+	assert.True(t, status.MarginLevel.IsZero())
+	assert.Empty(t, status.Positions)
+
+	provider.Err = errors.New("timeout")
+	assert.Error(t, m.Poll())
+}
+
+func TestMonitor_StoppedReader(t *testing.T) {
+	entry := krakentest.NewOrderEntry()
+	m, err := New(newProvider(), pairs, WithBufferSize(1), WithAutoReduce(entry, LevelMarginCall, ReduceOnly, decimal.NewFromInt(1)))
+	require.NoError(t, err)
+	require.NoError(t, m.Poll())
+
+	// nobody reads alerts: handling isn't blocked and positions are reduced at every crossing
+	for i := 0; i < 3; i++ {
+		m.Handle(ticker(ws.BTCUSD, "400", "2000"))
+		m.Handle(ticker(ws.BTCUSD, "1100", "2000"))
+	}
+	assert.Len(t, entry.Added(), 3)
+	assert.Equal(t, uint64(5), m.Dropped())
+
+	require.NoError(t, m.Close())
+	require.NoError(t, m.Close())
+	alerts := drain(m)
+	require.Len(t, alerts, 1, "the latest alert is kept")
+	assert.Equal(t, LevelNormal, alerts[0].Status.Level)
+	_, ok := <-m.Alerts()
+	assert.False(t, ok)
+}
+
+func TestMonitor_SharedClient(t *testing.T) {
+	server := krakentest.NewServer()
+	defer server.Close()
+	k := ws.NewKraken(server.URL())
+	require.NoError(t, k.Connect())
+	defer k.Close()
+
+	m, err := New(newProvider(), pairs, WithPollInterval(0))
+	require.NoError(t, err)
+	defer m.Close()
+	require.NoError(t, m.Poll())
+	require.NoError(t, m.Subscribe(k, []string{ws.BTCUSD}))
+
+	// another consumer of the same channel has its own handle
+	tickers, err := k.SubscribeTickerHandle([]string{ws.BTCUSD})
+	require.NoError(t, err)
+	defer tickers.Close()
+	require.Eventually(t, func() bool { return tickers.Status() == ws.StateSubscribed }, time.Second, 5*time.Millisecond)
+
+	require.NoError(t, server.PublishTicker(ws.BTCUSD, krakentest.Ticker{Ask: decimal.NewFromInt(401), Bid: decimal.NewFromInt(400)}))
+	select {
+	case alert := <-m.Alerts():
+		assert.Equal(t, LevelMarginCall, alert.Status.Level)
+	case <-time.After(time.Second):
+		require.FailNow(t, "alert isn't received")
+	}
+	select {
+	case event := <-tickers.C():
+		assert.Equal(t, "400.00000", event.Data.Bid.Price.String())
+	case <-time.After(time.Second):
+		require.FailNow(t, "ticker isn't received")
+	}
+}
@@ -0,0 +1,151 @@
+package strategy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aopoltorzhicky/go_kraken/candles"
+	ws "github.com/aopoltorzhicky/go_kraken/websocket"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Strategy - trading strategy. It receives trades, candles and updates of own orders and sends orders to `ws.OrderEntry`
+// which is passed to `Start`, so the same strategy runs with live websocket client, paper engine and backtester.
+// Methods are never called concurrently.
+type Strategy interface {
+	Start(orders ws.OrderEntry)
+	OnTrade(pair string, trade candles.Trade)
+	OnCandle(pair string, candle candles.Candle)
+	// OnUpdate - receives `ownTrades` and `openOrders` updates and statuses of order requests
+	OnUpdate(update ws.Update)
+}
+
+// IsOrderUpdate - returns true if update is delivered to `Strategy.OnUpdate`
+func IsOrderUpdate(update ws.Update) bool {
+	switch update.ChannelName {
+	case ws.ChanOwnTrades, ws.ChanOpenOrders, ws.EventAddOrder, ws.EventEditOrder, ws.EventCancelOrder, ws.EventCancelAllStatus:
+		return true
+	default:
+		return false
+	}
+}
+
+// tradeHandler - order entry which fills its orders by live trades, e.g. `paper.Engine`
+type tradeHandler interface {
+	HandleTrades(pair string, trades []ws.Trade)
+}
+
+// Runner - runs strategy with live trades of websocket client
+type Runner struct {
+	strategy    Strategy
+	orders      ws.OrderEntry
+	engine      tradeHandler
+	builders    map[string]*candles.Builder
+	unsubscribe func() error
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+	mx       sync.Mutex
+}
+
+// Run - subscribes to trades of pairs and starts strategy. Candles with `interval` are built from trades.
+// `orders` is the websocket client itself for live trading or paper engine. Paper engine also receives the trades to fill its orders.
+func Run(k *ws.Kraken, orders ws.OrderEntry, s Strategy, pairs []string, interval time.Duration) (*Runner, error) {
+	if len(pairs) == 0 {
+		return nil, errors.New("pairs are required")
+	}
+
+	r := &Runner{
+		strategy: s,
+		orders:   orders,
+		builders: make(map[string]*candles.Builder, len(pairs)),
+		stop:     make(chan struct{}),
+	}
+	r.engine, _ = orders.(tradeHandler)
+
+	for _, pair := range pairs {
+		pair := pair
+		builder, err := candles.NewTimeBuilder(interval, candles.WithHandler(func(candle candles.Candle) {
+			r.strategy.OnCandle(pair, candle)
+		}))
+		if err != nil {
+			return nil, err
+		}
+		r.builders[pair] = builder
+	}
+
+	s.Start(orders)
+
+	r.wg.Add(1)
+	go r.listen()
+
+	handle, err := k.SubscribeTradesHandle(pairs, ws.WithCallback(r.trades))
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	r.unsubscribe = handle.Close
+	return r, nil
+}
+
+// Close - unsubscribes from trades and stops delivering updates to strategy
+func (r *Runner) Close() error {
+	var err error
+	r.stopOnce.Do(func() {
+		if r.unsubscribe != nil {
+			err = r.unsubscribe()
+		}
+		close(r.stop)
+	})
+	r.wg.Wait()
+	return err
+}
+
+func (r *Runner) trades(event ws.Event[[]ws.Trade]) {
+	if r.engine != nil {
+		r.engine.HandleTrades(event.Pair, event.Data)
+	}
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	builder, ok := r.builders[event.Pair]
+	if !ok {
+		return
+	}
+	for i := range event.Data {
+		trade, err := candles.FromWebsocket(event.Data[i])
+		if err != nil {
+			log.Errorf("strategy: invalid trade of %s: %s", event.Pair, err)
+			continue
+		}
+		if err := builder.Add(trade); err != nil {
+			log.Errorf("strategy: %s", err)
+		}
+		r.strategy.OnTrade(event.Pair, trade)
+	}
+}
+
+func (r *Runner) listen() {
+	defer r.wg.Done()
+
+	updates := r.orders.Listen()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case update, ok := <-updates:
+			if !ok {
+				return
+			}
+			if !IsOrderUpdate(update) {
+				continue
+			}
+			r.mx.Lock()
+			r.strategy.OnUpdate(update)
+			r.mx.Unlock()
+		}
+	}
+}
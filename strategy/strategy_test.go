@@ -0,0 +1,109 @@
+package strategy
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aopoltorzhicky/go_kraken/candles"
+	"github.com/aopoltorzhicky/go_kraken/krakentest"
+	"github.com/aopoltorzhicky/go_kraken/paper"
+	ws "github.com/aopoltorzhicky/go_kraken/websocket"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var books = krakentest.Books{
+	ws.BTCUSD: {
+		Pair:  ws.BTCUSD,
+		Asks:  []ws.PriceLevel{{Price: decimal.NewFromInt(101), Volume: decimal.NewFromInt(1)}},
+		Bids:  []ws.PriceLevel{{Price: decimal.NewFromInt(100), Volume: decimal.NewFromInt(1)}},
+		Valid: true,
+	},
+}
+
+var pairs = krakentest.AssetPairs{
+	"XXBTZUSD": {WSName: ws.BTCUSD, PairDecimals: 1, LotDecimals: 8, Fees: [][]float64{{0, 0.26}}},
+}
+
+type strategyMock struct {
+	orders  ws.OrderEntry
+	trades  int
+	candles int
+	updates []string
+	mx      sync.Mutex
+}
+
+func (m *strategyMock) Start(orders ws.OrderEntry) {
+	m.orders = orders
+}
+
+func (m *strategyMock) OnTrade(pair string, trade candles.Trade) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.trades++
+	if m.trades == 1 {
+		_ = m.orders.AddOrder(ws.AddOrderRequest{Pair: pair, Type: ws.SideBuy, Ordertype: ws.OrderTypeLimit, Price: "99", Volume: "1"})
+	}
+}
+
+func (m *strategyMock) OnCandle(pair string, candle candles.Candle) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.candles++
+}
+
+func (m *strategyMock) OnUpdate(update ws.Update) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.updates = append(m.updates, update.ChannelName)
+}
+
+func (m *strategyMock) state() (int, int, []string) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	return m.trades, m.candles, append([]string(nil), m.updates...)
+}
+
+func TestRun(t *testing.T) {
+	server := krakentest.NewServer()
+	defer server.Close()
+	k := ws.NewKraken(server.URL())
+	require.NoError(t, k.Connect())
+	defer k.Close()
+
+	engine, err := paper.New(books, pairs)
+	require.NoError(t, err)
+
+	s := &strategyMock{}
+	runner, err := Run(k, engine, s, []string{ws.BTCUSD}, time.Minute)
+	require.NoError(t, err)
+	defer runner.Close()
+
+	start := time.Unix(1700000000, 0)
+	require.Eventually(t, func() bool {
+		require.NoError(t, server.PublishTrade(ws.BTCUSD, krakentest.Trade{Price: decimal.NewFromInt(100), Volume: decimal.NewFromInt(1), Side: ws.Sell, Time: start}))
+		trades, _, _ := s.state()
+		return trades > 0
+	}, time.Second, 20*time.Millisecond)
+
+	require.NoError(t, server.PublishTrade(ws.BTCUSD, krakentest.Trade{Price: decimal.NewFromInt(99), Volume: decimal.NewFromInt(5), Side: ws.Sell, Time: start.Add(time.Minute)}))
+	require.Eventually(t, func() bool {
+		_, candles, updates := s.state()
+		return candles == 1 && len(updates) >= 5
+	}, time.Second, 5*time.Millisecond)
+
+	_, _, updates := s.state()
+	assert.Equal(t, ws.EventAddOrder, updates[0])
+	assert.Contains(t, updates, ws.ChanOwnTrades, "paper order is filled by live trades")
+	assert.Equal(t, paper.StatusClosed, engine.Orders()[0].Status)
+
+	require.NoError(t, runner.Close())
+}
+
+func TestIsOrderUpdate(t *testing.T) {
+	assert.True(t, IsOrderUpdate(ws.Update{ChannelName: ws.ChanOwnTrades}))
+	assert.True(t, IsOrderUpdate(ws.Update{ChannelName: ws.EventCancelAllStatus}))
+	assert.False(t, IsOrderUpdate(ws.Update{ChannelName: ws.ChanTrades}))
+}
@@ -0,0 +1,307 @@
+package websocket
+
+import (
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+)
+
+// Analytics errors
+var (
+	ErrEmptyBook   = errors.New("order book side is empty")
+	ErrInvalidSide = errors.New("side has to be `buy` or `sell`")
+)
+
+var (
+	decimalTwo  = decimal.NewFromInt(2)
+	basisPoints = decimal.NewFromInt(10000)
+)
+
+// FillEstimate - result of walking the order book with a market order.
+// All values are exact except VWAP and slippage which are results of division with `decimal.DivisionPrecision` digits.
+type FillEstimate struct {
+	// Side - side of the market order: `buy` consumes asks, `sell` consumes bids
+	Side string
+	// Volume - filled base volume
+	Volume decimal.Decimal
+	// Cost - filled quote amount
+	Cost decimal.Decimal
+	// VWAP - volume-weighted average fill price
+	VWAP decimal.Decimal
+	// WorstPrice - price of the last touched level
+	WorstPrice decimal.Decimal
+	// Levels - count of touched levels
+	Levels int
+	// Complete - false if the book doesn't have enough liquidity for the requested amount
+	Complete bool
+	// Slippage - relative difference between VWAP and mid price. Positive value means the fill is worse than mid.
+	Slippage decimal.Decimal
+	// SlippageBps - slippage in basis points
+	SlippageBps decimal.Decimal
+}
+
+// Depth - cumulative volume of both sides
+type Depth struct {
+	Bids decimal.Decimal
+	Asks decimal.Decimal
+}
+
+// bookLevels - sides of order book sorted from the best price
+type bookLevels struct {
+	asks []PriceLevel
+	bids []PriceLevel
+}
+
+func (o *OrderBook) levels() bookLevels {
+	return o.Snapshot().levels()
+}
+
+func (s OrderBookSnapshot) levels() bookLevels {
+	return bookLevels{asks: s.Asks, bids: s.Bids}
+}
+
+// FillBase - estimates market order of `volume` in base currency.
+// Every analytics method of `OrderBook` takes its own snapshot, use `OrderBookSnapshot` to compute several values on the same state.
+func (o *OrderBook) FillBase(side string, volume decimal.Decimal) (FillEstimate, error) {
+	return o.levels().fill(side, volume, false)
+}
+
+// FillQuote - estimates market order spending `amount` in quote currency
+func (o *OrderBook) FillQuote(side string, amount decimal.Decimal) (FillEstimate, error) {
+	return o.levels().fill(side, amount, true)
+}
+
+// Mid - returns mid price
+func (o *OrderBook) Mid() (decimal.Decimal, error) {
+	return o.levels().mid()
+}
+
+// Spread - returns difference between best ask and best bid
+func (o *OrderBook) Spread() (decimal.Decimal, error) {
+	return o.levels().spread()
+}
+
+// SpreadBps - returns spread in basis points of mid price
+func (o *OrderBook) SpreadBps() (decimal.Decimal, error) {
+	return o.levels().spreadBps()
+}
+
+// Microprice - returns mid price weighted by volumes of best levels: `(bid * askVolume + ask * bidVolume) / (askVolume + bidVolume)`
+func (o *OrderBook) Microprice() (decimal.Decimal, error) {
+	return o.levels().microprice()
+}
+
+// Imbalance - returns `(bids - asks) / (bids + asks)` of volumes of top `levels` levels. It's in range [-1, 1].
+func (o *OrderBook) Imbalance(levels int) (decimal.Decimal, error) {
+	return o.levels().imbalance(levels)
+}
+
+// DepthWithin - returns cumulative volume of levels whose prices are within `bps` basis points from mid price
+func (o *OrderBook) DepthWithin(bps decimal.Decimal) (Depth, error) {
+	return o.levels().depthWithin(bps)
+}
+
+// FillBase - estimates market order of `volume` in base currency
+func (s OrderBookSnapshot) FillBase(side string, volume decimal.Decimal) (FillEstimate, error) {
+	return s.levels().fill(side, volume, false)
+}
+
+// FillQuote - estimates market order spending `amount` in quote currency
+func (s OrderBookSnapshot) FillQuote(side string, amount decimal.Decimal) (FillEstimate, error) {
+	return s.levels().fill(side, amount, true)
+}
+
+// Mid - returns mid price
+func (s OrderBookSnapshot) Mid() (decimal.Decimal, error) {
+	return s.levels().mid()
+}
+
+// Spread - returns difference between best ask and best bid
+func (s OrderBookSnapshot) Spread() (decimal.Decimal, error) {
+	return s.levels().spread()
+}
+
+// SpreadBps - returns spread in basis points of mid price
+func (s OrderBookSnapshot) SpreadBps() (decimal.Decimal, error) {
+	return s.levels().spreadBps()
+}
+
+// Microprice - returns mid price weighted by volumes of best levels
+func (s OrderBookSnapshot) Microprice() (decimal.Decimal, error) {
+	return s.levels().microprice()
+}
+
+// Imbalance - returns `(bids - asks) / (bids + asks)` of volumes of top `levels` levels
+func (s OrderBookSnapshot) Imbalance(levels int) (decimal.Decimal, error) {
+	return s.levels().imbalance(levels)
+}
+
+// DepthWithin - returns cumulative volume of levels whose prices are within `bps` basis points from mid price
+func (s OrderBookSnapshot) DepthWithin(bps decimal.Decimal) (Depth, error) {
+	return s.levels().depthWithin(bps)
+}
+
+func (b bookLevels) best() (PriceLevel, PriceLevel, error) {
+	if len(b.asks) == 0 || len(b.bids) == 0 {
+		return PriceLevel{}, PriceLevel{}, ErrEmptyBook
+	}
+	return b.asks[0], b.bids[0], nil
+}
+
+func (b bookLevels) mid() (decimal.Decimal, error) {
+	ask, bid, err := b.best()
+	if err != nil {
+		return decimal.Zero, err
+	}
+	// division by 2 is exact
+	return ask.Price.Add(bid.Price).Div(decimalTwo), nil
+}
+
+func (b bookLevels) spread() (decimal.Decimal, error) {
+	ask, bid, err := b.best()
+	if err != nil {
+		return decimal.Zero, err
+	}
+	return ask.Price.Sub(bid.Price), nil
+}
+
+func (b bookLevels) spreadBps() (decimal.Decimal, error) {
+	spread, err := b.spread()
+	if err != nil {
+		return decimal.Zero, err
+	}
+	mid, _ := b.mid()
+	if mid.IsZero() {
+		return decimal.Zero, errors.New("mid price is zero")
+	}
+	return spread.Mul(basisPoints).Div(mid), nil
+}
+
+func (b bookLevels) microprice() (decimal.Decimal, error) {
+	ask, bid, err := b.best()
+	if err != nil {
+		return decimal.Zero, err
+	}
+	total := ask.Volume.Add(bid.Volume)
+	if total.IsZero() {
+		return decimal.Zero, errors.New("best levels have zero volume")
+	}
+	return bid.Price.Mul(ask.Volume).Add(ask.Price.Mul(bid.Volume)).Div(total), nil
+}
+
+func (b bookLevels) imbalance(levels int) (decimal.Decimal, error) {
+	if levels <= 0 {
+		return decimal.Zero, errors.Errorf("invalid levels count: %d", levels)
+	}
+	if _, _, err := b.best(); err != nil {
+		return decimal.Zero, err
+	}
+	bids := sumVolume(b.bids, levels)
+	asks := sumVolume(b.asks, levels)
+	total := bids.Add(asks)
+	if total.IsZero() {
+		return decimal.Zero, nil
+	}
+	return bids.Sub(asks).Div(total), nil
+}
+
+func (b bookLevels) depthWithin(bps decimal.Decimal) (Depth, error) {
+	if bps.IsNegative() {
+		return Depth{}, errors.Errorf("invalid basis points: %s", bps)
+	}
+	mid, err := b.mid()
+	if err != nil {
+		return Depth{}, err
+	}
+	// comparison is done with multiplied values to avoid division: |price - mid| * 10000 <= mid * bps
+	limit := mid.Mul(bps)
+
+	var depth Depth
+	for _, level := range b.asks {
+		if level.Price.Sub(mid).Mul(basisPoints).GreaterThan(limit) {
+			break
+		}
+		depth.Asks = depth.Asks.Add(level.Volume)
+	}
+	for _, level := range b.bids {
+		if mid.Sub(level.Price).Mul(basisPoints).GreaterThan(limit) {
+			break
+		}
+		depth.Bids = depth.Bids.Add(level.Volume)
+	}
+	return depth, nil
+}
+
+// fill - walks the side consumed by market order. If `quote` is true `amount` is in quote currency.
+func (b bookLevels) fill(side string, amount decimal.Decimal, quote bool) (FillEstimate, error) {
+	var levels []PriceLevel
+	switch side {
+	case SideBuy:
+		levels = b.asks
+	case SideSell:
+		levels = b.bids
+	default:
+		return FillEstimate{}, ErrInvalidSide
+	}
+	if !amount.IsPositive() {
+		return FillEstimate{}, errors.Errorf("amount has to be positive: %s", amount)
+	}
+	if len(levels) == 0 {
+		return FillEstimate{}, ErrEmptyBook
+	}
+
+	estimate := FillEstimate{Side: side}
+	remaining := amount
+	for _, level := range levels {
+		volume := level.Volume
+		cost := level.Price.Mul(volume)
+		if quote {
+			if cost.GreaterThanOrEqual(remaining) {
+				cost = remaining
+				volume = remaining.Div(level.Price)
+			}
+			remaining = remaining.Sub(cost)
+		} else {
+			if volume.GreaterThanOrEqual(remaining) {
+				volume = remaining
+				cost = level.Price.Mul(volume)
+			}
+			remaining = remaining.Sub(volume)
+		}
+
+		estimate.Volume = estimate.Volume.Add(volume)
+		estimate.Cost = estimate.Cost.Add(cost)
+		estimate.WorstPrice = level.Price
+		estimate.Levels++
+
+		if remaining.IsZero() {
+			estimate.Complete = true
+			break
+		}
+	}
+
+	if estimate.Volume.IsZero() {
+		return estimate, nil
+	}
+	estimate.VWAP = estimate.Cost.Div(estimate.Volume)
+
+	if mid, err := b.mid(); err == nil && !mid.IsZero() {
+		diff := estimate.VWAP.Sub(mid)
+		if side == SideSell {
+			diff = diff.Neg()
+		}
+		estimate.Slippage = diff.Div(mid)
+		estimate.SlippageBps = diff.Mul(basisPoints).Div(mid)
+	}
+	return estimate, nil
+}
+
+func sumVolume(levels []PriceLevel, count int) decimal.Decimal {
+	sum := decimal.Zero
+	for i := range levels {
+		if i == count {
+			break
+		}
+		sum = sum.Add(levels[i].Volume)
+	}
+	return sum
+}
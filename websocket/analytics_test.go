@@ -0,0 +1,111 @@
+package websocket
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testAnalyticsBook(t *testing.T) *OrderBook {
+	book := NewOrderBook(10, 1, 8)
+	require.NoError(t, book.ApplyUpdate(OrderBookUpdate{
+		IsSnapshot: true,
+		Asks: []OrderBookItem{
+			{Price: "101.0", Volume: "1.00000000"},
+			{Price: "102.0", Volume: "2.00000000"},
+			{Price: "110.0", Volume: "5.00000000"},
+		},
+		Bids: []OrderBookItem{
+			{Price: "99.0", Volume: "3.00000000"},
+			{Price: "98.0", Volume: "1.00000000"},
+		},
+	}, false))
+	return book
+}
+
+func requireDecimal(t *testing.T, expected string, actual decimal.Decimal) {
+	t.Helper()
+	assert.True(t, decimal.RequireFromString(expected).Equal(actual), "expected %s, got %s", expected, actual)
+}
+
+func TestOrderBook_Analytics(t *testing.T) {
+	book := testAnalyticsBook(t)
+
+	mid, err := book.Mid()
+	require.NoError(t, err)
+	requireDecimal(t, "100", mid)
+
+	spread, err := book.SpreadBps()
+	require.NoError(t, err)
+	requireDecimal(t, "200", spread)
+
+	micro, err := book.Microprice()
+	require.NoError(t, err)
+	// (99 * 1 + 101 * 3) / 4
+	requireDecimal(t, "100.5", micro)
+
+	imbalance, err := book.Imbalance(2)
+	require.NoError(t, err)
+	// (4 - 3) / 7
+	requireDecimal(t, "0.1428571428571429", imbalance)
+
+	depth, err := book.DepthWithin(decimal.NewFromInt(200))
+	require.NoError(t, err)
+	requireDecimal(t, "3", depth.Asks)
+	requireDecimal(t, "4", depth.Bids)
+
+	_, err = book.Imbalance(0)
+	assert.Error(t, err)
+}
+
+func TestOrderBook_Fill(t *testing.T) {
+	book := testAnalyticsBook(t)
+
+	buy, err := book.FillBase(SideBuy, decimal.RequireFromString("2"))
+	require.NoError(t, err)
+	assert.True(t, buy.Complete)
+	assert.Equal(t, 2, buy.Levels)
+	requireDecimal(t, "203", buy.Cost)
+	requireDecimal(t, "101.5", buy.VWAP)
+	requireDecimal(t, "102", buy.WorstPrice)
+	requireDecimal(t, "150", buy.SlippageBps)
+
+	sell, err := book.FillQuote(SideSell, decimal.RequireFromString("346"))
+	require.NoError(t, err)
+	assert.True(t, sell.Complete)
+	requireDecimal(t, "3.5", sell.Volume)
+	requireDecimal(t, "346", sell.Cost)
+	requireDecimal(t, "98", sell.WorstPrice)
+
+	partial, err := book.FillBase(SideBuy, decimal.RequireFromString("100"))
+	require.NoError(t, err)
+	assert.False(t, partial.Complete)
+	requireDecimal(t, "8", partial.Volume)
+	assert.Equal(t, 3, partial.Levels)
+
+	_, err = book.FillBase("short", decimal.RequireFromString("1"))
+	assert.ErrorIs(t, err, ErrInvalidSide)
+
+	_, err = NewOrderBook(10, 1, 8).FillBase(SideBuy, decimal.RequireFromString("1"))
+	assert.ErrorIs(t, err, ErrEmptyBook)
+}
+
+func TestOrderBookSnapshot_Analytics(t *testing.T) {
+	k := NewKraken(ProdBaseURL)
+	book, err := k.NewManagedBook(BTCUSD, 10, 1, 8)
+	require.NoError(t, err)
+	require.NoError(t, k.handleMessage([]byte(bookSnapshotMessage)))
+
+	snapshot := book.Snapshot()
+	assert.True(t, snapshot.Valid)
+
+	spread, err := snapshot.Spread()
+	require.NoError(t, err)
+	requireDecimal(t, "0.1", spread)
+
+	fill, err := snapshot.FillBase(SideBuy, decimal.RequireFromString("1"))
+	require.NoError(t, err)
+	requireDecimal(t, "5541.3", fill.VWAP)
+}
@@ -0,0 +1,45 @@
+package websocket
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Actions of level diff
+const (
+	LevelAdded   = "added"
+	LevelChanged = "changed"
+	LevelRemoved = "removed"
+)
+
+// LevelDiff - normalized change of price level
+type LevelDiff struct {
+	// Side - `asks` or `bids`
+	Side   string          `json:"side"`
+	Action string          `json:"action"`
+	Price  decimal.Decimal `json:"price"`
+	// Volume - new volume of the level. It's zero for removed level.
+	Volume decimal.Decimal `json:"volume"`
+	// Truncated - level was removed because it fell off the depth window
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// BookDiff - changes of order book made by one update
+type BookDiff struct {
+	// Sequence - sequence of the update in the book. It's the same as sequence of snapshot taken right after the update.
+	Sequence uint64    `json:"sequence"`
+	Time     time.Time `json:"time"`
+	// Snapshot - the book was cleared before applying changes, so consumers have to drop their levels
+	Snapshot bool        `json:"snapshot"`
+	Changes  []LevelDiff `json:"changes"`
+}
+
+// OnDiff - sets handler which receives changes of every applied update. Republished levels with the same volume
+// are skipped and levels which fall off the depth window are reported as removed. Handler is called synchronously
+// from `ApplyUpdate` after the book is unlocked, so it may read the book. Pass nil to remove the handler.
+func (o *OrderBook) OnDiff(handler func(BookDiff)) {
+	o.mx.Lock()
+	o.onDiff = handler
+	o.mx.Unlock()
+}
@@ -0,0 +1,72 @@
+package websocket
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOrderBook_OnDiff(t *testing.T) {
+	book := NewOrderBook(2, 1, 8)
+
+	var diffs []BookDiff
+	book.OnDiff(func(diff BookDiff) {
+		// handler may read the book
+		assert.Equal(t, diff.Sequence, book.Snapshot().Sequence)
+		diffs = append(diffs, diff)
+	})
+
+	require.NoError(t, book.ApplyUpdate(OrderBookUpdate{
+		IsSnapshot: true,
+		Asks: []OrderBookItem{
+			{Price: "101.0", Volume: "1.00000000"},
+			{Price: "102.0", Volume: "2.00000000"},
+		},
+		Bids: []OrderBookItem{{Price: "99.0", Volume: "3.00000000"}},
+	}, false))
+	require.Len(t, diffs, 1)
+	assert.True(t, diffs[0].Snapshot)
+	assert.EqualValues(t, 1, diffs[0].Sequence)
+	require.Len(t, diffs[0].Changes, 3)
+	assert.Equal(t, LevelDiff{Side: SideAsks, Action: LevelAdded, Price: diffs[0].Changes[0].Price, Volume: diffs[0].Changes[0].Volume}, diffs[0].Changes[0])
+	assert.Equal(t, SideBids, diffs[0].Changes[2].Side)
+
+	require.NoError(t, book.ApplyUpdate(OrderBookUpdate{
+		Asks: []OrderBookItem{
+			// republished level without changes
+			{Price: "101.0", Volume: "1.00000000", Republish: true},
+			// pushes 102.0 off the depth window
+			{Price: "100.5", Volume: "1.00000000"},
+			// added and truncated by the same update
+			{Price: "103.0", Volume: "1.00000000"},
+		},
+		Bids: []OrderBookItem{
+			{Price: "99.0", Volume: "4.00000000"},
+			{Price: "98.0", Volume: "0.00000000"},
+		},
+	}, false))
+	require.Len(t, diffs, 2)
+	assert.False(t, diffs[1].Snapshot)
+	assert.EqualValues(t, 2, diffs[1].Sequence)
+	require.Len(t, diffs[1].Changes, 3)
+
+	added := diffs[1].Changes[0]
+	assert.Equal(t, LevelAdded, added.Action)
+	assert.Equal(t, "100.5", added.Price.String())
+
+	removed := diffs[1].Changes[1]
+	assert.Equal(t, LevelRemoved, removed.Action)
+	assert.Equal(t, "102", removed.Price.String())
+	assert.True(t, removed.Volume.IsZero())
+	assert.True(t, removed.Truncated)
+
+	changed := diffs[1].Changes[2]
+	assert.Equal(t, SideBids, changed.Side)
+	assert.Equal(t, LevelChanged, changed.Action)
+	assert.Equal(t, "4", changed.Volume.String())
+
+	book.OnDiff(nil)
+	require.NoError(t, book.ApplyUpdate(OrderBookUpdate{Asks: []OrderBookItem{{Price: "101.0", Volume: "0"}}}, false))
+	assert.Len(t, diffs, 2)
+}
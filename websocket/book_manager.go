@@ -0,0 +1,296 @@
+package websocket
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aopoltorzhicky/go_kraken/rest"
+	"github.com/pkg/errors"
+)
+
+// AssetPairsProvider - source of pairs metadata. `rest.Kraken` implements it.
+type AssetPairsProvider interface {
+	AssetPairs(pairs ...string) (map[string]rest.AssetPair, error)
+}
+
+// TopOfBook - best bid and ask of the pair
+type TopOfBook struct {
+	Pair string
+	Ask  PriceLevel
+	Bid  PriceLevel
+	Time time.Time
+}
+
+// DepthProvider - source of REST order books. `rest.Kraken` implements it.
+type DepthProvider interface {
+	GetOrderBook(pair string, depth int64) (map[string]rest.OrderBook, error)
+}
+
+// BookManagerOption - option function for order book manager
+type BookManagerOption func(*BookManager)
+
+// WithTopOfBookHandler - add function which is called when best bid or ask of a pair changes its price or volume
+func WithTopOfBookHandler(fn func(TopOfBook)) BookManagerOption {
+	return func(m *BookManager) {
+		m.onTop = fn
+	}
+}
+
+// WithBookStateHandler - add function which is called when book of a pair becomes invalid or valid again
+func WithBookStateHandler(fn func(BookEvent)) BookManagerOption {
+	return func(m *BookManager) {
+		m.onState = fn
+	}
+}
+
+// WithRESTCrossCheck - periodically requests order books by REST API and compares their top `levels` levels with websocket books.
+// Handler is called only if books diverged or request failed. Books which are resynchronizing are skipped.
+func WithRESTCrossCheck(provider DepthProvider, interval time.Duration, levels int, handler func(Divergence)) BookManagerOption {
+	return func(m *BookManager) {
+		m.depthProvider = provider
+		m.crossCheckInterval = interval
+		m.crossCheckLevels = levels
+		if levels <= 0 {
+			m.crossCheckLevels = checksumDepth
+		}
+		m.onDivergence = handler
+	}
+}
+
+// BookManager - keeps synchronized order books of several pairs. Precision of prices and volumes is taken from pairs metadata.
+type BookManager struct {
+	books map[string]*ManagedBook
+
+	onTop   func(TopOfBook)
+	onState func(BookEvent)
+
+	depthProvider      DepthProvider
+	crossCheckInterval time.Duration
+	crossCheckLevels   int
+	onDivergence       func(Divergence)
+	// restNames - REST names of pairs by websocket names
+	restNames map[string]string
+
+	tops    map[string]TopOfBook
+	updated map[string]time.Time
+	mx      sync.RWMutex
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewBookManager - subscribes to order books of pairs with depth. Pairs are websocket names, e.g. `XBT/USD`.
+func (k *Kraken) NewBookManager(pairs []string, depth int, assets AssetPairsProvider, opts ...BookManagerOption) (*BookManager, error) {
+	if len(pairs) == 0 {
+		return nil, errors.New("pairs are required")
+	}
+
+	metadata, err := assets.AssetPairs()
+	if err != nil {
+		return nil, errors.Wrap(err, "can't receive asset pairs")
+	}
+	byName := make(map[string]rest.AssetPair, len(metadata))
+	for _, pair := range metadata {
+		byName[pair.WSName] = pair
+	}
+
+	m := &BookManager{
+		books:     make(map[string]*ManagedBook, len(pairs)),
+		restNames: make(map[string]string, len(pairs)),
+		tops:      make(map[string]TopOfBook, len(pairs)),
+		updated:   make(map[string]time.Time, len(pairs)),
+		stop:      make(chan struct{}),
+	}
+	for i := range opts {
+		opts[i](m)
+	}
+
+	for _, pair := range pairs {
+		info, ok := byName[pair]
+		if !ok {
+			m.Close()
+			return nil, errors.Errorf("unknown pair: %s", pair)
+		}
+
+		pair := pair
+		book, err := k.NewManagedBook(pair, depth, info.PairDecimals, info.LotDecimals,
+			WithBookUpdateCallback(func(book *OrderBook) {
+				m.updatedBook(pair, book)
+			}),
+			WithBookStateCallback(m.stateChanged),
+		)
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		m.books[pair] = book
+		m.restNames[pair] = info.Altname
+	}
+
+	if m.depthProvider != nil && m.crossCheckInterval > 0 {
+		m.wg.Add(1)
+		go m.crossCheckThread()
+	}
+	return m, nil
+}
+
+// Pairs - returns pairs of the manager
+func (m *BookManager) Pairs() []string {
+	pairs := make([]string, 0, len(m.books))
+	for pair := range m.books {
+		pairs = append(pairs, pair)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+// Book - returns managed order book of the pair
+func (m *BookManager) Book(pair string) (*ManagedBook, bool) {
+	book, ok := m.books[pair]
+	return book, ok
+}
+
+// Snapshot - returns consistent copy of order book of the pair
+func (m *BookManager) Snapshot(pair string) (OrderBookSnapshot, bool) {
+	book, ok := m.books[pair]
+	if !ok {
+		return OrderBookSnapshot{}, false
+	}
+
+	return book.Snapshot(), true
+}
+
+// Top - returns best bid and ask of the pair
+func (m *BookManager) Top(pair string) (TopOfBook, bool) {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+
+	top, ok := m.tops[pair]
+	return top, ok
+}
+
+// LastUpdate - returns time of the last applied update of the pair's book. It's zero if no update was applied.
+func (m *BookManager) LastUpdate(pair string) time.Time {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+	return m.updated[pair]
+}
+
+// Stale - returns pairs whose books are invalid or weren't updated longer than `maxAge`
+func (m *BookManager) Stale(maxAge time.Duration) []string {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+
+	stale := make([]string, 0)
+	now := time.Now()
+	for pair, book := range m.books {
+		if !book.Valid() || now.Sub(m.updated[pair]) > maxAge {
+			stale = append(stale, pair)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+// Resyncs - returns count of resynchronizations by pair
+func (m *BookManager) Resyncs() map[string]uint64 {
+	result := make(map[string]uint64, len(m.books))
+	for pair, book := range m.books {
+		result[pair] = book.Resyncs()
+	}
+	return result
+}
+
+// CheckREST - requests order book of the pair by REST API and compares it with websocket book.
+// It requires `WithRESTCrossCheck` option.
+func (m *BookManager) CheckREST(pair string) Divergence {
+	book, ok := m.books[pair]
+	if !ok {
+		return Divergence{Pair: pair, Time: time.Now(), Err: errors.Errorf("unknown pair: %s", pair)}
+	}
+	if m.depthProvider == nil {
+		return Divergence{Pair: pair, Time: time.Now(), Err: errors.New("depth provider isn't set")}
+	}
+
+	response, err := m.depthProvider.GetOrderBook(m.restNames[pair], int64(m.crossCheckLevels))
+	if err != nil {
+		return Divergence{Pair: pair, Time: time.Now(), Err: errors.Wrap(err, "can't receive order book")}
+	}
+	// response contains the only pair under Kraken's name which may differ from requested one
+	for _, remote := range response {
+		return book.Snapshot().CompareREST(remote, m.crossCheckLevels)
+	}
+	return Divergence{Pair: pair, Time: time.Now(), Err: errors.Errorf("empty order book response: %s", pair)}
+}
+
+func (m *BookManager) crossCheckThread() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.crossCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			for _, pair := range m.Pairs() {
+				if !m.books[pair].Valid() {
+					continue
+				}
+				if divergence := m.CheckREST(pair); divergence.Diverged() && m.onDivergence != nil {
+					m.onDivergence(divergence)
+				}
+			}
+		}
+	}
+}
+
+// Close - unsubscribes from all books
+func (m *BookManager) Close() error {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+	})
+	m.wg.Wait()
+
+	var result error
+	for _, book := range m.books {
+		if err := book.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+func (m *BookManager) updatedBook(pair string, book *OrderBook) {
+	now := time.Now()
+	askPrice, askVolume := book.Asks.Best()
+	bidPrice, bidVolume := book.Bids.Best()
+	top := TopOfBook{
+		Pair: pair,
+		Ask:  PriceLevel{Price: askPrice, Volume: askVolume},
+		Bid:  PriceLevel{Price: bidPrice, Volume: bidVolume},
+		Time: now,
+	}
+
+	m.mx.Lock()
+	m.updated[pair] = now
+	prev, ok := m.tops[pair]
+	changed := !ok || !prev.Ask.Equal(top.Ask) || !prev.Bid.Equal(top.Bid)
+	if changed {
+		m.tops[pair] = top
+	}
+	m.mx.Unlock()
+
+	if changed && m.onTop != nil {
+		m.onTop(top)
+	}
+}
+
+func (m *BookManager) stateChanged(event BookEvent) {
+	if m.onState != nil {
+		m.onState(event)
+	}
+}
@@ -0,0 +1,64 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aopoltorzhicky/go_kraken/rest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type assetPairsMock map[string]rest.AssetPair
+
+func (m assetPairsMock) AssetPairs(pairs ...string) (map[string]rest.AssetPair, error) {
+	return m, nil
+}
+
+var testAssetPairs = assetPairsMock{
+	"XXBTZUSD": {Altname: "XBTUSD", WSName: "XBT/USD", PairDecimals: 1, LotDecimals: 8},
+	"XETHZUSD": {Altname: "ETHUSD", WSName: "ETH/USD", PairDecimals: 2, LotDecimals: 8},
+}
+
+func TestBookManager(t *testing.T) {
+	k := NewKraken(ProdBaseURL)
+
+	var tops []TopOfBook
+	manager, err := k.NewBookManager([]string{BTCUSD, ETHUSD}, 10, testAssetPairs, WithTopOfBookHandler(func(top TopOfBook) {
+		tops = append(tops, top)
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, []string{ETHUSD, BTCUSD}, manager.Pairs())
+	assert.Equal(t, []string{ETHUSD, BTCUSD}, manager.Stale(time.Minute))
+
+	require.NoError(t, k.handleMessage([]byte(bookSnapshotMessage)))
+	require.Len(t, tops, 1)
+	assert.Equal(t, BTCUSD, tops[0].Pair)
+	assert.Equal(t, "5541.3", tops[0].Ask.Price.String())
+	assert.Equal(t, "5541.2", tops[0].Bid.Price.String())
+
+	// update deeper than top of book doesn't notify
+	require.NoError(t, k.handleMessage([]byte(`[0,{"a":[["5541.50000","1.00000000","1534614248.456738"]],"c":"3906377897"},"book-10","XBT/USD"]`)))
+	assert.Len(t, tops, 1)
+
+	snapshot, ok := manager.Snapshot(BTCUSD)
+	require.True(t, ok)
+	assert.True(t, snapshot.Valid)
+	assert.Len(t, snapshot.Asks, 2)
+	assert.Len(t, snapshot.Bids, 1)
+	assert.False(t, snapshot.Time.IsZero())
+
+	assert.Equal(t, []string{ETHUSD}, manager.Stale(time.Minute))
+	assert.Equal(t, map[string]uint64{BTCUSD: 0, ETHUSD: 0}, manager.Resyncs())
+
+	require.NoError(t, manager.Close())
+	assert.Empty(t, k.Subscriptions())
+}
+
+func TestBookManager_UnknownPair(t *testing.T) {
+	k := NewKraken(ProdBaseURL)
+
+	_, err := k.NewBookManager([]string{BTCUSD, "UNKNOWN/USD"}, 10, testAssetPairs)
+	assert.Error(t, err)
+	assert.Empty(t, k.Subscriptions())
+}
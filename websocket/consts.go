@@ -6,6 +6,13 @@ const (
 	AuthBaseURL        = "wss://ws-auth.kraken.com"
 	SandboxBaseURL     = "wss://beta-ws.kraken.com"
 	AuthSandboxBaseURL = "wss://beta-ws-auth.kraken.com"
+
+	// Websocket API v2
+	ProdBaseURLV2        = "wss://ws.kraken.com/v2"
+	AuthBaseURLV2        = "wss://ws-auth.kraken.com/v2"
+	Level3BaseURLV2      = "wss://ws-l3.kraken.com/v2"
+	SandboxBaseURLV2     = "wss://beta-ws.kraken.com/v2"
+	AuthSandboxBaseURLV2 = "wss://beta-ws-auth.kraken.com/v2"
 )
 
 // Available channels
@@ -18,6 +25,12 @@ const (
 	ChanOpenOrders = "openOrders"
 	ChanOwnTrades  = "ownTrades"
 	ChanAll        = "*"
+
+	// Websocket API v2 only
+	ChanInstrument = "instrument"
+	ChanBalances   = "balances"
+	ChanExecutions = "executions"
+	ChanLevel3     = "level3"
 )
 
 // Events
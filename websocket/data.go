@@ -5,6 +5,7 @@ import (
 	"fmt"
 
 	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
 )
 
 // Update - notification from channel or events
@@ -226,6 +227,8 @@ type OrderBookUpdate struct {
 	Bids       []OrderBookItem
 	CheckSum   string
 	IsSnapshot bool
+	// Gap - is true if previous updates of this book were dropped by the client, so local order book has to be resynchronized.
+	Gap bool
 }
 
 // UnmarshalJSON - unmarshal candle update
@@ -261,50 +264,61 @@ func (obu *OrderBookUpdate) UnmarshalJSON(data []byte) error {
 
 // OwnTrade - Own trades.
 type OwnTrade struct {
-	Cost      json.Number `json:"cost"`
-	Fee       json.Number `json:"fee"`
-	Margin    json.Number `json:"margin"`
-	OrderID   string      `json:"ordertxid"`
-	OrderType string      `json:"ordertype"`
-	Pair      string      `json:"pair"`
-	PosTxID   string      `json:"postxid"`
-	Price     json.Number `json:"price"`
-	Time      json.Number `json:"time"`
-	Type      string      `json:"type"`
-	Vol       json.Number `json:"vol"`
-	UserRef   json.Number `json:"userref"`
+	Cost      decimal.Decimal `json:"cost"`
+	Fee       decimal.Decimal `json:"fee"`
+	Margin    decimal.Decimal `json:"margin"`
+	OrderID   string          `json:"ordertxid"`
+	OrderType string          `json:"ordertype"`
+	Pair      string          `json:"pair"`
+	PosTxID   string          `json:"postxid"`
+	Price     decimal.Decimal `json:"price"`
+	Time      Timestamp       `json:"time"`
+	Type      string          `json:"type"`
+	Vol       decimal.Decimal `json:"vol"`
+	UserRef   int64           `json:"userref"`
 }
 
 // OpenOrderDescr -
 type OpenOrderDescr struct {
-	Close     string      `json:"close"`
-	Leverage  string      `json:"leverage"`
-	Order     string      `json:"order"`
-	Ordertype string      `json:"ordertype"`
-	Pair      string      `json:"pair"`
-	Price     json.Number `json:"price"`
-	Price2    json.Number `json:"price2"`
-	Type      string      `json:"type"`
+	Close     string          `json:"close"`
+	Leverage  string          `json:"leverage"`
+	Order     string          `json:"order"`
+	Ordertype string          `json:"ordertype"`
+	Pair      string          `json:"pair"`
+	Price     decimal.Decimal `json:"price"`
+	Price2    decimal.Decimal `json:"price2"`
+	Type      string          `json:"type"`
 }
 
-// OpenOrder -
+// OpenOrder - order of `openOrders` channel. The first message of order has all fields and the next ones have only changed fields,
+// e.g. `status` or `vol_exec`. Use `Has` to check if field was sent and `Merge` to apply such delta to cached order.
 type OpenOrder struct {
-	Cost       json.Number    `json:"cost"`
-	Descr      OpenOrderDescr `json:"descr"`
-	Fee        json.Number    `json:"fee"`
-	LimitPrice json.Number    `json:"limitprice"`
-	Misc       string         `json:"misc"`
-	Oflags     string         `json:"oflags"`
-	OpenTime   json.Number    `json:"opentm"`
-	StartTime  json.Number    `json:"starttm"`
-	ExpireTime json.Number    `json:"expiretm"`
-	Price      json.Number    `json:"price"`
-	Refid      string         `json:"refid"`
-	Status     string         `json:"status"`
-	StopPrice  json.Number    `json:"stopprice"`
-	UserRef    int64          `json:"userref"`
-	Vol        json.Number    `json:"vol,string"`
-	VolExec    json.Number    `json:"vol_exec"`
+	Cost        decimal.Decimal `json:"cost"`
+	Descr       OpenOrderDescr  `json:"descr"`
+	Fee         decimal.Decimal `json:"fee"`
+	LimitPrice  decimal.Decimal `json:"limitprice"`
+	Misc        string          `json:"misc"`
+	Oflags      OrderFlags      `json:"oflags"`
+	OpenTime    Timestamp       `json:"opentm"`
+	StartTime   Timestamp       `json:"starttm"`
+	ExpireTime  Timestamp       `json:"expiretm"`
+	LastUpdated Timestamp       `json:"lastupdated"`
+	// Price - average price of executed volume
+	Price decimal.Decimal `json:"price"`
+	// AvgPrice - average price of executed volume which is sent in deltas
+	AvgPrice decimal.Decimal `json:"avg_price"`
+	Refid    string          `json:"refid"`
+	ClOrdID  string          `json:"cl_ord_id,omitempty"`
+	Status   OrderStatus     `json:"status"`
+	// CancelReason - reason of cancellation which is sent with `canceled` and `expired` status
+	CancelReason string          `json:"cancel_reason,omitempty"`
+	StopPrice    decimal.Decimal `json:"stopprice"`
+	UserRef      int64           `json:"userref"`
+	Vol          decimal.Decimal `json:"vol"`
+	VolExec      decimal.Decimal `json:"vol_exec"`
+
+	// fields - keys of JSON message. It's nil if order wasn't unmarshaled.
+	fields map[string]struct{}
 }
 
 // OwnTradesUpdate -
@@ -0,0 +1,283 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// ChannelMessage - data structure of Websocket API v2 channel message
+type ChannelMessage struct {
+	Channel string          `json:"channel"`
+	Type    string          `json:"type"`
+	Data    json.RawMessage `json:"data"`
+}
+
+type tickerV2 struct {
+	Symbol    string      `json:"symbol"`
+	Bid       json.Number `json:"bid"`
+	BidQty    json.Number `json:"bid_qty"`
+	Ask       json.Number `json:"ask"`
+	AskQty    json.Number `json:"ask_qty"`
+	Last      json.Number `json:"last"`
+	Volume    json.Number `json:"volume"`
+	VWAP      json.Number `json:"vwap"`
+	Low       json.Number `json:"low"`
+	High      json.Number `json:"high"`
+	Change    json.Number `json:"change"`
+	ChangePct json.Number `json:"change_pct"`
+}
+
+func (t tickerV2) toTickerUpdate() TickerUpdate {
+	open := t.Last
+	if last, err := decimal.NewFromString(t.Last.String()); err == nil {
+		if change, err := decimal.NewFromString(t.Change.String()); err == nil {
+			open = json.Number(last.Sub(change).String())
+		}
+	}
+	return TickerUpdate{
+		Ask:                Level{Price: t.Ask, Volume: t.AskQty},
+		Bid:                Level{Price: t.Bid, Volume: t.BidQty},
+		Close:              DecimalValues{Today: t.Last, Last24: t.Last},
+		Volume:             DecimalValues{Today: t.Volume, Last24: t.Volume},
+		VolumeAveragePrice: DecimalValues{Today: t.VWAP, Last24: t.VWAP},
+		Low:                DecimalValues{Today: t.Low, Last24: t.Low},
+		High:               DecimalValues{Today: t.High, Last24: t.High},
+		Open:               DecimalValues{Today: open, Last24: open},
+	}
+}
+
+type tradeV2 struct {
+	Symbol    string      `json:"symbol"`
+	Side      string      `json:"side"`
+	Price     json.Number `json:"price"`
+	Qty       json.Number `json:"qty"`
+	OrdType   string      `json:"ord_type"`
+	TradeID   int64       `json:"trade_id"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+func (t tradeV2) toTrade() Trade {
+	trade := Trade{
+		Price:     t.Price,
+		Volume:    t.Qty,
+		Time:      unixNumber(t.Timestamp),
+		Side:      Buy,
+		OrderType: Market,
+	}
+	if t.Side == SideSell {
+		trade.Side = Sell
+	}
+	if t.OrdType == OrderTypeLimit {
+		trade.OrderType = Limit
+	}
+	return trade
+}
+
+type candleV2 struct {
+	Symbol        string      `json:"symbol"`
+	Open          json.Number `json:"open"`
+	High          json.Number `json:"high"`
+	Low           json.Number `json:"low"`
+	Close         json.Number `json:"close"`
+	VWAP          json.Number `json:"vwap"`
+	Trades        int64       `json:"trades"`
+	Volume        json.Number `json:"volume"`
+	IntervalBegin time.Time   `json:"interval_begin"`
+	Interval      int64       `json:"interval"`
+	Timestamp     time.Time   `json:"timestamp"`
+}
+
+func (c candleV2) toCandle() Candle {
+	return Candle{
+		Time:      unixNumber(c.Timestamp),
+		EndTime:   unixNumber(c.IntervalBegin.Add(time.Duration(c.Interval) * time.Minute)),
+		Open:      c.Open,
+		High:      c.High,
+		Low:       c.Low,
+		Close:     c.Close,
+		VolumeWAP: c.VWAP,
+		Volume:    c.Volume,
+		Count:     c.Trades,
+	}
+}
+
+type bookLevelV2 struct {
+	Price json.Number `json:"price"`
+	Qty   json.Number `json:"qty"`
+}
+
+type bookV2 struct {
+	Symbol    string        `json:"symbol"`
+	Bids      []bookLevelV2 `json:"bids"`
+	Asks      []bookLevelV2 `json:"asks"`
+	Checksum  uint32        `json:"checksum"`
+	Timestamp time.Time     `json:"timestamp"`
+}
+
+func (b bookV2) toOrderBookUpdate(snapshot bool) OrderBookUpdate {
+	ts := unixNumber(b.Timestamp)
+	convert := func(levels []bookLevelV2) []OrderBookItem {
+		items := make([]OrderBookItem, len(levels))
+		for i := range levels {
+			items[i] = OrderBookItem{
+				Price:  levels[i].Price,
+				Volume: levels[i].Qty,
+				Time:   ts,
+			}
+		}
+		return items
+	}
+	return OrderBookUpdate{
+		Asks:       convert(b.Asks),
+		Bids:       convert(b.Bids),
+		CheckSum:   strconv.FormatUint(uint64(b.Checksum), 10),
+		IsSnapshot: snapshot,
+	}
+}
+
+// InstrumentAsset - asset reference data of `instrument` channel
+type InstrumentAsset struct {
+	ID               string          `json:"id"`
+	Status           string          `json:"status"`
+	Precision        int             `json:"precision"`
+	PrecisionDisplay int             `json:"precision_display"`
+	Borrowable       bool            `json:"borrowable"`
+	CollateralValue  decimal.Decimal `json:"collateral_value"`
+	MarginRate       decimal.Decimal `json:"margin_rate"`
+}
+
+// InstrumentPair - pair reference data of `instrument` channel
+type InstrumentPair struct {
+	Symbol             string          `json:"symbol"`
+	Base               string          `json:"base"`
+	Quote              string          `json:"quote"`
+	Status             string          `json:"status"`
+	QtyPrecision       int             `json:"qty_precision"`
+	QtyIncrement       decimal.Decimal `json:"qty_increment"`
+	PricePrecision     int             `json:"price_precision"`
+	PriceIncrement     decimal.Decimal `json:"price_increment"`
+	CostPrecision      int             `json:"cost_precision"`
+	CostMin            decimal.Decimal `json:"cost_min"`
+	QtyMin             decimal.Decimal `json:"qty_min"`
+	Marginable         bool            `json:"marginable"`
+	HasIndex           bool            `json:"has_index"`
+	MarginInitial      decimal.Decimal `json:"margin_initial"`
+	PositionLimitLong  int64           `json:"position_limit_long"`
+	PositionLimitShort int64           `json:"position_limit_short"`
+}
+
+// InstrumentUpdate - data structure of `instrument` channel message
+type InstrumentUpdate struct {
+	Assets     []InstrumentAsset `json:"assets"`
+	Pairs      []InstrumentPair  `json:"pairs"`
+	IsSnapshot bool              `json:"-"`
+}
+
+// BalanceWallet - balance of asset in a wallet
+type BalanceWallet struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id"`
+	Balance decimal.Decimal `json:"balance"`
+}
+
+// Balance - item of `balances` channel. Snapshot contains `Balance` and `Wallets`, update contains ledger entry fields.
+type Balance struct {
+	Asset      string          `json:"asset"`
+	AssetClass string          `json:"asset_class"`
+	Balance    decimal.Decimal `json:"balance"`
+	Wallets    []BalanceWallet `json:"wallets,omitempty"`
+	LedgerID   string          `json:"ledger_id,omitempty"`
+	RefID      string          `json:"ref_id,omitempty"`
+	Timestamp  *time.Time      `json:"timestamp,omitempty"`
+	Type       string          `json:"type,omitempty"`
+	Category   string          `json:"category,omitempty"`
+	WalletType string          `json:"wallet_type,omitempty"`
+	WalletID   string          `json:"wallet_id,omitempty"`
+	Amount     decimal.Decimal `json:"amount"`
+	Fee        decimal.Decimal `json:"fee"`
+}
+
+// BalancesUpdate - data structure of `balances` channel message
+type BalancesUpdate struct {
+	Balances   []Balance
+	IsSnapshot bool
+}
+
+// ExecutionFee - fee of execution
+type ExecutionFee struct {
+	Asset string          `json:"asset"`
+	Qty   decimal.Decimal `json:"qty"`
+}
+
+// Execution - item of `executions` channel: order status change or trade
+type Execution struct {
+	ExecType      string          `json:"exec_type"`
+	OrderID       string          `json:"order_id"`
+	ClOrdID       string          `json:"cl_ord_id,omitempty"`
+	OrderUserref  int64           `json:"order_userref,omitempty"`
+	Symbol        string          `json:"symbol,omitempty"`
+	Side          string          `json:"side,omitempty"`
+	OrderType     string          `json:"order_type,omitempty"`
+	OrderQty      decimal.Decimal `json:"order_qty"`
+	LimitPrice    decimal.Decimal `json:"limit_price"`
+	TimeInForce   string          `json:"time_in_force,omitempty"`
+	PostOnly      bool            `json:"post_only,omitempty"`
+	ReduceOnly    bool            `json:"reduce_only,omitempty"`
+	OrderStatus   string          `json:"order_status,omitempty"`
+	CumQty        decimal.Decimal `json:"cum_qty"`
+	CumCost       decimal.Decimal `json:"cum_cost"`
+	AvgPrice      decimal.Decimal `json:"avg_price"`
+	ExecID        string          `json:"exec_id,omitempty"`
+	TradeID       int64           `json:"trade_id,omitempty"`
+	LastQty       decimal.Decimal `json:"last_qty"`
+	LastPrice     decimal.Decimal `json:"last_price"`
+	Cost          decimal.Decimal `json:"cost"`
+	LiquidityInd  string          `json:"liquidity_ind,omitempty"`
+	Fees          []ExecutionFee  `json:"fees,omitempty"`
+	FeeUSDEquiv   decimal.Decimal `json:"fee_usd_equiv"`
+	Reason        string          `json:"reason,omitempty"`
+	Timestamp     time.Time       `json:"timestamp"`
+	Amended       bool            `json:"amended,omitempty"`
+	FeePreference string          `json:"fee_ccy_pref,omitempty"`
+}
+
+// ExecutionsUpdate - data structure of `executions` channel message
+type ExecutionsUpdate struct {
+	Executions []Execution
+	IsSnapshot bool
+}
+
+// Level3Order - single order of `level3` channel. `Event` is empty in snapshot and one of `add`, `modify` or `delete` in update.
+type Level3Order struct {
+	Event      string          `json:"event,omitempty"`
+	OrderID    string          `json:"order_id"`
+	LimitPrice decimal.Decimal `json:"limit_price"`
+	OrderQty   decimal.Decimal `json:"order_qty"`
+	Timestamp  time.Time       `json:"timestamp"`
+}
+
+// Level3Update - data structure of `level3` channel message
+type Level3Update struct {
+	Symbol     string        `json:"symbol"`
+	Bids       []Level3Order `json:"bids"`
+	Asks       []Level3Order `json:"asks"`
+	Checksum   uint32        `json:"checksum"`
+	Timestamp  time.Time     `json:"timestamp"`
+	IsSnapshot bool          `json:"-"`
+}
+
+// unixNumber - formats time as unix timestamp with microseconds like API v1 does
+func unixNumber(t time.Time) json.Number {
+	if t.IsZero() {
+		return ""
+	}
+	return json.Number(fmt.Sprintf("%d.%06d", t.Unix(), t.Nanosecond()/1000))
+}
+
+func decimalNumber(value decimal.Decimal) json.Number {
+	return json.Number(value.String())
+}
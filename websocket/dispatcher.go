@@ -0,0 +1,88 @@
+package websocket
+
+import "sync"
+
+// Listener - source of updates with single reader of `Listen()` channel. `Kraken`, `Pool` and `paper.Engine` implement it.
+type Listener interface {
+	Listen() <-chan Update
+}
+
+// Handler - consumer of updates which are passed by `Dispatcher`
+type Handler interface {
+	Handle(update Update)
+}
+
+// HandlerFunc - function which implements `Handler`
+type HandlerFunc func(update Update)
+
+// Handle -
+func (f HandlerFunc) Handle(update Update) {
+	f(update)
+}
+
+// Dispatcher - the only reader of `Listen()` channel. It passes every update to all handlers in order of registration.
+// Channels of a client should be read by subscription handles of consumers, but order statuses are sent only to `Listen()`,
+// so consumers which need them are registered in one dispatcher instead of reading `Listen()` concurrently.
+type Dispatcher struct {
+	source   Listener
+	handlers []Handler
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+	mx       sync.RWMutex
+}
+
+// NewDispatcher - creates dispatcher of `source` updates
+func NewDispatcher(source Listener, handlers ...Handler) *Dispatcher {
+	return &Dispatcher{
+		source:   source,
+		handlers: handlers,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Add - registers handler
+func (d *Dispatcher) Add(handler Handler) {
+	d.mx.Lock()
+	d.handlers = append(d.handlers, handler)
+	d.mx.Unlock()
+}
+
+// Start - starts reading of `Listen()` channel. It's stopped by `Close` or when the channel is closed.
+func (d *Dispatcher) Start() {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+
+		updates := d.source.Listen()
+		for {
+			select {
+			case <-d.stop:
+				return
+			case update, ok := <-updates:
+				if !ok {
+					return
+				}
+				d.dispatch(update)
+			}
+		}
+	}()
+}
+
+func (d *Dispatcher) dispatch(update Update) {
+	d.mx.RLock()
+	defer d.mx.RUnlock()
+
+	for i := range d.handlers {
+		d.handlers[i].Handle(update)
+	}
+}
+
+// Close - stops reading of `Listen()` channel
+func (d *Dispatcher) Close() {
+	d.stopOnce.Do(func() {
+		close(d.stop)
+	})
+	d.wg.Wait()
+}
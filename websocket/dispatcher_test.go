@@ -0,0 +1,51 @@
+package websocket
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type listenerMock chan Update
+
+func (m listenerMock) Listen() <-chan Update {
+	return m
+}
+
+func TestDispatcher(t *testing.T) {
+	source := make(listenerMock, 3)
+	var (
+		received [2][]string
+		mx       sync.Mutex
+	)
+	handler := func(i int) HandlerFunc {
+		return func(update Update) {
+			mx.Lock()
+			received[i] = append(received[i], update.ChannelName)
+			mx.Unlock()
+		}
+	}
+
+	d := NewDispatcher(source, handler(0))
+	d.Add(handler(1))
+	d.Start()
+
+	source <- Update{ChannelName: EventAddOrder}
+	source <- Update{ChannelName: EventCancelOrder}
+	require.Eventually(t, func() bool {
+		mx.Lock()
+		defer mx.Unlock()
+		return len(received[1]) == 2
+	}, time.Second, time.Millisecond)
+
+	d.Close()
+	d.Close()
+	assert.Equal(t, []string{EventAddOrder, EventCancelOrder}, received[0])
+	assert.Equal(t, received[0], received[1])
+
+	event := Event[TickerUpdate]{ChannelID: 1, ChannelName: ChanTicker, Pair: BTCUSD, Sequence: 2}
+	assert.Equal(t, Update{ChannelID: 1, ChannelName: ChanTicker, Pair: BTCUSD, Data: TickerUpdate{}, Sequence: Seq{Value: 2}}, event.Update())
+}
@@ -67,15 +67,19 @@ func (k *Kraken) handleEventSubscriptionStatus(data []byte) error {
 		log.Infof("\tChannel ID: %d", status.ChannelID)
 		log.Infof("\tReq ID: %s", status.ReqID)
 
-		if status.Status == SubscriptionStatusSubscribed {
-			k.subscriptions[status.ChannelID] = &status
-		} else if status.Status == SubscriptionStatusUnsubscribed {
-			delete(k.subscriptions, status.ChannelID)
-		}
 	}
+
+	k.applySubscriptionStatus(status)
 	return nil
 }
 
+// applySubscriptionStatus - updates registry, handles and token state by subscription status
+func (k *Kraken) applySubscriptionStatus(status SubscriptionStatus) {
+	k.registry.setStatus(status)
+	k.updateHandlesState(status)
+	k.handlePrivateStatus(status)
+}
+
 func (k *Kraken) handleEventCancelOrderStatus(data []byte) error {
 	var cancelOrderResponse CancelOrderResponse
 	if err := json.Unmarshal(data, &cancelOrderResponse); err != nil {
@@ -87,10 +91,10 @@ func (k *Kraken) handleEventCancelOrderStatus(data []byte) error {
 		log.Errorf(cancelOrderResponse.ErrorMessage)
 	case StatusOK:
 		log.Debug(" Order successfully cancelled")
-		k.msg <- Update{
+		k.publish(Update{
 			ChannelName: EventCancelOrder,
 			Data:        cancelOrderResponse,
-		}
+		})
 	default:
 		log.Errorf("Unknown status: %s", cancelOrderResponse.Status)
 	}
@@ -108,13 +112,15 @@ func (k *Kraken) handleEventAddOrderStatus(data []byte) error {
 		log.Errorf(addOrderResponse.ErrorMessage)
 	case StatusOK:
 		log.Debug("Order successfully sent")
-		k.msg <- Update{
-			ChannelName: EventAddOrder,
-			Data:        addOrderResponse,
-		}
 	default:
 		log.Errorf("Unknown status: %s", addOrderResponse.Status)
+		return nil
 	}
+	// rejections are published too, so order trackers can finish rejected orders
+	k.publish(Update{
+		ChannelName: EventAddOrder,
+		Data:        addOrderResponse,
+	})
 	return nil
 }
 
@@ -129,10 +135,10 @@ func (k *Kraken) handleEventCancellAllStatus(data []byte) error {
 		log.Errorf(cancelAllResponse.ErrorMessage)
 	case StatusOK:
 		log.Debugf("%d orders cancelled", cancelAllResponse.Count)
-		k.msg <- Update{
+		k.publish(Update{
 			ChannelName: EventCancelAllStatus,
 			Data:        cancelAllResponse,
-		}
+		})
 	default:
 		log.Errorf("Unknown status: %s", cancelAllResponse.Status)
 	}
@@ -149,10 +155,10 @@ func (k *Kraken) handleEventCancellAllOrdersAfter(data []byte) error {
 	case StatusError:
 		log.Errorf(cancelAllResponse.ErrorMessage)
 	case StatusOK:
-		k.msg <- Update{
+		k.publish(Update{
 			ChannelName: EventCancelAllOrdersAfter,
 			Data:        cancelAllResponse,
-		}
+		})
 	default:
 		log.Errorf("Unknown status: %s", cancelAllResponse.Status)
 	}
@@ -170,12 +176,13 @@ func (k *Kraken) handleEventEditOrderStatus(data []byte) error {
 		log.Errorf(editOrderResponse.ErrorMessage)
 	case StatusOK:
 		log.Debug("Order successfully edited")
-		k.msg <- Update{
-			ChannelName: EventEditOrder,
-			Data:        editOrderResponse,
-		}
 	default:
 		log.Errorf("Unknown status: %s", editOrderResponse.Status)
+		return nil
 	}
+	k.publish(Update{
+		ChannelName: EventEditOrder,
+		Data:        editOrderResponse,
+	})
 	return nil
 }
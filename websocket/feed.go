@@ -0,0 +1,70 @@
+package websocket
+
+import "sync"
+
+// Feed - buffered channel of events which never blocks the sender. If the buffer is full, the oldest event is dropped
+// and counted, so a slow or stopped reader can't stall the goroutine which publishes, e.g. the read loop of websocket.
+// It's used by packages which publish their own events built from websocket updates.
+type Feed[T any] struct {
+	out     chan T
+	dropped uint64
+	closed  bool
+	mx      sync.Mutex
+}
+
+// NewFeed - creates feed with buffer of `size` events
+func NewFeed[T any](size int) *Feed[T] {
+	if size < 1 {
+		size = 1
+	}
+	return &Feed[T]{
+		out: make(chan T, size),
+	}
+}
+
+// C - returns channel of events. It's closed by `Close`.
+func (f *Feed[T]) C() <-chan T {
+	return f.out
+}
+
+// Publish - sends events in order. Events of concurrent calls aren't interleaved.
+func (f *Feed[T]) Publish(events ...T) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	if f.closed {
+		return
+	}
+	for i := range events {
+		for sent := false; !sent; {
+			select {
+			case f.out <- events[i]:
+				sent = true
+			default:
+				select {
+				case <-f.out:
+					f.dropped++
+				default:
+				}
+			}
+		}
+	}
+}
+
+// Dropped - returns count of events which were dropped because the reader was too slow
+func (f *Feed[T]) Dropped() uint64 {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	return f.dropped
+}
+
+// Close - closes channel of events. Events which are published after it are ignored.
+func (f *Feed[T]) Close() {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	if !f.closed {
+		f.closed = true
+		close(f.out)
+	}
+}
@@ -0,0 +1,36 @@
+package websocket
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFeed(t *testing.T) {
+	feed := NewFeed[int](2)
+	feed.Publish(1, 2, 3)
+	feed.Publish(4)
+	assert.Equal(t, uint64(2), feed.Dropped())
+	assert.Equal(t, 3, <-feed.C())
+	assert.Equal(t, 4, <-feed.C())
+
+	// nobody reads the channel, publishers aren't blocked
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			feed.Publish(i, i)
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, uint64(20), feed.Dropped())
+	assert.Equal(t, <-feed.C(), <-feed.C(), "events of one call aren't interleaved")
+
+	feed.Close()
+	feed.Close()
+	feed.Publish(5)
+	_, ok := <-feed.C()
+	assert.False(t, ok)
+}
@@ -0,0 +1,546 @@
+package websocket
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// SubscriptionState - state of subscription to a channel for a pair
+type SubscriptionState string
+
+// Subscription states
+const (
+	StatePending      SubscriptionState = "pending"
+	StateSubscribed   SubscriptionState = "subscribed"
+	StateFailed       SubscriptionState = "failed"
+	StateUnsubscribed SubscriptionState = "unsubscribed"
+)
+
+// Event - typed channel message with the pair it belongs to
+type Event[T any] struct {
+	ChannelID   int64
+	ChannelName string
+	Pair        string
+	Sequence    int64
+	Data        T
+}
+
+// Update - converts event back to untyped update, e.g. to pass it to consumers which handle `Listen()` updates
+func (e Event[T]) Update() Update {
+	return Update{
+		ChannelID:   e.ChannelID,
+		Data:        e.Data,
+		ChannelName: e.ChannelName,
+		Pair:        e.Pair,
+		Sequence:    Seq{Value: e.Sequence},
+	}
+}
+
+// HandleOption - option function for subscription handles
+type HandleOption func(*handleConfig)
+
+type handleConfig struct {
+	bufferSize     int
+	overflowPolicy OverflowPolicy
+	callback       interface{}
+	subscribe      []SubscribeOption
+}
+
+// WithHandleBuffer - add custom capacity of handle's channel. Default: 128.
+func WithHandleBuffer(size int) HandleOption {
+	return func(cfg *handleConfig) {
+		cfg.bufferSize = size
+	}
+}
+
+// WithHandleOverflowPolicy - add behaviour of handle's channel when it's full. `OverflowBlock` stalls the read loop of the client,
+// so all other handles and `Listen()` wait for the consumer of this handle. `OverflowCoalesce` isn't supported by handles and works
+// as `OverflowDropOldest`. Dropped messages are counted by `Dropped` and the next order book update of the pair is marked by `Gap`.
+// Default: OverflowDropOldest.
+func WithHandleOverflowPolicy(policy OverflowPolicy) HandleOption {
+	return func(cfg *handleConfig) {
+		cfg.overflowPolicy = policy
+	}
+}
+
+// WithSubscribeOptions - add options of subscription request, for example `WithSnapshot`
+func WithSubscribeOptions(opts ...SubscribeOption) HandleOption {
+	return func(cfg *handleConfig) {
+		cfg.subscribe = append(cfg.subscribe, opts...)
+	}
+}
+
+// WithCallback - handle calls `fn` for every message instead of sending it to the channel. `fn` is called from the read loop, so it should be fast.
+// Type of event must match the subscription: for example, `func(Event[TickerUpdate])` for `SubscribeTickerHandle`.
+func WithCallback[T any](fn func(Event[T])) HandleOption {
+	return func(cfg *handleConfig) {
+		cfg.callback = fn
+	}
+}
+
+// channelName - returns channel name which Kraken uses in data messages for the subscription. For example, `book-10` or `ohlc-5`.
+func (s Subscription) channelName() string {
+	switch s.Name {
+	case ChanBook:
+		depth := s.Depth
+		if depth == 0 {
+			depth = Depth10
+		}
+		return s.Name + "-" + strconv.FormatInt(depth, 10)
+	case ChanCandles:
+		interval := s.Interval
+		if interval == 0 {
+			interval = Interval1
+		}
+		return s.Name + "-" + strconv.FormatInt(interval, 10)
+	default:
+		return s.Name
+	}
+}
+
+// isPrivateChannel - returns true for account channels which require authentication token
+func isPrivateChannel(name string) bool {
+	switch name {
+	case ChanOwnTrades, ChanOpenOrders, ChanExecutions, ChanBalances:
+		return true
+	default:
+		return false
+	}
+}
+
+// isPairlessChannel - returns true for channels which are subscribed without pairs
+func isPairlessChannel(name string) bool {
+	return isPrivateChannel(name) || name == ChanInstrument
+}
+
+// handle - untyped part of subscription handle which is stored in `Kraken`
+type handle interface {
+	name() string
+	matches(channelName, pair string) bool
+	deliver(upd Update) bool
+	setState(channelName, pair string, state SubscriptionState, err error)
+}
+
+// SubscriptionHandle - handle of subscription with its own typed channel or callback.
+// Messages delivered to a handle are not published to `Listen()` channel.
+type SubscriptionHandle[T any] struct {
+	dropped uint64 // first field for 64-bit alignment of atomic operations
+
+	k           *Kraken
+	id          uint64
+	spec        Subscription
+	channelName string
+
+	ch       chan Event[T]
+	callback func(Event[T])
+	policy   OverflowPolicy
+	done     chan struct{}
+	once     sync.Once
+
+	mx     sync.RWMutex
+	states map[string]SubscriptionState
+	err    error
+	closed bool
+
+	// gaps - pairs whose order book updates were dropped. The next delivered update of the pair is marked by `Gap`.
+	gaps  map[string]struct{}
+	gapMx sync.Mutex
+}
+
+func subscribeHandle[T any](k *Kraken, spec Subscription, pairs []string, opts []HandleOption) (*SubscriptionHandle[T], error) {
+	cfg := handleConfig{
+		bufferSize:     128,
+		overflowPolicy: OverflowDropOldest,
+	}
+	for i := range opts {
+		opts[i](&cfg)
+	}
+
+	for i := range cfg.subscribe {
+		cfg.subscribe[i](&spec)
+	}
+
+	h := &SubscriptionHandle[T]{
+		k:           k,
+		spec:        spec,
+		channelName: spec.channelName(),
+		policy:      cfg.overflowPolicy,
+		states:      make(map[string]SubscriptionState),
+		done:        make(chan struct{}),
+		gaps:        make(map[string]struct{}),
+	}
+
+	if cfg.callback != nil {
+		callback, ok := cfg.callback.(func(Event[T]))
+		if !ok {
+			return nil, errors.Errorf("invalid callback type %T for %s subscription", cfg.callback, spec.Name)
+		}
+		h.callback = callback
+	} else {
+		h.ch = make(chan Event[T], cfg.bufferSize)
+	}
+
+	if isPairlessChannel(spec.Name) {
+		h.states[""] = StatePending
+	} else {
+		if len(pairs) == 0 {
+			return nil, errors.New("pairs are required")
+		}
+		for i := range pairs {
+			h.states[pairs[i]] = StatePending
+		}
+	}
+
+	h.id = k.addHandle(h)
+
+	if err := k.subscribe(spec, pairs); err != nil {
+		k.removeHandle(h.id)
+		return nil, err
+	}
+
+	// subscription may be already established by another consumer
+	h.mx.Lock()
+	for pair := range h.states {
+		if state, ok := k.registry.state(h.channelName, pair); ok {
+			h.states[pair] = state
+		}
+	}
+	h.mx.Unlock()
+	return h, nil
+}
+
+// C - returns channel of typed messages. It's nil if handle was created with callback. Channel is closed by `Close`.
+func (h *SubscriptionHandle[T]) C() <-chan Event[T] {
+	return h.ch
+}
+
+// Status - returns aggregated status of subscription: failed if any pair failed, subscribed if all pairs are subscribed.
+func (h *SubscriptionHandle[T]) Status() SubscriptionState {
+	h.mx.RLock()
+	defer h.mx.RUnlock()
+
+	if h.closed {
+		return StateUnsubscribed
+	}
+
+	result := StateSubscribed
+	for _, state := range h.states {
+		switch state {
+		case StateFailed:
+			return StateFailed
+		case StatePending, StateUnsubscribed:
+			result = StatePending
+		}
+	}
+	return result
+}
+
+// PairStates - returns subscription state by pair. Private subscriptions have single state with empty pair.
+func (h *SubscriptionHandle[T]) PairStates() map[string]SubscriptionState {
+	h.mx.RLock()
+	defer h.mx.RUnlock()
+
+	states := make(map[string]SubscriptionState, len(h.states))
+	for pair, state := range h.states {
+		states[pair] = state
+	}
+	return states
+}
+
+// Err - returns the last subscription error received from Kraken
+func (h *SubscriptionHandle[T]) Err() error {
+	h.mx.RLock()
+	defer h.mx.RUnlock()
+	return h.err
+}
+
+// Dropped - returns count of messages dropped because handle's channel was full
+func (h *SubscriptionHandle[T]) Dropped() uint64 {
+	return atomic.LoadUint64(&h.dropped)
+}
+
+// Close - closes the channel and unsubscribes from pairs which are not used by other consumers.
+func (h *SubscriptionHandle[T]) Close() error {
+	first := false
+	h.once.Do(func() {
+		first = true
+		// release blocked delivery before taking write lock
+		close(h.done)
+	})
+	if !first {
+		return nil
+	}
+
+	h.mx.Lock()
+	h.closed = true
+	pairs := make([]string, 0, len(h.states))
+	for pair := range h.states {
+		pairs = append(pairs, pair)
+	}
+	if h.ch != nil {
+		close(h.ch)
+	}
+	h.mx.Unlock()
+
+	h.k.removeHandle(h.id)
+	return h.k.release(h.spec, pairs)
+}
+
+func (h *SubscriptionHandle[T]) matches(channelName, pair string) bool {
+	if channelName != h.channelName {
+		return false
+	}
+	if isPairlessChannel(h.spec.Name) {
+		return true
+	}
+
+	h.mx.RLock()
+	defer h.mx.RUnlock()
+	_, ok := h.states[pair]
+	return ok
+}
+
+func (h *SubscriptionHandle[T]) deliver(upd Update) bool {
+	data, ok := upd.Data.(T)
+	if !ok {
+		return false
+	}
+	event := Event[T]{
+		ChannelID:   upd.ChannelID,
+		ChannelName: upd.ChannelName,
+		Pair:        upd.Pair,
+		Sequence:    upd.Sequence.Value,
+		Data:        data,
+	}
+
+	if h.callback != nil {
+		select {
+		case <-h.done:
+		default:
+			h.callback(event)
+		}
+		return true
+	}
+
+	h.mx.RLock()
+	defer h.mx.RUnlock()
+
+	if h.closed {
+		return true
+	}
+
+	switch h.policy {
+	case OverflowBlock:
+		select {
+		case h.ch <- event:
+		case <-h.done:
+		case <-h.k.stop:
+		}
+	case OverflowDropNewest:
+		h.fillGap(&event)
+		select {
+		case h.ch <- event:
+		default:
+			h.drop(event)
+		}
+	default:
+		for sent := false; !sent; {
+			h.fillGap(&event)
+			select {
+			case h.ch <- event:
+				sent = true
+			default:
+				select {
+				case old := <-h.ch:
+					h.drop(old)
+				default:
+				}
+			}
+		}
+	}
+	return true
+}
+
+// drop - counts dropped message and remembers gap in order book stream of its pair
+func (h *SubscriptionHandle[T]) drop(event Event[T]) {
+	atomic.AddUint64(&h.dropped, 1)
+	if _, ok := any(event.Data).(OrderBookUpdate); ok {
+		h.gapMx.Lock()
+		h.gaps[event.Pair] = struct{}{}
+		h.gapMx.Unlock()
+	}
+}
+
+// fillGap - marks order book update if previous updates of the same pair were dropped, as `publisher` does for `Listen()`
+func (h *SubscriptionHandle[T]) fillGap(event *Event[T]) {
+	book, ok := any(event.Data).(OrderBookUpdate)
+	if !ok {
+		return
+	}
+
+	h.gapMx.Lock()
+	defer h.gapMx.Unlock()
+
+	if _, ok := h.gaps[event.Pair]; !ok {
+		return
+	}
+	delete(h.gaps, event.Pair)
+
+	if !book.IsSnapshot {
+		book.Gap = true
+		event.Data = any(book).(T)
+	}
+}
+
+func (h *SubscriptionHandle[T]) setState(channelName, pair string, state SubscriptionState, err error) {
+	if channelName != h.channelName {
+		return
+	}
+	if isPairlessChannel(h.spec.Name) {
+		pair = ""
+	}
+
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	if h.closed {
+		return
+	}
+	if _, ok := h.states[pair]; !ok {
+		return
+	}
+	h.states[pair] = state
+	if err != nil {
+		h.err = err
+	}
+}
+
+func (k *Kraken) addHandle(h handle) uint64 {
+	k.handlesMx.Lock()
+	defer k.handlesMx.Unlock()
+
+	k.handleID++
+	k.handles[k.handleID] = h
+	return k.handleID
+}
+
+func (k *Kraken) removeHandle(id uint64) {
+	k.handlesMx.Lock()
+	delete(k.handles, id)
+	k.handlesMx.Unlock()
+}
+
+func (h *SubscriptionHandle[T]) name() string {
+	return h.channelName
+}
+
+// dispatch - delivers update to subscription handles. If no handle accepts update, it's published to `Listen()` channel.
+// Handles are delivered without lock, so callbacks may subscribe and close handles.
+func (k *Kraken) dispatch(upd Update) {
+	k.handlesMx.RLock()
+	matched := make([]handle, 0, 1)
+	for _, h := range k.handles {
+		if h.matches(upd.ChannelName, upd.Pair) {
+			matched = append(matched, h)
+		}
+	}
+	k.handlesMx.RUnlock()
+
+	delivered := false
+	for _, h := range matched {
+		if h.deliver(upd) {
+			delivered = true
+		}
+	}
+	if !delivered {
+		k.publish(upd)
+	}
+}
+
+// updateHandlesState - applies subscription status to handles
+func (k *Kraken) updateHandlesState(status SubscriptionStatus) {
+	channelName := status.ChannelName
+	if channelName == "" {
+		channelName = status.Subscription.channelName()
+	}
+
+	var (
+		state SubscriptionState
+		err   error
+	)
+	switch status.Status {
+	case SubscriptionStatusSubscribed:
+		state = StateSubscribed
+	case SubscriptionStatusUnsubscribed:
+		state = StateUnsubscribed
+	case SubscriptionStatusError:
+		state = StateFailed
+		err = errors.New(status.Error)
+	default:
+		return
+	}
+
+	k.handlesMx.RLock()
+	defer k.handlesMx.RUnlock()
+	for _, h := range k.handles {
+		h.setState(channelName, status.Pair, state, err)
+	}
+}
+
+// SubscribeTickerHandle - subscribes to ticker and returns handle with typed channel of `TickerUpdate`.
+func (k *Kraken) SubscribeTickerHandle(pairs []string, opts ...HandleOption) (*SubscriptionHandle[TickerUpdate], error) {
+	return subscribeHandle[TickerUpdate](k, Subscription{Name: ChanTicker}, pairs, opts)
+}
+
+// SubscribeCandlesHandle - subscribes to candles and returns handle with typed channel of `Candle`.
+func (k *Kraken) SubscribeCandlesHandle(pairs []string, interval int64, opts ...HandleOption) (*SubscriptionHandle[Candle], error) {
+	return subscribeHandle[Candle](k, Subscription{Name: ChanCandles, Interval: interval}, pairs, opts)
+}
+
+// SubscribeTradesHandle - subscribes to trades and returns handle with typed channel of `[]Trade`.
+func (k *Kraken) SubscribeTradesHandle(pairs []string, opts ...HandleOption) (*SubscriptionHandle[[]Trade], error) {
+	return subscribeHandle[[]Trade](k, Subscription{Name: ChanTrades}, pairs, opts)
+}
+
+// SubscribeSpreadHandle - subscribes to spread and returns handle with typed channel of `Spread`.
+func (k *Kraken) SubscribeSpreadHandle(pairs []string, opts ...HandleOption) (*SubscriptionHandle[Spread], error) {
+	return subscribeHandle[Spread](k, Subscription{Name: ChanSpread}, pairs, opts)
+}
+
+// SubscribeBookHandle - subscribes to order book and returns handle with typed channel of `OrderBookUpdate`.
+func (k *Kraken) SubscribeBookHandle(pairs []string, depth int64, opts ...HandleOption) (*SubscriptionHandle[OrderBookUpdate], error) {
+	return subscribeHandle[OrderBookUpdate](k, Subscription{Name: ChanBook, Depth: depth}, pairs, opts)
+}
+
+// SubscribeOwnTradesHandle - subscribes to own trades and returns handle with typed channel of `OwnTradesUpdate`.
+func (k *Kraken) SubscribeOwnTradesHandle(opts ...HandleOption) (*SubscriptionHandle[OwnTradesUpdate], error) {
+	return subscribeHandle[OwnTradesUpdate](k, Subscription{Name: ChanOwnTrades}, nil, opts)
+}
+
+// SubscribeOpenOrdersHandle - subscribes to open orders and returns handle with typed channel of `OpenOrdersUpdate`.
+func (k *Kraken) SubscribeOpenOrdersHandle(opts ...HandleOption) (*SubscriptionHandle[OpenOrdersUpdate], error) {
+	return subscribeHandle[OpenOrdersUpdate](k, Subscription{Name: ChanOpenOrders}, nil, opts)
+}
+
+// SubscribeInstrumentHandle - subscribes to reference data of assets and pairs and returns handle with typed channel of `InstrumentUpdate`. Websocket API v2 only.
+func (k *Kraken) SubscribeInstrumentHandle(opts ...HandleOption) (*SubscriptionHandle[InstrumentUpdate], error) {
+	return subscribeHandle[InstrumentUpdate](k, Subscription{Name: ChanInstrument}, nil, opts)
+}
+
+// SubscribeBalancesHandle - subscribes to account balances and returns handle with typed channel of `BalancesUpdate`. Websocket API v2 only.
+func (k *Kraken) SubscribeBalancesHandle(opts ...HandleOption) (*SubscriptionHandle[BalancesUpdate], error) {
+	return subscribeHandle[BalancesUpdate](k, Subscription{Name: ChanBalances}, nil, opts)
+}
+
+// SubscribeExecutionsHandle - subscribes to order and trade events and returns handle with typed channel of `ExecutionsUpdate`. Websocket API v2 only.
+func (k *Kraken) SubscribeExecutionsHandle(opts ...HandleOption) (*SubscriptionHandle[ExecutionsUpdate], error) {
+	return subscribeHandle[ExecutionsUpdate](k, Subscription{Name: ChanExecutions}, nil, opts)
+}
+
+// SubscribeLevel3Handle - subscribes to individual orders of the book and returns handle with typed channel of `Level3Update`. Websocket API v2 only.
+func (k *Kraken) SubscribeLevel3Handle(pairs []string, depth int64, opts ...HandleOption) (*SubscriptionHandle[Level3Update], error) {
+	return subscribeHandle[Level3Update](k, Subscription{Name: ChanLevel3, Depth: depth}, pairs, opts)
+}
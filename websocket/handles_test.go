@@ -0,0 +1,159 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const tickerMessage = `[340,{"a":["5525.40000",1,"1.000"],"b":["5525.10000",1,"1.000"],"c":["5525.10000","0.00398963"],"v":["2634.11501494","3591.17907851"],"p":["5631.44067","5653.78939"],"t":[11493,16267],"l":["5505.00000","5505.00000"],"h":["5783.00000","5783.00000"],"o":["5760.70000","5763.40000"]},"ticker","XBT/USD"]`
+
+func TestSubscriptionHandle_FanOut(t *testing.T) {
+	k := NewKraken(ProdBaseURL)
+
+	first, err := k.SubscribeTickerHandle([]string{BTCUSD})
+	require.NoError(t, err)
+
+	var fromCallback []Event[TickerUpdate]
+	second, err := k.SubscribeTickerHandle([]string{BTCUSD}, WithCallback(func(e Event[TickerUpdate]) {
+		fromCallback = append(fromCallback, e)
+	}))
+	require.NoError(t, err)
+
+	assert.Equal(t, StatePending, first.Status())
+	require.NoError(t, k.handleMessage([]byte(`{"channelID":340,"channelName":"ticker","event":"subscriptionStatus","pair":"XBT/USD","status":"subscribed","subscription":{"name":"ticker"}}`)))
+	assert.Equal(t, StateSubscribed, first.Status())
+	assert.Equal(t, StateSubscribed, second.Status())
+
+	require.NoError(t, k.handleMessage([]byte(tickerMessage)))
+
+	event := <-first.C()
+	assert.Equal(t, BTCUSD, event.Pair)
+	assert.Equal(t, "5525.40000", event.Data.Ask.Price.String())
+	require.Len(t, fromCallback, 1)
+	assert.Equal(t, BTCUSD, fromCallback[0].Pair)
+
+	select {
+	case upd := <-k.Listen():
+		t.Errorf("update delivered to handle must not be published: %#v", upd)
+	default:
+	}
+
+	require.NoError(t, first.Close())
+	assert.Equal(t, StateUnsubscribed, first.Status())
+	_, ok := <-first.C()
+	assert.False(t, ok)
+
+	require.NoError(t, second.Close())
+	require.NoError(t, k.handleMessage([]byte(tickerMessage)))
+	upd := <-k.Listen()
+	assert.IsType(t, TickerUpdate{}, upd.Data)
+}
+
+func TestSubscriptionHandle_Failed(t *testing.T) {
+	k := NewKraken(ProdBaseURL)
+
+	h, err := k.SubscribeBookHandle([]string{BTCUSD}, 42)
+	require.NoError(t, err)
+
+	require.NoError(t, k.handleMessage([]byte(`{"errorMessage":"Subscription depth not supported","event":"subscriptionStatus","pair":"XBT/USD","status":"error","subscription":{"depth":42,"name":"book"}}`)))
+	assert.Equal(t, StateFailed, h.Status())
+	assert.EqualError(t, h.Err(), "Subscription depth not supported")
+}
+
+func TestSubscriptionHandle_InvalidCallback(t *testing.T) {
+	k := NewKraken(ProdBaseURL)
+
+	_, err := k.SubscribeSpreadHandle([]string{BTCUSD}, WithCallback(func(e Event[TickerUpdate]) {}))
+	assert.Error(t, err)
+}
+
+func TestSubscriptionHandle_Gap(t *testing.T) {
+	k := NewKraken(ProdBaseURL)
+
+	h, err := k.SubscribeBookHandle([]string{BTCUSD, ETHUSD}, Depth10, WithHandleBuffer(1), WithHandleOverflowPolicy(OverflowDropNewest))
+	require.NoError(t, err)
+
+	k.dispatch(bookUpdate(BTCUSD, true, "100", "1"))
+	k.dispatch(bookUpdate(BTCUSD, false, "101", "1"))
+	assert.Equal(t, uint64(1), h.Dropped())
+
+	first := <-h.C()
+	assert.True(t, first.Data.IsSnapshot)
+
+	k.dispatch(bookUpdate(ETHUSD, false, "10", "1"))
+	other := <-h.C()
+	assert.False(t, other.Data.Gap, "gap is tracked by pair")
+
+	k.dispatch(bookUpdate(BTCUSD, false, "102", "1"))
+	next := <-h.C()
+	assert.True(t, next.Data.Gap, "update after dropped one should be marked")
+
+	k.dispatch(bookUpdate(BTCUSD, false, "103", "1"))
+	assert.False(t, (<-h.C()).Data.Gap)
+
+	// order book fed from handle is resynced by the gap
+	book := NewOrderBook(10, 5, 8)
+	require.NoError(t, book.ApplyUpdate(first.Data, false))
+	assert.ErrorIs(t, book.ApplyUpdate(next.Data, false), ErrResyncRequired)
+	assert.True(t, book.NeedsResync())
+}
+
+func TestSubscriptionHandle_DropOldest(t *testing.T) {
+	k := NewKraken(ProdBaseURL)
+
+	slow, err := k.SubscribeBookHandle([]string{BTCUSD}, Depth10, WithHandleBuffer(1))
+	require.NoError(t, err)
+	fast, err := k.SubscribeBookHandle([]string{BTCUSD}, Depth10, WithHandleBuffer(4))
+	require.NoError(t, err)
+
+	// nobody reads the slow handle: other consumers aren't blocked and the latest update is kept
+	k.dispatch(bookUpdate(BTCUSD, true, "100", "1"))
+	k.dispatch(bookUpdate(BTCUSD, false, "101", "1"))
+	k.dispatch(bookUpdate(BTCUSD, false, "102", "1"))
+	assert.Equal(t, uint64(2), slow.Dropped())
+	assert.Zero(t, fast.Dropped())
+	assert.Len(t, fast.C(), 3)
+
+	last := <-slow.C()
+	assert.True(t, last.Data.Gap)
+	assert.Equal(t, "102", last.Data.Asks[0].Price.String())
+}
+
+func TestSubscriptionHandle_CloseFromCallback(t *testing.T) {
+	k := NewKraken(ProdBaseURL)
+
+	var (
+		h     *SubscriptionHandle[TickerUpdate]
+		other *SubscriptionHandle[TickerUpdate]
+		calls int
+	)
+	h, err := k.SubscribeTickerHandle([]string{BTCUSD}, WithCallback(func(e Event[TickerUpdate]) {
+		calls++
+		// callbacks run without lock of handles, so they may subscribe and unsubscribe
+		var err error
+		other, err = k.SubscribeTickerHandle([]string{ETHUSD})
+		assert.NoError(t, err)
+		assert.NoError(t, h.Close())
+	}))
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		require.NoError(t, k.handleMessage([]byte(tickerMessage)))
+		require.NoError(t, k.handleMessage([]byte(tickerMessage)))
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("read loop is blocked by callback")
+	}
+
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, StateUnsubscribed, h.Status())
+	require.NotNil(t, other)
+	assert.NoError(t, other.Close())
+}
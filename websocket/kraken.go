@@ -3,29 +3,61 @@ package websocket
 import (
 	"encoding/json"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/aopoltorzhicky/go_kraken/rest"
 	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
+// OrderEntry - order entry surface of websocket API. `Kraken` and `paper.Engine` implement it,
+// so strategy which depends on it switches between live and paper trading by one flag.
+type OrderEntry interface {
+	AddOrder(req AddOrderRequest) error
+	EditOrder(req EditOrderRequest) error
+	CancelOrder(orderIDs []string) error
+	CancelAll() error
+	Listen() <-chan Update
+}
+
+var _ OrderEntry = (*Kraken)(nil)
+
 // Kraken -
 type Kraken struct {
-	url   string
-	token string
+	url      string
+	tokens   *tokenManager
+	protocol protocol
+	reqID    int64
 
-	conn          *websocket.Conn
-	subscriptions map[int64]*SubscriptionStatus
+	conn     *websocket.Conn
+	registry *subscriptionRegistry
 
 	reconnectTimeout time.Duration
 	readTimeout      time.Duration
 	heartbeatTimeout time.Duration
 
-	msg  chan Update
-	stop chan struct{}
+	msg            *publisher
+	bufferSize     int
+	overflowPolicy OverflowPolicy
+	stop           chan struct{}
+
+	handles   map[uint64]handle
+	handleID  uint64
+	handlesMx sync.RWMutex
+
+	reconnectHooks map[uint64]func()
+	hookID         uint64
+	hooksMx        sync.RWMutex
+
+	// disconnectedAt - time when connection was lost. It's zero while connection is alive.
+	disconnectedAt time.Time
+
+	recorder   *Recorder
+	recordConn string
 
 	lock sync.RWMutex
 }
@@ -37,15 +69,22 @@ func NewKraken(url string, opts ...KrakenOption) *Kraken {
 		reconnectTimeout: 5 * time.Second,
 		readTimeout:      15 * time.Second,
 		heartbeatTimeout: 10 * time.Second,
-		subscriptions:    make(map[int64]*SubscriptionStatus),
-		msg:              make(chan Update, 1024),
+		registry:         newSubscriptionRegistry(),
+		tokens:           newTokenManager(),
+		protocol:         protocolV1{},
+		bufferSize:       1024,
+		overflowPolicy:   OverflowBlock,
 		stop:             make(chan struct{}, 1),
+		handles:          make(map[uint64]handle),
+		reconnectHooks:   make(map[uint64]func()),
 	}
 
 	for i := range opts {
 		opts[i](&kraken)
 	}
 
+	kraken.msg = newPublisher(kraken.bufferSize, kraken.overflowPolicy)
+
 	return &kraken
 }
 
@@ -73,19 +112,56 @@ func (k *Kraken) dial() error {
 	}
 	defer resp.Body.Close()
 
+	k.lock.Lock()
 	k.conn = c
+	k.disconnectedAt = time.Time{}
+	k.lock.Unlock()
+
+	k.record(FrameConnected, []byte(k.url))
 	return nil
 }
 
+func (k *Kraken) disconnected() {
+	k.lock.Lock()
+	lost := k.disconnectedAt.IsZero()
+	if lost {
+		k.disconnectedAt = time.Now()
+	}
+	k.lock.Unlock()
+
+	if lost {
+		k.record(FrameDisconnected, nil)
+	}
+}
+
+// DisconnectedSince - returns time when connection was lost. It's zero while client is connected or reconnected successfully.
+func (k *Kraken) DisconnectedSince() time.Time {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return k.disconnectedAt
+}
+
 func (k *Kraken) managerThread() {
 	heartbeat := time.NewTicker(k.heartbeatTimeout)
 	defer heartbeat.Stop()
 
-	connect := make(chan struct{})
+	// connect is buffered and written without blocking: the loop is its only reader
+	connect := make(chan struct{}, 1)
+	reconnect := func() {
+		k.disconnected()
+		select {
+		case connect <- struct{}{}:
+		default:
+		}
+	}
+
 	stopListener := make(chan struct{})
 	reconnectCh := make(chan struct{})
 	go k.listenSocket(stopListener, reconnectCh)
 
+	// failed - subscriptions which weren't requested after reconnect, they are retried by heartbeat
+	var failed []subscriptionGroup
+
 	for {
 		select {
 		case <-connect:
@@ -93,11 +169,14 @@ func (k *Kraken) managerThread() {
 
 			if err := k.dial(); err != nil {
 				log.Error(err)
-				connect <- struct{}{}
+				reconnect()
 				continue
 			}
 
-			if err := k.resubscribe(); err != nil {
+			k.tokens.reconnected()
+			k.notifyReconnect()
+			var err error
+			if failed, err = k.resubscribe(); err != nil {
 				log.Error(err)
 			}
 
@@ -105,58 +184,207 @@ func (k *Kraken) managerThread() {
 			reconnectCh = make(chan struct{})
 			go k.listenSocket(stopListener, reconnectCh)
 		case <-reconnectCh:
-			connect <- struct{}{}
+			// nil channel is never selected, so closed listener channel is handled once
+			reconnectCh = nil
+			reconnect()
 		case <-k.stop:
 			return
 		case <-heartbeat.C:
-			if err := k.send(PingRequest{
-				Event: EventPing,
-			}); err != nil {
+			if reconnectCh == nil {
+				// waiting for reconnection
+				continue
+			}
+			if err := k.send(k.protocol.ping(0)); err != nil {
 				log.Println(err)
 				close(stopListener)
-				connect <- struct{}{}
+				reconnectCh = nil
+				reconnect()
+				continue
+			}
+			if len(failed) > 0 {
+				var err error
+				if failed, err = k.requestGroups(k.registry.pendingGroups(failed)); err != nil {
+					log.Error(err)
+				}
 			}
 		}
 	}
 }
 
-func (k *Kraken) resubscribe() error {
-	for _, sub := range k.subscriptions {
-		switch sub.Subscription.Name {
-		// Private Channels
-		case ChanOwnTrades, ChanOpenOrders:
-			if err := k.subscribeToPrivate(sub.Subscription.Name); err != nil {
-				return err
-			}
-		default:
-			if err := k.send(SubscriptionRequest{
-				Event:        EventSubscribe,
-				Pairs:        []string{sub.Pair},
-				Subscription: sub.Subscription,
-			}); err != nil {
-				return err
-			}
+// resubscribe - reconciles desired subscriptions after reconnect. Public channels are requested before private ones,
+// which need token from REST, so failure of token doesn't delay them. It returns groups which weren't requested.
+func (k *Kraken) resubscribe() ([]subscriptionGroup, error) {
+	groups := k.registry.reset()
+	sort.SliceStable(groups, func(i, j int) bool {
+		return !isPrivateChannel(groups[i].spec.Name) && isPrivateChannel(groups[j].spec.Name)
+	})
+	return k.requestGroups(groups)
+}
+
+// requestGroups - sends subscription requests of all groups. It returns groups which weren't requested and joined errors of them.
+func (k *Kraken) requestGroups(groups []subscriptionGroup) ([]subscriptionGroup, error) {
+	var (
+		failed   []subscriptionGroup
+		messages []string
+	)
+	for _, group := range groups {
+		if err := k.sendSubscribe(group.spec, group.pairs); err != nil {
+			failed = append(failed, group)
+			messages = append(messages, group.spec.channelName()+": "+err.Error())
+		}
+	}
+	if len(failed) == 0 {
+		return nil, nil
+	}
+	return failed, errors.Errorf("can't resubscribe: %s", strings.Join(messages, "; "))
+}
+
+// OnReconnect - registers function which is called after reconnect before resubscription. It returns function which removes the hook.
+// Hook is called from connection goroutine, so it must not block.
+func (k *Kraken) OnReconnect(fn func()) func() {
+	k.hooksMx.Lock()
+	k.hookID++
+	id := k.hookID
+	k.reconnectHooks[id] = fn
+	k.hooksMx.Unlock()
+
+	return func() {
+		k.hooksMx.Lock()
+		delete(k.reconnectHooks, id)
+		k.hooksMx.Unlock()
+	}
+}
+
+func (k *Kraken) notifyReconnect() {
+	k.hooksMx.RLock()
+	defer k.hooksMx.RUnlock()
+	for _, fn := range k.reconnectHooks {
+		fn()
+	}
+}
+
+// Subscriptions - returns desired subscriptions with state of each pair
+func (k *Kraken) Subscriptions() []SubscriptionInfo {
+	return k.registry.list()
+}
+
+// subscribe - registers desired subscription and requests pairs which are not subscribed yet
+func (k *Kraken) subscribe(spec Subscription, pairs []string) error {
+	if !k.protocol.supports(spec.Name) {
+		return errors.Wrap(ErrUnsupported, spec.Name)
+	}
+	if isPairlessChannel(spec.Name) {
+		pairs = []string{""}
+	}
+	request := k.registry.add(spec, pairs)
+	if len(request) == 0 {
+		return nil
+	}
+	return k.sendSubscribe(spec, request)
+}
+
+// release - releases subscription used by a handle and unsubscribes from pairs which are not used anymore
+func (k *Kraken) release(spec Subscription, pairs []string) error {
+	if isPairlessChannel(spec.Name) {
+		pairs = []string{""}
+	}
+	unused := k.registry.release(spec, pairs)
+	if len(unused) == 0 {
+		return nil
+	}
+	return k.sendUnsubscribe(spec, unused)
+}
+
+// resync - resubscribes to pairs which are still desired to receive fresh snapshot. Consumers of the subscription are kept,
+// so the registry doesn't request it again while it's resubscribed.
+func (k *Kraken) resync(spec Subscription, pairs []string) error {
+	pairs = k.registry.resync(spec, pairs)
+	if len(pairs) == 0 {
+		return nil
+	}
+	if err := k.sendUnsubscribe(spec, pairs); err != nil {
+		return err
+	}
+	return k.sendSubscribe(spec, pairs)
+}
+
+// unsubscribe - removes desired subscriptions and unsubscribes from them
+func (k *Kraken) unsubscribe(spec Subscription, pairs []string) error {
+	if isPairlessChannel(spec.Name) {
+		pairs = []string{""}
+	}
+	for _, group := range k.registry.remove(spec, pairs) {
+		if err := k.sendUnsubscribe(group.spec, group.pairs); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+func (k *Kraken) sendSubscribe(spec Subscription, pairs []string) error {
+	var token string
+	if requiresToken(spec.Name) {
+		t, err := k.tokens.get(false)
+		if err != nil {
+			return err
+		}
+		token = t
+	}
+	msg, err := k.protocol.subscribe(k.nextReqID(), spec, pairs, token)
+	if err != nil {
+		return err
+	}
+	return k.send(msg)
+}
+
+func (k *Kraken) sendUnsubscribe(spec Subscription, pairs []string) error {
+	var token string
+	if requiresToken(spec.Name) {
+		t, err := k.tokens.get(false)
+		if err != nil {
+			return err
+		}
+		token = t
+	}
+	msg, err := k.protocol.unsubscribe(k.nextReqID(), spec, pairs, token)
+	if err != nil {
+		return err
+	}
+	return k.send(msg)
+}
+
 // Listen provides an atomic interface for receiving API messages.
 // When a websocket connection is terminated, the publisher channel will close.
 func (k *Kraken) Listen() <-chan Update {
-	return k.msg
+	return k.msg.out
+}
+
+// Metrics - returns runtime counters of the client: dropped and coalesced updates, token expiration.
+func (k *Kraken) Metrics() Metrics {
+	metrics := k.msg.metrics()
+	k.tokens.metrics(&metrics)
+	return metrics
+}
+
+func (k *Kraken) publish(upd Update) {
+	k.msg.publish(upd)
 }
 
 // Close - provides an interface for a user initiated shutdown.
 func (k *Kraken) Close() error {
+	// connection is replaced by reconnect under the lock
+	k.lock.Lock()
 	if k.conn != nil {
 		if err := k.conn.Close(); err != nil {
+			k.lock.Unlock()
 			return err
 		}
 	}
+	k.lock.Unlock()
 
 	close(k.stop)
-	close(k.msg)
+	k.msg.close()
+	k.record(FrameClosed, nil)
 	return nil
 }
 
@@ -171,12 +399,18 @@ func (k *Kraken) send(msg interface{}) error {
 		return err
 	}
 	log.Tracef("client->server: %s", string(data))
-	return k.conn.WriteMessage(websocket.TextMessage, data)
+	if err := k.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		return err
+	}
+	k.record(FrameSent, data)
+	return nil
 }
 
 func (k *Kraken) listenSocket(stop chan struct{}, reconnectCh chan struct{}) {
 	defer close(reconnectCh)
+	k.lock.RLock()
 	conn := k.conn
+	k.lock.RUnlock()
 	if conn == nil {
 		return
 	}
@@ -198,6 +432,7 @@ func (k *Kraken) listenSocket(stop chan struct{}, reconnectCh chan struct{}) {
 				log.Error(err)
 				return
 			}
+			k.record(FrameReceived, msg)
 
 			if err := conn.SetReadDeadline(time.Now().Add(k.readTimeout)); err != nil {
 				log.Error(err)
@@ -214,181 +449,186 @@ func (k *Kraken) listenSocket(stop chan struct{}, reconnectCh chan struct{}) {
 }
 
 func (k *Kraken) handleMessage(data []byte) error {
-	if len(data) == 0 {
-		return errors.Errorf("Empty response: %s", string(data))
-	}
-	switch data[0] {
-	case '[':
-		return k.handleChannel(data)
-	case '{':
-		return k.handleEvent(data)
-	default:
-		return errors.Errorf("Unexpected message: %s", string(data))
-	}
+	return k.protocol.handleMessage(k, data)
+}
+
+func (k *Kraken) nextReqID() int64 {
+	return atomic.AddInt64(&k.reqID, 1)
 }
 
 // SubscribeTicker - Ticker information includes best ask and best bid prices, 24hr volume, last trade price, volume weighted average price, etc for a given currency pair. A ticker message is published every time a trade or a group of trade happens.
-func (k *Kraken) SubscribeTicker(pairs []string) error {
-	return k.send(SubscriptionRequest{
-		Event: EventSubscribe,
-		Pairs: pairs,
-		Subscription: Subscription{
-			Name: ChanTicker,
-		},
-	})
+func (k *Kraken) SubscribeTicker(pairs []string, opts ...SubscribeOption) error {
+	return k.subscribe(newSubscription(ChanTicker, opts), pairs)
 }
 
 // SubscribeCandles - Open High Low Close (Candle) feed for a currency pair and interval period.
-func (k *Kraken) SubscribeCandles(pairs []string, interval int64) error {
-	return k.send(SubscriptionRequest{
-		Event: EventSubscribe,
-		Pairs: pairs,
-		Subscription: Subscription{
-			Name:     ChanCandles,
-			Interval: interval,
-		},
-	})
+func (k *Kraken) SubscribeCandles(pairs []string, interval int64, opts ...SubscribeOption) error {
+	spec := newSubscription(ChanCandles, opts)
+	spec.Interval = interval
+	return k.subscribe(spec, pairs)
 }
 
 // SubscribeTrades - Trade feed for a currency pair.
-func (k *Kraken) SubscribeTrades(pairs []string) error {
-	return k.send(SubscriptionRequest{
-		Event: EventSubscribe,
-		Pairs: pairs,
-		Subscription: Subscription{
-			Name: ChanTrades,
-		},
-	})
+func (k *Kraken) SubscribeTrades(pairs []string, opts ...SubscribeOption) error {
+	return k.subscribe(newSubscription(ChanTrades, opts), pairs)
 }
 
 // SubscribeSpread - Spread feed to show best bid and ask price for a currency pair
-func (k *Kraken) SubscribeSpread(pairs []string) error {
-	return k.send(SubscriptionRequest{
-		Event: EventSubscribe,
-		Pairs: pairs,
-		Subscription: Subscription{
-			Name: ChanSpread,
-		},
-	})
+func (k *Kraken) SubscribeSpread(pairs []string, opts ...SubscribeOption) error {
+	return k.subscribe(newSubscription(ChanSpread, opts), pairs)
 }
 
 // SubscribeBook - Order book levels. On subscription, a snapshot will be published at the specified depth, following the snapshot, level updates will be published.
-func (k *Kraken) SubscribeBook(pairs []string, depth int64) error {
-	return k.send(SubscriptionRequest{
-		Event: EventSubscribe,
-		Pairs: pairs,
-		Subscription: Subscription{
-			Name:  ChanBook,
-			Depth: depth,
-		},
-	})
+func (k *Kraken) SubscribeBook(pairs []string, depth int64, opts ...SubscribeOption) error {
+	spec := newSubscription(ChanBook, opts)
+	spec.Depth = depth
+	return k.subscribe(spec, pairs)
 }
 
 // Unsubscribe - Unsubscribe from single subscription, can specify multiple currency pairs.
 func (k *Kraken) Unsubscribe(channelType string, pairs []string) error {
-	return k.send(UnsubscribeRequest{
-		Event: EventUnsubscribe,
-		Pairs: pairs,
-		Subscription: Subscription{
-			Name: channelType,
-		},
-	})
+	return k.unsubscribe(Subscription{
+		Name: channelType,
+	}, pairs)
 }
 
 // UnsubscribeCandles - Unsubscribe from candles subscription, can specify multiple currency pairs.
 func (k *Kraken) UnsubscribeCandles(pairs []string, interval int64) error {
-	return k.send(UnsubscribeRequest{
-		Event: EventUnsubscribe,
-		Pairs: pairs,
-		Subscription: Subscription{
-			Name:     ChanCandles,
-			Interval: interval,
-		},
-	})
+	return k.unsubscribe(Subscription{
+		Name:     ChanCandles,
+		Interval: interval,
+	}, pairs)
 }
 
 // UnsubscribeBook - Unsubscribe from order book subscription, can specify multiple currency pairs.
 func (k *Kraken) UnsubscribeBook(pairs []string, depth int64) error {
-	return k.send(UnsubscribeRequest{
-		Event: EventUnsubscribe,
-		Pairs: pairs,
-		Subscription: Subscription{
-			Name:  ChanBook,
-			Depth: depth,
-		},
-	})
+	return k.unsubscribe(Subscription{
+		Name:  ChanBook,
+		Depth: depth,
+	}, pairs)
 }
 
-// Authenticate - authenticate in private Websocket API
+// Authenticate - authenticate in private Websocket API. The client keeps credentials and refreshes token when it's required.
 func (k *Kraken) Authenticate(key, secret string) error {
-	data, err := rest.New(key, secret).GetWebSocketsToken()
-	if err != nil {
-		return err
-	}
-	k.token = data.Token
-	return nil
-}
-
-func (k *Kraken) subscribeToPrivate(channelName string) error {
-	return k.send(AuthSubscriptionRequest{
-		Event: EventSubscribe,
-		Subs: AuthDataRequest{
-			Name:  channelName,
-			Token: k.token,
-		},
-	})
+	k.tokens.setProvider(NewRESTTokenProvider(key, secret))
+	_, err := k.tokens.get(false)
+	return err
 }
 
 // SubscribeOwnTrades - method tries to subscribe on OwnTrades channel events
-func (k *Kraken) SubscribeOwnTrades() error {
-	return k.subscribeToPrivate(ChanOwnTrades)
+func (k *Kraken) SubscribeOwnTrades(opts ...SubscribeOption) error {
+	return k.subscribe(newSubscription(ChanOwnTrades, opts), nil)
 }
 
 // SubscribeOpenOrders - method tries to subscribe on OpenOrders channel events
-func (k *Kraken) SubscribeOpenOrders() error {
-	return k.subscribeToPrivate(ChanOpenOrders)
+func (k *Kraken) SubscribeOpenOrders(opts ...SubscribeOption) error {
+	return k.subscribe(newSubscription(ChanOpenOrders, opts), nil)
+}
+
+// SubscribeInstrument - subscribes to reference data of assets and pairs. Websocket API v2 only.
+func (k *Kraken) SubscribeInstrument(opts ...SubscribeOption) error {
+	return k.subscribe(newSubscription(ChanInstrument, opts), nil)
+}
+
+// SubscribeBalances - subscribes to account balances and ledger entries. Websocket API v2 only.
+func (k *Kraken) SubscribeBalances(opts ...SubscribeOption) error {
+	return k.subscribe(newSubscription(ChanBalances, opts), nil)
+}
+
+// SubscribeExecutions - subscribes to order status changes and own trades. Websocket API v2 only.
+func (k *Kraken) SubscribeExecutions(opts ...SubscribeOption) error {
+	return k.subscribe(newSubscription(ChanExecutions, opts), nil)
+}
+
+// SubscribeLevel3 - subscribes to individual orders of the book. It requires authentication and `Level3BaseURLV2` endpoint. Websocket API v2 only.
+func (k *Kraken) SubscribeLevel3(pairs []string, depth int64, opts ...SubscribeOption) error {
+	spec := newSubscription(ChanLevel3, opts)
+	spec.Depth = depth
+	return k.subscribe(spec, pairs)
+}
+
+// UnsubscribeLevel3 - Unsubscribe from level 3 order book subscription, can specify multiple currency pairs.
+func (k *Kraken) UnsubscribeLevel3(pairs []string) error {
+	return k.unsubscribe(Subscription{
+		Name: ChanLevel3,
+	}, pairs)
 }
 
 // AddOrder - method adds new order.
 func (k *Kraken) AddOrder(req AddOrderRequest) error {
-	req.Event = EventAddOrder
-	req.Token = k.token
-	return k.send(req)
+	token, err := k.tokens.get(false)
+	if err != nil {
+		return err
+	}
+	msg, err := k.protocol.addOrder(req, token)
+	if err != nil {
+		return err
+	}
+	return k.send(msg)
 }
 
 // CancelOrder - method cancels order or list of orders.
 func (k *Kraken) CancelOrder(orderIDs []string) error {
-	return k.send(CancelOrderRequest{
-		AuthRequest: AuthRequest{
-			Token: k.token,
-			Event: EventCancelOrder,
-		},
-		TxID: orderIDs,
-	})
+	token, err := k.tokens.get(false)
+	if err != nil {
+		return err
+	}
+	return k.send(k.protocol.cancelOrder(orderIDs, token))
 }
 
 // CancelAll - method cancels order or list of orders.
 func (k *Kraken) CancelAll() error {
-	return k.send(AuthRequest{
-		Token: k.token,
-		Event: EventCancelAll,
-	})
+	token, err := k.tokens.get(false)
+	if err != nil {
+		return err
+	}
+	return k.send(k.protocol.cancelAll(token))
 }
 
 // CancelAllOrdersAfter -  provides a `Dead Man's Switch` mechanism to protect the client from network malfunction, extreme latency or unexpected matching engine downtime. The client can send a request with a timeout (in seconds), that will start a countdown timer which will cancel *all* client orders when the timer expires.
 func (k *Kraken) CancelAllOrdersAfter(timeout int64) error {
-	return k.send(CancelAllOrdersAfterRequest{
-		AuthRequest: AuthRequest{
-			Token: k.token,
-			Event: EventCancelAllOrdersAfter,
-		},
-		Timeout: timeout,
-	})
+	token, err := k.tokens.get(false)
+	if err != nil {
+		return err
+	}
+	return k.send(k.protocol.cancelAllOrdersAfter(timeout, token))
 }
 
 // EditOrder - method adds new order.
 func (k *Kraken) EditOrder(req EditOrderRequest) error {
-	req.Event = EventEditOrder
-	req.Token = k.token
-	return k.send(req)
+	token, err := k.tokens.get(false)
+	if err != nil {
+		return err
+	}
+	msg, err := k.protocol.editOrder(req, token)
+	if err != nil {
+		return err
+	}
+	return k.send(msg)
+}
+
+// AmendOrder - method changes quantity and prices of the order keeping its identifiers and queue priority where possible. Websocket API v2 only.
+func (k *Kraken) AmendOrder(req AmendOrderParams) error {
+	token, err := k.tokens.get(false)
+	if err != nil {
+		return err
+	}
+	msg, err := k.protocol.amendOrder(req, token)
+	if err != nil {
+		return err
+	}
+	return k.send(msg)
+}
+
+// BatchAdd - method adds from 2 to 15 orders of the same pair at once. Websocket API v2 only.
+func (k *Kraken) BatchAdd(req BatchAddParams) error {
+	token, err := k.tokens.get(false)
+	if err != nil {
+		return err
+	}
+	msg, err := k.protocol.batchAdd(req, token)
+	if err != nil {
+		return err
+	}
+	return k.send(msg)
 }
@@ -0,0 +1,438 @@
+package websocket
+
+import (
+	"bytes"
+	"hash/crc32"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+)
+
+// Events of `level3` channel update
+const (
+	Level3Add    = "add"
+	Level3Modify = "modify"
+	Level3Delete = "delete"
+)
+
+// level3ChecksumDepth - count of price levels of each side which are used in checksum
+const level3ChecksumDepth = 10
+
+// Level3Book - order book of individual orders built by `level3` channel of Websocket API v2.
+// Orders of a price level are kept in FIFO queue in order of arrival, so queue position of every order is known.
+// Both sides share the lock of the book, so update is applied to the whole book atomically.
+type Level3Book struct {
+	Asks *Level3BookSide
+	Bids *Level3BookSide
+
+	depth           int
+	pricePrecision  int32
+	volumePrecision int32
+
+	mx *sync.RWMutex
+}
+
+// NewLevel3Book - creates level 3 order book.
+//
+//	depth - is a requested depth in price levels from Kraken
+//
+//	pricePrecision - count of valuable signs after dot in price, which is required for checksum verification
+//
+//	volumePrecision - count of valuable signs after dot in volume, which is required for checksum verification
+func NewLevel3Book(depth, pricePrecision, volumePrecision int) *Level3Book {
+	mx := new(sync.RWMutex)
+	return &Level3Book{
+		Asks:            newLevel3BookSide(depth, pricePrecision, volumePrecision, true, mx),
+		Bids:            newLevel3BookSide(depth, pricePrecision, volumePrecision, false, mx),
+		depth:           depth,
+		pricePrecision:  int32(pricePrecision),
+		volumePrecision: int32(volumePrecision),
+		mx:              mx,
+	}
+}
+
+// ApplyUpdate - applies update from `level3` channel. Snapshot replaces the whole book.
+// If you need to verify checksum, set verify to true.
+func (b *Level3Book) ApplyUpdate(upd Level3Update, verify bool) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if upd.IsSnapshot {
+		b.Asks.reset()
+		b.Bids.reset()
+	}
+
+	if err := b.Asks.applyOrders(upd.Asks); err != nil {
+		return err
+	}
+	if err := b.Bids.applyOrders(upd.Bids); err != nil {
+		return err
+	}
+
+	if verify {
+		if cs := b.checksum(); cs != upd.Checksum {
+			return errors.Errorf("invalid level 3 checksum: local %d != remote %d", cs, upd.Checksum)
+		}
+	}
+	return nil
+}
+
+// Checksum - computes checksum of top 10 price levels of each side over every order in queue order.
+// Details https://docs.kraken.com/api/docs/websocket-v2/level3
+func (b *Level3Book) Checksum() uint32 {
+	b.mx.RLock()
+	defer b.mx.RUnlock()
+	return b.checksum()
+}
+
+func (b *Level3Book) checksum() uint32 {
+	var str bytes.Buffer
+	str.Write(b.Asks.checksum())
+	str.Write(b.Bids.checksum())
+	return crc32.ChecksumIEEE(str.Bytes())
+}
+
+// Order - returns order by its id
+func (b *Level3Book) Order(orderID string) (Level3Order, bool) {
+	b.mx.RLock()
+	defer b.mx.RUnlock()
+
+	if order, ok := b.Asks.order(orderID); ok {
+		return order, ok
+	}
+	return b.Bids.order(orderID)
+}
+
+// QueuePosition - returns zero-based position of the order in queue of its price level and volume of orders ahead of it
+func (b *Level3Book) QueuePosition(orderID string) (int, decimal.Decimal, bool) {
+	b.mx.RLock()
+	defer b.mx.RUnlock()
+
+	if position, ahead, ok := b.Asks.queuePosition(orderID); ok {
+		return position, ahead, ok
+	}
+	return b.Bids.queuePosition(orderID)
+}
+
+// Aggregate - collapses individual orders to price levels and returns them as `OrderBook`
+func (b *Level3Book) Aggregate() *OrderBook {
+	b.mx.RLock()
+	asks, bids := b.Asks.aggregate(), b.Bids.aggregate()
+	b.mx.RUnlock()
+
+	book := NewOrderBook(b.depth, int(b.pricePrecision), int(b.volumePrecision))
+	// snapshot is always applicable, so error may be only on invalid numbers which can't be in the book
+	_ = book.ApplyUpdate(OrderBookUpdate{
+		Asks:       asks,
+		Bids:       bids,
+		IsSnapshot: true,
+	}, false)
+	return book
+}
+
+// String - returns full order book as a string
+func (b *Level3Book) String() string {
+	b.mx.RLock()
+	defer b.mx.RUnlock()
+
+	var builder strings.Builder
+	builder.WriteString("\r\n==== ASKS ====\r\n")
+	b.Asks.write(&builder)
+	builder.WriteString("==== BIDS ====\r\n")
+	b.Bids.write(&builder)
+	return builder.String()
+}
+
+// level3Queue - orders of one price level in order of arrival
+type level3Queue struct {
+	price  decimal.Decimal
+	orders []Level3Order
+}
+
+func (q *level3Queue) index(orderID string) int {
+	for i := range q.orders {
+		if q.orders[i].OrderID == orderID {
+			return i
+		}
+	}
+	return -1
+}
+
+func (q *level3Queue) remove(i int) {
+	q.orders = append(q.orders[:i], q.orders[i+1:]...)
+}
+
+func (q *level3Queue) volume() decimal.Decimal {
+	volume := decimal.Zero
+	for i := range q.orders {
+		volume = volume.Add(q.orders[i].OrderQty)
+	}
+	return volume
+}
+
+// Level3BookSide - one side of level 3 order book. Price levels are kept in slice sorted from the best price,
+// so new level is inserted by binary search. The side is guarded by the lock of its book.
+type Level3BookSide struct {
+	levels map[string]*level3Queue
+	// prices - price level key of every order by order id
+	prices          map[string]string
+	sorted          []*level3Queue
+	depth           int
+	pricePrecision  int32
+	volumePrecision int32
+	isAsk           bool
+
+	mx *sync.RWMutex
+}
+
+func newLevel3BookSide(depth, pricePrecision, volumePrecision int, isAsk bool, mx *sync.RWMutex) *Level3BookSide {
+	return &Level3BookSide{
+		levels:          make(map[string]*level3Queue),
+		prices:          make(map[string]string),
+		sorted:          make([]*level3Queue, 0, depth+1),
+		depth:           depth,
+		pricePrecision:  int32(pricePrecision),
+		volumePrecision: int32(volumePrecision),
+		isAsk:           isAsk,
+		mx:              mx,
+	}
+}
+
+func (s *Level3BookSide) reset() {
+	s.levels = make(map[string]*level3Queue)
+	s.prices = make(map[string]string)
+	s.sorted = s.sorted[:0]
+}
+
+func (s *Level3BookSide) applyOrders(orders []Level3Order) error {
+	defer s.truncate()
+
+	for i := range orders {
+		if err := s.applyOrder(orders[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyOrder - applies single order event. Modification which decreases quantity at the same price keeps queue position,
+// other modifications move the order to the end of the queue.
+func (s *Level3BookSide) applyOrder(order Level3Order) error {
+	switch order.Event {
+	case "", Level3Add:
+		s.delete(order.OrderID)
+		s.add(order)
+	case Level3Modify:
+		key, ok := s.prices[order.OrderID]
+		if !ok {
+			return errors.Errorf("unknown order in modify event: %s", order.OrderID)
+		}
+		queue := s.levels[key]
+		i := queue.index(order.OrderID)
+		if key == s.key(order.LimitPrice) && order.OrderQty.LessThanOrEqual(queue.orders[i].OrderQty) {
+			order.Event = ""
+			queue.orders[i] = order
+			return nil
+		}
+		s.delete(order.OrderID)
+		s.add(order)
+	case Level3Delete:
+		s.delete(order.OrderID)
+	default:
+		return errors.Errorf("unknown level 3 event: %s", order.Event)
+	}
+	return nil
+}
+
+func (s *Level3BookSide) key(price decimal.Decimal) string {
+	return price.StringFixed(s.pricePrecision)
+}
+
+// search - returns index of the price level or index where it has to be inserted
+func (s *Level3BookSide) search(price decimal.Decimal) (int, bool) {
+	i := sort.Search(len(s.sorted), func(i int) bool {
+		if s.isAsk {
+			return s.sorted[i].price.GreaterThanOrEqual(price)
+		}
+		return s.sorted[i].price.LessThanOrEqual(price)
+	})
+	return i, i < len(s.sorted) && s.sorted[i].price.Equal(price)
+}
+
+func (s *Level3BookSide) add(order Level3Order) {
+	order.Event = ""
+	key := s.key(order.LimitPrice)
+	queue, ok := s.levels[key]
+	if !ok {
+		queue = &level3Queue{price: order.LimitPrice.Round(s.pricePrecision)}
+		s.levels[key] = queue
+
+		i, _ := s.search(queue.price)
+		s.sorted = append(s.sorted, nil)
+		copy(s.sorted[i+1:], s.sorted[i:])
+		s.sorted[i] = queue
+	}
+	queue.orders = append(queue.orders, order)
+	s.prices[order.OrderID] = key
+}
+
+func (s *Level3BookSide) delete(orderID string) {
+	key, ok := s.prices[orderID]
+	if !ok {
+		return
+	}
+	delete(s.prices, orderID)
+
+	queue := s.levels[key]
+	if i := queue.index(orderID); i >= 0 {
+		queue.remove(i)
+	}
+	if len(queue.orders) == 0 {
+		delete(s.levels, key)
+		if i, found := s.search(queue.price); found {
+			s.sorted = append(s.sorted[:i], s.sorted[i+1:]...)
+		}
+	}
+}
+
+// truncate - removes price levels out of depth
+func (s *Level3BookSide) truncate() {
+	if s.depth <= 0 || len(s.sorted) <= s.depth {
+		return
+	}
+	for _, queue := range s.sorted[s.depth:] {
+		for i := range queue.orders {
+			delete(s.prices, queue.orders[i].OrderID)
+		}
+		delete(s.levels, s.key(queue.price))
+	}
+	s.sorted = s.sorted[:s.depth]
+}
+
+// Order - returns order by its id
+func (s *Level3BookSide) Order(orderID string) (Level3Order, bool) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return s.order(orderID)
+}
+
+func (s *Level3BookSide) order(orderID string) (Level3Order, bool) {
+	key, ok := s.prices[orderID]
+	if !ok {
+		return Level3Order{}, false
+	}
+	queue := s.levels[key]
+	return queue.orders[queue.index(orderID)], true
+}
+
+// QueuePosition - returns zero-based position of the order in queue of its price level and volume of orders ahead of it
+func (s *Level3BookSide) QueuePosition(orderID string) (int, decimal.Decimal, bool) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return s.queuePosition(orderID)
+}
+
+func (s *Level3BookSide) queuePosition(orderID string) (int, decimal.Decimal, bool) {
+	key, ok := s.prices[orderID]
+	if !ok {
+		return 0, decimal.Zero, false
+	}
+	queue := s.levels[key]
+	position := queue.index(orderID)
+	ahead := decimal.Zero
+	for i := 0; i < position; i++ {
+		ahead = ahead.Add(queue.orders[i].OrderQty)
+	}
+	return position, ahead, true
+}
+
+// Range - ranges by price levels from best price to depth. Orders are passed in queue order.
+func (s *Level3BookSide) Range(handler func(price decimal.Decimal, orders []Level3Order) error) error {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	for i := range s.sorted {
+		orders := make([]Level3Order, len(s.sorted[i].orders))
+		copy(orders, s.sorted[i].orders)
+		if err := handler(s.sorted[i].price, orders); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Best - returns best price and total volume at this price. If order book is not initialized it returns Zero
+func (s *Level3BookSide) Best() (decimal.Decimal, decimal.Decimal) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	if len(s.sorted) == 0 {
+		return decimal.Zero, decimal.Zero
+	}
+	return s.sorted[0].price, s.sorted[0].volume()
+}
+
+// Len - returns count of price levels
+func (s *Level3BookSide) Len() int {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return len(s.sorted)
+}
+
+func (s *Level3BookSide) aggregate() []OrderBookItem {
+	items := make([]OrderBookItem, 0, len(s.sorted))
+	for _, queue := range s.sorted {
+		items = append(items, OrderBookItem{
+			Price:  decimalNumber(queue.price),
+			Volume: decimalNumber(queue.volume()),
+		})
+	}
+	return items
+}
+
+func (s *Level3BookSide) checksum() []byte {
+	var str bytes.Buffer
+	for i, queue := range s.sorted {
+		if i == level3ChecksumDepth {
+			break
+		}
+		price := checksumValue(queue.price, s.pricePrecision)
+		for j := range queue.orders {
+			str.WriteString(price)
+			str.WriteString(checksumValue(queue.orders[j].OrderQty, s.volumePrecision))
+		}
+	}
+	return str.Bytes()
+}
+
+// String -
+func (s *Level3BookSide) String() string {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	var builder strings.Builder
+	s.write(&builder)
+	return builder.String()
+}
+
+func (s *Level3BookSide) write(builder *strings.Builder) {
+	for _, queue := range s.sorted {
+		builder.WriteString(queue.price.StringFixed(s.pricePrecision))
+		builder.WriteString(" |")
+		for i := range queue.orders {
+			builder.WriteString(" ")
+			builder.WriteString(queue.orders[i].OrderQty.StringFixed(s.volumePrecision))
+		}
+		builder.WriteString("\r\n")
+	}
+}
+
+// checksumValue - formats value with precision and removes dot and leading zeros
+func checksumValue(value decimal.Decimal, precision int32) string {
+	str := value.StringFixed(precision)
+	str = strings.Replace(str, ".", "", 1)
+	return strings.TrimLeft(str, "0")
+}
@@ -0,0 +1,108 @@
+package websocket
+
+import (
+	"encoding/json"
+	"hash/crc32"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const level3Snapshot = `{"symbol":"XBT/USD","checksum":0,"bids":[{"order_id":"O1","limit_price":100.5,"order_qty":1.5,"timestamp":"2023-10-06T17:35:00.000000Z"},{"order_id":"O2","limit_price":100.5,"order_qty":2,"timestamp":"2023-10-06T17:35:01.000000Z"},{"order_id":"O3","limit_price":100.4,"order_qty":3,"timestamp":"2023-10-06T17:35:02.000000Z"}],"asks":[{"order_id":"O4","limit_price":100.6,"order_qty":0.5,"timestamp":"2023-10-06T17:35:03.000000Z"}]}`
+
+func TestLevel3Book_Queue(t *testing.T) {
+	var snapshot Level3Update
+	require.NoError(t, json.Unmarshal([]byte(level3Snapshot), &snapshot))
+	snapshot.IsSnapshot = true
+
+	book := NewLevel3Book(10, 1, 8)
+	require.NoError(t, book.ApplyUpdate(snapshot, false))
+
+	position, ahead, ok := book.QueuePosition("O2")
+	require.True(t, ok)
+	assert.Equal(t, 1, position)
+	assert.Equal(t, "1.5", ahead.String())
+
+	// partial fill of the first order keeps its priority, increase of the second order moves it to the end
+	require.NoError(t, book.ApplyUpdate(Level3Update{
+		Bids: []Level3Order{
+			{Event: Level3Modify, OrderID: "O1", LimitPrice: decimal.RequireFromString("100.5"), OrderQty: decimal.RequireFromString("1")},
+			{Event: Level3Add, OrderID: "O5", LimitPrice: decimal.RequireFromString("100.5"), OrderQty: decimal.RequireFromString("4")},
+			{Event: Level3Modify, OrderID: "O2", LimitPrice: decimal.RequireFromString("100.5"), OrderQty: decimal.RequireFromString("2.5")},
+			{Event: Level3Delete, OrderID: "O3"},
+		},
+	}, false))
+
+	var ids []string
+	require.NoError(t, book.Bids.Range(func(price decimal.Decimal, orders []Level3Order) error {
+		for i := range orders {
+			ids = append(ids, orders[i].OrderID)
+		}
+		return nil
+	}))
+	assert.Equal(t, []string{"O1", "O5", "O2"}, ids)
+
+	_, ok = book.Order("O3")
+	assert.False(t, ok)
+
+	price, volume := book.Bids.Best()
+	assert.Equal(t, "100.5", price.String())
+	assert.Equal(t, "7.5", volume.String())
+
+	aggregated := book.Aggregate()
+	aggPrice, aggVolume := aggregated.Bids.Best()
+	assert.True(t, price.Equal(aggPrice))
+	assert.True(t, volume.Equal(aggVolume))
+
+	err := book.ApplyUpdate(Level3Update{Bids: []Level3Order{{Event: Level3Modify, OrderID: "unknown"}}}, false)
+	assert.Error(t, err)
+}
+
+func TestLevel3Book_Checksum(t *testing.T) {
+	var snapshot Level3Update
+	require.NoError(t, json.Unmarshal([]byte(level3Snapshot), &snapshot))
+	snapshot.IsSnapshot = true
+	// asks first, every order of a level in queue order
+	snapshot.Checksum = crc32.ChecksumIEEE([]byte("1006" + "50000000" + "1005" + "150000000" + "1005" + "200000000" + "1004" + "300000000"))
+
+	book := NewLevel3Book(10, 1, 8)
+	require.NoError(t, book.ApplyUpdate(snapshot, true))
+
+	snapshot.Checksum++
+	assert.Error(t, book.ApplyUpdate(snapshot, true))
+}
+
+func TestLevel3Book_Levels(t *testing.T) {
+	order := func(id, price string) Level3Order {
+		return Level3Order{Event: Level3Add, OrderID: id, LimitPrice: decimal.RequireFromString(price), OrderQty: decimal.NewFromInt(1)}
+	}
+	prices := func(side *Level3BookSide) []string {
+		result := make([]string, 0)
+		require.NoError(t, side.Range(func(price decimal.Decimal, orders []Level3Order) error {
+			result = append(result, price.String())
+			return nil
+		}))
+		return result
+	}
+
+	book := NewLevel3Book(3, 1, 8)
+	require.NoError(t, book.ApplyUpdate(Level3Update{
+		Asks: []Level3Order{order("A1", "102"), order("A2", "101"), order("A3", "103"), order("A4", "101.5")},
+		Bids: []Level3Order{order("B1", "99"), order("B2", "100"), order("B3", "98.5")},
+	}, false))
+	assert.Equal(t, []string{"101", "101.5", "102"}, prices(book.Asks))
+	assert.Equal(t, []string{"100", "99", "98.5"}, prices(book.Bids))
+
+	_, ok := book.Order("A3")
+	assert.False(t, ok, "orders out of depth are removed")
+
+	require.NoError(t, book.ApplyUpdate(Level3Update{
+		Asks: []Level3Order{{Event: Level3Delete, OrderID: "A2"}, order("A5", "100.5")},
+		Bids: []Level3Order{{Event: Level3Modify, OrderID: "B2", LimitPrice: decimal.RequireFromString("98"), OrderQty: decimal.NewFromInt(1)}},
+	}, false))
+	assert.Equal(t, []string{"100.5", "101.5", "102"}, prices(book.Asks))
+	assert.Equal(t, []string{"99", "98.5", "98"}, prices(book.Bids))
+	assert.Equal(t, 3, book.Bids.Len())
+}
@@ -0,0 +1,278 @@
+package websocket
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrReconnected - connection was reestablished, so order book has to be resynchronized
+var ErrReconnected = errors.New("websocket reconnected")
+
+// BookState - validity of managed order book
+type BookState string
+
+// Book states
+const (
+	BookValid   BookState = "valid"
+	BookInvalid BookState = "invalid"
+)
+
+// BookEvent - notification about change of managed order book validity
+type BookEvent struct {
+	Pair  string
+	State BookState
+	// Reason - why book became invalid: checksum mismatch, missed updates or `ErrReconnected`. It's nil for valid state.
+	Reason  error
+	Resyncs uint64
+}
+
+// ManagedBookOption - option function for managed order book
+type ManagedBookOption func(*ManagedBook)
+
+// WithBookStateCallback - add function which is called when book becomes invalid or valid again
+func WithBookStateCallback(fn func(BookEvent)) ManagedBookOption {
+	return func(b *ManagedBook) {
+		b.onState = fn
+	}
+}
+
+// WithBookUpdateCallback - add function which is called after every applied update
+func WithBookUpdateCallback(fn func(book *OrderBook)) ManagedBookOption {
+	return func(b *ManagedBook) {
+		b.onUpdate = fn
+	}
+}
+
+// WithBookDiffCallback - add function which receives normalized changes of every applied update.
+// After resync the book sends diff with `Snapshot` flag, so consumers have to drop their levels.
+func WithBookDiffCallback(fn func(BookDiff)) ManagedBookOption {
+	return func(b *ManagedBook) {
+		b.book.OnDiff(fn)
+	}
+}
+
+// WithResyncTimeout - add custom time of waiting for snapshot after resync request or reconnect. If snapshot isn't received in time the resync is repeated. Default: 10s.
+func WithResyncTimeout(timeout time.Duration) ManagedBookOption {
+	return func(b *ManagedBook) {
+		b.resyncTimeout = timeout
+	}
+}
+
+// ManagedBook - order book of a pair which is kept in sync automatically. On checksum mismatch, reconnect or missed update
+// it unsubscribes and subscribes to `book` channel of the pair at the same depth and discards updates until a fresh snapshot arrives.
+// Resubscription keeps other consumers of the channel, and they receive the fresh snapshot too. Callbacks are called from the reading goroutine of the client and must not call `Close`.
+type ManagedBook struct {
+	k      *Kraken
+	pair   string
+	spec   Subscription
+	book   *OrderBook
+	handle *SubscriptionHandle[OrderBookUpdate]
+
+	onState       func(BookEvent)
+	onUpdate      func(*OrderBook)
+	resyncTimeout time.Duration
+	removeHook    func()
+
+	// bookMx - serializes applying of updates and reading of the whole book
+	bookMx sync.RWMutex
+
+	valid       bool
+	resyncing   bool
+	resyncAt    time.Time
+	resyncs     uint64
+	resyncTimer *time.Timer
+	closed      bool
+	mx          sync.Mutex
+}
+
+// NewManagedBook - subscribes to order book of the pair and keeps it in sync.
+//
+//	depth - is a requested depth from Kraken
+//
+//	pricePrecision - count of valuable signs after dot in price, which is required for checksum verification
+//
+//	volumePrecision - count of valuable signs after dot in volume, which is required for checksum verification
+func (k *Kraken) NewManagedBook(pair string, depth, pricePrecision, volumePrecision int, opts ...ManagedBookOption) (*ManagedBook, error) {
+	b := &ManagedBook{
+		k:             k,
+		pair:          pair,
+		spec:          Subscription{Name: ChanBook, Depth: int64(depth)},
+		book:          NewOrderBook(depth, pricePrecision, volumePrecision),
+		resyncTimeout: 10 * time.Second,
+	}
+	for i := range opts {
+		opts[i](b)
+	}
+
+	// updates received before the first snapshot are discarded
+	b.book.MarkResync()
+	b.resyncing = true
+	b.resyncAt = time.Now()
+	b.removeHook = k.OnReconnect(b.reconnected)
+
+	handle, err := k.SubscribeBookHandle([]string{pair}, int64(depth), WithCallback(b.apply))
+	if err != nil {
+		b.removeHook()
+		return nil, err
+	}
+	b.handle = handle
+
+	b.mx.Lock()
+	b.waitSnapshot()
+	b.mx.Unlock()
+	return b, nil
+}
+
+// Book - returns order book. It's valid only if `Valid` returns true.
+func (b *ManagedBook) Book() *OrderBook {
+	return b.book
+}
+
+// Pair - returns pair of the book
+func (b *ManagedBook) Pair() string {
+	return b.pair
+}
+
+// Valid - returns true if the book is synchronized with Kraken
+func (b *ManagedBook) Valid() bool {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.valid
+}
+
+// Resyncs - returns count of resynchronizations of the book
+func (b *ManagedBook) Resyncs() uint64 {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.resyncs
+}
+
+// Close - unsubscribes from the book if no other consumer uses it
+func (b *ManagedBook) Close() error {
+	b.removeHook()
+
+	b.mx.Lock()
+	b.closed = true
+	if b.resyncTimer != nil {
+		b.resyncTimer.Stop()
+	}
+	b.mx.Unlock()
+
+	return b.handle.Close()
+}
+
+// View - calls function with order book which isn't changed until the function returns
+func (b *ManagedBook) View(fn func(book *OrderBook)) {
+	b.bookMx.RLock()
+	defer b.bookMx.RUnlock()
+	fn(b.book)
+}
+
+// Snapshot - returns consistent copy of the book. Use it to compute analytics while the book is updated.
+func (b *ManagedBook) Snapshot() OrderBookSnapshot {
+	snapshot := b.book.Snapshot()
+	snapshot.Pair = b.pair
+	snapshot.Valid = b.Valid()
+	return snapshot
+}
+
+func (b *ManagedBook) apply(event Event[OrderBookUpdate]) {
+	b.bookMx.Lock()
+	err := b.book.ApplyUpdate(event.Data, true)
+	b.bookMx.Unlock()
+
+	b.mx.Lock()
+	switch {
+	case err == nil:
+		if !b.valid {
+			b.valid = true
+			b.resyncing = false
+			if b.resyncTimer != nil {
+				b.resyncTimer.Stop()
+			}
+			b.notify(BookEvent{Pair: b.pair, State: BookValid, Resyncs: b.resyncs})
+		}
+		b.mx.Unlock()
+		if b.onUpdate != nil {
+			b.onUpdate(b.book)
+		}
+		return
+	case errors.Is(err, ErrResyncRequired) && b.resyncing:
+		// stale update while waiting for snapshot, resync is repeated by timer
+		b.mx.Unlock()
+		return
+	}
+
+	b.book.MarkResync()
+	b.invalidate(err)
+	b.mx.Unlock()
+
+	b.resync()
+}
+
+// waitSnapshot - starts timer which repeats resync if snapshot isn't received in time. Must be called under lock.
+func (b *ManagedBook) waitSnapshot() {
+	if b.resyncTimer != nil {
+		b.resyncTimer.Stop()
+	}
+	b.resyncTimer = time.AfterFunc(b.resyncTimeout, b.resyncTimedOut)
+}
+
+func (b *ManagedBook) resyncTimedOut() {
+	b.mx.Lock()
+	if b.closed || !b.resyncing || time.Since(b.resyncAt) < b.resyncTimeout {
+		b.mx.Unlock()
+		return
+	}
+	b.resyncAt = time.Now()
+	b.resyncs++
+	b.mx.Unlock()
+
+	log.Warnf("snapshot of %s order book %s wasn't received in %s", b.spec.channelName(), b.pair, b.resyncTimeout)
+	b.resync()
+}
+
+// invalidate - marks book invalid and starts waiting for snapshot. Must be called under lock.
+func (b *ManagedBook) invalidate(reason error) {
+	b.resyncing = true
+	b.resyncAt = time.Now()
+	b.resyncs++
+	if !b.closed {
+		b.waitSnapshot()
+	}
+	if b.valid {
+		b.valid = false
+		b.notify(BookEvent{Pair: b.pair, State: BookInvalid, Reason: reason, Resyncs: b.resyncs})
+	}
+}
+
+func (b *ManagedBook) notify(event BookEvent) {
+	if b.onState != nil {
+		b.onState(event)
+	}
+}
+
+func (b *ManagedBook) resync() {
+	log.Warnf("resync of %s order book %s", b.spec.channelName(), b.pair)
+	if err := b.k.resync(b.spec, []string{b.pair}); err != nil {
+		log.Error(err)
+	}
+
+	b.mx.Lock()
+	if !b.closed && b.resyncing {
+		b.waitSnapshot()
+	}
+	b.mx.Unlock()
+}
+
+// reconnected - the client resubscribes to all channels after reconnect, so the book only waits for snapshot
+func (b *ManagedBook) reconnected() {
+	b.book.MarkResync()
+
+	b.mx.Lock()
+	b.invalidate(ErrReconnected)
+	b.mx.Unlock()
+}
@@ -0,0 +1,114 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	bookSnapshotMessage = `[0,{"as":[["5541.30000","2.50700000","1534614248.123678"]],"bs":[["5541.20000","1.52900000","1534614248.765567"]]},"book-10","XBT/USD"]`
+	bookUpdateMessage   = `[0,{"a":[["5541.40000","1.00000000","1534614248.456738"]],"c":"1"},"book-10","XBT/USD"]`
+)
+
+func TestManagedBook_Resync(t *testing.T) {
+	k := NewKraken(ProdBaseURL)
+
+	var events []BookEvent
+	book, err := k.NewManagedBook(BTCUSD, 10, 1, 8, WithBookStateCallback(func(e BookEvent) {
+		events = append(events, e)
+	}))
+	require.NoError(t, err)
+	assert.False(t, book.Valid())
+
+	// update before snapshot is discarded without resync
+	require.NoError(t, k.handleMessage([]byte(bookUpdateMessage)))
+	assert.Empty(t, events)
+	assert.EqualValues(t, 0, book.Resyncs())
+
+	require.NoError(t, k.handleMessage([]byte(bookSnapshotMessage)))
+	assert.True(t, book.Valid())
+	require.Len(t, events, 1)
+	assert.Equal(t, BookValid, events[0].State)
+
+	// invalid checksum
+	require.NoError(t, k.handleMessage([]byte(bookUpdateMessage)))
+	assert.False(t, book.Valid())
+	assert.EqualValues(t, 1, book.Resyncs())
+	require.Len(t, events, 2)
+	assert.Equal(t, BookInvalid, events[1].State)
+	assert.Error(t, events[1].Reason)
+
+	// stale updates are discarded until snapshot
+	require.NoError(t, k.handleMessage([]byte(bookUpdateMessage)))
+	assert.EqualValues(t, 1, book.Resyncs())
+
+	require.NoError(t, k.handleMessage([]byte(bookSnapshotMessage)))
+	assert.True(t, book.Valid())
+	price, _ := book.Book().Asks.Best()
+	assert.Equal(t, "5541.3", price.String())
+
+	k.notifyReconnect()
+	assert.False(t, book.Valid())
+	assert.EqualValues(t, 2, book.Resyncs())
+	require.Len(t, events, 4)
+	assert.ErrorIs(t, events[3].Reason, ErrReconnected)
+
+	require.NoError(t, book.Close())
+	assert.Empty(t, k.Subscriptions())
+}
+
+func TestManagedBook_ResyncTimeout(t *testing.T) {
+	k := NewKraken(ProdBaseURL)
+
+	book, err := k.NewManagedBook(BTCUSD, 10, 1, 8, WithResyncTimeout(20*time.Millisecond))
+	require.NoError(t, err)
+	defer book.Close()
+
+	// snapshot never arrives, so resync is repeated without new updates
+	assert.Eventually(t, func() bool {
+		return book.Resyncs() >= 2
+	}, time.Second, 5*time.Millisecond)
+	assert.False(t, book.Valid())
+
+	require.NoError(t, k.handleMessage([]byte(bookSnapshotMessage)))
+	assert.True(t, book.Valid())
+	resyncs := book.Resyncs()
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, resyncs, book.Resyncs())
+}
+
+func TestManagedBook_SharedResync(t *testing.T) {
+	k := NewKraken(ProdBaseURL)
+
+	handle, err := k.SubscribeBookHandle([]string{BTCUSD}, 10)
+	require.NoError(t, err)
+	book, err := k.NewManagedBook(BTCUSD, 10, 1, 8)
+	require.NoError(t, err)
+	require.NoError(t, k.handleMessage([]byte(bookSubscribedMessage)))
+	require.NoError(t, k.handleMessage([]byte(bookSnapshotMessage)))
+	require.True(t, book.Valid())
+
+	// invalid checksum resubscribes the channel shared with the handle
+	require.NoError(t, k.handleMessage([]byte(bookUpdateMessage)))
+	require.NoError(t, k.handleMessage([]byte(`{"channelID":0,"channelName":"book-10","event":"subscriptionStatus","pair":"XBT/USD","status":"unsubscribed","subscription":{"depth":10,"name":"book"}}`)))
+	subscriptions := k.Subscriptions()
+	require.Len(t, subscriptions, 1)
+	assert.Equal(t, StatePending, subscriptions[0].State)
+	assert.Equal(t, 2, subscriptions[0].Consumers)
+
+	require.NoError(t, k.handleMessage([]byte(bookSubscribedMessage)))
+	require.NoError(t, k.handleMessage([]byte(bookSnapshotMessage)))
+	assert.True(t, book.Valid())
+	assert.Equal(t, StateSubscribed, k.Subscriptions()[0].State)
+
+	// the handle keeps the subscription after the book is closed
+	require.NoError(t, book.Close())
+	subscriptions = k.Subscriptions()
+	require.Len(t, subscriptions, 1)
+	assert.Equal(t, 1, subscriptions[0].Consumers)
+	require.NoError(t, handle.Close())
+	assert.Empty(t, k.Subscriptions())
+}
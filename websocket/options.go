@@ -36,3 +36,60 @@ func WithHeartbeatTimeout(timeout time.Duration) KrakenOption {
 		k.heartbeatTimeout = timeout
 	}
 }
+
+// WithUpdateBufferSize - add custom capacity of `Listen()` channel. Default: 1024.
+func WithUpdateBufferSize(size int) KrakenOption {
+	return func(k *Kraken) {
+		k.bufferSize = size
+	}
+}
+
+// WithOverflowPolicy - add custom behaviour of `Listen()` channel when it's full. Default: OverflowBlock.
+func WithOverflowPolicy(policy OverflowPolicy) KrakenOption {
+	return func(k *Kraken) {
+		k.overflowPolicy = policy
+	}
+}
+
+// WithTokenProvider - add source of tokens for private Websocket API. Tokens are refreshed on expiration and after reconnect.
+func WithTokenProvider(provider TokenProvider) KrakenOption {
+	return func(k *Kraken) {
+		k.tokens.setProvider(provider)
+	}
+}
+
+// WithCredentials - add API key and secret which are used to receive tokens for private Websocket API.
+func WithCredentials(key, secret string) KrakenOption {
+	return func(k *Kraken) {
+		k.tokens.setProvider(NewRESTTokenProvider(key, secret))
+	}
+}
+
+// WithRecorder - add recorder of received and sent messages and connection events. `conn` is a name of the connection in recording,
+// pool appends shard id to it.
+func WithRecorder(recorder *Recorder, conn string) KrakenOption {
+	return func(k *Kraken) {
+		k.recorder = recorder
+		k.recordConn = conn
+	}
+}
+
+// SubscribeOption - option function for subscription requests
+type SubscribeOption func(*Subscription)
+
+// WithSnapshot - request or skip initial snapshot of the channel. Default: Kraken's default for the channel.
+func WithSnapshot(snapshot bool) SubscribeOption {
+	return func(s *Subscription) {
+		s.Snapshot = &snapshot
+	}
+}
+
+func newSubscription(name string, opts []SubscribeOption) Subscription {
+	spec := Subscription{
+		Name: name,
+	}
+	for i := range opts {
+		opts[i](&spec)
+	}
+	return spec
+}
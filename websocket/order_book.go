@@ -2,17 +2,29 @@ package websocket
 
 import (
 	"bytes"
-	"fmt"
 	"hash/crc32"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
+// ErrResyncRequired - order book missed some updates and waits for a new snapshot
+var ErrResyncRequired = errors.New("order book requires resync: waiting for snapshot")
+
 // OrderBook -
 type OrderBook struct {
 	Asks *OrderBookSide
 	Bids *OrderBookSide
+
+	needResync bool
+	// sequence - count of applied updates including snapshots
+	sequence uint64
+	updated  time.Time
+	onDiff   func(BookDiff)
+	mx       sync.RWMutex
 }
 
 // NewOrderBook - creates order book.
@@ -31,28 +43,99 @@ func NewOrderBook(depth, pricePrecision, volumePrecision int) *OrderBook {
 
 // ApplyUpdate - applies updates from kraken websocket.
 // If you need to verify checksum, set verify to true.
+// Snapshot replaces the whole order book. If update has `Gap` flag the order book is marked as needing resync
+// and all updates are rejected with `ErrResyncRequired` until the next snapshot.
 func (o *OrderBook) ApplyUpdate(upd OrderBookUpdate, verify bool) error {
-	if err := o.Asks.applyUpdates(upd.Asks); err != nil {
-		return err
+	diff, handler, err := o.applyUpdate(upd, verify)
+	if handler != nil && diff != nil {
+		handler(*diff)
+	}
+	return err
+}
+
+func (o *OrderBook) applyUpdate(upd OrderBookUpdate, verify bool) (*BookDiff, func(BookDiff), error) {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+
+	switch {
+	case upd.IsSnapshot:
+		o.Asks.reset()
+		o.Bids.reset()
+		o.needResync = false
+	case upd.Gap:
+		o.needResync = true
+	}
+
+	if o.needResync {
+		return nil, nil, ErrResyncRequired
+	}
+
+	o.sequence++
+	o.updated = time.Now()
+
+	var (
+		diff    *BookDiff
+		changes *[]LevelDiff
+	)
+	if o.onDiff != nil {
+		diff = &BookDiff{
+			Sequence: o.sequence,
+			Time:     o.updated,
+			Snapshot: upd.IsSnapshot,
+		}
+		changes = &diff.Changes
+	}
+
+	if err := o.Asks.applyUpdates(upd.Asks, changes); err != nil {
+		return diff, o.onDiff, err
 	}
-	if err := o.Bids.applyUpdates(upd.Bids); err != nil {
-		return err
+	if err := o.Bids.applyUpdates(upd.Bids, changes); err != nil {
+		return diff, o.onDiff, err
 	}
 
 	if verify && !upd.IsSnapshot {
 		if cs := o.Checksum(); cs != upd.CheckSum {
-			return errors.Errorf("invalid checksum: local %s != remote %s", cs, upd.CheckSum)
+			return diff, o.onDiff, errors.Errorf("invalid checksum: local %s != remote %s", cs, upd.CheckSum)
 		}
 	}
-	return nil
+	return diff, o.onDiff, nil
+}
+
+// MarkResync - marks order book as inconsistent. It will ignore updates until the next snapshot.
+func (o *OrderBook) MarkResync() {
+	o.mx.Lock()
+	o.needResync = true
+	o.mx.Unlock()
+}
+
+// NeedsResync - returns true if order book missed updates and waits for snapshot
+func (o *OrderBook) NeedsResync() bool {
+	o.mx.RLock()
+	defer o.mx.RUnlock()
+	return o.needResync
+}
+
+// Snapshot - returns copy of both sides which isn't torn by concurrent `ApplyUpdate`.
+// `Sequence` of snapshot is a count of applied updates and `Time` is a time of the last one.
+func (o *OrderBook) Snapshot() OrderBookSnapshot {
+	o.mx.RLock()
+	defer o.mx.RUnlock()
+
+	return OrderBookSnapshot{
+		Asks:     sideLevels(o.Asks),
+		Bids:     sideLevels(o.Bids),
+		Time:     o.updated,
+		Sequence: o.sequence,
+		Valid:    !o.needResync,
+	}
 }
 
 // Checksum - computes order book checksum. Details https://docs.kraken.com/websockets/#book-checksum
 func (o *OrderBook) Checksum() string {
 	var str bytes.Buffer
-	str.Write(o.Asks.checksum())
-	str.Write(o.Bids.checksum())
-	return fmt.Sprint(crc32.ChecksumIEEE(str.Bytes()))
+	o.Asks.writeChecksum(&str)
+	o.Bids.writeChecksum(&str)
+	return strconv.FormatUint(uint64(crc32.ChecksumIEEE(str.Bytes())), 10)
 }
 
 // String - returns full order book as a string
@@ -2,56 +2,44 @@ package websocket
 
 import (
 	"bytes"
+	"math"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 
+	"github.com/pkg/errors"
 	"github.com/shopspring/decimal"
 )
 
-type orderBookLevel struct {
-	Price  decimal.Decimal
-	Volume decimal.Decimal
-}
-
-type byPrice []orderBookLevel
-
-func (a byPrice) Len() int           { return len(a) }
-func (a byPrice) Less(i, j int) bool { return a[i].Price.Cmp(a[j].Price) == -1 }
-func (a byPrice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-
-func newOrderBookLevels(m map[string]orderBookLevel, asc bool) []orderBookLevel {
-	result := make([]orderBookLevel, 0)
-
-	for _, value := range m {
-		result = append(result, value)
-	}
-
-	if asc {
-		sort.Sort(byPrice(result))
-	} else {
-		sort.Sort(sort.Reverse(byPrice(result)))
-	}
+// checksumDepth - count of best levels of each side which are used in checksum
+const checksumDepth = 10
 
-	return result
+// orderBookLevel - price level with price and volume scaled by precision to integers
+type orderBookLevel struct {
+	price  int64
+	volume int64
 }
 
-// OrderBookSide -
+// OrderBookSide - one side of order book. Levels are kept in slice sorted from the best price, so update is a binary search
+// and a shift of the tail. Prices and volumes are stored as integers scaled by precision.
 type OrderBookSide struct {
-	m               map[string]orderBookLevel
-	sorted          []orderBookLevel
+	levels          []orderBookLevel
 	depth           int
 	pricePrecision  int32
 	volumePrecision int32
 	isAsk           bool
 
+	// checksumCache - checksum part of the side. It's rebuilt only if one of top levels changes.
+	checksumCache []byte
+	checksumValid bool
+
 	mx *sync.RWMutex
 }
 
 func newOrderBookSide(depth, pricePrecision, volumePrecision int, isAsk bool) *OrderBookSide {
 	return &OrderBookSide{
-		m:               make(map[string]orderBookLevel),
-		sorted:          make([]orderBookLevel, 0),
+		levels:          make([]orderBookLevel, 0, depth+1),
 		depth:           depth,
 		pricePrecision:  int32(pricePrecision),
 		volumePrecision: int32(volumePrecision),
@@ -60,44 +48,134 @@ func newOrderBookSide(depth, pricePrecision, volumePrecision int, isAsk bool) *O
 	}
 }
 
-func (o *OrderBookSide) applyUpdate(upd OrderBookItem) error {
-	flValue, err := upd.Volume.Float64()
+// search - returns index of the price or index where it has to be inserted
+func (o *OrderBookSide) search(price int64) (int, bool) {
+	i := sort.Search(len(o.levels), func(i int) bool {
+		if o.isAsk {
+			return o.levels[i].price >= price
+		}
+		return o.levels[i].price <= price
+	})
+	return i, i < len(o.levels) && o.levels[i].price == price
+}
+
+// applyUpdate - applies level update. If `changes` isn't nil, changes of the side are appended to it.
+func (o *OrderBookSide) applyUpdate(upd OrderBookItem, changes *[]LevelDiff) error {
+	price, err := parseScaled(upd.Price.String(), o.pricePrecision)
 	if err != nil {
-		return err
+		return errors.Wrap(err, "price")
+	}
+	volume, err := parseScaled(upd.Volume.String(), o.volumePrecision)
+	if err != nil {
+		return errors.Wrap(err, "volume")
 	}
 
-	price := decimal.RequireFromString(upd.Price.String())
-	key := price.StringFixed(o.pricePrecision)
+	i, found := o.search(price)
+	level := orderBookLevel{price: price, volume: volume}
+	var action string
+	switch {
+	case volume == 0 && found:
+		o.levels = append(o.levels[:i], o.levels[i+1:]...)
+		action = LevelRemoved
+	case volume == 0:
+		return nil
+	case found && o.levels[i].volume == volume:
+		// republished level
+		return nil
+	case found:
+		o.levels[i].volume = volume
+		action = LevelChanged
+	default:
+		o.levels = append(o.levels, orderBookLevel{})
+		copy(o.levels[i+1:], o.levels[i:])
+		o.levels[i] = level
+		action = LevelAdded
+	}
+	if i < checksumDepth {
+		o.checksumValid = false
+	}
+	if changes != nil {
+		*changes = append(*changes, o.levelDiff(action, level))
+	}
+	return nil
+}
 
+// applyUpdates - applies updates and cuts levels deeper than depth. If `changes` isn't nil, changes of the side
+// including levels removed by depth are appended to it.
+func (o *OrderBookSide) applyUpdates(updates []OrderBookItem, changes *[]LevelDiff) error {
 	o.mx.Lock()
-	if flValue == 0 {
-		delete(o.m, key)
-	} else {
-		o.m[key] = orderBookLevel{
-			Price:  price,
-			Volume: decimal.RequireFromString(upd.Volume.String()),
+	defer o.mx.Unlock()
+
+	start := 0
+	if changes != nil {
+		start = len(*changes)
+	}
+
+	for i := range updates {
+		if err := o.applyUpdate(updates[i], changes); err != nil {
+			return err
+		}
+	}
+
+	if len(o.levels) > o.depth {
+		if changes != nil {
+			for _, level := range o.levels[o.depth:] {
+				*changes = o.truncated(*changes, start, level)
+			}
+		}
+		o.levels = o.levels[:o.depth]
+		if o.depth < checksumDepth {
+			o.checksumValid = false
 		}
 	}
-	o.mx.Unlock()
 	return nil
 }
 
-func (o *OrderBookSide) applyUpdates(updates []OrderBookItem) error {
-	for i := range updates {
-		if err := o.applyUpdate(updates[i]); err != nil {
-			return err
+// truncated - registers removal of level which is cut off by depth. If the level was added by the same update,
+// its changes are dropped because consumers never knew about it.
+func (o *OrderBookSide) truncated(changes []LevelDiff, start int, level orderBookLevel) []LevelDiff {
+	price := o.price(level)
+	for i := start; i < len(changes); i++ {
+		if !changes[i].Price.Equal(price) {
+			continue
+		}
+		if changes[i].Action != LevelAdded {
+			break
+		}
+		result := changes[:i]
+		for _, change := range changes[i+1:] {
+			if !change.Price.Equal(price) {
+				result = append(result, change)
+			}
 		}
+		return result
 	}
+	diff := o.levelDiff(LevelRemoved, level)
+	diff.Truncated = true
+	return append(changes, diff)
+}
 
-	o.mx.Lock()
-	levels := newOrderBookLevels(o.m, o.isAsk)
-	for _, level := range levels[o.depth:] {
-		delete(o.m, level.Price.StringFixed(o.pricePrecision))
+func (o *OrderBookSide) levelDiff(action string, level orderBookLevel) LevelDiff {
+	diff := LevelDiff{
+		Side:   SideBids,
+		Action: action,
+		Price:  o.price(level),
+		Volume: o.volume(level),
 	}
-	o.sorted = levels[:o.depth]
-	o.mx.Unlock()
+	if o.isAsk {
+		diff.Side = SideAsks
+	}
+	if action == LevelRemoved {
+		diff.Volume = decimal.Zero
+	}
+	return diff
+}
 
-	return nil
+func (o *OrderBookSide) reset() {
+	o.mx.Lock()
+	o.levels = o.levels[:0]
+	o.checksumValid = false
+	o.mx.Unlock()
 }
 
 // Get - receives volume by price. If not exists returns false
@@ -105,12 +183,11 @@ func (o *OrderBookSide) Get(price decimal.Decimal) (decimal.Decimal, bool) {
 	o.mx.RLock()
 	defer o.mx.RUnlock()
 
-	key := price.StringFixed(o.pricePrecision)
-	level, ok := o.m[key]
+	i, ok := o.search(price.Shift(o.pricePrecision).Round(0).IntPart())
 	if !ok {
 		return decimal.Zero, ok
 	}
-	return level.Volume, ok
+	return o.volume(o.levels[i]), ok
 }
 
 // Range - ranges by order book side from best price to depth
@@ -118,8 +195,8 @@ func (o *OrderBookSide) Range(handler func(price, volume decimal.Decimal) error)
 	o.mx.RLock()
 	defer o.mx.RUnlock()
 
-	for i := range o.sorted {
-		if err := handler(o.sorted[i].Price, o.sorted[i].Volume); err != nil {
+	for i := range o.levels {
+		if err := handler(o.price(o.levels[i]), o.volume(o.levels[i])); err != nil {
 			return err
 		}
 	}
@@ -131,29 +208,45 @@ func (o *OrderBookSide) Best() (decimal.Decimal, decimal.Decimal) {
 	o.mx.RLock()
 	defer o.mx.RUnlock()
 
-	if len(o.sorted) == 0 {
+	if len(o.levels) == 0 {
 		return decimal.Zero, decimal.Zero
 	}
-	return o.sorted[0].Price, o.sorted[0].Volume
+	return o.price(o.levels[0]), o.volume(o.levels[0])
 }
 
-func (o *OrderBookSide) checksum() []byte {
+// Len - returns count of price levels
+func (o *OrderBookSide) Len() int {
 	o.mx.RLock()
 	defer o.mx.RUnlock()
+	return len(o.levels)
+}
 
-	var str bytes.Buffer
-	for _, level := range o.sorted {
-		price := level.Price.StringFixed(o.pricePrecision)
-		price = strings.Replace(price, ".", "", 1)
-		price = strings.TrimLeft(price, "0")
-		str.WriteString(price)
+func (o *OrderBookSide) price(level orderBookLevel) decimal.Decimal {
+	return decimal.New(level.price, -o.pricePrecision)
+}
 
-		volume := level.Volume.StringFixed(o.volumePrecision)
-		volume = strings.Replace(volume, ".", "", 1)
-		volume = strings.TrimLeft(volume, "0")
-		str.WriteString(volume)
+func (o *OrderBookSide) volume(level orderBookLevel) decimal.Decimal {
+	return decimal.New(level.volume, -o.volumePrecision)
+}
+
+// writeChecksum - writes checksum part of top levels: price and volume without dot and leading zeros, which are scaled integers
+func (o *OrderBookSide) writeChecksum(buf *bytes.Buffer) {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+
+	if !o.checksumValid {
+		cache := o.checksumCache[:0]
+		for i := range o.levels {
+			if i == checksumDepth {
+				break
+			}
+			cache = strconv.AppendInt(cache, o.levels[i].price, 10)
+			cache = strconv.AppendInt(cache, o.levels[i].volume, 10)
+		}
+		o.checksumCache = cache
+		o.checksumValid = true
 	}
-	return str.Bytes()
+	buf.Write(o.checksumCache)
 }
 
 // String -
@@ -162,20 +255,84 @@ func (o *OrderBookSide) String() string {
 	defer o.mx.RUnlock()
 
 	var str strings.Builder
-	for i := range o.sorted {
+	for i := range o.levels {
 		str.WriteByte('\t')
-		if o.pricePrecision > 0 {
-			str.WriteString(o.sorted[i].Price.StringFixed(o.pricePrecision))
-		} else {
-			str.WriteString(o.sorted[i].Price.String())
-		}
+		str.WriteString(o.price(o.levels[i]).StringFixed(o.pricePrecision))
 		str.WriteString(" [ ")
-		if o.volumePrecision > 0 {
-			str.WriteString(o.sorted[i].Volume.StringFixed(o.volumePrecision))
-		} else {
-			str.WriteString(o.sorted[i].Volume.String())
-		}
+		str.WriteString(o.volume(o.levels[i]).StringFixed(o.volumePrecision))
 		str.WriteString(" ]\r\n")
 	}
 	return str.String()
 }
+
+// parseScaled - parses decimal string to integer scaled by precision without allocations.
+// Values with more significant fractional digits than precision are rounded.
+func parseScaled(value string, precision int32) (int64, error) {
+	if value == "" {
+		return 0, errors.New("empty number")
+	}
+
+	str := value
+	negative := false
+	if str[0] == '-' || str[0] == '+' {
+		negative = str[0] == '-'
+		str = str[1:]
+	}
+
+	var (
+		result   int64
+		digits   bool
+		dot      bool
+		fraction int32
+	)
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		switch {
+		case c == '.' && !dot:
+			dot = true
+		case c >= '0' && c <= '9':
+			digits = true
+			if dot {
+				if fraction == precision {
+					if c != '0' {
+						return parseScaledSlow(value, precision)
+					}
+					continue
+				}
+				fraction++
+			}
+			if result > (math.MaxInt64-int64(c-'0'))/10 {
+				return 0, errors.Errorf("number is out of range: %s", value)
+			}
+			result = result*10 + int64(c-'0')
+		default:
+			return parseScaledSlow(value, precision)
+		}
+	}
+	if !digits {
+		return 0, errors.Errorf("invalid number: %s", value)
+	}
+	for ; fraction < precision; fraction++ {
+		if result > math.MaxInt64/10 {
+			return 0, errors.Errorf("number is out of range: %s", value)
+		}
+		result *= 10
+	}
+	if negative {
+		result = -result
+	}
+	return result, nil
+}
+
+// parseScaledSlow - parses numbers with exponent or extra precision
+func parseScaledSlow(value string, precision int32) (int64, error) {
+	d, err := decimal.NewFromString(value)
+	if err != nil {
+		return 0, errors.Errorf("invalid number: %s", value)
+	}
+	scaled := d.Shift(precision).Round(0)
+	if !scaled.BigInt().IsInt64() {
+		return 0, errors.Errorf("number is out of range: %s", value)
+	}
+	return scaled.IntPart(), nil
+}
@@ -0,0 +1,208 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// legacyOrderBookSide - previous implementation of order book side: map of levels which is sorted after every update.
+// It's kept to check equivalence and to compare performance.
+type legacyOrderBookSide struct {
+	m               map[string]legacyLevel
+	sorted          []legacyLevel
+	depth           int
+	pricePrecision  int32
+	volumePrecision int32
+	isAsk           bool
+}
+
+type legacyLevel struct {
+	Price  decimal.Decimal
+	Volume decimal.Decimal
+}
+
+func newLegacyOrderBookSide(depth, pricePrecision, volumePrecision int, isAsk bool) *legacyOrderBookSide {
+	return &legacyOrderBookSide{
+		m:               make(map[string]legacyLevel),
+		depth:           depth,
+		pricePrecision:  int32(pricePrecision),
+		volumePrecision: int32(volumePrecision),
+		isAsk:           isAsk,
+	}
+}
+
+func (o *legacyOrderBookSide) applyUpdates(updates []OrderBookItem) error {
+	for _, upd := range updates {
+		flValue, err := upd.Volume.Float64()
+		if err != nil {
+			return err
+		}
+		price := decimal.RequireFromString(upd.Price.String())
+		key := price.StringFixed(o.pricePrecision)
+		if flValue == 0 {
+			delete(o.m, key)
+		} else {
+			o.m[key] = legacyLevel{Price: price, Volume: decimal.RequireFromString(upd.Volume.String())}
+		}
+	}
+
+	levels := make([]legacyLevel, 0)
+	for _, value := range o.m {
+		levels = append(levels, value)
+	}
+	sort.Slice(levels, func(i, j int) bool {
+		if o.isAsk {
+			return levels[i].Price.LessThan(levels[j].Price)
+		}
+		return levels[i].Price.GreaterThan(levels[j].Price)
+	})
+	if len(levels) > o.depth {
+		for _, level := range levels[o.depth:] {
+			delete(o.m, level.Price.StringFixed(o.pricePrecision))
+		}
+		levels = levels[:o.depth]
+	}
+	o.sorted = levels
+	return nil
+}
+
+func (o *legacyOrderBookSide) checksum() []byte {
+	var str bytes.Buffer
+	for i, level := range o.sorted {
+		if i == checksumDepth {
+			break
+		}
+		str.WriteString(checksumValue(level.Price, o.pricePrecision))
+		str.WriteString(checksumValue(level.Volume, o.volumePrecision))
+	}
+	return str.Bytes()
+}
+
+func randomUpdates(r *rand.Rand, count int) []OrderBookItem {
+	updates := make([]OrderBookItem, count)
+	for i := range updates {
+		price := fmt.Sprintf("%d.%d0000", 5000+r.Intn(2000), r.Intn(10))
+		volume := "0.00000000"
+		if r.Intn(4) > 0 {
+			volume = fmt.Sprintf("%d.%08d", r.Intn(10), r.Intn(100000000))
+		}
+		updates[i] = OrderBookItem{Price: json.Number(price), Volume: json.Number(volume)}
+	}
+	return updates
+}
+
+func TestOrderBookSide_Legacy(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, isAsk := range []bool{true, false} {
+		side := newOrderBookSide(100, 1, 8, isAsk)
+		legacy := newLegacyOrderBookSide(100, 1, 8, isAsk)
+
+		for i := 0; i < 500; i++ {
+			updates := randomUpdates(r, 1+r.Intn(5))
+			require.NoError(t, side.applyUpdates(updates, nil))
+			require.NoError(t, legacy.applyUpdates(updates))
+
+			require.Equal(t, len(legacy.sorted), side.Len())
+			j := 0
+			require.NoError(t, side.Range(func(price, volume decimal.Decimal) error {
+				assert.True(t, legacy.sorted[j].Price.Equal(price))
+				assert.True(t, legacy.sorted[j].Volume.Equal(volume))
+				j++
+				return nil
+			}))
+
+			var buf bytes.Buffer
+			side.writeChecksum(&buf)
+			require.Equal(t, string(legacy.checksum()), buf.String())
+		}
+	}
+}
+
+func TestOrderBookSide_Malformed(t *testing.T) {
+	side := newOrderBookSide(10, 1, 8, true)
+	assert.Error(t, side.applyUpdates([]OrderBookItem{{Price: "abc", Volume: "1"}}, nil))
+	assert.Error(t, side.applyUpdates([]OrderBookItem{{Price: "1.0", Volume: ""}}, nil))
+	assert.Error(t, side.applyUpdates([]OrderBookItem{{Price: "99999999999999999999", Volume: "1"}}, nil))
+}
+
+func TestParseScaled(t *testing.T) {
+	tests := []struct {
+		value     string
+		precision int32
+		want      int64
+		wantErr   bool
+	}{
+		{"5541.30000", 1, 55413, false},
+		{"0.00012", 8, 12000, false},
+		{"12", 2, 1200, false},
+		{"-1.5", 1, -15, false},
+		{"1.25", 1, 13, false},
+		{"1e2", 0, 100, false},
+		{".", 2, 0, true},
+		{"1.2.3", 2, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseScaled(tt.value, tt.precision)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func benchmarkUpdates(depth int) [][]OrderBookItem {
+	r := rand.New(rand.NewSource(1))
+	batches := make([][]OrderBookItem, 1000)
+	for i := range batches {
+		batches[i] = randomUpdates(r, 2)
+	}
+	// initial book of full depth
+	snapshot := make([]OrderBookItem, depth)
+	for i := range snapshot {
+		snapshot[i] = OrderBookItem{Price: json.Number(fmt.Sprintf("%d.00000", 5000+i*2)), Volume: "1.00000000"}
+	}
+	return append([][]OrderBookItem{snapshot}, batches...)
+}
+
+func BenchmarkOrderBookSide(b *testing.B) {
+	for _, depth := range []int{10, 100, 1000} {
+		batches := benchmarkUpdates(depth)
+
+		b.Run(fmt.Sprintf("sorted slice/%d", depth), func(b *testing.B) {
+			side := newOrderBookSide(depth, 1, 8, true)
+			var buf bytes.Buffer
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_ = side.applyUpdates(batches[i%len(batches)], nil)
+				buf.Reset()
+				side.writeChecksum(&buf)
+				_ = crc32.ChecksumIEEE(buf.Bytes())
+			}
+		})
+
+		b.Run(fmt.Sprintf("legacy map/%d", depth), func(b *testing.B) {
+			side := newLegacyOrderBookSide(depth, 1, 8, true)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_ = side.applyUpdates(batches[i%len(batches)])
+				_ = crc32.ChecksumIEEE(side.checksum())
+			}
+		})
+	}
+}
+
@@ -0,0 +1,329 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+)
+
+// Errors of sequence tracking
+var (
+	ErrSequenceGap       = errors.New("sequence gap")
+	ErrSequenceDuplicate = errors.New("duplicate sequence")
+)
+
+// OrderStatus - status of order
+type OrderStatus string
+
+// Order statuses
+const (
+	OrderStatusPending  OrderStatus = "pending"
+	OrderStatusOpen     OrderStatus = "open"
+	OrderStatusClosed   OrderStatus = "closed"
+	OrderStatusCanceled OrderStatus = "canceled"
+	OrderStatusExpired  OrderStatus = "expired"
+)
+
+// Final - returns true if order is closed, cancelled or expired
+func (s OrderStatus) Final() bool {
+	return s == OrderStatusClosed || s == OrderStatusCanceled || s == OrderStatusExpired
+}
+
+// OrderFlags - comma separated order flags, e.g. `post,fciq`
+type OrderFlags string
+
+// Order flags
+const (
+	FlagPostOnly     = "post"
+	FlagFeeInBase    = "fcib"
+	FlagFeeInQuote   = "fciq"
+	FlagNoMPP        = "nompp"
+	FlagVolumeQuoted = "viqc"
+)
+
+// Has - returns true if flag is set
+func (f OrderFlags) Has(flag string) bool {
+	for _, value := range f.List() {
+		if value == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// List - returns flags as slice
+func (f OrderFlags) List() []string {
+	result := make([]string, 0)
+	for _, value := range strings.Split(string(f), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+// Timestamp - unix time with fraction of seconds which Kraken sends as string, e.g. `1534614057.321597`. `0` is zero time.
+type Timestamp struct {
+	time.Time
+}
+
+// UnmarshalJSON - unmarshal timestamp from string or number
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	value := strings.Trim(string(data), `"`)
+	if value == "" || value == "null" {
+		t.Time = time.Time{}
+		return nil
+	}
+	seconds, err := decimal.NewFromString(value)
+	if err != nil {
+		return errors.Wrap(err, "invalid timestamp")
+	}
+	if seconds.IsZero() {
+		t.Time = time.Time{}
+		return nil
+	}
+	t.Time = time.Unix(0, seconds.Shift(9).Round(0).IntPart()).UTC()
+	return nil
+}
+
+// MarshalJSON - marshal timestamp as Kraken does
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+// String - unix time with microseconds, e.g. `1534614057.321597`
+func (t Timestamp) String() string {
+	if t.IsZero() {
+		return "0"
+	}
+	micros := t.UnixNano() / int64(time.Microsecond)
+	return fmt.Sprintf("%d.%06d", micros/1e6, micros%1e6)
+}
+
+// openOrderField - field of open order which is merged from delta
+type openOrderField struct {
+	name  string
+	isSet func(o *OpenOrder) bool
+	copy  func(dst, src *OpenOrder)
+}
+
+// openOrderFields - fields of open order by JSON names
+var openOrderFields = []openOrderField{
+	{"cost", func(o *OpenOrder) bool { return !o.Cost.IsZero() }, func(dst, src *OpenOrder) { dst.Cost = src.Cost }},
+	{"descr", func(o *OpenOrder) bool { return o.Descr != OpenOrderDescr{} }, func(dst, src *OpenOrder) { dst.Descr = src.Descr }},
+	{"fee", func(o *OpenOrder) bool { return !o.Fee.IsZero() }, func(dst, src *OpenOrder) { dst.Fee = src.Fee }},
+	{"limitprice", func(o *OpenOrder) bool { return !o.LimitPrice.IsZero() }, func(dst, src *OpenOrder) { dst.LimitPrice = src.LimitPrice }},
+	{"misc", func(o *OpenOrder) bool { return o.Misc != "" }, func(dst, src *OpenOrder) { dst.Misc = src.Misc }},
+	{"oflags", func(o *OpenOrder) bool { return o.Oflags != "" }, func(dst, src *OpenOrder) { dst.Oflags = src.Oflags }},
+	{"opentm", func(o *OpenOrder) bool { return !o.OpenTime.IsZero() }, func(dst, src *OpenOrder) { dst.OpenTime = src.OpenTime }},
+	{"starttm", func(o *OpenOrder) bool { return !o.StartTime.IsZero() }, func(dst, src *OpenOrder) { dst.StartTime = src.StartTime }},
+	{"expiretm", func(o *OpenOrder) bool { return !o.ExpireTime.IsZero() }, func(dst, src *OpenOrder) { dst.ExpireTime = src.ExpireTime }},
+	{"lastupdated", func(o *OpenOrder) bool { return !o.LastUpdated.IsZero() }, func(dst, src *OpenOrder) { dst.LastUpdated = src.LastUpdated }},
+	{"price", func(o *OpenOrder) bool { return !o.Price.IsZero() }, func(dst, src *OpenOrder) { dst.Price = src.Price }},
+	{"avg_price", func(o *OpenOrder) bool { return !o.AvgPrice.IsZero() }, func(dst, src *OpenOrder) { dst.AvgPrice = src.AvgPrice }},
+	{"refid", func(o *OpenOrder) bool { return o.Refid != "" }, func(dst, src *OpenOrder) { dst.Refid = src.Refid }},
+	{"cl_ord_id", func(o *OpenOrder) bool { return o.ClOrdID != "" }, func(dst, src *OpenOrder) { dst.ClOrdID = src.ClOrdID }},
+	{"status", func(o *OpenOrder) bool { return o.Status != "" }, func(dst, src *OpenOrder) { dst.Status = src.Status }},
+	{"cancel_reason", func(o *OpenOrder) bool { return o.CancelReason != "" }, func(dst, src *OpenOrder) { dst.CancelReason = src.CancelReason }},
+	{"stopprice", func(o *OpenOrder) bool { return !o.StopPrice.IsZero() }, func(dst, src *OpenOrder) { dst.StopPrice = src.StopPrice }},
+	{"userref", func(o *OpenOrder) bool { return o.UserRef != 0 }, func(dst, src *OpenOrder) { dst.UserRef = src.UserRef }},
+	{"vol", func(o *OpenOrder) bool { return !o.Vol.IsZero() }, func(dst, src *OpenOrder) { dst.Vol = src.Vol }},
+	{"vol_exec", func(o *OpenOrder) bool { return !o.VolExec.IsZero() }, func(dst, src *OpenOrder) { dst.VolExec = src.VolExec }},
+}
+
+// UnmarshalJSON - unmarshal open order and remember which fields were sent
+func (o *OpenOrder) UnmarshalJSON(data []byte) error {
+	type plain OpenOrder
+	var value plain
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*o = OpenOrder(value)
+	o.fields = make(map[string]struct{}, len(raw))
+	for key, field := range raw {
+		if string(field) != "null" {
+			o.fields[key] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// Has - returns true if field with JSON name was sent in message. For order which wasn't unmarshaled, e.g. created by
+// paper engine, it returns true if field isn't zero.
+func (o OpenOrder) Has(name string) bool {
+	if o.fields != nil {
+		_, ok := o.fields[name]
+		return ok
+	}
+	for i := range openOrderFields {
+		if openOrderFields[i].name == name {
+			return openOrderFields[i].isSet(&o)
+		}
+	}
+	return false
+}
+
+// Merge - applies fields of delta which were sent to the order
+func (o *OpenOrder) Merge(delta OpenOrder) {
+	// fields are copied, because copies of order share the map
+	if o.fields != nil {
+		fields := make(map[string]struct{}, len(o.fields)+len(delta.fields))
+		for key := range o.fields {
+			fields[key] = struct{}{}
+		}
+		o.fields = fields
+	}
+	for i := range openOrderFields {
+		if !delta.Has(openOrderFields[i].name) {
+			continue
+		}
+		openOrderFields[i].copy(o, &delta)
+		if o.fields != nil {
+			o.fields[openOrderFields[i].name] = struct{}{}
+		}
+	}
+}
+
+// AveragePrice - average price of executed volume. Kraken sends it as `price` in the first message and as `avg_price` in deltas.
+func (o OpenOrder) AveragePrice() decimal.Decimal {
+	if o.Has("avg_price") {
+		return o.AvgPrice
+	}
+	return o.Price
+}
+
+// SequenceTracker - checks sequence numbers of private channels. Sequence of channel starts from 1 after each subscription.
+type SequenceTracker struct {
+	last map[string]int64
+	mx   sync.Mutex
+}
+
+// NewSequenceTracker - creates sequence tracker
+func NewSequenceTracker() *SequenceTracker {
+	return &SequenceTracker{
+		last: make(map[string]int64),
+	}
+}
+
+// Check - registers sequence of update. It returns `ErrSequenceGap` if updates were missed and `ErrSequenceDuplicate`
+// if update was already received. Updates without sequence are skipped.
+func (t *SequenceTracker) Check(update Update) error {
+	sequence := update.Sequence.Value
+	if sequence <= 0 {
+		return nil
+	}
+
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	last, ok := t.last[update.ChannelName]
+	switch {
+	case !ok || sequence == 1:
+		t.last[update.ChannelName] = sequence
+	case sequence <= last:
+		return errors.Wrapf(ErrSequenceDuplicate, "%s: %d after %d", update.ChannelName, sequence, last)
+	case sequence > last+1:
+		t.last[update.ChannelName] = sequence
+		return errors.Wrapf(ErrSequenceGap, "%s: %d after %d", update.ChannelName, sequence, last)
+	default:
+		t.last[update.ChannelName] = sequence
+	}
+	return nil
+}
+
+// Last - returns the last sequence of channel
+func (t *SequenceTracker) Last(channel string) int64 {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	return t.last[channel]
+}
+
+// Reset - forgets sequences, e.g. after reconnect
+func (t *SequenceTracker) Reset() {
+	t.mx.Lock()
+	t.last = make(map[string]int64)
+	t.mx.Unlock()
+}
+
+// OpenOrdersCache - open orders which are built from `openOrders` channel. Orders are removed when they reach final status.
+type OpenOrdersCache struct {
+	orders   map[string]OpenOrder
+	sequence *SequenceTracker
+	mx       sync.RWMutex
+}
+
+// NewOpenOrdersCache - creates cache of open orders
+func NewOpenOrdersCache() *OpenOrdersCache {
+	return &OpenOrdersCache{
+		orders:   make(map[string]OpenOrder),
+		sequence: NewSequenceTracker(),
+	}
+}
+
+// Apply - merges update of `openOrders` channel and returns merged orders by transaction IDs including final ones.
+// Message with sequence 1 is a snapshot which replaces the cache. Gap of sequence is returned as error after the update
+// is applied, so caller may resubscribe or reconcile orders with REST.
+func (c *OpenOrdersCache) Apply(update Update) (map[string]OpenOrder, error) {
+	data, ok := update.Data.(OpenOrdersUpdate)
+	if !ok {
+		return nil, errors.Errorf("unexpected data of %s: %T", update.ChannelName, update.Data)
+	}
+	err := c.sequence.Check(update)
+	if errors.Is(err, ErrSequenceDuplicate) {
+		return nil, err
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if update.Sequence.Value == 1 {
+		c.orders = make(map[string]OpenOrder)
+	}
+	changed := make(map[string]OpenOrder)
+	for _, orders := range data {
+		for txID, delta := range orders {
+			order, ok := c.orders[txID]
+			if !ok {
+				order = OpenOrder{fields: make(map[string]struct{})}
+			}
+			order.Merge(delta)
+			changed[txID] = order
+			if order.Status.Final() {
+				delete(c.orders, txID)
+			} else {
+				c.orders[txID] = order
+			}
+		}
+	}
+	return changed, err
+}
+
+// Get - returns open order by transaction ID
+func (c *OpenOrdersCache) Get(txID string) (OpenOrder, bool) {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	order, ok := c.orders[txID]
+	return order, ok
+}
+
+// All - returns copy of open orders by transaction IDs
+func (c *OpenOrdersCache) All() map[string]OpenOrder {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+
+	result := make(map[string]OpenOrder, len(c.orders))
+	for txID, order := range c.orders {
+		result[txID] = order
+	}
+	return result
+}
@@ -0,0 +1,165 @@
+package websocket
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	openOrdersSnapshot = `[[{"OGTT3Y-C6I3P-XRI6HX":{"cost":"0.00000","descr":{"close":"","leverage":"0:1","order":"sell 10.00345345 XBT/EUR @ limit 34.50000 with 0:1 leverage","ordertype":"limit","pair":"XBT/EUR","price":"34.50000","price2":"0.00000","type":"sell"},"expiretm":"0.000000","fee":"0.00000","limitprice":"34.50000","misc":"","oflags":"fcib,post","opentm":"1534614057.321597","refid":"OKIVMP-5GVZN-Z2D2UA","starttm":"0.000000","status":"open","stopprice":"0.000000","userref":5,"vol":"10.00345345","vol_exec":"0.00000000","price":"0.00000"}}],"openOrders",{"sequence":1}]`
+	openOrdersDelta    = `[[{"OGTT3Y-C6I3P-XRI6HX":{"vol_exec":"4.00000000","cost":"138.00000","fee":"0.22080","avg_price":"34.50000","lastupdated":"1534614060.100000"}}],"openOrders",{"sequence":2}]`
+	openOrdersClosed   = `[[{"OGTT3Y-C6I3P-XRI6HX":{"status":"closed","userref":5}}],"openOrders",{"sequence":3}]`
+)
+
+func parseOpenOrders(t *testing.T, data string) Update {
+	var msg Message
+	require.NoError(t, json.Unmarshal([]byte(data), &msg))
+	var update OpenOrdersUpdate
+	require.NoError(t, json.Unmarshal(msg.Data, &update))
+	return msg.toUpdate(update)
+}
+
+func TestOpenOrder_Unmarshal(t *testing.T) {
+	update := parseOpenOrders(t, openOrdersSnapshot)
+	assert.Equal(t, ChanOpenOrders, update.ChannelName)
+	assert.Equal(t, int64(1), update.Sequence.Value)
+
+	order := update.Data.(OpenOrdersUpdate)[0]["OGTT3Y-C6I3P-XRI6HX"]
+	assert.Equal(t, "10.00345345", order.Vol.String())
+	assert.Equal(t, "34.5", order.Descr.Price.String())
+	assert.Equal(t, OrderStatusOpen, order.Status)
+	assert.Equal(t, int64(5), order.UserRef)
+	assert.True(t, order.Oflags.Has(FlagPostOnly))
+	assert.False(t, order.Oflags.Has(FlagFeeInQuote))
+	assert.Equal(t, []string{FlagFeeInBase, FlagPostOnly}, order.Oflags.List())
+	assert.Equal(t, time.Unix(1534614057, 321597000).UTC(), order.OpenTime.Time)
+	assert.True(t, order.ExpireTime.IsZero())
+	assert.True(t, order.Has("vol_exec"))
+	assert.False(t, order.Has("avg_price"))
+
+	delta := parseOpenOrders(t, openOrdersDelta).Data.(OpenOrdersUpdate)[0]["OGTT3Y-C6I3P-XRI6HX"]
+	assert.False(t, delta.Has("vol"))
+	assert.True(t, delta.Vol.IsZero(), "missing field is zero")
+
+	order.Merge(delta)
+	assert.Equal(t, "10.00345345", order.Vol.String(), "field which isn't in delta is kept")
+	assert.Equal(t, "4", order.VolExec.String())
+	assert.Equal(t, "0.2208", order.Fee.String())
+	assert.Equal(t, "34.5", order.AveragePrice().String())
+	assert.Equal(t, OrderStatusOpen, order.Status)
+	assert.Equal(t, "1534614060.100000", order.LastUpdated.String())
+}
+
+func TestOpenOrder_MergeCopy(t *testing.T) {
+	order := parseOpenOrders(t, openOrdersSnapshot).Data.(OpenOrdersUpdate)[0]["OGTT3Y-C6I3P-XRI6HX"]
+	delta := parseOpenOrders(t, openOrdersDelta).Data.(OpenOrdersUpdate)[0]["OGTT3Y-C6I3P-XRI6HX"]
+
+	merged := order
+	merged.Merge(delta)
+	assert.True(t, merged.Has("avg_price"))
+	assert.False(t, order.Has("avg_price"), "merge doesn't change copies of order")
+
+	// order which wasn't unmarshaled has non-zero fields only
+	built := OpenOrder{Status: OrderStatusCanceled}
+	merged.Merge(built)
+	assert.Equal(t, OrderStatusCanceled, merged.Status)
+	assert.Equal(t, "4", merged.VolExec.String())
+}
+
+func TestTimestamp(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{name: "string", data: `"1534614057.321597"`, want: "1534614057.321597"},
+		{name: "number", data: `1534614057.5`, want: "1534614057.500000"},
+		{name: "zero", data: `"0.000000"`, want: "0"},
+		{name: "null", data: `null`, want: "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ts Timestamp
+			require.NoError(t, json.Unmarshal([]byte(tt.data), &ts))
+			assert.Equal(t, tt.want, ts.String())
+
+			data, err := json.Marshal(ts)
+			require.NoError(t, err)
+			assert.Equal(t, `"`+tt.want+`"`, string(data))
+		})
+	}
+
+	var ts Timestamp
+	assert.Error(t, json.Unmarshal([]byte(`"abc"`), &ts))
+}
+
+func TestOwnTrade_Unmarshal(t *testing.T) {
+	data := `[[{"TDLH43-DVQXD-2KHVYY":{"cost":"1000000.00000","fee":"1600.00000","margin":"0.00000","ordertxid":"TDLH43-DVQXD-2KHVYY","ordertype":"limit","pair":"XBT/EUR","postxid":"OGTT3Y-C6I3P-XRI6HX","price":"100000.00000","time":"1560516023.070651","type":"sell","vol":"1000000000.00000000","userref":7}}],"ownTrades",{"sequence":2}]`
+	var msg Message
+	require.NoError(t, json.Unmarshal([]byte(data), &msg))
+	var update OwnTradesUpdate
+	require.NoError(t, json.Unmarshal(msg.Data, &update))
+
+	trade := update[0]["TDLH43-DVQXD-2KHVYY"]
+	assert.True(t, trade.Cost.Equal(decimal.NewFromInt(1000000)))
+	assert.True(t, trade.Fee.Equal(decimal.NewFromInt(1600)))
+	assert.Equal(t, "1000000000", trade.Vol.String())
+	assert.Equal(t, int64(7), trade.UserRef)
+	assert.Equal(t, "1560516023.070651", trade.Time.String())
+}
+
+func TestSequenceTracker(t *testing.T) {
+	tracker := NewSequenceTracker()
+	update := func(channel string, sequence int64) Update {
+		return Update{ChannelName: channel, Sequence: Seq{Value: sequence}}
+	}
+
+	assert.NoError(t, tracker.Check(update(ChanOpenOrders, 1)))
+	assert.NoError(t, tracker.Check(update(ChanOpenOrders, 2)))
+	assert.NoError(t, tracker.Check(update(ChanOwnTrades, 1)))
+	assert.ErrorIs(t, tracker.Check(update(ChanOpenOrders, 2)), ErrSequenceDuplicate)
+	assert.ErrorIs(t, tracker.Check(update(ChanOpenOrders, 5)), ErrSequenceGap)
+	assert.Equal(t, int64(5), tracker.Last(ChanOpenOrders))
+	assert.NoError(t, tracker.Check(update(ChanOpenOrders, 6)))
+	assert.NoError(t, tracker.Check(update(ChanOpenOrders, 0)), "update without sequence")
+	assert.NoError(t, tracker.Check(update(ChanOpenOrders, 1)), "resubscription")
+
+	tracker.Reset()
+	assert.Zero(t, tracker.Last(ChanOpenOrders))
+}
+
+func TestOpenOrdersCache(t *testing.T) {
+	cache := NewOpenOrdersCache()
+
+	changed, err := cache.Apply(parseOpenOrders(t, openOrdersSnapshot))
+	require.NoError(t, err)
+	require.Len(t, changed, 1)
+	require.Len(t, cache.All(), 1)
+
+	changed, err = cache.Apply(parseOpenOrders(t, openOrdersDelta))
+	require.NoError(t, err)
+	order, ok := cache.Get("OGTT3Y-C6I3P-XRI6HX")
+	require.True(t, ok)
+	assert.Equal(t, "10.00345345", order.Vol.String())
+	assert.Equal(t, "4", order.VolExec.String())
+	assert.Equal(t, order, changed["OGTT3Y-C6I3P-XRI6HX"])
+
+	_, err = cache.Apply(parseOpenOrders(t, openOrdersDelta))
+	assert.ErrorIs(t, err, ErrSequenceDuplicate)
+
+	closed := parseOpenOrders(t, openOrdersClosed)
+	closed.Sequence.Value = 5
+	changed, err = cache.Apply(closed)
+	assert.ErrorIs(t, err, ErrSequenceGap, "update is applied in spite of gap")
+	assert.Equal(t, OrderStatusClosed, changed["OGTT3Y-C6I3P-XRI6HX"].Status)
+	assert.Equal(t, "4", changed["OGTT3Y-C6I3P-XRI6HX"].VolExec.String())
+	assert.Empty(t, cache.All(), "final order is removed")
+
+	_, err = cache.Apply(Update{ChannelName: ChanOpenOrders, Data: OwnTradesUpdate{}})
+	assert.Error(t, err)
+}
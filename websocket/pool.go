@@ -0,0 +1,568 @@
+package websocket
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// ShardStrategy - chooses connection for the pair. `shards` are ids of alive connections, the function returns one of them.
+type ShardStrategy func(pair string, shards []int) int
+
+// HashShards - rendezvous hashing of pair: every pair goes to the shard with the highest hash of pair and shard id.
+// When a shard dies only its pairs are moved. It's default strategy of `Pool`.
+func HashShards(pair string, shards []int) int {
+	var (
+		best      int
+		bestScore uint64
+	)
+	for i, shard := range shards {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(pair))
+		_, _ = h.Write([]byte(strconv.Itoa(shard)))
+		if score := h.Sum64(); i == 0 || score > bestScore {
+			best, bestScore = shard, score
+		}
+	}
+	return best
+}
+
+// PoolOption - option function for `Pool`
+type PoolOption func(*Pool)
+
+// WithShards - add count of connections. Default: 4.
+func WithShards(count int) PoolOption {
+	return func(p *Pool) {
+		p.size = count
+	}
+}
+
+// WithShardStrategy - add custom strategy of pair distribution. Default: `HashShards`.
+func WithShardStrategy(strategy ShardStrategy) PoolOption {
+	return func(p *Pool) {
+		p.strategy = strategy
+	}
+}
+
+// WithShardOptions - add options of every connection
+func WithShardOptions(opts ...KrakenOption) PoolOption {
+	return func(p *Pool) {
+		p.krakenOpts = append(p.krakenOpts, opts...)
+	}
+}
+
+// WithDeadShardTimeout - add time after which disconnected shard is considered dead and its pairs are moved to other shards. Default: 30s.
+func WithDeadShardTimeout(timeout time.Duration) PoolOption {
+	return func(p *Pool) {
+		p.deadTimeout = timeout
+	}
+}
+
+// WithPoolBufferSize - add custom capacity of merged `Listen()` channel. Default: 1024.
+func WithPoolBufferSize(size int) PoolOption {
+	return func(p *Pool) {
+		p.bufferSize = size
+	}
+}
+
+// ShardInfo - state of pool's connection
+type ShardInfo struct {
+	ID    int
+	Alive bool
+	// DisconnectedSince - time when connection was lost. It's zero for connected shard.
+	DisconnectedSince time.Time
+	Pairs             []string
+}
+
+type poolShard struct {
+	id    int
+	k     *Kraken
+	alive bool
+}
+
+type poolSubscription struct {
+	spec  Subscription
+	pairs map[string]struct{}
+}
+
+// typedSubscriber - typed consumer of merged stream. `deliver` returns false if update has other type.
+type typedSubscriber interface {
+	deliver(upd Update) bool
+	close()
+}
+
+// Pool - spreads public subscriptions across several connections. Every pair is served by one connection which is chosen by strategy.
+// Connections reconnect independently. If connection is disconnected longer than dead timeout, its pairs are moved to alive connections.
+// Updates of all connections are merged to `Listen()` channel or to typed channels created by `PoolChannel`.
+type Pool struct {
+	size        int
+	strategy    ShardStrategy
+	krakenOpts  []KrakenOption
+	deadTimeout time.Duration
+	bufferSize  int
+
+	shards        []*poolShard
+	assigned      map[string]int
+	subscriptions map[string]*poolSubscription
+
+	out         chan Update
+	typed       []typedSubscriber
+	typedMx     sync.RWMutex
+	stop        chan struct{}
+	wg          sync.WaitGroup
+	forwarders  sync.WaitGroup
+	closeOnce   sync.Once
+	mx          sync.Mutex
+	connectOnce sync.Once
+}
+
+// NewPool - creates pool of connections to `url`. Call `Connect` to connect them.
+func NewPool(url string, opts ...PoolOption) *Pool {
+	p := &Pool{
+		size:          4,
+		strategy:      HashShards,
+		deadTimeout:   30 * time.Second,
+		bufferSize:    1024,
+		assigned:      make(map[string]int),
+		subscriptions: make(map[string]*poolSubscription),
+		stop:          make(chan struct{}),
+	}
+	for i := range opts {
+		opts[i](p)
+	}
+	if p.size < 1 {
+		p.size = 1
+	}
+
+	p.out = make(chan Update, p.bufferSize)
+	p.shards = make([]*poolShard, p.size)
+	for i := range p.shards {
+		p.shards[i] = &poolShard{
+			id:    i,
+			k:     NewKraken(url, p.krakenOpts...),
+			alive: true,
+		}
+		if k := p.shards[i].k; k.recorder != nil {
+			k.recordConn += "/" + strconv.Itoa(i)
+		}
+		p.forwarders.Add(1)
+		go p.forward(p.shards[i])
+	}
+	return p
+}
+
+// Connect - connects all shards and starts health checking. If any shard can't connect, the pool is closed.
+func (p *Pool) Connect() error {
+	for _, shard := range p.shards {
+		if err := shard.k.Connect(); err != nil {
+			// shards which are already connected mustn't keep running
+			p.Close()
+			return errors.Wrapf(err, "shard %d", shard.id)
+		}
+	}
+
+	p.connectOnce.Do(func() {
+		p.wg.Add(1)
+		go p.healthThread()
+	})
+	return nil
+}
+
+// Listen - returns merged updates of all shards which aren't consumed by typed channels
+func (p *Pool) Listen() <-chan Update {
+	return p.out
+}
+
+// Shards - returns state of shards
+func (p *Pool) Shards() []ShardInfo {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	infos := make([]ShardInfo, len(p.shards))
+	for i, shard := range p.shards {
+		infos[i] = ShardInfo{
+			ID:                shard.id,
+			Alive:             shard.alive,
+			DisconnectedSince: shard.k.DisconnectedSince(),
+			Pairs:             make([]string, 0),
+		}
+	}
+	for pair, id := range p.assigned {
+		infos[id].Pairs = append(infos[id].Pairs, pair)
+	}
+	for i := range infos {
+		sort.Strings(infos[i].Pairs)
+	}
+	return infos
+}
+
+// Shard - returns id of the shard which serves the pair
+func (p *Pool) Shard(pair string) (int, bool) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	id, ok := p.assigned[pair]
+	return id, ok
+}
+
+// SubscribeTicker - subscribes to ticker of pairs
+func (p *Pool) SubscribeTicker(pairs []string, opts ...SubscribeOption) error {
+	return p.subscribe(newSubscription(ChanTicker, opts), pairs)
+}
+
+// SubscribeCandles - subscribes to candles of pairs with interval
+func (p *Pool) SubscribeCandles(pairs []string, interval int64, opts ...SubscribeOption) error {
+	spec := newSubscription(ChanCandles, opts)
+	spec.Interval = interval
+	return p.subscribe(spec, pairs)
+}
+
+// SubscribeTrades - subscribes to trades of pairs
+func (p *Pool) SubscribeTrades(pairs []string, opts ...SubscribeOption) error {
+	return p.subscribe(newSubscription(ChanTrades, opts), pairs)
+}
+
+// SubscribeSpread - subscribes to spread of pairs
+func (p *Pool) SubscribeSpread(pairs []string, opts ...SubscribeOption) error {
+	return p.subscribe(newSubscription(ChanSpread, opts), pairs)
+}
+
+// SubscribeBook - subscribes to order books of pairs with depth
+func (p *Pool) SubscribeBook(pairs []string, depth int64, opts ...SubscribeOption) error {
+	spec := newSubscription(ChanBook, opts)
+	spec.Depth = depth
+	return p.subscribe(spec, pairs)
+}
+
+// UnsubscribeBook - unsubscribes from order books of pairs with depth
+func (p *Pool) UnsubscribeBook(pairs []string, depth int64) error {
+	return p.unsubscribe(Subscription{Name: ChanBook, Depth: depth}, pairs)
+}
+
+// UnsubscribeCandles - unsubscribes from candles of pairs with interval
+func (p *Pool) UnsubscribeCandles(pairs []string, interval int64) error {
+	return p.unsubscribe(Subscription{Name: ChanCandles, Interval: interval}, pairs)
+}
+
+// Unsubscribe - unsubscribes from channel of pairs
+func (p *Pool) Unsubscribe(channelType string, pairs []string) error {
+	return p.unsubscribe(Subscription{Name: channelType}, pairs)
+}
+
+// Rebalance - reassigns all pairs by strategy among alive shards. Use it after dead shards become alive again.
+func (p *Pool) Rebalance() error {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	alive := p.aliveShards()
+	if len(alive) == 0 {
+		return errors.New("no alive shards")
+	}
+	var result error
+	for _, pair := range p.assignedPairs() {
+		if err := p.move(pair, p.strategy(pair, alive)); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// Close - closes all connections and merged channels
+func (p *Pool) Close() error {
+	var result error
+	p.closeOnce.Do(func() {
+		close(p.stop)
+		p.wg.Wait()
+
+		for _, shard := range p.shards {
+			if err := shard.k.Close(); err != nil && result == nil {
+				result = err
+			}
+		}
+		p.forwarders.Wait()
+
+		close(p.out)
+		p.typedMx.Lock()
+		for _, sub := range p.typed {
+			sub.close()
+		}
+		p.typed = nil
+		p.typedMx.Unlock()
+	})
+	return result
+}
+
+func subscriptionKey(spec Subscription) string {
+	return spec.channelName()
+}
+
+func (p *Pool) subscribe(spec Subscription, pairs []string) error {
+	if isPairlessChannel(spec.Name) {
+		return errors.Errorf("channel %s can't be sharded", spec.Name)
+	}
+
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	key := subscriptionKey(spec)
+	sub, ok := p.subscriptions[key]
+	if !ok {
+		sub = &poolSubscription{spec: spec, pairs: make(map[string]struct{})}
+		p.subscriptions[key] = sub
+	}
+
+	alive := p.aliveShards()
+	if len(alive) == 0 {
+		return errors.New("no alive shards")
+	}
+
+	groups := make(map[int][]string)
+	for _, pair := range pairs {
+		sub.pairs[pair] = struct{}{}
+		id, ok := p.assigned[pair]
+		if !ok {
+			id = p.strategy(pair, alive)
+			p.assigned[pair] = id
+		}
+		groups[id] = append(groups[id], pair)
+	}
+
+	for id, group := range groups {
+		if err := p.shards[id].k.subscribe(spec, group); err != nil {
+			return errors.Wrapf(err, "shard %d", id)
+		}
+	}
+	return nil
+}
+
+func (p *Pool) unsubscribe(spec Subscription, pairs []string) error {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	groups := make(map[int][]string)
+	for key, sub := range p.subscriptions {
+		if !sub.spec.matches(spec) {
+			continue
+		}
+		for _, pair := range pairs {
+			if _, ok := sub.pairs[pair]; !ok {
+				continue
+			}
+			delete(sub.pairs, pair)
+			if id, ok := p.assigned[pair]; ok {
+				groups[id] = append(groups[id], pair)
+			}
+		}
+		if len(sub.pairs) == 0 {
+			delete(p.subscriptions, key)
+		}
+	}
+
+	for _, pair := range pairs {
+		if !p.isSubscribed(pair) {
+			delete(p.assigned, pair)
+		}
+	}
+
+	for id, group := range groups {
+		if err := p.shards[id].k.unsubscribe(spec, group); err != nil {
+			return errors.Wrapf(err, "shard %d", id)
+		}
+	}
+	return nil
+}
+
+// matches - returns true if subscription is selected by unsubscribe request. Zero depth or interval of request matches any.
+func (s Subscription) matches(request Subscription) bool {
+	if s.Name != request.Name {
+		return false
+	}
+	if request.Depth != 0 && s.Depth != request.Depth {
+		return false
+	}
+	if request.Interval != 0 && s.Interval != request.Interval {
+		return false
+	}
+	return true
+}
+
+func (p *Pool) isSubscribed(pair string) bool {
+	for _, sub := range p.subscriptions {
+		if _, ok := sub.pairs[pair]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Pool) aliveShards() []int {
+	alive := make([]int, 0, len(p.shards))
+	for _, shard := range p.shards {
+		if shard.alive {
+			alive = append(alive, shard.id)
+		}
+	}
+	return alive
+}
+
+func (p *Pool) assignedPairs() []string {
+	pairs := make([]string, 0, len(p.assigned))
+	for pair := range p.assigned {
+		pairs = append(pairs, pair)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+// move - moves all subscriptions of the pair to the shard
+func (p *Pool) move(pair string, to int) error {
+	from, ok := p.assigned[pair]
+	if !ok || from == to {
+		return nil
+	}
+	p.assigned[pair] = to
+
+	for _, sub := range p.subscriptions {
+		if _, ok := sub.pairs[pair]; !ok {
+			continue
+		}
+		// dead connection may not send unsubscribe, but it mustn't resubscribe the pair after reconnect
+		if err := p.shards[from].k.unsubscribe(sub.spec, []string{pair}); err != nil {
+			log.Errorf("shard %d: %s", from, err)
+		}
+		if err := p.shards[to].k.subscribe(sub.spec, []string{pair}); err != nil {
+			return errors.Wrapf(err, "shard %d", to)
+		}
+	}
+	return nil
+}
+
+func (p *Pool) healthThread() {
+	defer p.wg.Done()
+
+	interval := p.deadTimeout / 2
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case now := <-ticker.C:
+			p.checkShards(now)
+		}
+	}
+}
+
+// checkShards - marks shards which are disconnected longer than dead timeout as dead and moves their pairs
+func (p *Pool) checkShards(now time.Time) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	var died []int
+	for _, shard := range p.shards {
+		since := shard.k.DisconnectedSince()
+		switch {
+		case shard.alive && !since.IsZero() && now.Sub(since) >= p.deadTimeout:
+			shard.alive = false
+			died = append(died, shard.id)
+			log.Warnf("shard %d is dead: disconnected since %s", shard.id, since)
+		case !shard.alive && since.IsZero():
+			shard.alive = true
+			log.Infof("shard %d is alive", shard.id)
+		}
+	}
+	if len(died) == 0 {
+		return
+	}
+
+	alive := p.aliveShards()
+	if len(alive) == 0 {
+		log.Error("all shards are dead")
+		return
+	}
+	for _, pair := range p.assignedPairs() {
+		id := p.assigned[pair]
+		if p.shards[id].alive {
+			continue
+		}
+		if err := p.move(pair, p.strategy(pair, alive)); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+func (p *Pool) forward(shard *poolShard) {
+	defer p.forwarders.Done()
+
+	for upd := range shard.k.Listen() {
+		if p.deliverTyped(upd) {
+			continue
+		}
+		select {
+		case p.out <- upd:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *Pool) deliverTyped(upd Update) bool {
+	p.typedMx.RLock()
+	defer p.typedMx.RUnlock()
+
+	for _, sub := range p.typed {
+		if sub.deliver(upd) {
+			return true
+		}
+	}
+	return false
+}
+
+type poolChannel[T any] struct {
+	ch   chan Event[T]
+	stop chan struct{}
+}
+
+func (c *poolChannel[T]) deliver(upd Update) bool {
+	data, ok := upd.Data.(T)
+	if !ok {
+		return false
+	}
+	select {
+	case c.ch <- Event[T]{
+		ChannelID:   upd.ChannelID,
+		ChannelName: upd.ChannelName,
+		Pair:        upd.Pair,
+		Sequence:    upd.Sequence.Value,
+		Data:        data,
+	}:
+	case <-c.stop:
+	}
+	return true
+}
+
+func (c *poolChannel[T]) close() {
+	close(c.ch)
+}
+
+// PoolChannel - returns typed channel of pool's updates. Updates of type `T` are sent to the channel instead of `Listen()`,
+// for example `PoolChannel[OrderBookUpdate](pool, 1024)` receives order books of all shards.
+// It should be called before `Connect`. Channel is closed by `Pool.Close`.
+func PoolChannel[T any](p *Pool, bufferSize int) <-chan Event[T] {
+	c := &poolChannel[T]{
+		ch:   make(chan Event[T], bufferSize),
+		stop: p.stop,
+	}
+	p.typedMx.Lock()
+	p.typed = append(p.typed, c)
+	p.typedMx.Unlock()
+	return c.ch
+}
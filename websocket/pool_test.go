@@ -0,0 +1,190 @@
+package websocket
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testPairs(count int) []string {
+	pairs := make([]string, count)
+	for i := range pairs {
+		pairs[i] = fmt.Sprintf("P%d/USD", i)
+	}
+	return pairs
+}
+
+func subscribedPairs(k *Kraken) int {
+	return len(k.Subscriptions())
+}
+
+func TestHashShards(t *testing.T) {
+	shards := []int{0, 1, 2, 3}
+	counts := make(map[int]int)
+	moved := 0
+	for _, pair := range testPairs(400) {
+		shard := HashShards(pair, shards)
+		counts[shard]++
+
+		// removing other shard doesn't move the pair
+		for _, removed := range shards {
+			if removed == shard {
+				continue
+			}
+			alive := make([]int, 0, 3)
+			for _, id := range shards {
+				if id != removed {
+					alive = append(alive, id)
+				}
+			}
+			if HashShards(pair, alive) != shard {
+				moved++
+			}
+		}
+	}
+	assert.Zero(t, moved)
+	for _, id := range shards {
+		assert.Greater(t, counts[id], 50)
+	}
+}
+
+func TestPool_Subscribe(t *testing.T) {
+	pool := NewPool(ProdBaseURL, WithShards(3))
+	defer pool.Close()
+
+	pairs := testPairs(30)
+	require.NoError(t, pool.SubscribeBook(pairs, Depth10))
+	require.NoError(t, pool.SubscribeTicker(pairs[:10]))
+
+	total := 0
+	for _, shard := range pool.Shards() {
+		assert.True(t, shard.Alive)
+		total += len(shard.Pairs)
+		for _, pair := range shard.Pairs {
+			id, ok := pool.Shard(pair)
+			require.True(t, ok)
+			assert.Equal(t, shard.ID, id)
+		}
+	}
+	assert.Equal(t, 30, total)
+	assert.Equal(t, 40, subscribedPairs(pool.shards[0].k)+subscribedPairs(pool.shards[1].k)+subscribedPairs(pool.shards[2].k))
+
+	require.NoError(t, pool.UnsubscribeBook(pairs[10:], Depth10))
+	_, ok := pool.Shard(pairs[20])
+	assert.False(t, ok)
+	_, ok = pool.Shard(pairs[0])
+	assert.True(t, ok)
+
+	assert.Error(t, pool.subscribe(Subscription{Name: ChanBalances}, nil))
+}
+
+func TestPool_DeadShard(t *testing.T) {
+	pool := NewPool(ProdBaseURL, WithShards(2), WithDeadShardTimeout(time.Second))
+	defer pool.Close()
+
+	pairs := testPairs(20)
+	require.NoError(t, pool.SubscribeBook(pairs, Depth10))
+	dead := pool.shards[0]
+	before := len(pool.Shards()[0].Pairs)
+	require.NotZero(t, before)
+
+	dead.k.disconnected()
+	pool.checkShards(time.Now())
+	assert.True(t, pool.Shards()[0].Alive, "shard isn't dead before timeout")
+
+	pool.checkShards(time.Now().Add(2 * time.Second))
+	shards := pool.Shards()
+	assert.False(t, shards[0].Alive)
+	assert.Empty(t, shards[0].Pairs)
+	assert.Len(t, shards[1].Pairs, 20)
+	assert.Zero(t, subscribedPairs(dead.k))
+	assert.Equal(t, 20, subscribedPairs(pool.shards[1].k))
+
+	// reconnected shard receives pairs after rebalance
+	dead.k.lock.Lock()
+	dead.k.disconnectedAt = time.Time{}
+	dead.k.lock.Unlock()
+	pool.checkShards(time.Now())
+	require.NoError(t, pool.Rebalance())
+	assert.Len(t, pool.Shards()[0].Pairs, before)
+}
+
+func TestPool_Listen(t *testing.T) {
+	pool := NewPool(ProdBaseURL, WithShards(2))
+	books := PoolChannel[OrderBookUpdate](pool, 16)
+
+	require.NoError(t, pool.SubscribeBook([]string{BTCUSD}, Depth10))
+	require.NoError(t, pool.SubscribeTicker([]string{BTCUSD}))
+	id, _ := pool.Shard(BTCUSD)
+	k := pool.shards[id].k
+
+	require.NoError(t, k.handleMessage([]byte(bookSnapshotMessage)))
+	require.NoError(t, k.handleMessage([]byte(`[0,{"a":["5525.40000",1,"1.000"],"b":["5525.10000",1,"1.000"],"c":["5525.10000","0.00398963"],"v":["2634.11501494","3591.17907851"],"p":["5631.44067","5653.78939"],"t":[11493,16267],"l":["5505.00000","5505.00000"],"h":["5783.00000","5783.00000"],"o":["5760.70000","5763.40000"]},"ticker","XBT/USD"]`)))
+
+	select {
+	case event := <-books:
+		assert.Equal(t, BTCUSD, event.Pair)
+		assert.True(t, event.Data.IsSnapshot)
+	case <-time.After(time.Second):
+		t.Fatal("book wasn't received")
+	}
+
+	select {
+	case upd := <-pool.Listen():
+		assert.Equal(t, ChanTicker, upd.ChannelName)
+	case <-time.After(time.Second):
+		t.Fatal("ticker wasn't received")
+	}
+
+	require.NoError(t, pool.Close())
+	_, ok := <-books
+	assert.False(t, ok)
+}
+
+func TestPool_ConnectFailure(t *testing.T) {
+	// only the first connection is accepted
+	var accepted int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&accepted, 1) > 1 {
+			http.Error(w, "too many connections", http.StatusServiceUnavailable)
+			return
+		}
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	pool := NewPool("ws"+strings.TrimPrefix(server.URL, "http"), WithShards(2))
+	err := pool.Connect()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "shard 1")
+
+	select {
+	case <-pool.shards[0].k.stop:
+	default:
+		t.Fatal("connected shard wasn't closed")
+	}
+	select {
+	case _, ok := <-pool.Listen():
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("pool wasn't closed")
+	}
+	assert.NoError(t, pool.Close())
+}
@@ -0,0 +1,151 @@
+package websocket
+
+import (
+	"github.com/pkg/errors"
+)
+
+// ErrUnsupported - method or channel is not supported by protocol version of the client
+var ErrUnsupported = errors.New("not supported by protocol version")
+
+// protocol - wire format of Kraken Websocket API. It builds requests and decodes server messages.
+type protocol interface {
+	version() int
+	supports(channel string) bool
+	subscribe(reqID int64, spec Subscription, pairs []string, token string) (interface{}, error)
+	unsubscribe(reqID int64, spec Subscription, pairs []string, token string) (interface{}, error)
+	ping(reqID int64) interface{}
+	addOrder(req AddOrderRequest, token string) (interface{}, error)
+	editOrder(req EditOrderRequest, token string) (interface{}, error)
+	amendOrder(req AmendOrderParams, token string) (interface{}, error)
+	batchAdd(req BatchAddParams, token string) (interface{}, error)
+	cancelOrder(orderIDs []string, token string) interface{}
+	cancelAll(token string) interface{}
+	cancelAllOrdersAfter(timeout int64, token string) interface{}
+	handleMessage(k *Kraken, data []byte) error
+}
+
+// requiresToken - returns true if subscription to the channel requires authentication token
+func requiresToken(name string) bool {
+	return isPrivateChannel(name) || name == ChanLevel3
+}
+
+// protocolV1 - array framed messages and `event` requests of Websocket API v1
+type protocolV1 struct{}
+
+func (protocolV1) version() int { return 1 }
+
+func (protocolV1) supports(channel string) bool {
+	switch channel {
+	case ChanInstrument, ChanBalances, ChanExecutions, ChanLevel3:
+		return false
+	default:
+		return true
+	}
+}
+
+func (p protocolV1) subscribe(_ int64, spec Subscription, pairs []string, token string) (interface{}, error) {
+	if !p.supports(spec.Name) {
+		return nil, errors.Wrap(ErrUnsupported, spec.Name)
+	}
+	if isPrivateChannel(spec.Name) {
+		return AuthSubscriptionRequest{
+			Event: EventSubscribe,
+			Subs: AuthDataRequest{
+				Name:     spec.Name,
+				Token:    token,
+				Snapshot: spec.Snapshot,
+			},
+		}, nil
+	}
+	return SubscriptionRequest{
+		Event:        EventSubscribe,
+		Pairs:        pairs,
+		Subscription: spec,
+	}, nil
+}
+
+func (protocolV1) unsubscribe(_ int64, spec Subscription, pairs []string, token string) (interface{}, error) {
+	if isPrivateChannel(spec.Name) {
+		return AuthSubscriptionRequest{
+			Event: EventUnsubscribe,
+			Subs: AuthDataRequest{
+				Name:  spec.Name,
+				Token: token,
+			},
+		}, nil
+	}
+	spec.Snapshot = nil
+	return UnsubscribeRequest{
+		Event:        EventUnsubscribe,
+		Pairs:        pairs,
+		Subscription: spec,
+	}, nil
+}
+
+func (protocolV1) ping(reqID int64) interface{} {
+	return PingRequest{
+		Event: EventPing,
+		ReqID: int(reqID),
+	}
+}
+
+func (protocolV1) addOrder(req AddOrderRequest, token string) (interface{}, error) {
+	req.Event = EventAddOrder
+	req.Token = token
+	return req, nil
+}
+
+func (protocolV1) editOrder(req EditOrderRequest, token string) (interface{}, error) {
+	req.Event = EventEditOrder
+	req.Token = token
+	return req, nil
+}
+
+func (protocolV1) amendOrder(AmendOrderParams, string) (interface{}, error) {
+	return nil, errors.Wrap(ErrUnsupported, MethodAmendOrder)
+}
+
+func (protocolV1) batchAdd(BatchAddParams, string) (interface{}, error) {
+	return nil, errors.Wrap(ErrUnsupported, MethodBatchAdd)
+}
+
+func (protocolV1) cancelOrder(orderIDs []string, token string) interface{} {
+	return CancelOrderRequest{
+		AuthRequest: AuthRequest{
+			Token: token,
+			Event: EventCancelOrder,
+		},
+		TxID: orderIDs,
+	}
+}
+
+func (protocolV1) cancelAll(token string) interface{} {
+	return AuthRequest{
+		Token: token,
+		Event: EventCancelAll,
+	}
+}
+
+func (protocolV1) cancelAllOrdersAfter(timeout int64, token string) interface{} {
+	return CancelAllOrdersAfterRequest{
+		AuthRequest: AuthRequest{
+			Token: token,
+			Event: EventCancelAllOrdersAfter,
+		},
+		Timeout: timeout,
+	}
+}
+
+func (protocolV1) handleMessage(k *Kraken, data []byte) error {
+	if len(data) == 0 {
+		return errors.Errorf("Empty response: %s", string(data))
+	}
+	switch data[0] {
+	case '[':
+		return k.handleChannel(data)
+	case '{':
+		return k.handleEvent(data)
+	default:
+		return errors.Errorf("Unexpected message: %s", string(data))
+	}
+}
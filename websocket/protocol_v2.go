@@ -0,0 +1,709 @@
+package websocket
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+	log "github.com/sirupsen/logrus"
+)
+
+// NewKrakenV2 - creates client of Websocket API v2. It has the same API as v1 client, but also supports
+// `instrument`, `balances`, `executions` and `level3` channels, `BatchAdd` and `AmendOrder` methods.
+// `ownTrades`, `openOrders` and `spread` channels are not available in v2.
+func NewKrakenV2(url string, opts ...KrakenOption) *Kraken {
+	kraken := NewKraken(url, opts...)
+	kraken.protocol = newProtocolV2()
+	return kraken
+}
+
+// pendingRequest - subscription request waiting for acknowledgement. Kraken sends one response for each symbol.
+type pendingRequest struct {
+	spec      Subscription
+	remaining int
+}
+
+// protocolV2 - JSON objects with `method`/`params` requests and `channel`/`type` messages of Websocket API v2
+type protocolV2 struct {
+	pending map[int64]*pendingRequest
+	mx      sync.Mutex
+}
+
+func newProtocolV2() *protocolV2 {
+	return &protocolV2{
+		pending: make(map[int64]*pendingRequest),
+	}
+}
+
+func (*protocolV2) version() int { return 2 }
+
+func (*protocolV2) supports(channel string) bool {
+	switch channel {
+	case ChanOwnTrades, ChanOpenOrders, ChanSpread:
+		return false
+	default:
+		return true
+	}
+}
+
+func (p *protocolV2) subscribe(reqID int64, spec Subscription, pairs []string, token string) (interface{}, error) {
+	if !p.supports(spec.Name) {
+		return nil, errors.Wrap(ErrUnsupported, spec.Name)
+	}
+	params := p.params(spec, pairs, token)
+	switch spec.Name {
+	case ChanExecutions:
+		params.SnapOrders = spec.Snapshot
+		params.SnapTrades = spec.Snapshot
+	default:
+		params.Snapshot = spec.Snapshot
+	}
+	p.wait(reqID, spec, len(pairs))
+	return MethodRequest{
+		Method: MethodSubscribe,
+		Params: params,
+		ReqID:  reqID,
+	}, nil
+}
+
+func (p *protocolV2) unsubscribe(reqID int64, spec Subscription, pairs []string, token string) (interface{}, error) {
+	p.wait(reqID, spec, len(pairs))
+	return MethodRequest{
+		Method: MethodUnsubscribe,
+		Params: p.params(spec, pairs, token),
+		ReqID:  reqID,
+	}, nil
+}
+
+func (*protocolV2) params(spec Subscription, pairs []string, token string) SubscribeParams {
+	params := SubscribeParams{
+		Channel: spec.Name,
+		Token:   token,
+	}
+	for i := range pairs {
+		if pairs[i] != "" {
+			params.Symbol = append(params.Symbol, pairs[i])
+		}
+	}
+	switch spec.Name {
+	case ChanBook:
+		params.Depth = spec.Depth
+		if params.Depth == 0 {
+			params.Depth = Depth10
+		}
+	case ChanLevel3:
+		params.Depth = spec.Depth
+	case ChanCandles:
+		params.Interval = spec.Interval
+		if params.Interval == 0 {
+			params.Interval = Interval1
+		}
+	}
+	return params
+}
+
+func (p *protocolV2) wait(reqID int64, spec Subscription, count int) {
+	p.mx.Lock()
+	p.pending[reqID] = &pendingRequest{spec: spec, remaining: count}
+	p.mx.Unlock()
+}
+
+// acknowledge - returns subscription of the request and forgets it when all symbols are acknowledged
+func (p *protocolV2) acknowledge(reqID int64) (Subscription, bool) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	req, ok := p.pending[reqID]
+	if !ok {
+		return Subscription{}, false
+	}
+	req.remaining--
+	if req.remaining <= 0 {
+		delete(p.pending, reqID)
+	}
+	return req.spec, true
+}
+
+func (*protocolV2) ping(reqID int64) interface{} {
+	return MethodRequest{
+		Method: MethodPing,
+		ReqID:  reqID,
+	}
+}
+
+func (*protocolV2) addOrder(req AddOrderRequest, token string) (interface{}, error) {
+	params := AddOrderParams{
+		OrderType:   req.Ordertype,
+		Side:        req.Type,
+		Symbol:      req.Pair,
+		Deadline:    req.Deadline,
+		TimeInForce: strings.ToLower(req.TimeInForce),
+		Validate:    req.Validate == "true",
+		Margin:      req.Leverage != "" && req.Leverage != "none",
+		ReduceOnly:  req.ReduceOnly,
+		Token:       token,
+	}
+
+	qty, err := v2Number(req.Volume)
+	if err != nil {
+		return nil, err
+	}
+	params.OrderQty = qty
+
+	limit, trigger, err := v2Prices(req.Ordertype, req.Price, req.Price2)
+	if err != nil {
+		return nil, err
+	}
+	params.LimitPrice = limit
+	params.Triggers = trigger
+
+	if params.EffectiveTime, err = v2Time(req.Starttm); err != nil {
+		return nil, err
+	}
+	if params.ExpireTime, err = v2Time(req.Expiretm); err != nil {
+		return nil, err
+	}
+	if req.UserRef != "" {
+		if params.OrderUserref, err = strconv.ParseInt(req.UserRef, 10, 64); err != nil {
+			return nil, errors.Wrap(err, "userref")
+		}
+	}
+	if err := applyOrderFlags(req.OFlags, &params.PostOnly, &params.FeePreference, &params.NoMPP); err != nil {
+		return nil, err
+	}
+
+	if req.CloseOrderType != "" {
+		closeLimit, closeTrigger, err := v2Prices(req.CloseOrderType, req.ClosePrice, req.ClosePrice2)
+		if err != nil {
+			return nil, err
+		}
+		params.Conditional = &ConditionalParams{
+			OrderType:  req.CloseOrderType,
+			LimitPrice: closeLimit,
+		}
+		if closeTrigger != nil {
+			params.Conditional.TriggerPrice = closeTrigger.Price
+			params.Conditional.TriggerPriceType = closeTrigger.PriceType
+		}
+	}
+
+	return MethodRequest{
+		Method: MethodAddOrder,
+		Params: params,
+		ReqID:  req.ReqID,
+	}, nil
+}
+
+func (*protocolV2) editOrder(req EditOrderRequest, token string) (interface{}, error) {
+	params := EditOrderParams{
+		OrderID:  req.OrderID,
+		Symbol:   req.Pair,
+		Validate: req.Validate == "true",
+		Token:    token,
+	}
+
+	var err error
+	if params.OrderQty, err = v2Number(req.Volume); err != nil {
+		return nil, err
+	}
+	if req.Price2 != "" {
+		// price is a trigger and price2 is a limit price of stop-loss-limit and take-profit-limit orders
+		_, params.Triggers, err = v2Prices(OrderTypeStopLoss, req.Price, "")
+		if err != nil {
+			return nil, err
+		}
+		if params.LimitPrice, err = v2Number(req.Price2); err != nil {
+			return nil, err
+		}
+	} else if params.LimitPrice, err = v2Number(req.Price); err != nil {
+		return nil, err
+	}
+	if req.NewUserRef != "" {
+		if params.OrderUserref, err = strconv.ParseInt(req.NewUserRef, 10, 64); err != nil {
+			return nil, errors.Wrap(err, "newuserref")
+		}
+	}
+	if err := applyOrderFlags(req.OFlags, &params.PostOnly, &params.FeePreference, &params.NoMPP); err != nil {
+		return nil, err
+	}
+
+	return MethodRequest{
+		Method: MethodEditOrder,
+		Params: params,
+		ReqID:  req.ReqID,
+	}, nil
+}
+
+func (*protocolV2) amendOrder(req AmendOrderParams, token string) (interface{}, error) {
+	req.Token = token
+	return MethodRequest{
+		Method: MethodAmendOrder,
+		Params: req,
+		ReqID:  req.ReqID,
+	}, nil
+}
+
+func (*protocolV2) batchAdd(req BatchAddParams, token string) (interface{}, error) {
+	if len(req.Orders) < 2 {
+		return nil, errors.New("batch must contain at least 2 orders")
+	}
+	req.Token = token
+	return MethodRequest{
+		Method: MethodBatchAdd,
+		Params: req,
+		ReqID:  req.ReqID,
+	}, nil
+}
+
+func (*protocolV2) cancelOrder(orderIDs []string, token string) interface{} {
+	return MethodRequest{
+		Method: MethodCancelOrder,
+		Params: CancelOrderParams{
+			OrderID: orderIDs,
+			Token:   token,
+		},
+	}
+}
+
+func (*protocolV2) cancelAll(token string) interface{} {
+	return MethodRequest{
+		Method: MethodCancelAll,
+		Params: TokenParams{
+			Token: token,
+		},
+	}
+}
+
+func (*protocolV2) cancelAllOrdersAfter(timeout int64, token string) interface{} {
+	return MethodRequest{
+		Method: MethodCancelAllOrdersAfter,
+		Params: CancelAllOrdersAfterParams{
+			Timeout: timeout,
+			Token:   token,
+		},
+	}
+}
+
+func (p *protocolV2) handleMessage(k *Kraken, data []byte) error {
+	var header struct {
+		Channel string `json:"channel"`
+		Method  string `json:"method"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return err
+	}
+
+	switch {
+	case header.Method != "":
+		var response MethodResponse
+		if err := json.Unmarshal(data, &response); err != nil {
+			return err
+		}
+		return p.handleResponse(k, response)
+	case header.Channel != "":
+		var msg ChannelMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return err
+		}
+		return p.handleChannel(k, msg)
+	default:
+		return errors.Errorf("Unexpected message: %s", string(data))
+	}
+}
+
+func (p *protocolV2) handleResponse(k *Kraken, response MethodResponse) error {
+	switch response.Method {
+	case MethodPong:
+		return nil
+	case MethodSubscribe, MethodUnsubscribe:
+		return p.handleSubscriptionResponse(k, response)
+	}
+
+	if !response.Success {
+		log.Errorf("%s: %s", response.Method, response.Error)
+		switch response.Method {
+		case MethodAddOrder:
+			k.publish(Update{
+				ChannelName: EventAddOrder,
+				Data: AddOrderResponse{
+					ReqID:        response.ReqID,
+					Event:        EventAddOrderStatus,
+					Status:       StatusError,
+					ErrorMessage: response.Error,
+				},
+			})
+		case MethodEditOrder:
+			k.publish(Update{
+				ChannelName: EventEditOrder,
+				Data: EditOrderResponse{
+					Event:        EventEditOrderStatus,
+					ReqID:        response.ReqID,
+					Status:       StatusError,
+					ErrorMessage: response.Error,
+				},
+			})
+		}
+		return nil
+	}
+
+	switch response.Method {
+	case MethodAddOrder:
+		var result OrderResult
+		if err := json.Unmarshal(response.Result, &result); err != nil {
+			return err
+		}
+		k.publish(Update{
+			ChannelName: EventAddOrder,
+			Data: AddOrderResponse{
+				ReqID:  response.ReqID,
+				Event:  EventAddOrderStatus,
+				Status: StatusOK,
+				TxID:   result.OrderID,
+			},
+		})
+	case MethodEditOrder:
+		var result OrderResult
+		if err := json.Unmarshal(response.Result, &result); err != nil {
+			return err
+		}
+		k.publish(Update{
+			ChannelName: EventEditOrder,
+			Data: EditOrderResponse{
+				Event:        EventEditOrderStatus,
+				TxID:         result.OrderID,
+				OriginalTxID: result.OriginalOrderID,
+				ReqID:        response.ReqID,
+				Status:       StatusOK,
+			},
+		})
+	case MethodAmendOrder:
+		var result OrderResult
+		if err := json.Unmarshal(response.Result, &result); err != nil {
+			return err
+		}
+		k.publish(Update{
+			ChannelName: MethodAmendOrder,
+			Data: AmendOrderResponse{
+				ReqID:   response.ReqID,
+				AmendID: result.AmendID,
+				OrderID: result.OrderID,
+				ClOrdID: result.ClOrdID,
+				Status:  StatusOK,
+			},
+		})
+	case MethodBatchAdd:
+		var result []OrderResult
+		if err := json.Unmarshal(response.Result, &result); err != nil {
+			return err
+		}
+		k.publish(Update{
+			ChannelName: MethodBatchAdd,
+			Data: BatchAddResponse{
+				ReqID:  response.ReqID,
+				Orders: result,
+				Status: StatusOK,
+			},
+		})
+	case MethodCancelOrder:
+		k.publish(Update{
+			ChannelName: EventCancelOrder,
+			Data: CancelOrderResponse{
+				ReqID:  response.ReqID,
+				Event:  EventCancelOrderStatus,
+				Status: StatusOK,
+			},
+		})
+	case MethodCancelAll:
+		var result CancelAllResult
+		if err := json.Unmarshal(response.Result, &result); err != nil {
+			return err
+		}
+		k.publish(Update{
+			ChannelName: EventCancelAllStatus,
+			Data: CancelAllResponse{
+				ReqID:  response.ReqID,
+				Count:  result.Count,
+				Event:  EventCancelAllStatus,
+				Status: StatusOK,
+			},
+		})
+	case MethodCancelAllOrdersAfter:
+		var result CancelAllOrdersAfterResult
+		if err := json.Unmarshal(response.Result, &result); err != nil {
+			return err
+		}
+		k.publish(Update{
+			ChannelName: EventCancelAllOrdersAfter,
+			Data: CancelAllOrdersAfterResponse{
+				ReqID:       response.ReqID,
+				Status:      StatusOK,
+				CurrentTime: result.CurrentTime,
+				TriggerTime: result.TriggerTime,
+			},
+		})
+	default:
+		log.Warnf("unknown method: %s", response.Method)
+	}
+	return nil
+}
+
+// handleSubscriptionResponse - converts acknowledgement of v2 subscription to v1 `SubscriptionStatus`
+func (p *protocolV2) handleSubscriptionResponse(k *Kraken, response MethodResponse) error {
+	var result SubscribeResult
+	if len(response.Result) > 0 {
+		if err := json.Unmarshal(response.Result, &result); err != nil {
+			return err
+		}
+	}
+
+	spec, ok := p.acknowledge(response.ReqID)
+	if !ok {
+		spec = Subscription{
+			Name:     result.Channel,
+			Depth:    result.Depth,
+			Interval: result.Interval,
+		}
+	}
+
+	status := SubscriptionStatus{
+		ChannelName:  spec.channelName(),
+		Event:        EventSubscriptionStatus,
+		Pair:         result.Symbol,
+		ReqID:        strconv.FormatInt(response.ReqID, 10),
+		Subscription: spec,
+	}
+	if status.Pair == "" {
+		status.Pair = response.Symbol
+	}
+
+	switch {
+	case !response.Success:
+		status.Status = SubscriptionStatusError
+		status.Error = response.Error
+		log.Errorf("%s: %s", status.Error, status.Pair)
+	case response.Method == MethodSubscribe:
+		status.Status = SubscriptionStatusSubscribed
+	default:
+		status.Status = SubscriptionStatusUnsubscribed
+	}
+
+	k.applySubscriptionStatus(status)
+	return nil
+}
+
+func (p *protocolV2) handleChannel(k *Kraken, msg ChannelMessage) error {
+	snapshot := msg.Type == TypeSnapshot
+
+	switch msg.Channel {
+	case ChanTicker:
+		var tickers []tickerV2
+		if err := json.Unmarshal(msg.Data, &tickers); err != nil {
+			return err
+		}
+		for i := range tickers {
+			k.dispatch(Update{
+				ChannelName: ChanTicker,
+				Pair:        tickers[i].Symbol,
+				Data:        tickers[i].toTickerUpdate(),
+			})
+		}
+	case ChanTrades:
+		var trades []tradeV2
+		if err := json.Unmarshal(msg.Data, &trades); err != nil {
+			return err
+		}
+		// trades of several symbols may be sent in one message, they are published by symbol in order of appearance
+		bySymbol := make(map[string][]Trade)
+		symbols := make([]string, 0, 1)
+		for i := range trades {
+			symbol := trades[i].Symbol
+			if _, ok := bySymbol[symbol]; !ok {
+				symbols = append(symbols, symbol)
+			}
+			bySymbol[symbol] = append(bySymbol[symbol], trades[i].toTrade())
+		}
+		for _, symbol := range symbols {
+			k.dispatch(Update{
+				ChannelName: ChanTrades,
+				Pair:        symbol,
+				Data:        bySymbol[symbol],
+			})
+		}
+	case ChanCandles:
+		var candles []candleV2
+		if err := json.Unmarshal(msg.Data, &candles); err != nil {
+			return err
+		}
+		for i := range candles {
+			k.dispatch(Update{
+				ChannelName: Subscription{Name: ChanCandles, Interval: candles[i].Interval}.channelName(),
+				Pair:        candles[i].Symbol,
+				Data:        candles[i].toCandle(),
+			})
+		}
+	case ChanBook:
+		var books []bookV2
+		if err := json.Unmarshal(msg.Data, &books); err != nil {
+			return err
+		}
+		for i := range books {
+			channelName, ok := k.registry.channelName(ChanBook, books[i].Symbol)
+			if !ok {
+				channelName = Subscription{Name: ChanBook}.channelName()
+			}
+			k.dispatch(Update{
+				ChannelName: channelName,
+				Pair:        books[i].Symbol,
+				Data:        books[i].toOrderBookUpdate(snapshot),
+			})
+		}
+	case ChanLevel3:
+		var books []Level3Update
+		if err := json.Unmarshal(msg.Data, &books); err != nil {
+			return err
+		}
+		for i := range books {
+			books[i].IsSnapshot = snapshot
+			k.dispatch(Update{
+				ChannelName: ChanLevel3,
+				Pair:        books[i].Symbol,
+				Data:        books[i],
+			})
+		}
+	case ChanInstrument:
+		var update InstrumentUpdate
+		if err := json.Unmarshal(msg.Data, &update); err != nil {
+			return err
+		}
+		update.IsSnapshot = snapshot
+		k.dispatch(Update{
+			ChannelName: ChanInstrument,
+			Data:        update,
+		})
+	case ChanBalances:
+		var balances []Balance
+		if err := json.Unmarshal(msg.Data, &balances); err != nil {
+			return err
+		}
+		k.dispatch(Update{
+			ChannelName: ChanBalances,
+			Data: BalancesUpdate{
+				Balances:   balances,
+				IsSnapshot: snapshot,
+			},
+		})
+	case ChanExecutions:
+		var executions []Execution
+		if err := json.Unmarshal(msg.Data, &executions); err != nil {
+			return err
+		}
+		k.dispatch(Update{
+			ChannelName: ChanExecutions,
+			Data: ExecutionsUpdate{
+				Executions: executions,
+				IsSnapshot: snapshot,
+			},
+		})
+	case channelStatus:
+		var statuses []systemStatusV2
+		if err := json.Unmarshal(msg.Data, &statuses); err != nil {
+			return err
+		}
+		for i := range statuses {
+			log.Infof("Status: %s", statuses[i].System)
+			log.Infof("Connection ID: %d", statuses[i].ConnectionID)
+			log.Infof("Version: %s", statuses[i].Version)
+		}
+	case channelHeartbeat:
+	default:
+		log.Warnf("unknown channel: %s", msg.Channel)
+	}
+	return nil
+}
+
+// v2Number - validates number of v1 request which is sent as native JSON number in v2
+func v2Number(value string) (json.Number, error) {
+	if value == "" {
+		return "", nil
+	}
+	if _, err := decimal.NewFromString(value); err != nil {
+		return "", errors.Errorf("invalid number: %s", value)
+	}
+	return json.Number(value), nil
+}
+
+// v2Prices - converts v1 `price` and `price2` of the order type to v2 limit price and trigger.
+// Relative trigger prices of v1 (`+10`, `-10`, `5%`) are converted to v2 offsets.
+func v2Prices(orderType, price, price2 string) (json.Number, *TriggerParams, error) {
+	switch orderType {
+	case OrderTypeStopLoss, OrderTypeTakeProfit, OrderTypeStopLossLimit, OrderTypeTakeProfitLimit:
+	default:
+		limit, err := v2Number(price)
+		return limit, nil, err
+	}
+
+	trigger := TriggerParams{}
+	switch {
+	case strings.HasSuffix(price, "%"):
+		trigger.PriceType = "pct"
+		price = strings.TrimSuffix(price, "%")
+	case strings.HasPrefix(price, "+") || strings.HasPrefix(price, "-"):
+		trigger.PriceType = "quote"
+	}
+	price = strings.TrimPrefix(price, "+")
+
+	var err error
+	if trigger.Price, err = v2Number(price); err != nil {
+		return "", nil, err
+	}
+	limit, err := v2Number(price2)
+	if err != nil {
+		return "", nil, err
+	}
+	return limit, &trigger, nil
+}
+
+// v2Time - converts v1 unix timestamp or `+<seconds>` offset to RFC3339 time
+func v2Time(value string) (string, error) {
+	if value == "" || value == "0" {
+		return "", nil
+	}
+	if strings.HasPrefix(value, "+") {
+		offset, err := strconv.ParseInt(value[1:], 10, 64)
+		if err != nil {
+			return "", errors.Errorf("invalid time offset: %s", value)
+		}
+		return time.Now().Add(time.Duration(offset) * time.Second).UTC().Format(time.RFC3339), nil
+	}
+	ts, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return "", errors.Errorf("invalid unix time: %s", value)
+	}
+	return time.Unix(ts, 0).UTC().Format(time.RFC3339), nil
+}
+
+// applyOrderFlags - converts comma separated v1 order flags to v2 fields
+func applyOrderFlags(oflags string, postOnly *bool, feePreference *string, noMPP *bool) error {
+	if oflags == "" {
+		return nil
+	}
+	for _, flag := range strings.Split(oflags, ",") {
+		switch strings.TrimSpace(flag) {
+		case "post":
+			*postOnly = true
+		case "fcib":
+			*feePreference = "base"
+		case "fciq":
+			*feePreference = "quote"
+		case "nompp":
+			*noMPP = true
+		default:
+			return errors.Wrap(ErrUnsupported, "order flag "+flag)
+		}
+	}
+	return nil
+}
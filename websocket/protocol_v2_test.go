@@ -0,0 +1,109 @@
+package websocket
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProtocolV2_Book(t *testing.T) {
+	k := NewKrakenV2(ProdBaseURLV2)
+
+	h, err := k.SubscribeBookHandle([]string{BTCUSD}, Depth25)
+	require.NoError(t, err)
+
+	require.NoError(t, k.handleMessage([]byte(`{"method":"subscribe","result":{"channel":"book","depth":25,"snapshot":true,"symbol":"XBT/USD"},"success":true,"time_in":"2023-09-25T09:04:31.742599Z","time_out":"2023-09-25T09:04:31.742648Z","req_id":1}`)))
+	assert.Equal(t, StateSubscribed, h.Status())
+
+	require.NoError(t, k.handleMessage([]byte(`{"channel":"book","type":"snapshot","data":[{"symbol":"XBT/USD","bids":[{"price":26500.1,"qty":0.5}],"asks":[{"price":26500.2,"qty":1.25}],"checksum":2439117997,"timestamp":"2023-09-25T09:04:31.742599Z"}]}`)))
+
+	event := <-h.C()
+	assert.Equal(t, "book-25", event.ChannelName)
+	assert.Equal(t, BTCUSD, event.Pair)
+	assert.True(t, event.Data.IsSnapshot)
+	assert.Equal(t, "2439117997", event.Data.CheckSum)
+	require.Len(t, event.Data.Asks, 1)
+	assert.Equal(t, "26500.2", event.Data.Asks[0].Price.String())
+	assert.Equal(t, "1.25", event.Data.Asks[0].Volume.String())
+	assert.Equal(t, "1695632671.742599", event.Data.Asks[0].Time.String())
+}
+
+func TestProtocolV2_SubscribeError(t *testing.T) {
+	k := NewKrakenV2(ProdBaseURLV2)
+
+	h, err := k.SubscribeTickerHandle([]string{"ALGO/USDx"})
+	require.NoError(t, err)
+
+	require.NoError(t, k.handleMessage([]byte(`{"error":"Currency pair not supported ALGO/USDx","method":"subscribe","req_id":1,"success":false,"symbol":"ALGO/USDx"}`)))
+	assert.Equal(t, StateFailed, h.Status())
+	assert.EqualError(t, h.Err(), "Currency pair not supported ALGO/USDx")
+}
+
+func TestProtocolV2_Unsupported(t *testing.T) {
+	assert.ErrorIs(t, NewKrakenV2(ProdBaseURLV2).SubscribeSpread([]string{BTCUSD}), ErrUnsupported)
+	assert.ErrorIs(t, NewKraken(ProdBaseURL).SubscribeInstrument(), ErrUnsupported)
+	assert.Empty(t, NewKraken(ProdBaseURL).Subscriptions())
+}
+
+func TestProtocolV2_AddOrder(t *testing.T) {
+	msg, err := newProtocolV2().addOrder(AddOrderRequest{
+		ReqID:          7,
+		Ordertype:      OrderTypeStopLossLimit,
+		Pair:           BTCUSD,
+		Price:          "+100",
+		Price2:         "26000.5",
+		Type:           SideSell,
+		Volume:         "0.01",
+		TimeInForce:    "GTC",
+		UserRef:        "42",
+		OFlags:         "post,fciq",
+		CloseOrderType: OrderTypeLimit,
+		ClosePrice:     "25000",
+	}, "token")
+	require.NoError(t, err)
+
+	data, err := json.Marshal(msg)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"method": "add_order",
+		"req_id": 7,
+		"params": {
+			"order_type": "stop-loss-limit",
+			"side": "sell",
+			"order_qty": 0.01,
+			"symbol": "XBT/USD",
+			"limit_price": 26000.5,
+			"triggers": {"price": 100, "price_type": "quote"},
+			"time_in_force": "gtc",
+			"post_only": true,
+			"fee_preference": "quote",
+			"order_userref": 42,
+			"conditional": {"order_type": "limit", "limit_price": 25000},
+			"token": "token"
+		}
+	}`, string(data))
+
+	_, err = newProtocolV2().addOrder(AddOrderRequest{Ordertype: OrderTypeLimit, Volume: "1", Price: "abc"}, "token")
+	assert.Error(t, err)
+}
+
+func TestProtocolV2_Executions(t *testing.T) {
+	k := NewKrakenV2(AuthBaseURLV2, WithTokenProvider(&tokenProviderMock{lifetime: time.Minute}))
+
+	h, err := k.SubscribeExecutionsHandle()
+	require.NoError(t, err)
+
+	require.NoError(t, k.handleMessage([]byte(`{"method":"subscribe","result":{"channel":"executions","snapshot":true},"success":true,"req_id":1}`)))
+	assert.Equal(t, StateSubscribed, h.Status())
+
+	require.NoError(t, k.handleMessage([]byte(`{"channel":"executions","type":"update","data":[{"order_id":"OK4GJX-KSTLS-7DZZO5","exec_type":"filled","order_status":"filled","last_qty":0.5,"last_price":26500.1,"timestamp":"2023-09-22T10:33:05.709993Z"}],"sequence":3}`)))
+
+	event := <-h.C()
+	assert.False(t, event.Data.IsSnapshot)
+	require.Len(t, event.Data.Executions, 1)
+	assert.Equal(t, "OK4GJX-KSTLS-7DZZO5", event.Data.Executions[0].OrderID)
+	assert.Equal(t, "26500.1", event.Data.Executions[0].LastPrice.String())
+}
@@ -0,0 +1,397 @@
+package websocket
+
+import (
+	"sync"
+	"time"
+)
+
+// OverflowPolicy - behaviour of `Listen()` channel when the consumer is slower than the socket
+type OverflowPolicy int
+
+// Overflow policies
+const (
+	// OverflowBlock - waits until consumer reads an update. A slow consumer stalls the read loop. It's default policy.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest - drops the oldest buffered update to make room for the new one.
+	OverflowDropOldest
+	// OverflowDropNewest - drops the new update if buffer is full.
+	OverflowDropNewest
+	// OverflowCoalesce - merges buffered updates of the same channel and pair: ticker, spread and candle keep only the latest value,
+	// trades, order book and private updates are concatenated. Updates without pair (order events) are never merged.
+	OverflowCoalesce
+)
+
+// String -
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "block"
+	case OverflowDropOldest:
+		return "drop_oldest"
+	case OverflowDropNewest:
+		return "drop_newest"
+	case OverflowCoalesce:
+		return "coalesce"
+	default:
+		return "unknown"
+	}
+}
+
+// Metrics - runtime counters of `Kraken` client
+type Metrics struct {
+	// DroppedUpdates - total count of updates dropped by overflow policy
+	DroppedUpdates uint64
+	// DroppedByChannel - count of dropped updates by channel name
+	DroppedByChannel map[string]uint64
+	// CoalescedUpdates - count of updates merged into already buffered ones
+	CoalescedUpdates uint64
+	// TokenExpiresAt - expiration time of current websocket token. Token doesn't expire while `TokenInUse` is true.
+	TokenExpiresAt time.Time
+	// TokenInUse - current token is used by private subscription of the connection
+	TokenInUse bool
+	// TokenRefreshes - count of received tokens
+	TokenRefreshes uint64
+}
+
+type coalesceKey struct {
+	channel string
+	pair    string
+	id      uint64
+}
+
+// publisher - delivers updates to `Listen()` channel according to overflow policy
+type publisher struct {
+	policy OverflowPolicy
+	size   int
+	out    chan Update
+	stop   chan struct{}
+	done   chan struct{}
+
+	closed   bool
+	closeMx  sync.RWMutex
+	stopOnce sync.Once
+
+	mx        sync.Mutex
+	queue     []coalesceKey
+	pending   map[coalesceKey]*Update
+	wake      chan struct{}
+	nextID    uint64
+	gaps      map[string]struct{}
+	dropped   map[string]uint64
+	total     uint64
+	coalesced uint64
+}
+
+func newPublisher(size int, policy OverflowPolicy) *publisher {
+	if size < 1 {
+		size = 1
+	}
+	p := &publisher{
+		policy:  policy,
+		size:    size,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		pending: make(map[coalesceKey]*Update),
+		wake:    make(chan struct{}, 1),
+		gaps:    make(map[string]struct{}),
+		dropped: make(map[string]uint64),
+	}
+
+	if policy == OverflowCoalesce {
+		// all buffering is done in coalescing queue
+		p.out = make(chan Update)
+		go p.pump()
+	} else {
+		p.out = make(chan Update, size)
+		close(p.done)
+	}
+	return p
+}
+
+func (p *publisher) publish(upd Update) {
+	p.closeMx.RLock()
+	defer p.closeMx.RUnlock()
+
+	if p.closed {
+		return
+	}
+
+	switch p.policy {
+	case OverflowDropNewest:
+		p.fillGap(&upd)
+		select {
+		case p.out <- upd:
+		default:
+			p.drop(upd)
+		}
+	case OverflowDropOldest:
+		for {
+			p.fillGap(&upd)
+			select {
+			case p.out <- upd:
+				return
+			default:
+			}
+
+			select {
+			case old := <-p.out:
+				p.drop(old)
+			default:
+			}
+		}
+	case OverflowCoalesce:
+		p.enqueue(upd)
+	default:
+		select {
+		case p.out <- upd:
+		case <-p.stop:
+		}
+	}
+}
+
+// drop - counts dropped update and remembers gap in order book stream
+func (p *publisher) drop(upd Update) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	p.total++
+	p.dropped[upd.ChannelName]++
+
+	if _, ok := upd.Data.(OrderBookUpdate); ok {
+		p.gaps[gapKey(upd)] = struct{}{}
+	}
+}
+
+// fillGap - marks order book update if previous updates of the same book were dropped
+func (p *publisher) fillGap(upd *Update) {
+	data, ok := upd.Data.(OrderBookUpdate)
+	if !ok {
+		return
+	}
+
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	key := gapKey(*upd)
+	if _, ok := p.gaps[key]; !ok {
+		return
+	}
+	delete(p.gaps, key)
+
+	if !data.IsSnapshot {
+		data.Gap = true
+		upd.Data = data
+	}
+}
+
+func gapKey(upd Update) string {
+	return upd.ChannelName + ":" + upd.Pair
+}
+
+func (p *publisher) enqueue(upd Update) {
+	p.mx.Lock()
+
+	key := coalesceKey{
+		channel: upd.ChannelName,
+		pair:    upd.Pair,
+	}
+	if upd.Pair == "" {
+		p.nextID++
+		key.id = p.nextID
+	}
+
+	if buffered, ok := p.pending[key]; ok && merge(buffered, upd) {
+		p.coalesced++
+		p.mx.Unlock()
+		return
+	}
+
+	if len(p.queue) >= p.size {
+		oldest := p.queue[0]
+		p.queue = p.queue[1:]
+		if dropped, ok := p.pending[oldest]; ok {
+			delete(p.pending, oldest)
+			p.total++
+			p.dropped[dropped.ChannelName]++
+			if _, ok := dropped.Data.(OrderBookUpdate); ok {
+				p.gaps[gapKey(*dropped)] = struct{}{}
+			}
+		}
+	}
+
+	if _, ok := p.pending[key]; ok {
+		// update can't be merged: deliver it as separate item
+		p.nextID++
+		key.id = p.nextID
+	}
+	p.queue = append(p.queue, key)
+	p.pending[key] = &upd
+	p.mx.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *publisher) pump() {
+	defer close(p.done)
+
+	for {
+		p.mx.Lock()
+		if len(p.queue) == 0 {
+			p.mx.Unlock()
+			select {
+			case <-p.wake:
+				continue
+			case <-p.stop:
+				return
+			}
+		}
+		key := p.queue[0]
+		p.queue = p.queue[1:]
+		upd := p.pending[key]
+		delete(p.pending, key)
+		p.mx.Unlock()
+
+		if upd == nil {
+			continue
+		}
+		p.fillGap(upd)
+
+		select {
+		case p.out <- *upd:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// merge - merges `upd` into buffered update. Returns false if updates can't be merged.
+func merge(buffered *Update, upd Update) bool {
+	switch data := upd.Data.(type) {
+	case TickerUpdate, Spread, Candle:
+		buffered.Data = data
+	case []Trade:
+		old, ok := buffered.Data.([]Trade)
+		if !ok {
+			return false
+		}
+		buffered.Data = append(old, data...)
+	case OrderBookUpdate:
+		old, ok := buffered.Data.(OrderBookUpdate)
+		if !ok {
+			return false
+		}
+		if data.IsSnapshot {
+			buffered.Data = data
+			break
+		}
+		old.Asks = append(old.Asks, data.Asks...)
+		old.Bids = append(old.Bids, data.Bids...)
+		old.CheckSum = data.CheckSum
+		old.Gap = old.Gap || data.Gap
+		buffered.Data = old
+	case OwnTradesUpdate:
+		old, ok := buffered.Data.(OwnTradesUpdate)
+		if !ok {
+			return false
+		}
+		buffered.Data = append(old, data...)
+	case OpenOrdersUpdate:
+		old, ok := buffered.Data.(OpenOrdersUpdate)
+		if !ok {
+			return false
+		}
+		buffered.Data = append(old, data...)
+	default:
+		return false
+	}
+	buffered.Sequence = upd.Sequence
+	buffered.ChannelID = upd.ChannelID
+	return true
+}
+
+func (p *publisher) metrics() Metrics {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	m := Metrics{
+		DroppedUpdates:   p.total,
+		CoalescedUpdates: p.coalesced,
+		DroppedByChannel: make(map[string]uint64, len(p.dropped)),
+	}
+	for name, count := range p.dropped {
+		m.DroppedByChannel[name] = count
+	}
+	return m
+}
+
+func (p *publisher) close() {
+	// release blocked senders before waiting for them
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+	<-p.done
+
+	p.closeMx.Lock()
+	defer p.closeMx.Unlock()
+
+	if p.closed {
+		return
+	}
+	p.closed = true
+	close(p.out)
+}
+
+// Publisher - `Listen()` channel of components which imitate the client, e.g. `paper.Engine`. Updates are delivered by
+// overflow policy as the client delivers them and dropped updates are counted by `Metrics`.
+type Publisher struct {
+	p  *publisher
+	mx sync.Mutex
+}
+
+// NewPublisher - creates channel of updates with buffer of `size` updates and overflow `policy`
+func NewPublisher(size int, policy OverflowPolicy) *Publisher {
+	return &Publisher{
+		p: newPublisher(size, policy),
+	}
+}
+
+// C - returns channel of updates. It's closed by `Close`.
+func (p *Publisher) C() <-chan Update {
+	return p.p.out
+}
+
+// Publish - sends updates in order. Updates of concurrent calls aren't interleaved. With `OverflowBlock` it waits until
+// the reader receives them.
+func (p *Publisher) Publish(updates ...Update) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	for i := range updates {
+		p.p.publish(updates[i])
+	}
+}
+
+// PublishUnlock - takes turn of publisher, releases `l` and sends updates. Updates of calls which are serialized by `l` keep
+// order of the calls, while holders of `l` aren't blocked by a slow reader.
+func (p *Publisher) PublishUnlock(l sync.Locker, updates ...Update) {
+	p.mx.Lock()
+	l.Unlock()
+	defer p.mx.Unlock()
+
+	for i := range updates {
+		p.p.publish(updates[i])
+	}
+}
+
+// Metrics - returns counters of dropped and coalesced updates
+func (p *Publisher) Metrics() Metrics {
+	return p.p.metrics()
+}
+
+// Close - releases blocked senders and closes channel of updates
+func (p *Publisher) Close() {
+	p.p.close()
+}
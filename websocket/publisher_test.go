@@ -0,0 +1,108 @@
+package websocket
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func bookUpdate(pair string, snapshot bool, price, volume string) Update {
+	return Update{
+		ChannelName: "book-10",
+		Pair:        pair,
+		Data: OrderBookUpdate{
+			Asks: []OrderBookItem{
+				{Price: json.Number(price), Volume: json.Number(volume), Time: "1"},
+			},
+			IsSnapshot: snapshot,
+		},
+	}
+}
+
+func TestPublisher_DropNewest(t *testing.T) {
+	p := newPublisher(1, OverflowDropNewest)
+	p.publish(bookUpdate(BTCUSD, true, "100", "1"))
+	p.publish(bookUpdate(BTCUSD, false, "101", "1"))
+	p.publish(Update{ChannelName: ChanTicker, Pair: BTCUSD, Data: TickerUpdate{}})
+
+	m := p.metrics()
+	assert.Equal(t, uint64(2), m.DroppedUpdates)
+	assert.Equal(t, uint64(1), m.DroppedByChannel["book-10"])
+	assert.Equal(t, uint64(1), m.DroppedByChannel[ChanTicker])
+
+	first := <-p.out
+	assert.True(t, first.Data.(OrderBookUpdate).IsSnapshot)
+
+	p.publish(bookUpdate(BTCUSD, false, "102", "1"))
+	next := <-p.out
+	assert.True(t, next.Data.(OrderBookUpdate).Gap, "update after dropped one should be marked")
+
+	p.close()
+}
+
+func TestPublisher_DropOldest(t *testing.T) {
+	p := newPublisher(2, OverflowDropOldest)
+	for _, price := range []string{"100", "101", "102"} {
+		p.publish(bookUpdate(BTCUSD, false, price, "1"))
+	}
+
+	assert.Equal(t, uint64(1), p.metrics().DroppedUpdates)
+
+	first := <-p.out
+	assert.Equal(t, json.Number("101"), first.Data.(OrderBookUpdate).Asks[0].Price)
+	second := <-p.out
+	assert.True(t, second.Data.(OrderBookUpdate).Gap)
+
+	p.close()
+}
+
+func TestPublisher_Coalesce(t *testing.T) {
+	p := newPublisher(4, OverflowCoalesce)
+	p.mx.Lock()
+	// block pump to make sure all updates are buffered
+	for _, price := range []string{"100", "101"} {
+		upd := bookUpdate(BTCUSD, false, price, "1")
+		key := coalesceKey{channel: upd.ChannelName, pair: upd.Pair}
+		if buffered, ok := p.pending[key]; ok {
+			require.True(t, merge(buffered, upd))
+			continue
+		}
+		p.queue = append(p.queue, key)
+		p.pending[key] = &upd
+	}
+	p.mx.Unlock()
+
+	p.enqueue(Update{ChannelName: ChanTicker, Pair: BTCUSD, Data: TickerUpdate{Open: DecimalValues{Today: "1"}}})
+	p.enqueue(Update{ChannelName: ChanTicker, Pair: BTCUSD, Data: TickerUpdate{Open: DecimalValues{Today: "2"}}})
+
+	book := <-p.out
+	assert.Len(t, book.Data.(OrderBookUpdate).Asks, 2)
+
+	ticker := <-p.out
+	assert.Equal(t, json.Number("2"), ticker.Data.(TickerUpdate).Open.Today)
+	assert.GreaterOrEqual(t, p.metrics().CoalescedUpdates, uint64(1))
+
+	p.close()
+	_, ok := <-p.out
+	assert.False(t, ok)
+}
+
+func TestOrderBook_ApplyUpdateGap(t *testing.T) {
+	book := NewOrderBook(10, 1, 1)
+	snapshot := bookUpdate(BTCUSD, true, "100.0", "1.0").Data.(OrderBookUpdate)
+	require.NoError(t, book.ApplyUpdate(snapshot, false))
+
+	gap := bookUpdate(BTCUSD, false, "101.0", "1.0").Data.(OrderBookUpdate)
+	gap.Gap = true
+	assert.ErrorIs(t, book.ApplyUpdate(gap, false), ErrResyncRequired)
+	assert.True(t, book.NeedsResync())
+
+	snapshot = bookUpdate(BTCUSD, true, "102.0", "1.0").Data.(OrderBookUpdate)
+	require.NoError(t, book.ApplyUpdate(snapshot, false))
+	assert.False(t, book.NeedsResync())
+
+	price, _ := book.Asks.Best()
+	assert.Equal(t, "102", price.String())
+}
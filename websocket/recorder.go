@@ -0,0 +1,262 @@
+package websocket
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// FrameKind - kind of recorded frame
+type FrameKind string
+
+// Frame kinds
+const (
+	// FrameReceived - raw message received from server
+	FrameReceived FrameKind = "recv"
+	// FrameSent - raw message sent to server
+	FrameSent FrameKind = "send"
+	// FrameConnected - connection is established. Data is URL of the server.
+	FrameConnected FrameKind = "connect"
+	// FrameDisconnected - connection is lost
+	FrameDisconnected FrameKind = "disconnect"
+	// FrameClosed - client is closed by user
+	FrameClosed FrameKind = "close"
+)
+
+// recordingExt - extension of recording files
+const recordingExt = ".jsonl.gz"
+
+// Frame - recorded message or lifecycle event of connection
+type Frame struct {
+	// Time - local time when frame was received or sent
+	Time time.Time `json:"time"`
+	// Conn - name of connection which is passed to `WithRecorder`
+	Conn string    `json:"conn"`
+	Kind FrameKind `json:"kind"`
+	Data string    `json:"data,omitempty"`
+}
+
+// RecorderOption - option function for `Recorder`
+type RecorderOption func(*Recorder)
+
+// WithRotateSize - add size of uncompressed frames after which file is rotated. Default: 64MB.
+func WithRotateSize(size int64) RecorderOption {
+	return func(r *Recorder) {
+		r.rotateSize = size
+	}
+}
+
+// WithRotateInterval - add time after which file is rotated. Default: 1h.
+func WithRotateInterval(interval time.Duration) RecorderOption {
+	return func(r *Recorder) {
+		r.rotateInterval = interval
+	}
+}
+
+// WithFilePrefix - add custom prefix of file names. Default: `kraken`.
+func WithFilePrefix(prefix string) RecorderOption {
+	return func(r *Recorder) {
+		r.prefix = prefix
+	}
+}
+
+// Recorder - writes frames of one or several connections to rotating gzip files with one JSON frame per line.
+// It's passed to client by `WithRecorder` option. Recorder is safe for concurrent use.
+type Recorder struct {
+	dir            string
+	prefix         string
+	rotateSize     int64
+	rotateInterval time.Duration
+
+	file    *os.File
+	gz      *gzip.Writer
+	buf     *bufio.Writer
+	written int64
+	opened  time.Time
+	index   int
+	closed  bool
+
+	mx sync.Mutex
+}
+
+// NewRecorder - creates recorder which writes files to `dir`. Directory is created if it doesn't exist.
+func NewRecorder(dir string, opts ...RecorderOption) (*Recorder, error) {
+	r := &Recorder{
+		dir:            dir,
+		prefix:         "kraken",
+		rotateSize:     64 << 20,
+		rotateInterval: time.Hour,
+	}
+	for i := range opts {
+		opts[i](r)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Record - writes frame. File is opened on the first frame and rotated by size and time.
+func (r *Recorder) Record(frame Frame) error {
+	line, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if r.closed {
+		return errors.New("recorder is closed")
+	}
+	if r.file != nil && (r.written >= r.rotateSize || frame.Time.Sub(r.opened) >= r.rotateInterval) {
+		if err := r.closeFile(); err != nil {
+			return err
+		}
+	}
+	if r.file == nil {
+		if err := r.openFile(frame.Time); err != nil {
+			return err
+		}
+	}
+
+	n, err := r.buf.Write(line)
+	r.written += int64(n)
+	return err
+}
+
+// Flush - writes buffered frames to the current file
+func (r *Recorder) Flush() error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+	if err := r.buf.Flush(); err != nil {
+		return err
+	}
+	return r.gz.Flush()
+}
+
+// Close - flushes and closes the current file
+func (r *Recorder) Close() error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	r.closed = true
+	if r.file == nil {
+		return nil
+	}
+	return r.closeFile()
+}
+
+func (r *Recorder) openFile(now time.Time) error {
+	r.index++
+	name := fmt.Sprintf("%s-%s-%04d%s", r.prefix, now.UTC().Format("20060102T150405.000000000"), r.index, recordingExt)
+	file, err := os.Create(filepath.Join(r.dir, name))
+	if err != nil {
+		return err
+	}
+	r.file = file
+	r.gz = gzip.NewWriter(file)
+	r.buf = bufio.NewWriter(r.gz)
+	r.written = 0
+	r.opened = now
+	return nil
+}
+
+func (r *Recorder) closeFile() error {
+	defer func() {
+		r.file = nil
+		r.gz = nil
+		r.buf = nil
+	}()
+
+	if err := r.buf.Flush(); err != nil {
+		r.file.Close()
+		return err
+	}
+	if err := r.gz.Close(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
+
+// RecordingFiles - returns recording files in `dir` with prefix in order of recording
+func RecordingFiles(dir, prefix string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, prefix+"-*"+recordingExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// FrameReader - reads frames of recording file
+type FrameReader struct {
+	file    *os.File
+	decoder *json.Decoder
+}
+
+// OpenRecording - opens recording file for reading
+func OpenRecording(path string) (*FrameReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, path)
+	}
+	return &FrameReader{
+		file:    file,
+		decoder: json.NewDecoder(gz),
+	}, nil
+}
+
+// Next - returns the next frame. It returns `io.EOF` at the end of file.
+func (r *FrameReader) Next() (Frame, error) {
+	var frame Frame
+	if err := r.decoder.Decode(&frame); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// file of crashed recorder ends with incomplete frame
+			return frame, io.EOF
+		}
+		return frame, err
+	}
+	return frame, nil
+}
+
+// Close - closes file. Error of decompression is returned by `Next`.
+func (r *FrameReader) Close() error {
+	return r.file.Close()
+}
+
+// record - writes frame of the client if recorder is set
+func (k *Kraken) record(kind FrameKind, data []byte) {
+	if k.recorder == nil {
+		return
+	}
+	if err := k.recorder.Record(Frame{
+		Time: time.Now(),
+		Conn: k.recordConn,
+		Kind: kind,
+		Data: string(data),
+	}); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,107 @@
+package websocket
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readRecording(t *testing.T, files []string) []Frame {
+	t.Helper()
+
+	var frames []Frame
+	for _, path := range files {
+		reader, err := OpenRecording(path)
+		require.NoError(t, err)
+		for {
+			frame, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			frames = append(frames, frame)
+		}
+		require.NoError(t, reader.Close())
+	}
+	return frames
+}
+
+func TestRecorder_Rotate(t *testing.T) {
+	dir := t.TempDir()
+	recorder, err := NewRecorder(dir, WithRotateSize(200), WithRotateInterval(time.Minute), WithFilePrefix("test"))
+	require.NoError(t, err)
+
+	start := time.Unix(1534614248, 0).UTC()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, recorder.Record(Frame{
+			Time: start.Add(time.Duration(i) * time.Second),
+			Conn: "main",
+			Kind: FrameReceived,
+			Data: bookUpdateMessage,
+		}))
+	}
+	// frame after interval opens new file
+	require.NoError(t, recorder.Record(Frame{Time: start.Add(time.Hour), Conn: "main", Kind: FrameClosed}))
+	require.NoError(t, recorder.Close())
+	assert.Error(t, recorder.Record(Frame{Time: start, Kind: FrameClosed}))
+
+	files, err := RecordingFiles(dir, "test")
+	require.NoError(t, err)
+	require.Len(t, files, 6)
+
+	frames := readRecording(t, files)
+	require.Len(t, frames, 11)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, start.Add(time.Duration(i)*time.Second), frames[i].Time)
+		assert.Equal(t, bookUpdateMessage, frames[i].Data)
+	}
+	assert.Equal(t, FrameClosed, frames[10].Kind)
+}
+
+func TestRecorder_Truncated(t *testing.T) {
+	dir := t.TempDir()
+	recorder, err := NewRecorder(dir)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, recorder.Record(Frame{Time: time.Now(), Kind: FrameReceived, Data: bookSnapshotMessage}))
+	}
+	require.NoError(t, recorder.Flush())
+
+	// recorder wasn't closed: frames are readable up to the last flush
+	files, err := RecordingFiles(dir, "kraken")
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	data, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(files[0], data[:len(data)-2], 0o644))
+
+	assert.Len(t, readRecording(t, files), 3)
+	require.NoError(t, recorder.Close())
+}
+
+func TestKraken_Record(t *testing.T) {
+	dir := t.TempDir()
+	recorder, err := NewRecorder(dir)
+	require.NoError(t, err)
+
+	pool := NewPool(ProdBaseURL, WithShards(2), WithShardOptions(WithRecorder(recorder, "pool")))
+	k := pool.shards[1].k
+	k.disconnected()
+	k.disconnected()
+	require.NoError(t, pool.Close())
+	require.NoError(t, recorder.Close())
+
+	files, err := RecordingFiles(dir, "kraken")
+	require.NoError(t, err)
+	var kinds []FrameKind
+	for _, frame := range readRecording(t, files) {
+		if frame.Conn == "pool/1" {
+			kinds = append(kinds, frame.Kind)
+		}
+	}
+	assert.Equal(t, []FrameKind{FrameDisconnected, FrameClosed}, kinds)
+}
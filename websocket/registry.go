@@ -0,0 +1,325 @@
+package websocket
+
+import (
+	"sort"
+	"sync"
+)
+
+// SubscriptionInfo - desired subscription to a channel for a pair and its current state
+type SubscriptionInfo struct {
+	Subscription Subscription
+	ChannelName  string
+	Pair         string
+	State        SubscriptionState
+	ChannelID    int64
+	Error        string
+	// Consumers - count of subscribe calls and handles which use the subscription
+	Consumers int
+}
+
+type registryKey struct {
+	channelName string
+	pair        string
+}
+
+type registryEntry struct {
+	spec      Subscription
+	state     SubscriptionState
+	channelID int64
+	err       string
+	refs      int
+	// resyncing - the channel is resubscribed to get fresh snapshot, so its unsubscription is expected
+	resyncing bool
+}
+
+// subscriptionGroup - subscription request for several pairs with the same parameters
+type subscriptionGroup struct {
+	spec  Subscription
+	pairs []string
+}
+
+// subscriptionRegistry - desired state of subscriptions. It's safe for concurrent use.
+type subscriptionRegistry struct {
+	entries map[registryKey]*registryEntry
+	mx      sync.RWMutex
+}
+
+func newSubscriptionRegistry() *subscriptionRegistry {
+	return &subscriptionRegistry{
+		entries: make(map[registryKey]*registryEntry),
+	}
+}
+
+// add - registers desired subscription and returns pairs which have to be requested from Kraken:
+// new ones and ones which failed before. Private channels are registered with empty pair.
+func (r *subscriptionRegistry) add(spec Subscription, pairs []string) []string {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	channelName := spec.channelName()
+	request := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		key := registryKey{channelName, pair}
+		entry, ok := r.entries[key]
+		if !ok {
+			entry = &registryEntry{
+				spec:  spec,
+				state: StatePending,
+			}
+			r.entries[key] = entry
+			request = append(request, pair)
+		} else if entry.state == StateFailed || entry.state == StateUnsubscribed {
+			entry.spec = spec
+			entry.state = StatePending
+			entry.err = ""
+			request = append(request, pair)
+		}
+		entry.refs++
+	}
+	return request
+}
+
+// release - decrements count of consumers and returns pairs which are not used anymore
+func (r *subscriptionRegistry) release(spec Subscription, pairs []string) []string {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	channelName := spec.channelName()
+	unused := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		key := registryKey{channelName, pair}
+		entry, ok := r.entries[key]
+		if !ok {
+			continue
+		}
+		entry.refs--
+		if entry.refs <= 0 {
+			delete(r.entries, key)
+			unused = append(unused, pair)
+		}
+	}
+	return unused
+}
+
+// remove - removes desired subscriptions of channel `name` for pairs regardless of consumers count.
+// If `spec` has depth or interval only exact channel is removed. Returns removed subscriptions grouped by parameters.
+func (r *subscriptionRegistry) remove(spec Subscription, pairs []string) []subscriptionGroup {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	exact := spec.Depth != 0 || spec.Interval != 0
+	channelName := spec.channelName()
+
+	wanted := make(map[string]struct{}, len(pairs))
+	for i := range pairs {
+		wanted[pairs[i]] = struct{}{}
+	}
+
+	groups := make(map[string]*subscriptionGroup)
+	for key, entry := range r.entries {
+		if entry.spec.Name != spec.Name {
+			continue
+		}
+		if exact && key.channelName != channelName {
+			continue
+		}
+		if _, ok := wanted[key.pair]; !ok {
+			continue
+		}
+		delete(r.entries, key)
+
+		group, ok := groups[key.channelName]
+		if !ok {
+			group = &subscriptionGroup{spec: entry.spec}
+			groups[key.channelName] = group
+		}
+		group.pairs = append(group.pairs, key.pair)
+	}
+	return sortGroups(groups)
+}
+
+// setStatus - applies subscription status received from Kraken
+func (r *subscriptionRegistry) setStatus(status SubscriptionStatus) {
+	channelName := status.ChannelName
+	if channelName == "" {
+		channelName = status.Subscription.channelName()
+	}
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	entry, ok := r.entries[registryKey{channelName, status.Pair}]
+	if !ok {
+		return
+	}
+
+	switch status.Status {
+	case SubscriptionStatusSubscribed:
+		entry.state = StateSubscribed
+		entry.channelID = status.ChannelID
+		entry.err = ""
+		entry.resyncing = false
+	case SubscriptionStatusUnsubscribed:
+		entry.channelID = 0
+		if !entry.resyncing {
+			entry.state = StateUnsubscribed
+		}
+	case SubscriptionStatusError:
+		entry.state = StateFailed
+		entry.err = status.Error
+		entry.resyncing = false
+	}
+}
+
+// state - returns current state of subscription
+func (r *subscriptionRegistry) state(channelName, pair string) (SubscriptionState, bool) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	entry, ok := r.entries[registryKey{channelName, pair}]
+	if !ok {
+		return "", false
+	}
+	return entry.state, true
+}
+
+// channelName - returns name of desired channel `name` for the pair, e.g. `book-25` for `book`.
+// Websocket API v2 doesn't send parameters of subscription in data messages, so they are restored from the registry.
+func (r *subscriptionRegistry) channelName(name, pair string) (string, bool) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	var result string
+	for key, entry := range r.entries {
+		if entry.spec.Name != name || key.pair != pair {
+			continue
+		}
+		if result == "" || key.channelName < result {
+			result = key.channelName
+		}
+	}
+	return result, result != ""
+}
+
+// retry - marks subscriptions of channel `name` as pending and returns them grouped by parameters
+func (r *subscriptionRegistry) retry(name string) []subscriptionGroup {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	groups := make(map[string]*subscriptionGroup)
+	for key, entry := range r.entries {
+		if entry.spec.Name != name {
+			continue
+		}
+		entry.state = StatePending
+		entry.err = ""
+
+		group, ok := groups[key.channelName]
+		if !ok {
+			group = &subscriptionGroup{spec: entry.spec}
+			groups[key.channelName] = group
+		}
+		group.pairs = append(group.pairs, key.pair)
+	}
+	return sortGroups(groups)
+}
+
+// resync - marks desired subscriptions of pairs as pending until they are resubscribed. It returns pairs which are still desired.
+func (r *subscriptionRegistry) resync(spec Subscription, pairs []string) []string {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	channelName := spec.channelName()
+	result := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		entry, ok := r.entries[registryKey{channelName, pair}]
+		if !ok {
+			continue
+		}
+		entry.state = StatePending
+		entry.err = ""
+		entry.resyncing = true
+		result = append(result, pair)
+	}
+	return result
+}
+
+// reset - marks all subscriptions as pending and returns them grouped by parameters for resubscription
+func (r *subscriptionRegistry) reset() []subscriptionGroup {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	groups := make(map[string]*subscriptionGroup)
+	for key, entry := range r.entries {
+		entry.state = StatePending
+		entry.channelID = 0
+		entry.err = ""
+		entry.resyncing = false
+
+		group, ok := groups[key.channelName]
+		if !ok {
+			group = &subscriptionGroup{spec: entry.spec}
+			groups[key.channelName] = group
+		}
+		group.pairs = append(group.pairs, key.pair)
+	}
+	return sortGroups(groups)
+}
+
+// pendingGroups - returns pairs of groups which are still desired and wait for subscription
+func (r *subscriptionRegistry) pendingGroups(groups []subscriptionGroup) []subscriptionGroup {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	result := make([]subscriptionGroup, 0, len(groups))
+	for _, group := range groups {
+		channelName := group.spec.channelName()
+		pairs := make([]string, 0, len(group.pairs))
+		for _, pair := range group.pairs {
+			if entry, ok := r.entries[registryKey{channelName, pair}]; ok && entry.state == StatePending {
+				pairs = append(pairs, pair)
+			}
+		}
+		if len(pairs) > 0 {
+			result = append(result, subscriptionGroup{spec: group.spec, pairs: pairs})
+		}
+	}
+	return result
+}
+
+func (r *subscriptionRegistry) list() []SubscriptionInfo {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	result := make([]SubscriptionInfo, 0, len(r.entries))
+	for key, entry := range r.entries {
+		result = append(result, SubscriptionInfo{
+			Subscription: entry.spec,
+			ChannelName:  key.channelName,
+			Pair:         key.pair,
+			State:        entry.state,
+			ChannelID:    entry.channelID,
+			Error:        entry.err,
+			Consumers:    entry.refs,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].ChannelName == result[j].ChannelName {
+			return result[i].Pair < result[j].Pair
+		}
+		return result[i].ChannelName < result[j].ChannelName
+	})
+	return result
+}
+
+func sortGroups(groups map[string]*subscriptionGroup) []subscriptionGroup {
+	result := make([]subscriptionGroup, 0, len(groups))
+	for _, group := range groups {
+		sort.Strings(group.pairs)
+		result = append(result, *group)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].spec.channelName() < result[j].spec.channelName()
+	})
+	return result
+}
@@ -0,0 +1,55 @@
+package websocket
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscriptionRegistry(t *testing.T) {
+	r := newSubscriptionRegistry()
+	book := Subscription{Name: ChanBook, Depth: Depth25}
+
+	assert.Equal(t, []string{BTCUSD, ETHUSD}, r.add(book, []string{BTCUSD, ETHUSD}))
+	assert.Empty(t, r.add(book, []string{BTCUSD}), "already requested pair must not be sent twice")
+	assert.Equal(t, []string{""}, r.add(Subscription{Name: ChanOwnTrades}, []string{""}))
+
+	r.setStatus(SubscriptionStatus{
+		ChannelID:    10,
+		ChannelName:  "book-25",
+		Status:       SubscriptionStatusSubscribed,
+		Pair:         BTCUSD,
+		Subscription: book,
+	})
+	r.setStatus(SubscriptionStatus{
+		Status:       SubscriptionStatusError,
+		Pair:         ETHUSD,
+		Error:        "Currency pair not supported",
+		Subscription: book,
+	})
+
+	state, ok := r.state("book-25", BTCUSD)
+	assert.True(t, ok)
+	assert.Equal(t, StateSubscribed, state)
+	state, _ = r.state("book-25", ETHUSD)
+	assert.Equal(t, StateFailed, state)
+
+	assert.Equal(t, []string{ETHUSD}, r.add(book, []string{ETHUSD}), "failed pair must be requested again")
+
+	assert.Empty(t, r.release(book, []string{BTCUSD}))
+	assert.Equal(t, []string{BTCUSD}, r.release(book, []string{BTCUSD}))
+
+	groups := r.reset()
+	assert.Equal(t, []subscriptionGroup{
+		{spec: book, pairs: []string{ETHUSD}},
+		{spec: Subscription{Name: ChanOwnTrades}, pairs: []string{""}},
+	}, groups)
+
+	for _, info := range r.list() {
+		assert.Equal(t, StatePending, info.State)
+	}
+
+	removed := r.remove(Subscription{Name: ChanBook}, []string{ETHUSD})
+	assert.Len(t, removed, 1)
+	assert.Len(t, r.list(), 1)
+}
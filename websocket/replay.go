@@ -0,0 +1,168 @@
+package websocket
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// ReplayMaxSpeed - replays frames without delays
+const ReplayMaxSpeed = 0
+
+// ReplayOption - option function for `Replayer`
+type ReplayOption func(*Replayer)
+
+// WithReplaySpeed - add speed of replay: 1 is real time, 10 is 10 times faster, `ReplayMaxSpeed` doesn't wait between frames. Default: 1.
+func WithReplaySpeed(speed float64) ReplayOption {
+	return func(r *Replayer) {
+		r.speed = speed
+	}
+}
+
+// WithReplayConn - replay only frames of the connection, e.g. one shard of recorded pool. Default: all frames.
+func WithReplayConn(conn string) ReplayOption {
+	return func(r *Replayer) {
+		r.conn = conn
+	}
+}
+
+// WithFrameHandler - add function which receives every replayed frame including sent messages before it's applied
+func WithFrameHandler(fn func(Frame)) ReplayOption {
+	return func(r *Replayer) {
+		r.handler = fn
+	}
+}
+
+// Replayer - replays recorded frames to client through the same path as received messages. Client shouldn't be connected:
+// subscriptions and handles are created as usual, and recorded disconnects and reconnects are reproduced.
+type Replayer struct {
+	k       *Kraken
+	files   []string
+	speed   float64
+	conn    string
+	handler func(Frame)
+
+	connected bool
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+// NewReplayer - creates replayer of files to the client. Files are replayed in passed order, see `RecordingFiles`.
+func NewReplayer(k *Kraken, files []string, opts ...ReplayOption) *Replayer {
+	r := &Replayer{
+		k:     k,
+		files: files,
+		speed: 1,
+		stop:  make(chan struct{}),
+	}
+	for i := range opts {
+		opts[i](r)
+	}
+	return r
+}
+
+// Run - replays files. It blocks until all frames are replayed or `Stop` is called.
+func (r *Replayer) Run() error {
+	var (
+		first   time.Time
+		started = time.Now()
+	)
+	for _, path := range r.files {
+		reader, err := OpenRecording(path)
+		if err != nil {
+			return err
+		}
+
+		for {
+			frame, err := reader.Next()
+			if err != nil {
+				reader.Close()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				return errors.Wrap(err, path)
+			}
+			if r.conn != "" && frame.Conn != r.conn {
+				continue
+			}
+
+			if first.IsZero() {
+				first = frame.Time
+			}
+			if !r.wait(started, frame.Time.Sub(first)) {
+				reader.Close()
+				return nil
+			}
+			r.apply(frame)
+		}
+	}
+	return nil
+}
+
+// Stop - stops replay
+func (r *Replayer) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+	})
+}
+
+// wait - waits until time of frame with offset from the first frame. It returns false if replay is stopped.
+func (r *Replayer) wait(started time.Time, offset time.Duration) bool {
+	if r.speed <= ReplayMaxSpeed {
+		select {
+		case <-r.stop:
+			return false
+		default:
+			return true
+		}
+	}
+
+	delay := time.Until(started.Add(time.Duration(float64(offset) / r.speed)))
+	if delay <= 0 {
+		select {
+		case <-r.stop:
+			return false
+		default:
+			return true
+		}
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-r.stop:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (r *Replayer) apply(frame Frame) {
+	if r.handler != nil {
+		r.handler(frame)
+	}
+
+	switch frame.Kind {
+	case FrameReceived:
+		if err := r.k.handleMessage([]byte(frame.Data)); err != nil {
+			log.Error(err)
+		}
+	case FrameDisconnected:
+		r.k.disconnected()
+	case FrameConnected:
+		if !r.connected {
+			r.connected = true
+			return
+		}
+		// the same steps as reconnect of live client, requests are not sent because recorded ones are replayed
+		r.k.lock.Lock()
+		r.k.disconnectedAt = time.Time{}
+		r.k.lock.Unlock()
+		r.k.tokens.reconnected()
+		r.k.notifyReconnect()
+		r.k.registry.reset()
+	}
+}
@@ -0,0 +1,103 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const bookSubscribedMessage = `{"channelID":0,"channelName":"book-10","event":"subscriptionStatus","pair":"XBT/USD","status":"subscribed","subscription":{"depth":10,"name":"book"}}`
+
+func writeRecording(t *testing.T, frames []Frame) []string {
+	t.Helper()
+
+	dir := t.TempDir()
+	recorder, err := NewRecorder(dir)
+	require.NoError(t, err)
+	for i := range frames {
+		require.NoError(t, recorder.Record(frames[i]))
+	}
+	require.NoError(t, recorder.Close())
+
+	files, err := RecordingFiles(dir, "kraken")
+	require.NoError(t, err)
+	return files
+}
+
+func TestReplayer(t *testing.T) {
+	start := time.Unix(1534614248, 0).UTC()
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+	files := writeRecording(t, []Frame{
+		{Time: at(0), Conn: "main", Kind: FrameConnected, Data: ProdBaseURL},
+		{Time: at(1), Conn: "main", Kind: FrameSent, Data: `{"event":"subscribe"}`},
+		{Time: at(2), Conn: "main", Kind: FrameReceived, Data: bookSubscribedMessage},
+		{Time: at(3), Conn: "main", Kind: FrameReceived, Data: bookSnapshotMessage},
+		{Time: at(4), Conn: "other", Kind: FrameReceived, Data: bookSnapshotMessage},
+		{Time: at(5), Conn: "main", Kind: FrameReceived, Data: bookUpdateMessage},
+		{Time: at(6), Conn: "main", Kind: FrameDisconnected},
+		{Time: at(10), Conn: "main", Kind: FrameConnected, Data: ProdBaseURL},
+		{Time: at(11), Conn: "main", Kind: FrameReceived, Data: bookSubscribedMessage},
+		{Time: at(12), Conn: "main", Kind: FrameReceived, Data: bookSnapshotMessage},
+	})
+
+	k := NewKraken(ProdBaseURL)
+	handle, err := k.SubscribeBookHandle([]string{BTCUSD}, Depth10, WithHandleBuffer(16))
+	require.NoError(t, err)
+	reconnects := 0
+	k.OnReconnect(func() { reconnects++ })
+
+	var (
+		kinds        []FrameKind
+		disconnected bool
+	)
+	replayer := NewReplayer(k, files, WithReplaySpeed(ReplayMaxSpeed), WithReplayConn("main"), WithFrameHandler(func(frame Frame) {
+		kinds = append(kinds, frame.Kind)
+		if frame.Kind == FrameConnected && !k.DisconnectedSince().IsZero() {
+			disconnected = true
+		}
+	}))
+	require.NoError(t, replayer.Run())
+
+	assert.Len(t, kinds, 9)
+	assert.True(t, disconnected)
+	assert.True(t, k.DisconnectedSince().IsZero())
+	assert.Equal(t, 1, reconnects)
+
+	var snapshots, updates int
+	for len(handle.C()) > 0 {
+		event := <-handle.C()
+		if event.Data.IsSnapshot {
+			snapshots++
+		} else {
+			updates++
+		}
+	}
+	assert.Equal(t, 2, snapshots)
+	assert.Equal(t, 1, updates)
+}
+
+func TestReplayer_Speed(t *testing.T) {
+	start := time.Unix(1534614248, 0).UTC()
+	files := writeRecording(t, []Frame{
+		{Time: start, Kind: FrameReceived, Data: bookSnapshotMessage},
+		{Time: start.Add(time.Second), Kind: FrameReceived, Data: bookUpdateMessage},
+	})
+
+	k := NewKraken(ProdBaseURL)
+	began := time.Now()
+	require.NoError(t, NewReplayer(k, files, WithReplaySpeed(10)).Run())
+	elapsed := time.Since(began)
+	assert.GreaterOrEqual(t, elapsed, 90*time.Millisecond)
+	assert.Less(t, elapsed, 500*time.Millisecond)
+
+	// stopped replayer returns without waiting
+	replayer := NewReplayer(k, files)
+	replayer.Stop()
+	began = time.Now()
+	require.NoError(t, replayer.Run())
+	assert.Less(t, time.Since(began), 500*time.Millisecond)
+}
@@ -14,6 +14,7 @@ type Subscription struct {
 	Name     string `json:"name"`
 	Interval int64  `json:"interval,omitempty"`
 	Depth    int64  `json:"depth,omitempty"`
+	Snapshot *bool  `json:"snapshot,omitempty"`
 }
 
 // SubscriptionRequest - data structure for subscription request
@@ -35,6 +36,7 @@ type UnsubscribeRequest struct {
 // SubscriptionStatus - data structure for subscription status event
 type SubscriptionStatus struct {
 	ChannelID    int64        `json:"channelID"`
+	ChannelName  string       `json:"channelName,omitempty"`
 	Event        string       `json:"event"`
 	Status       string       `json:"status"`
 	Pair         string       `json:"pair"`
@@ -65,8 +67,9 @@ type SystemStatus struct {
 
 // AuthDataRequest - data structure for private subscription request
 type AuthDataRequest struct {
-	Name  string `json:"name"`
-	Token string `json:"token"`
+	Name     string `json:"name"`
+	Token    string `json:"token"`
+	Snapshot *bool  `json:"snapshot,omitempty"`
 }
 
 // AuthSubscriptionRequest - data structure for private subscription request
@@ -84,9 +87,11 @@ type AuthRequest struct {
 // AddOrderRequest -
 type AddOrderRequest struct {
 	AuthRequest
+	ReqID          int64  `json:"reqid,omitempty"`
 	Ordertype      string `json:"ordertype"`
 	Pair           string `json:"pair"`
 	Price          string `json:"price"`
+	Price2         string `json:"price2,omitempty"`
 	Type           string `json:"type"`
 	Volume         string `json:"volume"`
 	Starttm        string `json:"starttm,omitempty"`
@@ -97,6 +102,7 @@ type AddOrderRequest struct {
 	UserRef        string `json:"userref,omitempty"`
 	OFlags         string `json:"oflags,omitempty"`
 	Leverage       string `json:"leverage,omitempty"`
+	ReduceOnly     bool   `json:"reduce_only,omitempty"`
 	ClosePrice     string `json:"close[price],omitempty"`
 	ClosePrice2    string `json:"close[price2],omitempty"`
 	CloseOrderType string `json:"close[ordertype],omitempty"`
@@ -104,6 +110,7 @@ type AddOrderRequest struct {
 
 // AddOrderResponse -
 type AddOrderResponse struct {
+	ReqID        int64  `json:"reqid,omitempty"`
 	Description  string `json:"descr"`
 	Event        string `json:"event"`
 	Status       string `json:"status"`
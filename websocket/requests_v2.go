@@ -0,0 +1,244 @@
+package websocket
+
+import (
+	"encoding/json"
+)
+
+// Methods of Websocket API v2
+const (
+	MethodSubscribe            = "subscribe"
+	MethodUnsubscribe          = "unsubscribe"
+	MethodPing                 = "ping"
+	MethodPong                 = "pong"
+	MethodAddOrder             = "add_order"
+	MethodAmendOrder           = "amend_order"
+	MethodBatchAdd             = "batch_add"
+	MethodCancelOrder          = "cancel_order"
+	MethodCancelAll            = "cancel_all"
+	MethodCancelAllOrdersAfter = "cancel_all_orders_after"
+	MethodEditOrder            = "edit_order"
+)
+
+// Message types of Websocket API v2
+const (
+	TypeSnapshot = "snapshot"
+	TypeUpdate   = "update"
+)
+
+// service channels of Websocket API v2
+const (
+	channelStatus    = "status"
+	channelHeartbeat = "heartbeat"
+)
+
+// MethodRequest - data structure of Websocket API v2 request
+type MethodRequest struct {
+	Method string      `json:"method"`
+	Params interface{} `json:"params,omitempty"`
+	ReqID  int64       `json:"req_id,omitempty"`
+}
+
+// MethodResponse - data structure of Websocket API v2 response on request
+type MethodResponse struct {
+	Method  string          `json:"method"`
+	ReqID   int64           `json:"req_id,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Success bool            `json:"success"`
+	Error   string          `json:"error,omitempty"`
+	Symbol  string          `json:"symbol,omitempty"`
+	TimeIn  string          `json:"time_in,omitempty"`
+	TimeOut string          `json:"time_out,omitempty"`
+}
+
+// SubscribeParams - params of v2 subscribe and unsubscribe requests
+type SubscribeParams struct {
+	Channel    string   `json:"channel"`
+	Symbol     []string `json:"symbol,omitempty"`
+	Depth      int64    `json:"depth,omitempty"`
+	Interval   int64    `json:"interval,omitempty"`
+	Snapshot   *bool    `json:"snapshot,omitempty"`
+	SnapOrders *bool    `json:"snap_orders,omitempty"`
+	SnapTrades *bool    `json:"snap_trades,omitempty"`
+	Token      string   `json:"token,omitempty"`
+}
+
+// SubscribeResult - result of v2 subscribe and unsubscribe requests
+type SubscribeResult struct {
+	Channel  string `json:"channel"`
+	Symbol   string `json:"symbol,omitempty"`
+	Depth    int64  `json:"depth,omitempty"`
+	Interval int64  `json:"interval,omitempty"`
+	Snapshot bool   `json:"snapshot,omitempty"`
+}
+
+// TriggerParams - trigger of v2 stop and take profit orders
+type TriggerParams struct {
+	Reference string      `json:"reference,omitempty"`
+	Price     json.Number `json:"price,omitempty"`
+	PriceType string      `json:"price_type,omitempty"`
+}
+
+// ConditionalParams - secondary close order of v2 add order request
+type ConditionalParams struct {
+	OrderType        string      `json:"order_type"`
+	LimitPrice       json.Number `json:"limit_price,omitempty"`
+	LimitPriceType   string      `json:"limit_price_type,omitempty"`
+	TriggerPrice     json.Number `json:"trigger_price,omitempty"`
+	TriggerPriceType string      `json:"trigger_price_type,omitempty"`
+}
+
+// AddOrderParams - params of v2 add_order request
+type AddOrderParams struct {
+	OrderType     string             `json:"order_type"`
+	Side          string             `json:"side"`
+	OrderQty      json.Number        `json:"order_qty"`
+	Symbol        string             `json:"symbol,omitempty"`
+	LimitPrice    json.Number        `json:"limit_price,omitempty"`
+	Triggers      *TriggerParams     `json:"triggers,omitempty"`
+	TimeInForce   string             `json:"time_in_force,omitempty"`
+	Margin        bool               `json:"margin,omitempty"`
+	PostOnly      bool               `json:"post_only,omitempty"`
+	ReduceOnly    bool               `json:"reduce_only,omitempty"`
+	EffectiveTime string             `json:"effective_time,omitempty"`
+	ExpireTime    string             `json:"expire_time,omitempty"`
+	Deadline      string             `json:"deadline,omitempty"`
+	ClOrdID       string             `json:"cl_ord_id,omitempty"`
+	OrderUserref  int64              `json:"order_userref,omitempty"`
+	Conditional   *ConditionalParams `json:"conditional,omitempty"`
+	DisplayQty    json.Number        `json:"display_qty,omitempty"`
+	FeePreference string             `json:"fee_preference,omitempty"`
+	NoMPP         bool               `json:"no_mpp,omitempty"`
+	Validate      bool               `json:"validate,omitempty"`
+	Token         string             `json:"token,omitempty"`
+}
+
+// EditOrderParams - params of v2 edit_order request
+type EditOrderParams struct {
+	OrderID       string         `json:"order_id"`
+	Symbol        string         `json:"symbol"`
+	OrderQty      json.Number    `json:"order_qty,omitempty"`
+	LimitPrice    json.Number    `json:"limit_price,omitempty"`
+	Triggers      *TriggerParams `json:"triggers,omitempty"`
+	PostOnly      bool           `json:"post_only,omitempty"`
+	ReduceOnly    bool           `json:"reduce_only,omitempty"`
+	OrderUserref  int64          `json:"order_userref,omitempty"`
+	DisplayQty    json.Number    `json:"display_qty,omitempty"`
+	FeePreference string         `json:"fee_preference,omitempty"`
+	NoMPP         bool           `json:"no_mpp,omitempty"`
+	Deadline      string         `json:"deadline,omitempty"`
+	Validate      bool           `json:"validate,omitempty"`
+	Token         string         `json:"token,omitempty"`
+}
+
+// AmendOrderParams - params of v2 amend_order request. Amend keeps order identifiers and queue priority where possible.
+type AmendOrderParams struct {
+	ReqID            int64       `json:"-"`
+	OrderID          string      `json:"order_id,omitempty"`
+	ClOrdID          string      `json:"cl_ord_id,omitempty"`
+	OrderQty         json.Number `json:"order_qty"`
+	DisplayQty       json.Number `json:"display_qty,omitempty"`
+	LimitPrice       json.Number `json:"limit_price,omitempty"`
+	LimitPriceType   string      `json:"limit_price_type,omitempty"`
+	PostOnly         bool        `json:"post_only,omitempty"`
+	TriggerPrice     json.Number `json:"trigger_price,omitempty"`
+	TriggerPriceType string      `json:"trigger_price_type,omitempty"`
+	Deadline         string      `json:"deadline,omitempty"`
+	Token            string      `json:"token,omitempty"`
+}
+
+// BatchOrder - single order of v2 batch_add request
+type BatchOrder struct {
+	OrderType     string             `json:"order_type"`
+	Side          string             `json:"side"`
+	OrderQty      json.Number        `json:"order_qty"`
+	LimitPrice    json.Number        `json:"limit_price,omitempty"`
+	Triggers      *TriggerParams     `json:"triggers,omitempty"`
+	TimeInForce   string             `json:"time_in_force,omitempty"`
+	Margin        bool               `json:"margin,omitempty"`
+	PostOnly      bool               `json:"post_only,omitempty"`
+	ReduceOnly    bool               `json:"reduce_only,omitempty"`
+	EffectiveTime string             `json:"effective_time,omitempty"`
+	ExpireTime    string             `json:"expire_time,omitempty"`
+	ClOrdID       string             `json:"cl_ord_id,omitempty"`
+	OrderUserref  int64              `json:"order_userref,omitempty"`
+	Conditional   *ConditionalParams `json:"conditional,omitempty"`
+	DisplayQty    json.Number        `json:"display_qty,omitempty"`
+	FeePreference string             `json:"fee_preference,omitempty"`
+	NoMPP         bool               `json:"no_mpp,omitempty"`
+}
+
+// BatchAddParams - params of v2 batch_add request. All orders must have the same symbol.
+type BatchAddParams struct {
+	ReqID    int64        `json:"-"`
+	Symbol   string       `json:"symbol"`
+	Orders   []BatchOrder `json:"orders"`
+	Deadline string       `json:"deadline,omitempty"`
+	Validate bool         `json:"validate,omitempty"`
+	Token    string       `json:"token,omitempty"`
+}
+
+// CancelOrderParams - params of v2 cancel_order request
+type CancelOrderParams struct {
+	OrderID      []string `json:"order_id,omitempty"`
+	ClOrdID      []string `json:"cl_ord_id,omitempty"`
+	OrderUserref []int64  `json:"order_userref,omitempty"`
+	Token        string   `json:"token,omitempty"`
+}
+
+// CancelAllOrdersAfterParams - params of v2 cancel_all_orders_after request
+type CancelAllOrdersAfterParams struct {
+	Timeout int64  `json:"timeout"`
+	Token   string `json:"token,omitempty"`
+}
+
+// TokenParams - params of v2 requests which require only token
+type TokenParams struct {
+	Token string `json:"token,omitempty"`
+}
+
+// OrderResult - result of v2 add_order, edit_order, amend_order and cancel_order requests
+type OrderResult struct {
+	OrderID         string   `json:"order_id,omitempty"`
+	OriginalOrderID string   `json:"original_order_id,omitempty"`
+	AmendID         string   `json:"amend_id,omitempty"`
+	ClOrdID         string   `json:"cl_ord_id,omitempty"`
+	OrderUserref    int64    `json:"order_userref,omitempty"`
+	Warnings        []string `json:"warnings,omitempty"`
+}
+
+// systemStatusV2 - data of `status` channel
+type systemStatusV2 struct {
+	APIVersion   string `json:"api_version"`
+	ConnectionID uint64 `json:"connection_id"`
+	System       string `json:"system"`
+	Version      string `json:"version"`
+}
+
+// CancelAllResult - result of v2 cancel_all request
+type CancelAllResult struct {
+	Count int `json:"count"`
+}
+
+// CancelAllOrdersAfterResult - result of v2 cancel_all_orders_after request
+type CancelAllOrdersAfterResult struct {
+	CurrentTime string `json:"currentTime"`
+	TriggerTime string `json:"triggerTime"`
+}
+
+// BatchAddResponse - response on v2 batch_add request
+type BatchAddResponse struct {
+	ReqID        int64
+	Orders       []OrderResult
+	Status       string
+	ErrorMessage string
+}
+
+// AmendOrderResponse - response on v2 amend_order request
+type AmendOrderResponse struct {
+	ReqID        int64
+	AmendID      string
+	OrderID      string
+	ClOrdID      string
+	Status       string
+	ErrorMessage string
+}
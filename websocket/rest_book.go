@@ -0,0 +1,140 @@
+package websocket
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/aopoltorzhicky/go_kraken/rest"
+	"github.com/shopspring/decimal"
+)
+
+// Sides of order book
+const (
+	SideAsks = "asks"
+	SideBids = "bids"
+)
+
+// NewOrderBookFromREST - creates order book filled by REST order book. REST API allows deeper books than websocket.
+func NewOrderBookFromREST(book rest.OrderBook, depth, pricePrecision, volumePrecision int) (*OrderBook, error) {
+	ob := NewOrderBook(depth, pricePrecision, volumePrecision)
+	if err := ob.LoadREST(book); err != nil {
+		return nil, err
+	}
+	return ob, nil
+}
+
+// LoadREST - replaces content of order book by REST order book as websocket snapshot does
+func (o *OrderBook) LoadREST(book rest.OrderBook) error {
+	return o.ApplyUpdate(OrderBookUpdate{
+		Asks:       levelsToItems(book.AskLevels()),
+		Bids:       levelsToItems(book.BidLevels()),
+		IsSnapshot: true,
+	}, false)
+}
+
+func levelsToItems(levels []PriceLevel) []OrderBookItem {
+	items := make([]OrderBookItem, len(levels))
+	for i := range levels {
+		items[i] = OrderBookItem{
+			Price:  json.Number(levels[i].Price.String()),
+			Volume: json.Number(levels[i].Volume.String()),
+		}
+	}
+	return items
+}
+
+// LevelDivergence - price level whose volumes are different in local and remote books. Zero volume means the level is absent.
+type LevelDivergence struct {
+	Side   string
+	Price  decimal.Decimal
+	Local  decimal.Decimal
+	Remote decimal.Decimal
+}
+
+// Divergence - result of comparison of local book with REST snapshot
+type Divergence struct {
+	Pair string
+	// Sequence - sequence of local snapshot
+	Sequence uint64
+	Time     time.Time
+	Levels   []LevelDivergence
+	// Err - error of REST request. Levels are empty in this case.
+	Err error
+}
+
+// Diverged - returns true if books are different or comparison failed
+func (d Divergence) Diverged() bool {
+	return len(d.Levels) > 0 || d.Err != nil
+}
+
+// CompareREST - compares top `levels` levels of snapshot with REST order book.
+// Levels which are deeper than the last compared level of any of books are skipped because
+// they may be cut off by depth.
+func (s OrderBookSnapshot) CompareREST(book rest.OrderBook, levels int) Divergence {
+	result := Divergence{
+		Pair:     s.Pair,
+		Sequence: s.Sequence,
+		Time:     time.Now(),
+	}
+	result.Levels = append(result.Levels, compareLevels(SideAsks, s.Asks, book.AskLevels(), levels, true)...)
+	result.Levels = append(result.Levels, compareLevels(SideBids, s.Bids, book.BidLevels(), levels, false)...)
+	return result
+}
+
+func compareLevels(side string, local, remote []PriceLevel, count int, isAsk bool) []LevelDivergence {
+	if len(local) > count {
+		local = local[:count]
+	}
+	if len(remote) > count {
+		remote = remote[:count]
+	}
+
+	// better - returns true if price `a` is closer to top of the book than `b`
+	better := func(a, b decimal.Decimal) bool {
+		if isAsk {
+			return a.LessThan(b)
+		}
+		return a.GreaterThan(b)
+	}
+
+	var bound decimal.Decimal
+	switch {
+	case len(local) == 0 && len(remote) == 0:
+		return nil
+	case len(local) == 0:
+		bound = remote[len(remote)-1].Price
+	case len(remote) == 0:
+		bound = local[len(local)-1].Price
+	default:
+		bound = local[len(local)-1].Price
+		if last := remote[len(remote)-1].Price; better(last, bound) {
+			bound = last
+		}
+	}
+
+	var result []LevelDivergence
+	var i, j int
+	for i < len(local) || j < len(remote) {
+		var level LevelDivergence
+		switch {
+		case j == len(remote) || (i < len(local) && better(local[i].Price, remote[j].Price)):
+			level = LevelDivergence{Side: side, Price: local[i].Price, Local: local[i].Volume}
+			i++
+		case i == len(local) || better(remote[j].Price, local[i].Price):
+			level = LevelDivergence{Side: side, Price: remote[j].Price, Remote: remote[j].Volume}
+			j++
+		default:
+			level = LevelDivergence{Side: side, Price: local[i].Price, Local: local[i].Volume, Remote: remote[j].Volume}
+			i++
+			j++
+		}
+
+		if better(bound, level.Price) {
+			break
+		}
+		if !level.Local.Equal(level.Remote) {
+			result = append(result, level)
+		}
+	}
+	return result
+}
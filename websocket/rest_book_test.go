@@ -0,0 +1,92 @@
+package websocket
+
+import (
+	"testing"
+
+	"github.com/aopoltorzhicky/go_kraken/rest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type depthMock map[string]rest.OrderBook
+
+func (m depthMock) GetOrderBook(pair string, depth int64) (map[string]rest.OrderBook, error) {
+	book, ok := m[pair]
+	if !ok {
+		return map[string]rest.OrderBook{}, nil
+	}
+	return map[string]rest.OrderBook{"X" + pair: book}, nil
+}
+
+var testRESTBook = rest.OrderBook{
+	Asks: []rest.OrderBookItem{
+		{Price: 5541.3, Volume: 2.507, Timestamp: 1534614248},
+		{Price: 5541.5, Volume: 1, Timestamp: 1534614248},
+	},
+	Bids: []rest.OrderBookItem{
+		{Price: 5541.2, Volume: 1.529, Timestamp: 1534614248},
+	},
+}
+
+func TestNewOrderBookFromREST(t *testing.T) {
+	book, err := NewOrderBookFromREST(testRESTBook, 100, 1, 8)
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, book.Asks.Len())
+	price, volume := book.Bids.Best()
+	assert.Equal(t, "5541.2", price.String())
+	assert.Equal(t, "1.529", volume.String())
+	// the same book as in websocket checksum test
+	assert.Equal(t, "3906377897", book.Checksum())
+}
+
+func TestOrderBookSnapshot_CompareREST(t *testing.T) {
+	book, err := NewOrderBookFromREST(testRESTBook, 10, 1, 8)
+	require.NoError(t, err)
+	assert.False(t, book.Snapshot().CompareREST(testRESTBook, 10).Diverged())
+
+	require.NoError(t, book.ApplyUpdate(OrderBookUpdate{
+		Asks: []OrderBookItem{
+			{Price: "5541.30000", Volume: "1.00000000"},
+			{Price: "5541.40000", Volume: "1.00000000"},
+		},
+		Bids: []OrderBookItem{{Price: "5541.10000", Volume: "1.00000000"}},
+	}, false))
+
+	divergence := book.Snapshot().CompareREST(testRESTBook, 10)
+	require.Len(t, divergence.Levels, 2)
+	assert.Equal(t, SideAsks, divergence.Levels[0].Side)
+	assert.Equal(t, "1", divergence.Levels[0].Local.String())
+	assert.Equal(t, "2.507", divergence.Levels[0].Remote.String())
+	// level which exists only in local book
+	assert.Equal(t, SideAsks, divergence.Levels[1].Side)
+	assert.Equal(t, "5541.4", divergence.Levels[1].Price.String())
+	assert.True(t, divergence.Levels[1].Remote.IsZero())
+
+	// only the best levels are compared
+	assert.Len(t, book.Snapshot().CompareREST(testRESTBook, 1).Levels, 1)
+}
+
+func TestBookManager_CheckREST(t *testing.T) {
+	k := NewKraken(ProdBaseURL)
+
+	remote := rest.OrderBook{
+		Asks: []rest.OrderBookItem{{Price: 5541.3, Volume: 2, Timestamp: 1534614248}},
+		Bids: testRESTBook.Bids,
+	}
+	manager, err := k.NewBookManager([]string{BTCUSD}, 10, testAssetPairs,
+		WithRESTCrossCheck(depthMock{"XBTUSD": remote}, 0, 10, nil))
+	require.NoError(t, err)
+	defer manager.Close()
+
+	require.NoError(t, k.handleMessage([]byte(bookSnapshotMessage)))
+
+	divergence := manager.CheckREST(BTCUSD)
+	require.NoError(t, divergence.Err)
+	assert.Equal(t, BTCUSD, divergence.Pair)
+	require.Len(t, divergence.Levels, 1)
+	assert.Equal(t, "5541.3", divergence.Levels[0].Price.String())
+	assert.Equal(t, "2", divergence.Levels[0].Remote.String())
+
+	assert.Error(t, manager.CheckREST(ETHUSD).Err)
+}
@@ -0,0 +1,80 @@
+package websocket
+
+import (
+	"time"
+
+	"github.com/aopoltorzhicky/go_kraken/rest"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+)
+
+var decimalHundred = decimal.NewFromInt(100)
+
+// PriceLevel - aggregated price level of order book. It's the same type as levels of REST order book.
+type PriceLevel = rest.PriceLevel
+
+// OrderBookSnapshot - copy of order book at some moment. It doesn't share memory with the book
+// and isn't changed by following updates. It can be encoded to JSON and decoded back.
+type OrderBookSnapshot struct {
+	Pair string       `json:"pair,omitempty"`
+	Asks []PriceLevel `json:"asks"`
+	Bids []PriceLevel `json:"bids"`
+	// Time - time of the last applied update
+	Time time.Time `json:"time"`
+	// Sequence - count of updates applied to the book before the snapshot
+	Sequence uint64 `json:"sequence"`
+	Valid    bool   `json:"valid"`
+}
+
+// Aggregate - merges levels into buckets which are multiples of `tick`. Ask is moved up to the nearest multiple
+// and bid is moved down, so bucket price is never better than prices of its levels.
+func (s OrderBookSnapshot) Aggregate(tick decimal.Decimal) (OrderBookSnapshot, error) {
+	if !tick.IsPositive() {
+		return OrderBookSnapshot{}, errors.Errorf("tick has to be positive: %s", tick)
+	}
+
+	result := s
+	result.Asks = aggregateLevels(s.Asks, tick, true)
+	result.Bids = aggregateLevels(s.Bids, tick, false)
+	return result, nil
+}
+
+// AggregatePercent - merges levels into buckets with size of `percent` of mid price
+func (s OrderBookSnapshot) AggregatePercent(percent decimal.Decimal) (OrderBookSnapshot, error) {
+	if !percent.IsPositive() {
+		return OrderBookSnapshot{}, errors.Errorf("percent has to be positive: %s", percent)
+	}
+	mid, err := s.Mid()
+	if err != nil {
+		return OrderBookSnapshot{}, err
+	}
+	return s.Aggregate(mid.Mul(percent).Div(decimalHundred))
+}
+
+func aggregateLevels(levels []PriceLevel, tick decimal.Decimal, isAsk bool) []PriceLevel {
+	result := make([]PriceLevel, 0, len(levels))
+	for _, level := range levels {
+		// QuoRem is exact unlike Div which rounds the quotient
+		quotient, remainder := level.Price.QuoRem(tick, 0)
+		if isAsk && remainder.IsPositive() {
+			quotient = quotient.Add(decimal.NewFromInt(1))
+		}
+		price := quotient.Mul(tick)
+
+		if last := len(result) - 1; last >= 0 && result[last].Price.Equal(price) {
+			result[last].Volume = result[last].Volume.Add(level.Volume)
+			continue
+		}
+		result = append(result, PriceLevel{Price: price, Volume: level.Volume})
+	}
+	return result
+}
+
+func sideLevels(side *OrderBookSide) []PriceLevel {
+	levels := make([]PriceLevel, 0, side.Len())
+	_ = side.Range(func(price, volume decimal.Decimal) error {
+		levels = append(levels, PriceLevel{Price: price, Volume: volume})
+		return nil
+	})
+	return levels
+}
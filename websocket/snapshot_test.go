@@ -0,0 +1,106 @@
+package websocket
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOrderBook_Snapshot(t *testing.T) {
+	book := testAnalyticsBook(t)
+
+	snapshot := book.Snapshot()
+	assert.EqualValues(t, 1, snapshot.Sequence)
+	assert.False(t, snapshot.Time.IsZero())
+	assert.True(t, snapshot.Valid)
+	require.Len(t, snapshot.Asks, 3)
+	require.Len(t, snapshot.Bids, 2)
+
+	require.NoError(t, book.ApplyUpdate(OrderBookUpdate{
+		Asks: []OrderBookItem{{Price: "101.0", Volume: "0.00000000"}},
+	}, false))
+
+	// snapshot isn't changed by updates
+	assert.Len(t, snapshot.Asks, 3)
+	assert.EqualValues(t, 2, book.Snapshot().Sequence)
+
+	book.MarkResync()
+	assert.False(t, book.Snapshot().Valid)
+}
+
+func TestOrderBook_SnapshotConsistent(t *testing.T) {
+	book := NewOrderBook(10, 1, 8)
+	require.NoError(t, book.ApplyUpdate(OrderBookUpdate{IsSnapshot: true}, false))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// every update adds one level to both sides
+		for i := 0; i < 10; i++ {
+			price := json.Number(decimal.NewFromInt(int64(100 + i)).String())
+			_ = book.ApplyUpdate(OrderBookUpdate{
+				Asks: []OrderBookItem{{Price: price, Volume: "1"}},
+				Bids: []OrderBookItem{{Price: price, Volume: "1"}},
+			}, false)
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		snapshot := book.Snapshot()
+		assert.Equal(t, len(snapshot.Asks), len(snapshot.Bids))
+		assert.EqualValues(t, len(snapshot.Asks)+1, snapshot.Sequence)
+	}
+	wg.Wait()
+}
+
+func TestOrderBookSnapshot_Aggregate(t *testing.T) {
+	snapshot := testAnalyticsBook(t).Snapshot()
+
+	aggregated, err := snapshot.Aggregate(decimal.NewFromInt(5))
+	require.NoError(t, err)
+	require.Len(t, aggregated.Asks, 2)
+	requireDecimal(t, "105", aggregated.Asks[0].Price)
+	requireDecimal(t, "3", aggregated.Asks[0].Volume)
+	requireDecimal(t, "110", aggregated.Asks[1].Price)
+	requireDecimal(t, "5", aggregated.Asks[1].Volume)
+	require.Len(t, aggregated.Bids, 1)
+	requireDecimal(t, "95", aggregated.Bids[0].Price)
+	requireDecimal(t, "4", aggregated.Bids[0].Volume)
+	assert.Equal(t, snapshot.Sequence, aggregated.Sequence)
+
+	// 10% of mid 100
+	byPercent, err := snapshot.AggregatePercent(decimal.NewFromInt(10))
+	require.NoError(t, err)
+	require.Len(t, byPercent.Asks, 1)
+	requireDecimal(t, "110", byPercent.Asks[0].Price)
+	requireDecimal(t, "8", byPercent.Asks[0].Volume)
+	requireDecimal(t, "90", byPercent.Bids[0].Price)
+
+	_, err = snapshot.Aggregate(decimal.Zero)
+	assert.Error(t, err)
+}
+
+func TestOrderBookSnapshot_JSON(t *testing.T) {
+	snapshot := testAnalyticsBook(t).Snapshot()
+	snapshot.Pair = BTCUSD
+
+	data, err := json.Marshal(snapshot)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"asks":[{"price":"101","volume":"1"}`)
+
+	var decoded OrderBookSnapshot
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, snapshot.Pair, decoded.Pair)
+	assert.Equal(t, snapshot.Sequence, decoded.Sequence)
+	assert.True(t, snapshot.Time.Equal(decoded.Time))
+	require.Len(t, decoded.Asks, len(snapshot.Asks))
+	for i := range decoded.Asks {
+		assert.True(t, snapshot.Asks[i].Equal(decoded.Asks[i]))
+	}
+	require.Len(t, decoded.Bids, len(snapshot.Bids))
+}
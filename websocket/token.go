@@ -0,0 +1,175 @@
+package websocket
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aopoltorzhicky/go_kraken/rest"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrNotAuthenticated - private method was called without token provider
+var ErrNotAuthenticated = errors.New("not authenticated: call Authenticate or use WithTokenProvider option")
+
+const (
+	// tokenRefreshMargin - token is refreshed if it expires sooner than the margin
+	tokenRefreshMargin = 30 * time.Second
+	// maxTokenRetries - count of attempts to resubscribe private channel with refreshed token
+	maxTokenRetries = 3
+
+	invalidTokenError = "EGeneral:Invalid arguments:token"
+)
+
+// TokenProvider - source of authentication tokens for private Websocket API
+type TokenProvider interface {
+	// Token - returns new token and its lifetime
+	Token() (string, time.Duration, error)
+}
+
+// RESTTokenProvider - receives tokens by `GetWebSocketsToken` method of REST API
+type RESTTokenProvider struct {
+	api *rest.Kraken
+}
+
+// NewRESTTokenProvider - creates token provider by API key and secret
+func NewRESTTokenProvider(key, secret string) *RESTTokenProvider {
+	return &RESTTokenProvider{
+		api: rest.New(key, secret),
+	}
+}
+
+// Token - receives new token from REST API
+func (p *RESTTokenProvider) Token() (string, time.Duration, error) {
+	data, err := p.api.GetWebSocketsToken()
+	if err != nil {
+		return "", 0, err
+	}
+	return data.Token, time.Duration(data.Expires) * time.Second, nil
+}
+
+// tokenManager - keeps current token and refreshes it when required.
+// Kraken's token expires in 15 minutes after issue unless a connection uses it. After reconnect the token may be rejected.
+type tokenManager struct {
+	provider TokenProvider
+
+	token     string
+	expiresAt time.Time
+	// inUse - token is used by private subscription of current connection, so it doesn't expire
+	inUse     bool
+	stale     bool
+	refreshes uint64
+	retries   map[string]int
+
+	mx sync.Mutex
+}
+
+func newTokenManager() *tokenManager {
+	return &tokenManager{
+		retries: make(map[string]int),
+	}
+}
+
+func (m *tokenManager) setProvider(provider TokenProvider) {
+	m.mx.Lock()
+	m.provider = provider
+	m.token = ""
+	m.mx.Unlock()
+}
+
+// get - returns current token or receives new one if it's expired, stale or `force` is set
+func (m *tokenManager) get(force bool) (string, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if m.provider == nil {
+		return "", ErrNotAuthenticated
+	}
+
+	expired := !m.inUse && time.Now().Add(tokenRefreshMargin).After(m.expiresAt)
+	if m.token != "" && !force && !m.stale && !expired {
+		return m.token, nil
+	}
+
+	token, lifetime, err := m.provider.Token()
+	if err != nil {
+		return "", errors.Wrap(err, "can't receive websocket token")
+	}
+	m.token = token
+	m.expiresAt = time.Now().Add(lifetime)
+	m.inUse = false
+	m.stale = false
+	m.refreshes++
+	log.Debugf("websocket token is refreshed, expires at %s", m.expiresAt)
+	return m.token, nil
+}
+
+// reconnected - marks token as stale after reconnect
+func (m *tokenManager) reconnected() {
+	m.mx.Lock()
+	m.inUse = false
+	m.stale = true
+	m.mx.Unlock()
+}
+
+// used - marks token as used by private subscription of current connection
+func (m *tokenManager) used(channelName string) {
+	m.mx.Lock()
+	m.inUse = true
+	delete(m.retries, channelName)
+	m.mx.Unlock()
+}
+
+// retry - returns true if subscription of the channel can be retried with new token
+func (m *tokenManager) retry(channelName string) bool {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	m.retries[channelName]++
+	return m.retries[channelName] <= maxTokenRetries
+}
+
+func (m *tokenManager) metrics(metrics *Metrics) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	metrics.TokenExpiresAt = m.expiresAt
+	metrics.TokenInUse = m.inUse
+	metrics.TokenRefreshes = m.refreshes
+}
+
+func isInvalidTokenError(message string) bool {
+	return strings.Contains(message, invalidTokenError)
+}
+
+// handlePrivateStatus - tracks token usage by private subscriptions and retries subscription with fresh token if Kraken rejects it.
+func (k *Kraken) handlePrivateStatus(status SubscriptionStatus) {
+	name := status.ChannelName
+	if name == "" {
+		name = status.Subscription.Name
+	}
+	if !isPrivateChannel(name) {
+		return
+	}
+
+	switch status.Status {
+	case SubscriptionStatusSubscribed:
+		k.tokens.used(name)
+	case SubscriptionStatusError:
+		if !isInvalidTokenError(status.Error) || !k.tokens.retry(name) {
+			return
+		}
+		go func() {
+			if _, err := k.tokens.get(true); err != nil {
+				log.Error(err)
+				return
+			}
+			for _, group := range k.registry.retry(name) {
+				if err := k.sendSubscribe(group.spec, group.pairs); err != nil {
+					log.Error(err)
+				}
+			}
+		}()
+	}
+}
@@ -0,0 +1,82 @@
+package websocket
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type tokenProviderMock struct {
+	lifetime time.Duration
+	calls    int
+	mx       sync.Mutex
+}
+
+func (p *tokenProviderMock) Token() (string, time.Duration, error) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	p.calls++
+	return "token", p.lifetime, nil
+}
+
+func (p *tokenProviderMock) count() int {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return p.calls
+}
+
+func TestTokenManager(t *testing.T) {
+	m := newTokenManager()
+	_, err := m.get(false)
+	assert.ErrorIs(t, err, ErrNotAuthenticated)
+
+	provider := &tokenProviderMock{lifetime: 15 * time.Minute}
+	m.setProvider(provider)
+
+	_, err = m.get(false)
+	require.NoError(t, err)
+	_, err = m.get(false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, provider.count(), "valid token must be reused")
+
+	m.reconnected()
+	_, err = m.get(false)
+	require.NoError(t, err)
+	assert.Equal(t, 2, provider.count(), "token must be refreshed after reconnect")
+
+	provider.lifetime = time.Second
+	_, err = m.get(true)
+	require.NoError(t, err)
+	_, err = m.get(false)
+	require.NoError(t, err)
+	assert.Equal(t, 4, provider.count(), "token which expires soon must be refreshed")
+
+	m.used(ChanOwnTrades)
+	_, err = m.get(false)
+	require.NoError(t, err)
+	assert.Equal(t, 4, provider.count(), "token used by connection doesn't expire")
+
+	var metrics Metrics
+	m.metrics(&metrics)
+	assert.True(t, metrics.TokenInUse)
+	assert.Equal(t, uint64(4), metrics.TokenRefreshes)
+}
+
+func TestKraken_RetryInvalidToken(t *testing.T) {
+	provider := &tokenProviderMock{lifetime: 15 * time.Minute}
+	k := NewKraken(AuthBaseURL, WithTokenProvider(provider))
+
+	require.NoError(t, k.SubscribeOwnTrades())
+	require.NoError(t, k.handleMessage([]byte(`{"errorMessage":"EGeneral:Invalid arguments:token","event":"subscriptionStatus","status":"error","subscription":{"name":"ownTrades"}}`)))
+
+	assert.Eventually(t, func() bool {
+		return provider.count() == 2
+	}, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		subs := k.Subscriptions()
+		return len(subs) == 1 && subs[0].State == StatePending
+	}, time.Second, 10*time.Millisecond)
+}